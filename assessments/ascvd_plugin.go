@@ -0,0 +1,374 @@
+package assessments
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/intervention-engine/riskservice/terminology"
+)
+
+// ASCVDPlugin is a risk calculation service implementing the ACC/AHA Pooled Cohort Equations, which estimate the
+// 10-year risk of a first atherosclerotic cardiovascular disease (ASCVD) event: a heart attack, death from coronary
+// heart disease, or a stroke.
+// See: Goff DC Jr, et al. 2013 ACC/AHA guideline on the assessment of cardiovascular risk.  Circulation
+// 2014;129(25 Suppl 2):S49-S73.
+//
+// The inputs come from the patient's record as follows:
+//   - Age, sex and race: the patient's age and gender, and their race from the US Core race extension (see
+//     plugin.RaceCodes).  There are equations for African American and white men and women, and the white ones
+//     are used for other races (and when the race isn't recorded), as the guideline recommends.
+//   - Total cholesterol, HDL cholesterol and systolic blood pressure: the latest result for each, where the systolic
+//     pressure may be recorded on its own or as part of a blood pressure panel
+//   - Treated hypertension: a current antihypertensive medication
+//   - Diabetes: a diabetes diagnosis
+//   - Smoker: the latest smoking status is a current smoker
+//
+// There is a result whenever one of the inputs changes, once the patient has all of them (the patient isn't
+// presumed to be a nonsmoker without a smoking status).  The equations were only validated for ages 40 to 79, so
+// the plugin isn't applicable to patients outside of those ages.  The pie slices show which inputs put the patient
+// at more risk, in broad categories, but unlike the points-based scores, there is no score: the risk comes from
+// the equations themselves.
+type ASCVDPlugin struct {
+}
+
+// NewASCVDPlugin returns a new ASCVDPlugin
+func NewASCVDPlugin() *ASCVDPlugin {
+	return &ASCVDPlugin{}
+}
+
+// The LOINC codes for the observations the Pooled Cohort Equations use
+const (
+	TotalCholesterolCode = "2093-3"
+	HDLCholesterolCode   = "2085-9"
+	SystolicBPCode       = "8480-6"
+	SmokingStatusCode    = "72166-2"
+)
+
+// BloodPressurePanelCodes are the LOINC codes for blood pressure panels, which have the systolic blood pressure as a
+// component
+var BloodPressurePanelCodes = []string{"55284-4", "85354-9"}
+
+// CurrentSmokerCodes are the SNOMED CT codes for the smoking statuses of current smokers: current every day smoker,
+// current some day smoker, smoker (current status unknown), heavy tobacco smoker and light tobacco smoker.  The
+// other statuses are nonsmokers, except for unknown if ever smoked (266927001), which is a missing status.
+var CurrentSmokerCodes = []string{"449868002", "428041000124106", "77176002", "428071000124103", "428061000124105"}
+
+// The ages for which the Pooled Cohort Equations were validated
+const (
+	ascvdMinAge = 40
+	ascvdMaxAge = 79
+)
+
+// Config provides the configuration parameters for the ASCVDPlugin
+func (a *ASCVDPlugin) Config() plugin.RiskServicePluginConfig {
+	var birthdays []int
+	for age := ascvdMinAge; age <= ascvdMaxAge+1; age++ {
+		birthdays = append(birthdays, age)
+	}
+	return plugin.RiskServicePluginConfig{
+		Name: "ASCVD 10-year risk",
+		Method: models.CodeableConcept{
+			Coding: []models.Coding{{System: "http://interventionengine.org/risk-assessments", Code: "ASCVD"}},
+			Text:   "ACC/AHA Pooled Cohort Equations",
+		},
+		PredictedOutcome: models.CodeableConcept{Text: "Atherosclerotic Cardiovascular Disease Within 10 Years"},
+		DefaultPieSlices: []plugin.Slice{
+			{Name: "Age", Weight: 25, MaxValue: 4},
+			{Name: "Total Cholesterol", Weight: 10, MaxValue: 3},
+			{Name: "HDL Cholesterol", Weight: 10, MaxValue: 3},
+			{Name: "Systolic Blood Pressure", Weight: 20, MaxValue: 4},
+			{Name: "Treated Hypertension", Weight: 5, MaxValue: 1},
+			{Name: "Diabetes", Weight: 15, MaxValue: 1},
+			{Name: "Smoker", Weight: 15, MaxValue: 1},
+		},
+		RequiredResourceTypes: []string{"Condition", "MedicationStatement", "Observation"},
+		RequiredObservationCodes: append([]string{TotalCholesterolCode, HDLCholesterolCode, SystolicBPCode,
+			SmokingStatusCode}, BloodPressurePanelCodes...),
+		// Every birthday counts, since age is continuous in the equations
+		SignificantBirthdays: birthdays,
+		// Diabetes counts once it's been diagnosed
+		ResolvedConditions: plugin.ResolvedConditionPolicy{CountsByDefault: true},
+	}
+}
+
+// Calculate takes a stream of events and returns a slice of corresponding risk calculation results
+func (a *ASCVDPlugin) Calculate(es *plugin.EventStream, fhirEndpointURL string) ([]plugin.RiskServiceCalculationResult, error) {
+	var results []plugin.RiskServiceCalculationResult
+
+	var female bool
+	switch es.Patient.Gender {
+	case "female":
+		female = true
+	case "male":
+	default:
+		return nil, plugin.NewNotApplicableError("The Pooled Cohort Equations are only applicable to patients whose gender is male or female")
+	}
+	equation := pooledCohortEquationFor(female, plugin.HasRace(es.Patient, plugin.BlackOrAfricanAmerican))
+
+	pie := plugin.NewPie(fhirEndpointURL + "/Patient/" + es.Patient.Id)
+	pie.Slices = a.Config().DefaultPieSlices
+
+	// Keep track of the inputs the patient has so far, and the current antihypertensives (counted by medication, so
+	// that overlapping statements for the same medication don't end it early)
+	var in ascvdInputs
+	var hasTC, hasHDL, hasSBP, hasSmokingStatus bool
+	medications := make(map[string]int)
+
+	for _, event := range es.Events {
+		// NOTE: guard against future dates (for example, our patient generator can create future events)
+		if event.Date.Local().After(time.Now()) {
+			continue
+		}
+
+		var changed bool
+		switch r := event.Value.(type) {
+		case *models.Condition:
+			if !event.End && !in.Diabetes && hasCondition(Diabetes, r) {
+				in.Diabetes = true
+				changed = true
+			}
+		case *models.Observation:
+			if event.End {
+				continue
+			}
+			if plugin.ContainsConcept(plugin.Codes{plugin.LOINCSystem: {TotalCholesterolCode}}, r.Code) {
+				if q, ok := event.Quantity(); ok {
+					changed = updateInput(&in.TotalCholesterol, &hasTC, cholesterolMgPerDL(q))
+				}
+			} else if plugin.ContainsConcept(plugin.Codes{plugin.LOINCSystem: {HDLCholesterolCode}}, r.Code) {
+				if q, ok := event.Quantity(); ok {
+					changed = updateInput(&in.HDL, &hasHDL, cholesterolMgPerDL(q))
+				}
+			} else if plugin.ContainsConcept(plugin.Codes{plugin.LOINCSystem: {SmokingStatusCode}}, r.Code) {
+				if concept, ok := event.CodeableConcept(); ok {
+					if smoker, known := currentSmoker(concept); known && (!hasSmokingStatus || smoker != in.Smoker) {
+						in.Smoker = smoker
+						hasSmokingStatus = true
+						changed = true
+					}
+				}
+			} else if plugin.ContainsConcept(plugin.Codes{plugin.LOINCSystem: {SystolicBPCode}}, r.Code) {
+				if q, ok := event.Quantity(); ok {
+					changed = updateInput(&in.SystolicBP, &hasSBP, *q.Value)
+				}
+			} else if q, ok := event.ComponentQuantity(SystolicBPCode); ok {
+				changed = updateInput(&in.SystolicBP, &hasSBP, *q.Value)
+			}
+		case int:
+			if event.Type == "Age" {
+				in.Age = r
+				changed = true
+			}
+		default:
+			medication, ok := event.Medication()
+			if !ok || !plugin.ContainsConcept(terminology.Default.MustValueSet(Antihypertensives), medication) {
+				continue
+			}
+			key := plugin.MedicationKey(medication)
+			if !event.End {
+				medications[key]++
+			} else if medications[key] > 0 {
+				medications[key]--
+			}
+			if treated := calculateCount(medications) > 0; treated != in.TreatedHypertension {
+				in.TreatedHypertension = treated
+				changed = true
+			}
+		}
+		if !changed || !hasTC || !hasHDL || !hasSBP || !hasSmokingStatus || in.Age < ascvdMinAge || in.Age > ascvdMaxAge {
+			continue
+		}
+
+		pie = pie.Clone(true)
+		pie.UpdateSliceValue("Age", (in.Age-30)/10)
+		pie.UpdateSliceValue("Total Cholesterol", totalCholesterolLevel(in.TotalCholesterol))
+		pie.UpdateSliceValue("HDL Cholesterol", hdlLevel(in.HDL))
+		pie.UpdateSliceValue("Systolic Blood Pressure", systolicBPLevel(in.SystolicBP))
+		pie.UpdateSliceValue("Treated Hypertension", boolToInt(in.TreatedHypertension))
+		pie.UpdateSliceValue("Diabetes", boolToInt(in.Diabetes))
+		pie.UpdateSliceValue("Smoker", boolToInt(in.Smoker))
+		risk := equation.tenYearRisk(in)
+		results = append(results, plugin.RiskServiceCalculationResult{
+			AsOf:               event.Date,
+			Score:              nil,
+			ProbabilityDecimal: &risk,
+			Pie:                pie,
+			Approximate:        event.Approximate(),
+		})
+	}
+
+	// A patient who was scored while aged 40 to 79 keeps those scores after aging out
+	if len(results) == 0 {
+		if in.Age < ascvdMinAge || in.Age > ascvdMaxAge {
+			return nil, plugin.NewNotApplicableError("The Pooled Cohort Equations are only applicable to patients aged 40 to 79")
+		}
+		return nil, plugin.NewNotApplicableError("The Pooled Cohort Equations require total cholesterol, HDL cholesterol, systolic blood pressure and smoking status")
+	}
+	return results, nil
+}
+
+// ascvdInputs are the inputs to the Pooled Cohort Equations, other than sex and race, which select the equation.
+// The cholesterols are in mg/dL, and the systolic blood pressure is in mm Hg.
+type ascvdInputs struct {
+	Age                 int
+	TotalCholesterol    float64
+	HDL                 float64
+	SystolicBP          float64
+	TreatedHypertension bool
+	Diabetes            bool
+	Smoker              bool
+}
+
+// pooledCohortEquation is the coefficients of one of the Pooled Cohort Equations, for the natural logs of the
+// inputs and the interactions of the log of age with the others
+type pooledCohortEquation struct {
+	LnAge, LnAgeSquared             float64
+	LnTC, LnAgeLnTC                 float64
+	LnHDL, LnAgeLnHDL               float64
+	LnTreatedSBP, LnAgeLnTreatedSBP float64
+	LnSBP, LnAgeLnSBP               float64
+	Smoker, LnAgeSmoker             float64
+	Diabetes                        float64
+	BaselineSurvival                float64
+	MeanSum                         float64
+}
+
+// The Pooled Cohort Equations, from table A of the guideline
+var (
+	whiteFemaleEquation = pooledCohortEquation{
+		LnAge: -29.799, LnAgeSquared: 4.884, LnTC: 13.540, LnAgeLnTC: -3.114, LnHDL: -13.578, LnAgeLnHDL: 3.149,
+		LnTreatedSBP: 2.019, LnSBP: 1.957, Smoker: 7.574, LnAgeSmoker: -1.665, Diabetes: 0.661,
+		BaselineSurvival: 0.9665, MeanSum: -29.18,
+	}
+	africanAmericanFemaleEquation = pooledCohortEquation{
+		LnAge: 17.114, LnTC: 0.940, LnHDL: -18.920, LnAgeLnHDL: 4.475, LnTreatedSBP: 29.291, LnAgeLnTreatedSBP: -6.432,
+		LnSBP: 27.820, LnAgeLnSBP: -6.087, Smoker: 0.691, Diabetes: 0.874,
+		BaselineSurvival: 0.9533, MeanSum: 86.61,
+	}
+	whiteMaleEquation = pooledCohortEquation{
+		LnAge: 12.344, LnTC: 11.853, LnAgeLnTC: -2.664, LnHDL: -7.990, LnAgeLnHDL: 1.769, LnTreatedSBP: 1.797,
+		LnSBP: 1.764, Smoker: 7.837, LnAgeSmoker: -1.795, Diabetes: 0.658,
+		BaselineSurvival: 0.9144, MeanSum: 61.18,
+	}
+	africanAmericanMaleEquation = pooledCohortEquation{
+		LnAge: 2.469, LnTC: 0.302, LnHDL: -0.307, LnTreatedSBP: 1.916, LnSBP: 1.809, Smoker: 0.549, Diabetes: 0.645,
+		BaselineSurvival: 0.8954, MeanSum: 19.54,
+	}
+)
+
+// pooledCohortEquationFor returns the equation for the patient's sex and race
+func pooledCohortEquationFor(female, africanAmerican bool) pooledCohortEquation {
+	switch {
+	case female && africanAmerican:
+		return africanAmericanFemaleEquation
+	case female:
+		return whiteFemaleEquation
+	case africanAmerican:
+		return africanAmericanMaleEquation
+	default:
+		return whiteMaleEquation
+	}
+}
+
+// tenYearRisk returns the 10-year risk of ASCVD, as a percentage rounded to one decimal place:
+// 1 - S10^e^(sum - mean sum), where the sum is of the coefficients times the inputs
+func (eq pooledCohortEquation) tenYearRisk(in ascvdInputs) float64 {
+	lnAge := math.Log(float64(in.Age))
+	lnTC := math.Log(in.TotalCholesterol)
+	lnHDL := math.Log(in.HDL)
+	lnSBP := math.Log(in.SystolicBP)
+
+	sum := eq.LnAge*lnAge + eq.LnAgeSquared*lnAge*lnAge +
+		eq.LnTC*lnTC + eq.LnAgeLnTC*lnAge*lnTC +
+		eq.LnHDL*lnHDL + eq.LnAgeLnHDL*lnAge*lnHDL
+	if in.TreatedHypertension {
+		sum += eq.LnTreatedSBP*lnSBP + eq.LnAgeLnTreatedSBP*lnAge*lnSBP
+	} else {
+		sum += eq.LnSBP*lnSBP + eq.LnAgeLnSBP*lnAge*lnSBP
+	}
+	if in.Smoker {
+		sum += eq.Smoker + eq.LnAgeSmoker*lnAge
+	}
+	if in.Diabetes {
+		sum += eq.Diabetes
+	}
+
+	risk := 100 * (1 - math.Pow(eq.BaselineSurvival, math.Exp(sum-eq.MeanSum)))
+	return math.Floor(risk*10+0.5) / 10
+}
+
+// updateInput sets an input to a new value, returning true if it changed
+func updateInput(input *float64, has *bool, value float64) bool {
+	if *has && *input == value {
+		return false
+	}
+	*input = value
+	*has = true
+	return true
+}
+
+// cholesterolMgPerDL returns the cholesterol quantity in mg/dL, converting it from mmol/L if need be
+func cholesterolMgPerDL(q *models.Quantity) float64 {
+	if strings.EqualFold(q.Code, "mmol/L") || strings.EqualFold(q.Unit, "mmol/L") {
+		return *q.Value * 38.67
+	}
+	return *q.Value
+}
+
+// currentSmoker returns whether the smoking status is a current smoker, and false for known if the status is
+// unknown
+func currentSmoker(status *models.CodeableConcept) (smoker, known bool) {
+	if status.MatchesCode(terminology.SNOMEDSystem, "266927001") {
+		return false, false
+	}
+	return plugin.ContainsConcept(plugin.Codes{terminology.SNOMEDSystem: CurrentSmokerCodes}, status), true
+}
+
+// totalCholesterolLevel returns the category of the total cholesterol for its pie slice: under 160, 160-199,
+// 200-239, or 240 and up
+func totalCholesterolLevel(tc float64) int {
+	switch {
+	case tc < 160:
+		return 0
+	case tc < 200:
+		return 1
+	case tc < 240:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// hdlLevel returns the category of the HDL cholesterol for its pie slice: 60 and up, 50-59, 40-49, or under 40
+func hdlLevel(hdl float64) int {
+	switch {
+	case hdl >= 60:
+		return 0
+	case hdl >= 50:
+		return 1
+	case hdl >= 40:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// systolicBPLevel returns the category of the systolic blood pressure for its pie slice: under 120, 120-129,
+// 130-139, 140-159, or 160 and up
+func systolicBPLevel(sbp float64) int {
+	switch {
+	case sbp < 120:
+		return 0
+	case sbp < 130:
+		return 1
+	case sbp < 140:
+		return 2
+	case sbp < 160:
+		return 3
+	default:
+		return 4
+	}
+}
@@ -0,0 +1,223 @@
+package assessments
+
+import (
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	. "gopkg.in/check.v1"
+)
+
+type ASCVDPluginSuite struct {
+	Plugin          *ASCVDPlugin
+	FHIREndpointURL string
+}
+
+var _ = Suite(&ASCVDPluginSuite{})
+
+func (as *ASCVDPluginSuite) SetUpSuite(c *C) {
+	as.Plugin = &ASCVDPlugin{}
+	as.FHIREndpointURL = "http://example.org/fhir"
+}
+
+func (as *ASCVDPluginSuite) TearDownSuite(c *C) {
+	as.Plugin = nil
+}
+
+func (as *ASCVDPluginSuite) TestGuidelineExamples(c *C) {
+	// The examples from the guideline: age 55, total cholesterol 213, HDL 50, untreated systolic BP 120, nonsmoker
+	// and no diabetes
+	for _, example := range []struct {
+		Gender          string
+		AfricanAmerican bool
+		Risk            float64
+	}{
+		{"female", false, 2.1},
+		{"female", true, 3.0},
+		{"male", false, 5.4},
+		{"male", true, 6.1},
+	} {
+		patient := as.patient(example.Gender)
+		if example.AfricanAmerican {
+			as.setRace(patient, plugin.BlackOrAfricanAmerican)
+		}
+		es := plugin.NewEventStream(patient)
+		es.Events = append(es.Events, ageEvent("1", 55, time.Date(2010, time.July, 1, 0, 0, 0, 0, time.UTC)))
+		as.appendInputs(es, time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC), 213, 50, 120)
+		results, err := as.Plugin.Calculate(es, as.FHIREndpointURL)
+		c.Assert(err, IsNil)
+		c.Assert(results, HasLen, 1, Commentf("%s, African American: %t", example.Gender, example.AfricanAmerican))
+		c.Assert(*results[0].ProbabilityDecimal, Equals, example.Risk, Commentf("%s, African American: %t", example.Gender, example.AfricanAmerican))
+	}
+}
+
+func (as *ASCVDPluginSuite) TestResultWhenInputChanges(c *C) {
+	es := plugin.NewEventStream(as.patient("male"))
+	es.Events = append(es.Events, ageEvent("1", 60, time.Date(2015, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	as.appendInputs(es, time.Date(2015, time.August, 1, 15, 0, 0, 0, time.UTC), 213, 50, 120)
+	es.Events = append(es.Events, bloodPressurePanelEvent("5", 150, 95, time.Date(2015, time.September, 1, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, medicationEvent("6", "Lisinopril", "29046", time.Date(2015, time.October, 1, 15, 0, 0, 0, time.UTC)))
+	// Neither the same total cholesterol again nor a medication that isn't an antihypertensive changes anything
+	es.Events = append(es.Events, totalCholesterolEvent("7", 213, "mg/dL", time.Date(2015, time.November, 1, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, medicationEvent("8", "Warfarin", "11289", time.Date(2015, time.November, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, smokingStatusEvent("9", "449868002", time.Date(2015, time.December, 1, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, conditionEvent("10", "Diabetes", "250.00", time.Date(2016, time.January, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, ageEvent("11", 61, time.Date(2016, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	results, err := as.Plugin.Calculate(es, as.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 6)
+	as.assertResult(c, results[0], time.Date(2015, time.August, 1, 15, 0, 0, 0, time.UTC), 8.2, 3, 2, 1, 1, 0, 0, 0)
+	as.assertResult(c, results[1], time.Date(2015, time.September, 1, 15, 0, 0, 0, time.UTC), 11.9, 3, 2, 1, 3, 0, 0, 0)
+	as.assertResult(c, results[2], time.Date(2015, time.October, 1, 15, 0, 0, 0, time.UTC), 13.9, 3, 2, 1, 3, 1, 0, 0)
+	as.assertResult(c, results[3], time.Date(2015, time.December, 1, 15, 0, 0, 0, time.UTC), 21.6, 3, 2, 1, 3, 1, 0, 1)
+	as.assertResult(c, results[4], time.Date(2016, time.January, 15, 15, 0, 0, 0, time.UTC), 37.5, 3, 2, 1, 3, 1, 1, 1)
+	as.assertResult(c, results[5], time.Date(2016, time.July, 1, 0, 0, 0, 0, time.UTC), 39.0, 3, 2, 1, 3, 1, 1, 1)
+}
+
+func (as *ASCVDPluginSuite) TestCholesterolInMmolPerL(c *C) {
+	es := plugin.NewEventStream(as.patient("female"))
+	es.Events = append(es.Events, ageEvent("1", 55, time.Date(2010, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, totalCholesterolEvent("2", 5.5, "mmol/L", time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, hdlEvent("3", 1.3, "mmol/L", time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, systolicBPEvent("4", 120, time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, smokingStatusEvent("5", "266919005", time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	results, err := as.Plugin.Calculate(es, as.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	// 212.7 mg/dL total cholesterol and 50.3 mg/dL HDL
+	as.assertResult(c, results[0], time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC), 2.0, 2, 2, 1, 1, 0, 0, 0)
+}
+
+func (as *ASCVDPluginSuite) TestMissingInputs(c *C) {
+	es := plugin.NewEventStream(as.patient("female"))
+	es.Events = append(es.Events, ageEvent("1", 55, time.Date(2010, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, totalCholesterolEvent("2", 213, "mg/dL", time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, hdlEvent("3", 50, "mg/dL", time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, systolicBPEvent("4", 120, time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	// An unknown smoking status is as good as none
+	es.Events = append(es.Events, smokingStatusEvent("5", "266927001", time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	results, err := as.Plugin.Calculate(es, as.FHIREndpointURL)
+
+	c.Assert(err, NotNil)
+	c.Assert(err, FitsTypeOf, plugin.NotApplicableError{})
+	c.Assert(err.Error(), Equals, "The Pooled Cohort Equations require total cholesterol, HDL cholesterol, systolic blood pressure and smoking status")
+	c.Assert(results, HasLen, 0)
+}
+
+func (as *ASCVDPluginSuite) TestOutsideAgeRange(c *C) {
+	// Too young to have had an age event
+	es := plugin.NewEventStream(as.patient("male"))
+	as.appendInputs(es, time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC), 213, 50, 120)
+	results, err := as.Plugin.Calculate(es, as.FHIREndpointURL)
+	c.Assert(err, FitsTypeOf, plugin.NotApplicableError{})
+	c.Assert(err.Error(), Equals, "The Pooled Cohort Equations are only applicable to patients aged 40 to 79")
+	c.Assert(results, HasLen, 0)
+
+	// Too old, with the inputs only from after aging out
+	es = plugin.NewEventStream(as.patient("male"))
+	es.Events = append(es.Events, ageEvent("1", 80, time.Date(2010, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	as.appendInputs(es, time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC), 213, 50, 120)
+	results, err = as.Plugin.Calculate(es, as.FHIREndpointURL)
+	c.Assert(err, FitsTypeOf, plugin.NotApplicableError{})
+	c.Assert(err.Error(), Equals, "The Pooled Cohort Equations are only applicable to patients aged 40 to 79")
+	c.Assert(results, HasLen, 0)
+}
+
+func (as *ASCVDPluginSuite) TestScoresKeptAfterAgingOut(c *C) {
+	// Scored at 70, and 81 now, so the score from when the equations applied is still the latest
+	es := plugin.NewEventStream(as.patient("male"))
+	es.Events = append(es.Events, ageEvent("1", 70, time.Date(2025, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	as.appendInputs(es, time.Date(2026, time.February, 15, 15, 0, 0, 0, time.UTC), 213, 50, 120)
+	es.Events = append(es.Events, ageEvent("6", 80, time.Date(2035, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, ageEvent("7", 81, time.Date(2036, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	results, err := as.Plugin.Calculate(es, as.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	as.assertResult(c, results[0], time.Date(2026, time.February, 15, 15, 0, 0, 0, time.UTC), 16.8, 4, 2, 1, 1, 0, 0, 0)
+}
+
+func (as *ASCVDPluginSuite) TestUnknownGender(c *C) {
+	es := plugin.NewEventStream(as.patient("unknown"))
+	es.Events = append(es.Events, ageEvent("1", 55, time.Date(2010, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	as.appendInputs(es, time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC), 213, 50, 120)
+	results, err := as.Plugin.Calculate(es, as.FHIREndpointURL)
+	c.Assert(err, FitsTypeOf, plugin.NotApplicableError{})
+	c.Assert(results, HasLen, 0)
+}
+
+func (as *ASCVDPluginSuite) patient(gender string) *models.Patient {
+	birthDate := &models.FHIRDateTime{Time: time.Date(1955, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	patient := &models.Patient{Gender: gender, BirthDate: birthDate}
+	patient.Id = "1223"
+	return patient
+}
+
+func (as *ASCVDPluginSuite) setRace(patient *models.Patient, code string) {
+	patient.Extension = append(patient.Extension, models.Extension{
+		Url:                  "http://hl7.org/fhir/StructureDefinition/us-core-race",
+		ValueCodeableConcept: &models.CodeableConcept{Coding: []models.Coding{{System: plugin.RaceCodeSystem, Code: code}}},
+	})
+}
+
+// appendInputs appends events for the lab results and vitals (in mg/dL and mm Hg), and a nonsmoker's smoking status,
+// all at the same time
+func (as *ASCVDPluginSuite) appendInputs(es *plugin.EventStream, effective time.Time, tc, hdl, sbp float64) {
+	es.Events = append(es.Events, totalCholesterolEvent("2", tc, "mg/dL", effective))
+	es.Events = append(es.Events, hdlEvent("3", hdl, "mg/dL", effective))
+	es.Events = append(es.Events, systolicBPEvent("4", sbp, effective))
+	es.Events = append(es.Events, smokingStatusEvent("5", "266919005", effective))
+}
+
+func (as *ASCVDPluginSuite) assertResult(c *C, result plugin.RiskServiceCalculationResult, asOf time.Time, risk float64, age, tc, hdl, sbp, treated, diabetes, smoker int) {
+	c.Assert(result.AsOf, DeepEquals, asOf)
+	c.Assert(result.Score, IsNil)
+	c.Assert(*result.ProbabilityDecimal, Equals, risk)
+	c.Assert(result.Pie.Slices, HasLen, 7)
+	for name, value := range map[string]int{"Age": age, "Total Cholesterol": tc, "HDL Cholesterol": hdl,
+		"Systolic Blood Pressure": sbp, "Treated Hypertension": treated, "Diabetes": diabetes, "Smoker": smoker} {
+		for _, slice := range result.Pie.Slices {
+			if slice.Name == name {
+				c.Assert(slice.Value, Equals, value, Commentf("slice %s", name))
+			}
+		}
+	}
+}
+
+func totalCholesterolEvent(id string, value float64, unit string, effective time.Time) plugin.Event {
+	return observationEvent(id, "Total Cholesterol", TotalCholesterolCode, models.Quantity{Value: &value, Unit: unit}, effective)
+}
+
+func hdlEvent(id string, value float64, unit string, effective time.Time) plugin.Event {
+	return observationEvent(id, "HDL Cholesterol", HDLCholesterolCode, models.Quantity{Value: &value, Unit: unit}, effective)
+}
+
+func systolicBPEvent(id string, value float64, effective time.Time) plugin.Event {
+	return observationEvent(id, "Systolic Blood Pressure", SystolicBPCode, models.Quantity{Value: &value, Unit: "mm[Hg]"}, effective)
+}
+
+func bloodPressurePanelEvent(id string, systolic, diastolic float64, effective time.Time) plugin.Event {
+	event := observationEvent(id, "Blood Pressure", "55284-4", models.Quantity{}, effective)
+	observation := event.Value.(*models.Observation)
+	observation.ValueQuantity = nil
+	observation.Component = []models.ObservationComponentComponent{
+		{
+			Code:          &models.CodeableConcept{Coding: []models.Coding{{System: "http://loinc.org", Code: SystolicBPCode}}},
+			ValueQuantity: &models.Quantity{Value: &systolic, Unit: "mm[Hg]"},
+		},
+		{
+			Code:          &models.CodeableConcept{Coding: []models.Coding{{System: "http://loinc.org", Code: "8462-4"}}},
+			ValueQuantity: &models.Quantity{Value: &diastolic, Unit: "mm[Hg]"},
+		},
+	}
+	return event
+}
+
+func smokingStatusEvent(id, snomedCode string, effective time.Time) plugin.Event {
+	event := observationEvent(id, "Smoking Status", SmokingStatusCode, models.Quantity{}, effective)
+	observation := event.Value.(*models.Observation)
+	observation.ValueQuantity = nil
+	observation.ValueCodeableConcept = &models.CodeableConcept{
+		Coding: []models.Coding{{System: "http://snomed.info/sct", Code: snomedCode}},
+	}
+	return event
+}
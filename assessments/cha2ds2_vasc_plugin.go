@@ -1,11 +1,11 @@
 package assessments
 
 import (
-	"strings"
 	"time"
 
 	"github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/intervention-engine/riskservice/terminology"
 )
 
 // CHA2DS2VAScPlugin is a risk calculation service implementing the CHA2DS2-VASc Score for Stroke in Patients with
@@ -38,6 +38,8 @@ func (c *CHA2DS2VAScPlugin) Config() plugin.RiskServicePluginConfig {
 		},
 		RequiredResourceTypes: []string{"Condition"},
 		SignificantBirthdays:  []int{65, 75},
+		// A history of any of the conditions is a risk factor, even once it has resolved
+		ResolvedConditions: plugin.ResolvedConditionPolicy{CountsByDefault: true},
 	}
 }
 
@@ -46,15 +48,7 @@ func (c *CHA2DS2VAScPlugin) Calculate(es *plugin.EventStream, fhirEndpointURL st
 	var results []plugin.RiskServiceCalculationResult
 
 	// First make sure there is AFIB in the history, since this score is only valid for patients with AFIB
-	var hasAFib bool
-	for i := 0; !hasAFib && i < len(es.Events); i++ {
-		if es.Events[i].Type == "Condition" && !es.Events[i].End {
-			if cond, ok := es.Events[i].Value.(*models.Condition); ok {
-				hasAFib = fuzzyFindCondition("427.31", "http://hl7.org/fhir/sid/icd-9", cond)
-			}
-		}
-	}
-	if !hasAFib {
+	if !es.EverHad(terminology.Default.MustValueSet(AtrialFibrillation)) {
 		return nil, plugin.NewNotApplicableError("CHA2DS2-VASc is only applicable to patients with Atrial Fibrillation")
 	}
 
@@ -70,7 +64,8 @@ func (c *CHA2DS2VAScPlugin) Calculate(es *plugin.EventStream, fhirEndpointURL st
 	// Now go through the event stream, updating the pie
 	var hasAfib bool
 	for _, event := range es.Events {
-		// NOTE: We are not paying attention to end times -- if it's in the patient history, we count it.
+		// NOTE: We are not paying attention to end times -- if it's in the patient history, we count it (which is
+		// also why the config says resolved conditions still count, so the service doesn't send their end events).
 		// Also guard against future dates (for example, our patient generator can create future events)
 		if event.End || event.Date.Local().After(time.Now()) {
 			continue
@@ -81,23 +76,23 @@ func (c *CHA2DS2VAScPlugin) Calculate(es *plugin.EventStream, fhirEndpointURL st
 		switch event.Type {
 		case "Condition":
 			r := event.Value.(*models.Condition)
-			if fuzzyFindCondition("427.31", "http://hl7.org/fhir/sid/icd-9", r) {
+			if hasCondition(AtrialFibrillation, r) {
 				// Found atrial fibrillation, so all events from here on should produce scores
 				hasAfib = true
 				isFactor = true
-			} else if fuzzyFindCondition("428", "http://hl7.org/fhir/sid/icd-9", r) {
+			} else if hasCondition(CongestiveHeartFailure, r) {
 				pie.UpdateSliceValue("Congestive Heart Failure", 1)
 				isFactor = true
-			} else if fuzzyFindCondition("401", "http://hl7.org/fhir/sid/icd-9", r) {
+			} else if hasCondition(Hypertension, r) {
 				pie.UpdateSliceValue("Hypertension", 1)
 				isFactor = true
-			} else if fuzzyFindCondition("250", "http://hl7.org/fhir/sid/icd-9", r) {
+			} else if hasCondition(Diabetes, r) {
 				pie.UpdateSliceValue("Diabetes", 1)
 				isFactor = true
-			} else if fuzzyFindCondition("434", "http://hl7.org/fhir/sid/icd-9", r) {
+			} else if hasCondition(Stroke, r) {
 				pie.UpdateSliceValue("Stroke", 2)
 				isFactor = true
-			} else if fuzzyFindCondition("443", "http://hl7.org/fhir/sid/icd-9", r) {
+			} else if hasCondition(VascularDisease, r) {
 				pie.UpdateSliceValue("Vascular Disease", 1)
 				isFactor = true
 			}
@@ -119,6 +114,7 @@ func (c *CHA2DS2VAScPlugin) Calculate(es *plugin.EventStream, fhirEndpointURL st
 				Score:              &score,
 				ProbabilityDecimal: &percent,
 				Pie:                pie,
+				Approximate:        event.Approximate(),
 			})
 		}
 	}
@@ -130,13 +126,7 @@ func (c *CHA2DS2VAScPlugin) Calculate(es *plugin.EventStream, fhirEndpointURL st
 // See: http://stroke.ahajournals.org/content/41/12/2731/T4.expansion.html
 var ScoreToStrokeRisk = map[int]float64{0: 0, 1: 1.3, 2: 2.2, 3: 3.2, 4: 4.0, 5: 6.7, 6: 9.8, 7: 9.6, 8: 6.7, 9: 15.2}
 
-func fuzzyFindCondition(codeStart, codeSystem string, condition *models.Condition) bool {
-	if condition.VerificationStatus == "confirmed" {
-		for _, coding := range condition.Code.Coding {
-			if strings.HasPrefix(coding.Code, codeStart) && coding.System == codeSystem {
-				return true
-			}
-		}
-	}
-	return false
+// hasCondition returns true if the condition is confirmed and its code is in the named value set
+func hasCondition(valueSet string, condition *models.Condition) bool {
+	return condition.VerificationStatus == "confirmed" && plugin.ContainsConcept(terminology.Default.MustValueSet(valueSet), condition.Code)
 }
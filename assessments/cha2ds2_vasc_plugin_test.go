@@ -172,6 +172,62 @@ func (cs *CHA2DS2VAScPluginSuite) TestNoAFib(c *C) {
 	c.Assert(results, HasLen, 0)
 }
 
+func (cs *CHA2DS2VAScPluginSuite) TestFemaleWithEveryFactorInICD10(c *C) {
+	birthDate := &models.FHIRDateTime{Time: time.Date(1940, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	patient := &models.Patient{Gender: "female", BirthDate: birthDate}
+	patient.Id = "1223"
+	icd10 := "http://hl7.org/fhir/sid/icd-10-cm"
+	es := plugin.NewEventStream(patient)
+	es.Events = append(es.Events, codedConditionEvent("1", "Atrial Fibrillation", icd10, "I48.91", time.Date(1990, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("2", "Congestive Heart Failure", icd10, "I50.9", time.Date(1993, time.March, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("3", "Hypertension", icd10, "I10", time.Date(1997, time.April, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("4", "Diabetes", icd10, "E11.9", time.Date(2000, time.May, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("5", "Stroke", icd10, "I63.50", time.Date(2004, time.June, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, ageEvent("6", 65, time.Date(2005, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("7", "Peripheral Vascular Disease", icd10, "I73.9", time.Date(2007, time.July, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, ageEvent("8", 75, time.Date(2015, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	results, err := cs.Plugin.Calculate(es, cs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 8)
+	cs.assertResult(c, results[0], time.Date(1990, time.February, 15, 15, 0, 0, 0, time.UTC), 1, 1.3, "1223", 0, 0, 0, 0, 0, 0, 1)
+	cs.assertResult(c, results[4], time.Date(2004, time.June, 15, 15, 0, 0, 0, time.UTC), 6, 9.8, "1223", 1, 1, 1, 2, 0, 0, 1)
+	cs.assertResult(c, results[7], time.Date(2015, time.July, 1, 0, 0, 0, 0, time.UTC), 9, 15.2, "1223", 1, 1, 1, 2, 1, 2, 1)
+}
+
+func (cs *CHA2DS2VAScPluginSuite) TestMixedCodingHistory(c *C) {
+	birthDate := &models.FHIRDateTime{Time: time.Date(1950, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	patient := &models.Patient{Gender: "male", BirthDate: birthDate}
+	patient.Id = "1223"
+	icd10, snomed := "http://hl7.org/fhir/sid/icd-10-cm", "http://snomed.info/sct"
+	es := plugin.NewEventStream(patient)
+	// An ICD-9 era CHF diagnosis and prior MI, then AFib and the rest coded in ICD-10-CM and SNOMED CT
+	es.Events = append(es.Events, conditionEvent("1", "Congestive Heart Failure", "428.0", time.Date(2010, time.March, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, conditionEvent("2", "Old Myocardial Infarction", "412", time.Date(2012, time.March, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("3", "Atrial Fibrillation", snomed, "49436004", time.Date(2015, time.November, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("4", "Essential Hypertension", snomed, "59621000", time.Date(2016, time.January, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("5", "Transient Ischemic Attack", icd10, "G45.9", time.Date(2016, time.May, 15, 15, 0, 0, 0, time.UTC)))
+	// Not a factor
+	es.Events = append(es.Events, codedConditionEvent("6", "Atrial Flutter", icd10, "I48.92", time.Date(2016, time.June, 15, 15, 0, 0, 0, time.UTC)))
+	results, err := cs.Plugin.Calculate(es, cs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 3)
+	cs.assertResult(c, results[0], time.Date(2015, time.November, 15, 15, 0, 0, 0, time.UTC), 2, 2.2, "1223", 1, 0, 0, 0, 1, 0, 0)
+	cs.assertResult(c, results[1], time.Date(2016, time.January, 15, 15, 0, 0, 0, time.UTC), 3, 3.2, "1223", 1, 1, 0, 0, 1, 0, 0)
+	cs.assertResult(c, results[2], time.Date(2016, time.May, 15, 15, 0, 0, 0, time.UTC), 5, 6.7, "1223", 1, 1, 0, 2, 1, 0, 0)
+}
+
+func (cs *CHA2DS2VAScPluginSuite) TestAFibInICD10IsApplicable(c *C) {
+	birthDate := &models.FHIRDateTime{Time: time.Date(1980, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	patient := &models.Patient{Gender: "male", BirthDate: birthDate}
+	patient.Id = "1223"
+	es := plugin.NewEventStream(patient)
+	es.Events = append(es.Events, codedConditionEvent("1", "Permanent Atrial Fibrillation", "http://hl7.org/fhir/sid/icd-10-cm", "I48.21", time.Date(2016, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	results, err := cs.Plugin.Calculate(es, cs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	cs.assertResult(c, results[0], time.Date(2016, time.February, 15, 15, 0, 0, 0, time.UTC), 0, 0.0, "1223", 0, 0, 0, 0, 0, 0, 0)
+}
+
 func (cs *CHA2DS2VAScPluginSuite) assertResult(c *C, result plugin.RiskServiceCalculationResult, asOf time.Time, score int, pct float64, patientID string, chf, hypertension, diabetes, stroke, vasc, age, gender int) {
 	c.Assert(result.AsOf, DeepEquals, asOf)
 	c.Assert(*result.Score, Equals, score)
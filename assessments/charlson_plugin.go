@@ -0,0 +1,147 @@
+package assessments
+
+import (
+	"math"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// CharlsonPlugin is a risk calculation service implementing the Charlson Comorbidity Index, which predicts 10-year
+// survival from the patient's comorbidities and age.
+// See: Charlson ME, et al. A new method of classifying prognostic comorbidity in longitudinal studies: development
+// and validation.  J Chronic Dis 1987;40(5):373-383.
+//
+// The patient's conditions are sorted into the 17 Charlson categories using the value sets named with
+// CharlsonValueSetPrefix.  When the patient has both the milder and more severe form of a disease (diabetes, liver
+// disease or cancer), only the more severe one counts.  The age points are those of the age-combined index: one for
+// each decade from 50.
+type CharlsonPlugin struct {
+}
+
+// NewCharlsonPlugin returns a new CharlsonPlugin
+func NewCharlsonPlugin() *CharlsonPlugin {
+	return &CharlsonPlugin{}
+}
+
+// charlsonCategories are the Charlson categories, in the order of their pie slices.  The slice weights are roughly
+// proportional to the points.
+var charlsonCategories = []comorbidityCategory{
+	{Name: CharlsonMyocardialInfarction, Points: 1, Weight: 3},
+	{Name: CharlsonCongestiveHeartFailure, Points: 1, Weight: 3},
+	{Name: CharlsonPeripheralVascularDisease, Points: 1, Weight: 3},
+	{Name: CharlsonCerebrovascularDisease, Points: 1, Weight: 3},
+	{Name: CharlsonDementia, Points: 1, Weight: 3},
+	{Name: CharlsonChronicPulmonaryDisease, Points: 1, Weight: 3},
+	{Name: CharlsonRheumaticDisease, Points: 1, Weight: 3},
+	{Name: CharlsonPepticUlcerDisease, Points: 1, Weight: 3},
+	{Name: CharlsonMildLiverDisease, Points: 1, Weight: 3, SupersededBy: CharlsonModerateSevereLiverDisease},
+	{Name: CharlsonDiabetes, Points: 1, Weight: 3, SupersededBy: CharlsonDiabetesWithComplications},
+	{Name: CharlsonDiabetesWithComplications, Points: 2, Weight: 5},
+	{Name: CharlsonHemiplegiaOrParaplegia, Points: 2, Weight: 5},
+	{Name: CharlsonRenalDisease, Points: 2, Weight: 5},
+	{Name: CharlsonMalignancy, Points: 2, Weight: 5, SupersededBy: CharlsonMetastaticSolidTumor},
+	{Name: CharlsonModerateSevereLiverDisease, Points: 3, Weight: 8},
+	{Name: CharlsonMetastaticSolidTumor, Points: 6, Weight: 16},
+	{Name: CharlsonAIDS, Points: 6, Weight: 16},
+}
+
+// Config provides the configuration parameters for the CharlsonPlugin
+func (ch *CharlsonPlugin) Config() plugin.RiskServicePluginConfig {
+	slices := append(comorbiditySlices(charlsonCategories), plugin.Slice{Name: "Age", Weight: 10, MaxValue: 4})
+	return plugin.RiskServicePluginConfig{
+		Name: "Charlson Comorbidity Index",
+		Method: models.CodeableConcept{
+			Coding: []models.Coding{{System: "http://interventionengine.org/risk-assessments", Code: "Charlson"}},
+			Text:   "Charlson Comorbidity Index",
+		},
+		PredictedOutcome:      models.CodeableConcept{Text: "10-Year Survival"},
+		DefaultPieSlices:      slices,
+		RequiredResourceTypes: []string{"Condition"},
+		SignificantBirthdays:  []int{50, 60, 70, 80},
+		// Comorbidities count once they've been diagnosed
+		ResolvedConditions: plugin.ResolvedConditionPolicy{CountsByDefault: true},
+	}
+}
+
+// Calculate takes a stream of events and returns a slice of corresponding risk calculation results
+func (ch *CharlsonPlugin) Calculate(es *plugin.EventStream, fhirEndpointURL string) ([]plugin.RiskServiceCalculationResult, error) {
+	var results []plugin.RiskServiceCalculationResult
+
+	pie := plugin.NewPie(fhirEndpointURL + "/Patient/" + es.Patient.Id)
+	pie.Slices = ch.Config().DefaultPieSlices
+
+	// Keep track of the categories the patient is in, so the superseded ones can be zeroed out
+	categories := make(map[string]bool)
+
+	for _, event := range es.Events {
+		// NOTE: guard against future dates (for example, our patient generator can create future events)
+		if event.End || event.Date.Local().After(time.Now()) {
+			continue
+		}
+
+		var isFactor bool
+		pie = pie.Clone(true)
+		switch r := event.Value.(type) {
+		case *models.Condition:
+			for _, category := range charlsonCategories {
+				if !categories[category.Name] && hasCondition(CharlsonValueSetPrefix+category.Name, r) {
+					categories[category.Name] = true
+					isFactor = true
+				}
+			}
+			if isFactor {
+				updateComorbiditySlices(pie, charlsonCategories, categories)
+			}
+		case int:
+			if event.Type == "Age" && r >= 50 {
+				pie.UpdateSliceValue("Age", charlsonAgePoints(r))
+				isFactor = true
+			}
+		}
+		if isFactor {
+			score := pie.TotalValues()
+			survival := CharlsonTenYearSurvival(score)
+			results = append(results, plugin.RiskServiceCalculationResult{
+				AsOf:               event.Date,
+				Score:              &score,
+				ProbabilityDecimal: &survival,
+				Pie:                pie,
+				Approximate:        event.Approximate(),
+			})
+		}
+	}
+
+	// If there are no results, provide a 0 score for the current time
+	if len(results) == 0 {
+		zero := 0
+		survival := CharlsonTenYearSurvival(zero)
+		results = append(results, plugin.RiskServiceCalculationResult{
+			AsOf:               time.Now(),
+			Score:              &zero,
+			ProbabilityDecimal: &survival,
+			Pie:                pie,
+		})
+	}
+
+	return results, nil
+}
+
+// charlsonAgePoints returns the points for the patient's age: one for each decade from 50, up to four
+func charlsonAgePoints(age int) int {
+	if age < 50 {
+		return 0
+	}
+	if points := (age - 40) / 10; points < 4 {
+		return points
+	}
+	return 4
+}
+
+// CharlsonTenYearSurvival returns the estimated 10-year survival, as a percentage rounded to one decimal place, for
+// the Charlson Comorbidity Index: 0.983^(e^(0.9 * index))
+func CharlsonTenYearSurvival(index int) float64 {
+	survival := 100 * math.Pow(0.983, math.Exp(0.9*float64(index)))
+	return math.Floor(survival*10+0.5) / 10
+}
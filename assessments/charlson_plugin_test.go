@@ -0,0 +1,116 @@
+package assessments
+
+import (
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	. "gopkg.in/check.v1"
+)
+
+type CharlsonPluginSuite struct {
+	Plugin          *CharlsonPlugin
+	FHIREndpointURL string
+}
+
+var _ = Suite(&CharlsonPluginSuite{})
+
+func (cs *CharlsonPluginSuite) SetUpSuite(c *C) {
+	cs.Plugin = &CharlsonPlugin{}
+	cs.FHIREndpointURL = "http://example.org/fhir"
+}
+
+func (cs *CharlsonPluginSuite) TearDownSuite(c *C) {
+	cs.Plugin = nil
+}
+
+func (cs *CharlsonPluginSuite) TestConfig(c *C) {
+	slices := cs.Plugin.Config().DefaultPieSlices
+	c.Assert(slices, HasLen, 18)
+	var weights int
+	for _, slice := range slices {
+		weights += slice.Weight
+	}
+	c.Assert(weights, Equals, 100)
+	c.Assert(slices[16], DeepEquals, plugin.Slice{Name: "AIDS/HIV", Weight: 16, MaxValue: 6})
+	c.Assert(slices[17], DeepEquals, plugin.Slice{Name: "Age", Weight: 10, MaxValue: 4})
+}
+
+func (cs *CharlsonPluginSuite) TestNoComorbidities(c *C) {
+	es := plugin.NewEventStream(cs.patient(1980))
+	// Not a Charlson comorbidity
+	es.Events = append(es.Events, conditionEvent("1", "Atrial Fibrillation", "427.31", time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	results, err := cs.Plugin.Calculate(es, cs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Assert(*results[0].Score, Equals, 0)
+	c.Assert(*results[0].ProbabilityDecimal, Equals, 98.3)
+	c.Assert(results[0].Pie.TotalValues(), Equals, 0)
+}
+
+func (cs *CharlsonPluginSuite) TestDeyoICD9History(c *C) {
+	es := plugin.NewEventStream(cs.patient(1950))
+	es.Events = append(es.Events, conditionEvent("1", "Diabetes", "250.00", time.Date(1995, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, ageEvent("2", 50, time.Date(2000, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, conditionEvent("3", "Old Myocardial Infarction", "412", time.Date(2003, time.March, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, conditionEvent("4", "Diabetes with Renal Manifestations", "250.40", time.Date(2005, time.April, 15, 15, 0, 0, 0, time.UTC)))
+	// A second code in a category the patient is already in doesn't change anything
+	es.Events = append(es.Events, conditionEvent("5", "Diabetes with Ophthalmic Manifestations", "250.50", time.Date(2006, time.May, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, ageEvent("6", 60, time.Date(2010, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	results, err := cs.Plugin.Calculate(es, cs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 5)
+	cs.assertResult(c, results[0], time.Date(1995, time.February, 15, 15, 0, 0, 0, time.UTC), 1, 95.9, map[string]int{CharlsonDiabetes: 1})
+	cs.assertResult(c, results[1], time.Date(2000, time.July, 1, 0, 0, 0, 0, time.UTC), 2, 90.1, map[string]int{CharlsonDiabetes: 1, "Age": 1})
+	cs.assertResult(c, results[2], time.Date(2003, time.March, 15, 15, 0, 0, 0, time.UTC), 3, 77.5, map[string]int{CharlsonDiabetes: 1, CharlsonMyocardialInfarction: 1, "Age": 1})
+	// Diabetes with complications supersedes diabetes without them
+	cs.assertResult(c, results[3], time.Date(2005, time.April, 15, 15, 0, 0, 0, time.UTC), 4, 53.4, map[string]int{CharlsonDiabetesWithComplications: 2, CharlsonMyocardialInfarction: 1, "Age": 1})
+	cs.assertResult(c, results[4], time.Date(2010, time.July, 1, 0, 0, 0, 0, time.UTC), 5, 21.4, map[string]int{CharlsonDiabetesWithComplications: 2, CharlsonMyocardialInfarction: 1, "Age": 2})
+}
+
+func (cs *CharlsonPluginSuite) TestQuanICD10History(c *C) {
+	icd10 := "http://hl7.org/fhir/sid/icd-10-cm"
+	es := plugin.NewEventStream(cs.patient(1980))
+	es.Events = append(es.Events, codedConditionEvent("1", "Malignant Neoplasm of Lung", icd10, "C34.90", time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("2", "Alcoholic Cirrhosis", icd10, "K70.30", time.Date(2011, time.March, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("3", "Secondary Malignant Neoplasm of Lung", icd10, "C78.00", time.Date(2012, time.April, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("4", "Hepatorenal Syndrome", icd10, "K76.7", time.Date(2013, time.May, 15, 15, 0, 0, 0, time.UTC)))
+	results, err := cs.Plugin.Calculate(es, cs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 4)
+	cs.assertResult(c, results[0], time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC), 2, 90.1, map[string]int{CharlsonMalignancy: 2})
+	cs.assertResult(c, results[1], time.Date(2011, time.March, 15, 15, 0, 0, 0, time.UTC), 3, 77.5, map[string]int{CharlsonMalignancy: 2, CharlsonMildLiverDisease: 1})
+	// Metastatic solid tumor supersedes malignancy, and moderate or severe liver disease supersedes mild
+	cs.assertResult(c, results[2], time.Date(2012, time.April, 15, 15, 0, 0, 0, time.UTC), 7, 0.0, map[string]int{CharlsonMetastaticSolidTumor: 6, CharlsonMildLiverDisease: 1})
+	cs.assertResult(c, results[3], time.Date(2013, time.May, 15, 15, 0, 0, 0, time.UTC), 9, 0.0, map[string]int{CharlsonMetastaticSolidTumor: 6, CharlsonModerateSevereLiverDisease: 3})
+}
+
+func (cs *CharlsonPluginSuite) TestAgePoints(c *C) {
+	c.Assert(charlsonAgePoints(49), Equals, 0)
+	c.Assert(charlsonAgePoints(50), Equals, 1)
+	c.Assert(charlsonAgePoints(69), Equals, 2)
+	c.Assert(charlsonAgePoints(70), Equals, 3)
+	c.Assert(charlsonAgePoints(80), Equals, 4)
+	c.Assert(charlsonAgePoints(95), Equals, 4)
+}
+
+func (cs *CharlsonPluginSuite) patient(birthYear int) *models.Patient {
+	birthDate := &models.FHIRDateTime{Time: time.Date(birthYear, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	patient := &models.Patient{Gender: "female", BirthDate: birthDate}
+	patient.Id = "1223"
+	return patient
+}
+
+// assertResult checks the result's score and survival, and that the pie's slices have the given values (and every
+// other slice is zero)
+func (cs *CharlsonPluginSuite) assertResult(c *C, result plugin.RiskServiceCalculationResult, asOf time.Time, score int, survival float64, values map[string]int) {
+	c.Assert(result.AsOf, DeepEquals, asOf)
+	c.Assert(*result.Score, Equals, score)
+	c.Assert(*result.ProbabilityDecimal, Equals, survival)
+	c.Assert(result.Pie, NotNil)
+	c.Assert(result.Pie.Patient, Equals, cs.FHIREndpointURL+"/Patient/1223")
+	c.Assert(result.Pie.Slices, HasLen, 18)
+	for _, slice := range result.Pie.Slices {
+		c.Assert(slice.Value, Equals, values[slice.Name], Commentf("Slice %s", slice.Name))
+	}
+}
@@ -0,0 +1,107 @@
+package assessments
+
+import (
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/terminology"
+)
+
+// CharlsonValueSetPrefix begins the names of the value sets for the Charlson categories, each of which is named
+// with the prefix followed by the category (e.g., "Charlson Renal Disease").
+const CharlsonValueSetPrefix = "Charlson "
+
+// The Charlson categories, which are also the names of the Charlson pie slices
+const (
+	CharlsonMyocardialInfarction       = "Myocardial Infarction"
+	CharlsonCongestiveHeartFailure     = "Congestive Heart Failure"
+	CharlsonPeripheralVascularDisease  = "Peripheral Vascular Disease"
+	CharlsonCerebrovascularDisease     = "Cerebrovascular Disease"
+	CharlsonDementia                   = "Dementia"
+	CharlsonChronicPulmonaryDisease    = "Chronic Pulmonary Disease"
+	CharlsonRheumaticDisease           = "Rheumatic Disease"
+	CharlsonPepticUlcerDisease         = "Peptic Ulcer Disease"
+	CharlsonMildLiverDisease           = "Mild Liver Disease"
+	CharlsonDiabetes                   = "Diabetes without Chronic Complications"
+	CharlsonDiabetesWithComplications  = "Diabetes with Chronic Complications"
+	CharlsonHemiplegiaOrParaplegia     = "Hemiplegia or Paraplegia"
+	CharlsonRenalDisease               = "Renal Disease"
+	CharlsonMalignancy                 = "Malignancy"
+	CharlsonModerateSevereLiverDisease = "Moderate or Severe Liver Disease"
+	CharlsonMetastaticSolidTumor       = "Metastatic Solid Tumor"
+	CharlsonAIDS                       = "AIDS/HIV"
+)
+
+// charlsonValueSets are the value sets for the Charlson categories.  The ICD-9 codes are from Deyo's adaptation of
+// the index, and the ICD-10 codes are from Quan's, which are also used for ICD-10-CM.  Each code includes its
+// descendants.
+// See: Quan H, et al. Coding algorithms for defining comorbidities in ICD-9-CM and ICD-10 administrative data.  Med
+// Care 2005;43(11):1130-1139.
+var charlsonValueSets = []*models.ValueSet{
+	charlsonValueSet(CharlsonMyocardialInfarction,
+		[]string{"410", "412"},
+		[]string{"I21", "I22", "I25.2"}),
+	charlsonValueSet(CharlsonCongestiveHeartFailure,
+		[]string{"428"},
+		[]string{"I09.9", "I11.0", "I13.0", "I13.2", "I25.5", "I42.0", "I42.5", "I42.6", "I42.7", "I42.8", "I42.9", "I43",
+			"I50", "P29.0"}),
+	charlsonValueSet(CharlsonPeripheralVascularDisease,
+		[]string{"441", "443.9", "785.4", "V43.4"},
+		[]string{"I70", "I71", "I73.1", "I73.8", "I73.9", "I77.1", "I79.0", "I79.2", "K55.1", "K55.8", "K55.9", "Z95.8",
+			"Z95.9"}),
+	charlsonValueSet(CharlsonCerebrovascularDisease,
+		icd9Range(430, 438),
+		concat([]string{"G45", "G46", "H34.0"}, icd10Range("I", 60, 69))),
+	charlsonValueSet(CharlsonDementia,
+		[]string{"290"},
+		concat(icd10Range("F", 0, 3), []string{"F05.1", "G30", "G31.1"})),
+	charlsonValueSet(CharlsonChronicPulmonaryDisease,
+		concat(icd9Range(490, 496), icd9Range(500, 505), []string{"506.4"}),
+		concat([]string{"I27.8", "I27.9"}, icd10Range("J", 40, 47), icd10Range("J", 60, 67),
+			[]string{"J68.4", "J70.1", "J70.3"})),
+	charlsonValueSet(CharlsonRheumaticDisease,
+		[]string{"710.0", "710.1", "710.4", "714.0", "714.1", "714.2", "714.81", "725"},
+		concat([]string{"M05", "M06", "M31.5", "M35.1", "M35.3", "M36.0"}, icd10Range("M", 32, 34))),
+	charlsonValueSet(CharlsonPepticUlcerDisease,
+		icd9Range(531, 534),
+		icd10Range("K", 25, 28)),
+	charlsonValueSet(CharlsonMildLiverDisease,
+		[]string{"571.2", "571.4", "571.5", "571.6"},
+		[]string{"B18", "K70.0", "K70.1", "K70.2", "K70.3", "K70.9", "K71.3", "K71.4", "K71.5", "K71.7", "K73", "K74",
+			"K76.0", "K76.2", "K76.3", "K76.4", "K76.8", "K76.9", "Z94.4"}),
+	charlsonValueSet(CharlsonDiabetes,
+		[]string{"250.0", "250.1", "250.2", "250.3", "250.7"},
+		withSuffixes(icd10Range("E", 10, 14), ".0", ".1", ".6", ".8", ".9")),
+	charlsonValueSet(CharlsonDiabetesWithComplications,
+		[]string{"250.4", "250.5", "250.6"},
+		withSuffixes(icd10Range("E", 10, 14), ".2", ".3", ".4", ".5", ".7")),
+	charlsonValueSet(CharlsonHemiplegiaOrParaplegia,
+		[]string{"342", "344.1"},
+		[]string{"G04.1", "G11.4", "G80.1", "G80.2", "G81", "G82", "G83.0", "G83.1", "G83.2", "G83.3", "G83.4",
+			"G83.9"}),
+	charlsonValueSet(CharlsonRenalDisease,
+		[]string{"582", "583.0", "583.1", "583.2", "583.3", "583.4", "583.5", "583.6", "583.7", "585", "586", "588"},
+		[]string{"I12.0", "I13.1", "N03.2", "N03.3", "N03.4", "N03.5", "N03.6", "N03.7", "N05.2", "N05.3", "N05.4",
+			"N05.5", "N05.6", "N05.7", "N18", "N19", "N25.0", "Z49.0", "Z49.1", "Z49.2", "Z94.0", "Z99.2"}),
+	charlsonValueSet(CharlsonMalignancy,
+		concat(icd9Range(140, 172), icd9Range(174, 195), icd9Range(200, 208)),
+		concat(icd10Range("C", 0, 26), icd10Range("C", 30, 34), icd10Range("C", 37, 41), []string{"C43"},
+			icd10Range("C", 45, 58), icd10Range("C", 60, 76), icd10Range("C", 81, 85), []string{"C88"},
+			icd10Range("C", 90, 97))),
+	charlsonValueSet(CharlsonModerateSevereLiverDisease,
+		[]string{"456.0", "456.1", "456.2", "572.2", "572.3", "572.4", "572.5", "572.6", "572.7", "572.8"},
+		[]string{"I85.0", "I85.9", "I86.4", "I98.2", "K70.4", "K71.1", "K72.1", "K72.9", "K76.5", "K76.6", "K76.7"}),
+	charlsonValueSet(CharlsonMetastaticSolidTumor,
+		[]string{"196", "197", "198", "199.0", "199.1"},
+		icd10Range("C", 77, 80)),
+	charlsonValueSet(CharlsonAIDS,
+		[]string{"042", "043", "044"},
+		[]string{"B20", "B21", "B22", "B24"}),
+}
+
+// charlsonValueSet returns the value set for a Charlson category with the given ICD-9 and ICD-10 codes
+func charlsonValueSet(category string, icd9Codes, icd10Codes []string) *models.ValueSet {
+	return terminology.NewValueSet(CharlsonValueSetPrefix+category, map[string][]string{
+		terminology.ICD9System:    icd9Codes,
+		terminology.ICD10System:   icd10Codes,
+		terminology.ICD10CMSystem: icd10Codes,
+	})
+}
@@ -0,0 +1,58 @@
+package assessments
+
+import "github.com/intervention-engine/riskservice/plugin"
+
+// comorbidityCategory is one of the categories of a comorbidity index, the points it adds to the index, and the
+// weight of its pie slice.  A category's points don't count if the patient is also in the category that supersedes
+// it (e.g., diabetes without complications is superseded by diabetes with them).  A category with negative points
+// lowers the index, so its slice is a negative slice.
+type comorbidityCategory struct {
+	Name         string
+	Points       int
+	Weight       int
+	SupersededBy string
+}
+
+// comorbiditySlices returns a pie slice for each of the categories.  Categories without points don't change the
+// index, so they don't get slices.
+func comorbiditySlices(categories []comorbidityCategory) []plugin.Slice {
+	var slices []plugin.Slice
+	for _, category := range categories {
+		if category.Points == 0 {
+			continue
+		}
+		slice := plugin.Slice{Name: category.Name, Weight: category.Weight, MaxValue: category.Points}
+		if category.Points < 0 {
+			slice.MaxValue = -category.Points
+			slice.Negative = true
+		}
+		slices = append(slices, slice)
+	}
+	return slices
+}
+
+// updateComorbiditySlices sets the value of each category's slice, given the categories the patient is in
+func updateComorbiditySlices(pie *plugin.Pie, categories []comorbidityCategory, present map[string]bool) {
+	for _, category := range categories {
+		if present[category.Name] && !present[category.SupersededBy] {
+			if category.Points < 0 {
+				pie.UpdateSliceValue(category.Name, -category.Points)
+			} else {
+				pie.UpdateSliceValue(category.Name, category.Points)
+			}
+		} else {
+			pie.UpdateSliceValue(category.Name, 0)
+		}
+	}
+}
+
+// comorbidityPoints returns the total points for the categories the patient is in
+func comorbidityPoints(categories []comorbidityCategory, present map[string]bool) int {
+	var points int
+	for _, category := range categories {
+		if present[category.Name] && !present[category.SupersededBy] {
+			points += category.Points
+		}
+	}
+	return points
+}
@@ -0,0 +1,149 @@
+package assessments
+
+import (
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// ElixhauserPlugin is a risk calculation service implementing the Elixhauser comorbidity measures, combined into a
+// single score with the van Walraven weights for predicting in-hospital mortality.
+// See: van Walraven C, et al. A modification of the Elixhauser comorbidity measures into a point system for
+// hospital death using administrative data.  Med Care 2009;47(6):626-633.
+//
+// The patient's conditions are sorted into the 31 AHRQ Elixhauser categories using the value sets named with
+// ElixhauserValueSetPrefix.  Unlike Charlson, the categories only count while the patient's conditions are active,
+// since several of them (e.g., weight loss or fluid and electrolyte disorders) are not chronic.  When the patient
+// has both the uncomplicated and complicated forms of hypertension or diabetes, or both a solid tumor and
+// metastatic cancer, only the latter counts.
+//
+// Some of the weights are negative, so the score can be negative.  Each category with a negative weight is a
+// negative slice, whose value is the magnitude of its weight and is subtracted from the score (see plugin.Slice).
+// The categories with no weight don't change the score, so they don't have slices.  There is no probability for
+// the score, so the risk assessments give the score itself.
+type ElixhauserPlugin struct {
+}
+
+// NewElixhauserPlugin returns a new ElixhauserPlugin
+func NewElixhauserPlugin() *ElixhauserPlugin {
+	return &ElixhauserPlugin{}
+}
+
+// elixhauserCategories are the Elixhauser categories with their van Walraven weights, in the order of their pie
+// slices.  The slice weights are roughly proportional to the magnitudes of the van Walraven weights.
+var elixhauserCategories = []comorbidityCategory{
+	{Name: ElixhauserCongestiveHeartFailure, Points: 7, Weight: 6},
+	{Name: ElixhauserCardiacArrhythmias, Points: 5, Weight: 5},
+	{Name: ElixhauserValvularDisease, Points: -1, Weight: 1},
+	{Name: ElixhauserPulmonaryCirculation, Points: 4, Weight: 4},
+	{Name: ElixhauserPeripheralVascular, Points: 2, Weight: 2},
+	{Name: ElixhauserHypertension, Points: 0, SupersededBy: ElixhauserHypertensionWithComplication},
+	{Name: ElixhauserHypertensionWithComplication, Points: 0},
+	{Name: ElixhauserParalysis, Points: 7, Weight: 6},
+	{Name: ElixhauserOtherNeurological, Points: 6, Weight: 5},
+	{Name: ElixhauserChronicPulmonary, Points: 3, Weight: 3},
+	{Name: ElixhauserDiabetes, Points: 0, SupersededBy: ElixhauserDiabetesWithComplications},
+	{Name: ElixhauserDiabetesWithComplications, Points: 0},
+	{Name: ElixhauserHypothyroidism, Points: 0},
+	{Name: ElixhauserRenalFailure, Points: 5, Weight: 5},
+	{Name: ElixhauserLiverDisease, Points: 11, Weight: 10},
+	{Name: ElixhauserPepticUlcer, Points: 0},
+	{Name: ElixhauserAIDS, Points: 0},
+	{Name: ElixhauserLymphoma, Points: 9, Weight: 8},
+	{Name: ElixhauserMetastaticCancer, Points: 12, Weight: 11},
+	{Name: ElixhauserSolidTumor, Points: 4, Weight: 4, SupersededBy: ElixhauserMetastaticCancer},
+	{Name: ElixhauserRheumatoidArthritis, Points: 0},
+	{Name: ElixhauserCoagulopathy, Points: 3, Weight: 3},
+	{Name: ElixhauserObesity, Points: -4, Weight: 4},
+	{Name: ElixhauserWeightLoss, Points: 6, Weight: 5},
+	{Name: ElixhauserFluidElectrolyte, Points: 5, Weight: 5},
+	{Name: ElixhauserBloodLossAnemia, Points: -2, Weight: 2},
+	{Name: ElixhauserDeficiencyAnemia, Points: -2, Weight: 2},
+	{Name: ElixhauserAlcoholAbuse, Points: 0},
+	{Name: ElixhauserDrugAbuse, Points: -7, Weight: 6},
+	{Name: ElixhauserPsychoses, Points: 0},
+	{Name: ElixhauserDepression, Points: -3, Weight: 3},
+}
+
+// Config provides the configuration parameters for the ElixhauserPlugin
+func (e *ElixhauserPlugin) Config() plugin.RiskServicePluginConfig {
+	return plugin.RiskServicePluginConfig{
+		Name: "Elixhauser Comorbidity Score",
+		Method: models.CodeableConcept{
+			Coding: []models.Coding{{System: "http://interventionengine.org/risk-assessments", Code: "Elixhauser"}},
+			Text:   "Elixhauser Comorbidity Score",
+		},
+		PredictedOutcome:      models.CodeableConcept{Text: "In-Hospital Mortality"},
+		DefaultPieSlices:      comorbiditySlices(elixhauserCategories),
+		RequiredResourceTypes: []string{"Condition"},
+	}
+}
+
+// Calculate takes a stream of events and returns a slice of corresponding risk calculation results
+func (e *ElixhauserPlugin) Calculate(es *plugin.EventStream, fhirEndpointURL string) ([]plugin.RiskServiceCalculationResult, error) {
+	var results []plugin.RiskServiceCalculationResult
+
+	pie := plugin.NewPie(fhirEndpointURL + "/Patient/" + es.Patient.Id)
+	pie.Slices = e.Config().DefaultPieSlices
+
+	// Keep a count of the active conditions in each category -- so one condition ending doesn't end the category
+	// while another is still active
+	active := make(map[string]int)
+
+	for _, event := range es.Events {
+		// NOTE: guard against future dates (for example, our patient generator can create future events)
+		if event.Date.Local().After(time.Now()) {
+			continue
+		}
+
+		r, ok := event.Value.(*models.Condition)
+		if !ok {
+			continue
+		}
+		var changed bool
+		for _, category := range elixhauserCategories {
+			if !hasCondition(ElixhauserValueSetPrefix+category.Name, r) {
+				continue
+			}
+			if !event.End {
+				active[category.Name]++
+				changed = changed || active[category.Name] == 1
+			} else if active[category.Name] > 0 {
+				active[category.Name]--
+				changed = changed || active[category.Name] == 0
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		present := make(map[string]bool)
+		for name, count := range active {
+			present[name] = count > 0
+		}
+		pie = pie.Clone(true)
+		updateComorbiditySlices(pie, elixhauserCategories, present)
+		score := pie.TotalValues()
+		results = append(results, plugin.RiskServiceCalculationResult{
+			AsOf:               event.Date,
+			Score:              &score,
+			ProbabilityDecimal: nil,
+			Pie:                pie,
+			Approximate:        event.Approximate(),
+		})
+	}
+
+	// If there are no results, provide a 0 score for the current time
+	if len(results) == 0 {
+		zero := 0
+		results = append(results, plugin.RiskServiceCalculationResult{
+			AsOf:               time.Now(),
+			Score:              &zero,
+			ProbabilityDecimal: nil,
+			Pie:                pie,
+		})
+	}
+
+	return results, nil
+}
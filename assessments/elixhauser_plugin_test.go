@@ -0,0 +1,108 @@
+package assessments
+
+import (
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	. "gopkg.in/check.v1"
+)
+
+type ElixhauserPluginSuite struct {
+	Plugin          *ElixhauserPlugin
+	FHIREndpointURL string
+}
+
+var _ = Suite(&ElixhauserPluginSuite{})
+
+func (es *ElixhauserPluginSuite) SetUpSuite(c *C) {
+	es.Plugin = &ElixhauserPlugin{}
+	es.FHIREndpointURL = "http://example.org/fhir"
+}
+
+func (es *ElixhauserPluginSuite) TearDownSuite(c *C) {
+	es.Plugin = nil
+}
+
+func (es *ElixhauserPluginSuite) TestConfig(c *C) {
+	slices := es.Plugin.Config().DefaultPieSlices
+	// Only the 21 categories with weights have slices
+	c.Assert(slices, HasLen, 21)
+	var weights, negatives int
+	for _, slice := range slices {
+		weights += slice.Weight
+		if slice.Negative {
+			negatives++
+		}
+	}
+	c.Assert(weights, Equals, 100)
+	c.Assert(negatives, Equals, 6)
+	c.Assert(slices[2], DeepEquals, plugin.Slice{Name: "Valvular Disease", Weight: 1, MaxValue: 1, Negative: true})
+}
+
+func (es *ElixhauserPluginSuite) TestNoComorbidities(c *C) {
+	stream := plugin.NewEventStream(es.patient())
+	stream.Events = append(stream.Events, conditionEvent("1", "Pneumonia", "486", time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	results, err := es.Plugin.Calculate(stream, es.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Assert(*results[0].Score, Equals, 0)
+	c.Assert(results[0].ProbabilityDecimal, IsNil)
+}
+
+func (es *ElixhauserPluginSuite) TestPositiveAndNegativeWeights(c *C) {
+	icd10 := "http://hl7.org/fhir/sid/icd-10-cm"
+	stream := plugin.NewEventStream(es.patient())
+	stream.Events = append(stream.Events, conditionEvent("1", "Morbid Obesity", "278.01", time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	stream.Events = append(stream.Events, codedConditionEvent("2", "Major Depressive Disorder", icd10, "F32.9", time.Date(2011, time.March, 15, 15, 0, 0, 0, time.UTC)))
+	stream.Events = append(stream.Events, conditionEvent("3", "Congestive Heart Failure", "428.0", time.Date(2012, time.April, 15, 15, 0, 0, 0, time.UTC)))
+	// Hypertension has no weight, and neither does its complicated form, even though it's also heart failure here
+	stream.Events = append(stream.Events, conditionEvent("4", "Hypertensive Heart Disease with Heart Failure", "402.91", time.Date(2013, time.May, 15, 15, 0, 0, 0, time.UTC)))
+	results, err := es.Plugin.Calculate(stream, es.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 4)
+	es.assertResult(c, results[0], time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC), -4, map[string]int{ElixhauserObesity: 4})
+	es.assertResult(c, results[1], time.Date(2011, time.March, 15, 15, 0, 0, 0, time.UTC), -7, map[string]int{ElixhauserObesity: 4, ElixhauserDepression: 3})
+	es.assertResult(c, results[2], time.Date(2012, time.April, 15, 15, 0, 0, 0, time.UTC), 0, map[string]int{ElixhauserObesity: 4, ElixhauserDepression: 3, ElixhauserCongestiveHeartFailure: 7})
+	es.assertResult(c, results[3], time.Date(2013, time.May, 15, 15, 0, 0, 0, time.UTC), 0, map[string]int{ElixhauserObesity: 4, ElixhauserDepression: 3, ElixhauserCongestiveHeartFailure: 7})
+}
+
+func (es *ElixhauserPluginSuite) TestOnlyActiveConditionsCount(c *C) {
+	stream := plugin.NewEventStream(es.patient())
+	start, end := conditionStartAndEndEvents("1", "Hypovolemia", "276.52", time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC), time.Date(2010, time.February, 20, 15, 0, 0, 0, time.UTC))
+	stream.Events = append(stream.Events, start)
+	stream.Events = append(stream.Events, conditionEvent("2", "Hyponatremia", "276.1", time.Date(2010, time.February, 16, 15, 0, 0, 0, time.UTC)))
+	stream.Events = append(stream.Events, conditionEvent("3", "Lung Cancer", "162.9", time.Date(2010, time.February, 17, 15, 0, 0, 0, time.UTC)))
+	stream.Events = append(stream.Events, end)
+	stream.Events = append(stream.Events, conditionEvent("4", "Secondary Malignant Neoplasm of Bone", "198.5", time.Date(2010, time.March, 15, 15, 0, 0, 0, time.UTC)))
+	results, err := es.Plugin.Calculate(stream, es.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	// The second fluid and electrolyte disorder doesn't change anything, and its category stays active when the
+	// first one ends
+	c.Assert(results, HasLen, 3)
+	es.assertResult(c, results[0], time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC), 5, map[string]int{ElixhauserFluidElectrolyte: 5})
+	es.assertResult(c, results[1], time.Date(2010, time.February, 17, 15, 0, 0, 0, time.UTC), 9, map[string]int{ElixhauserFluidElectrolyte: 5, ElixhauserSolidTumor: 4})
+	// Metastatic cancer supersedes the solid tumor
+	es.assertResult(c, results[2], time.Date(2010, time.March, 15, 15, 0, 0, 0, time.UTC), 17, map[string]int{ElixhauserFluidElectrolyte: 5, ElixhauserMetastaticCancer: 12})
+}
+
+func (es *ElixhauserPluginSuite) patient() *models.Patient {
+	birthDate := &models.FHIRDateTime{Time: time.Date(1950, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	patient := &models.Patient{Gender: "male", BirthDate: birthDate}
+	patient.Id = "1223"
+	return patient
+}
+
+// assertResult checks the result's score, and that the pie's slices have the given values (and every other slice is
+// zero)
+func (es *ElixhauserPluginSuite) assertResult(c *C, result plugin.RiskServiceCalculationResult, asOf time.Time, score int, values map[string]int) {
+	c.Assert(result.AsOf, DeepEquals, asOf)
+	c.Assert(*result.Score, Equals, score)
+	c.Assert(result.ProbabilityDecimal, IsNil)
+	c.Assert(result.Pie, NotNil)
+	c.Assert(result.Pie.Patient, Equals, es.FHIREndpointURL+"/Patient/1223")
+	c.Assert(result.Pie.Slices, HasLen, 21)
+	for _, slice := range result.Pie.Slices {
+		c.Assert(slice.Value, Equals, values[slice.Name], Commentf("Slice %s", slice.Name))
+	}
+}
@@ -0,0 +1,168 @@
+package assessments
+
+import (
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/terminology"
+)
+
+// ElixhauserValueSetPrefix begins the names of the value sets for the Elixhauser categories, each of which is named
+// with the prefix followed by the category (e.g., "Elixhauser Renal Failure").
+const ElixhauserValueSetPrefix = "Elixhauser "
+
+// The Elixhauser categories, which are also the names of the Elixhauser pie slices
+const (
+	ElixhauserCongestiveHeartFailure       = "Congestive Heart Failure"
+	ElixhauserCardiacArrhythmias           = "Cardiac Arrhythmias"
+	ElixhauserValvularDisease              = "Valvular Disease"
+	ElixhauserPulmonaryCirculation         = "Pulmonary Circulation Disorders"
+	ElixhauserPeripheralVascular           = "Peripheral Vascular Disorders"
+	ElixhauserHypertension                 = "Hypertension, Uncomplicated"
+	ElixhauserHypertensionWithComplication = "Hypertension, Complicated"
+	ElixhauserParalysis                    = "Paralysis"
+	ElixhauserOtherNeurological            = "Other Neurological Disorders"
+	ElixhauserChronicPulmonary             = "Chronic Pulmonary Disease"
+	ElixhauserDiabetes                     = "Diabetes, Uncomplicated"
+	ElixhauserDiabetesWithComplications    = "Diabetes, Complicated"
+	ElixhauserHypothyroidism               = "Hypothyroidism"
+	ElixhauserRenalFailure                 = "Renal Failure"
+	ElixhauserLiverDisease                 = "Liver Disease"
+	ElixhauserPepticUlcer                  = "Peptic Ulcer Disease excluding Bleeding"
+	ElixhauserAIDS                         = "AIDS/HIV"
+	ElixhauserLymphoma                     = "Lymphoma"
+	ElixhauserMetastaticCancer             = "Metastatic Cancer"
+	ElixhauserSolidTumor                   = "Solid Tumor without Metastasis"
+	ElixhauserRheumatoidArthritis          = "Rheumatoid Arthritis/Collagen Vascular Diseases"
+	ElixhauserCoagulopathy                 = "Coagulopathy"
+	ElixhauserObesity                      = "Obesity"
+	ElixhauserWeightLoss                   = "Weight Loss"
+	ElixhauserFluidElectrolyte             = "Fluid and Electrolyte Disorders"
+	ElixhauserBloodLossAnemia              = "Blood Loss Anemia"
+	ElixhauserDeficiencyAnemia             = "Deficiency Anemia"
+	ElixhauserAlcoholAbuse                 = "Alcohol Abuse"
+	ElixhauserDrugAbuse                    = "Drug Abuse"
+	ElixhauserPsychoses                    = "Psychoses"
+	ElixhauserDepression                   = "Depression"
+)
+
+// elixhauserValueSets are the value sets for the Elixhauser categories, using Quan's enhanced ICD-9-CM codes and his
+// ICD-10 codes, which are also used for ICD-10-CM.  Each code includes its descendants.
+// See: Quan H, et al. Coding algorithms for defining comorbidities in ICD-9-CM and ICD-10 administrative data.  Med
+// Care 2005;43(11):1130-1139.
+var elixhauserValueSets = []*models.ValueSet{
+	elixhauserValueSet(ElixhauserCongestiveHeartFailure,
+		concat([]string{"398.91", "402.01", "402.11", "402.91", "404.01", "404.03", "404.11", "404.13", "404.91", "404.93", "428"},
+			subcodeRange("425", 4, 9)),
+		concat([]string{"I09.9", "I11.0", "I13.0", "I13.2", "I25.5", "I42.0", "I43", "I50", "P29.0"}, subcodeRange("I42", 5, 9))),
+	elixhauserValueSet(ElixhauserCardiacArrhythmias,
+		concat([]string{"426.0", "426.10", "426.12", "426.13", "426.7", "426.9", "785.0", "996.01", "996.04", "V45.0", "V53.3"},
+			subcodeRange("427", 0, 4), subcodeRange("427", 6, 9)),
+		concat([]string{"I45.6", "I45.9", "R00.0", "R00.1", "R00.8", "T82.1", "Z45.0", "Z95.0"}, subcodeRange("I44", 1, 3),
+			icd10Range("I", 47, 49))),
+	elixhauserValueSet(ElixhauserValvularDisease,
+		concat([]string{"093.2", "424", "V42.2", "V43.3"}, icd9Range(394, 397), subcodeRange("746", 3, 6)),
+		concat([]string{"A52.0", "I09.1", "I09.8"}, icd10Range("I", 5, 8), icd10Range("I", 34, 39), subcodeRange("Q23", 0, 3),
+			subcodeRange("Z95", 2, 4))),
+	elixhauserValueSet(ElixhauserPulmonaryCirculation,
+		[]string{"415.0", "415.1", "416", "417.0", "417.8", "417.9"},
+		[]string{"I26", "I27", "I28.0", "I28.8", "I28.9"}),
+	elixhauserValueSet(ElixhauserPeripheralVascular,
+		concat([]string{"093.0", "437.3", "440", "441", "447.1", "557.1", "557.9", "V43.4"}, subcodeRange("443", 1, 9)),
+		[]string{"I70", "I71", "I73.1", "I73.8", "I73.9", "I77.1", "I79.0", "I79.2", "K55.1", "K55.8", "K55.9", "Z95.8",
+			"Z95.9"}),
+	elixhauserValueSet(ElixhauserHypertension,
+		[]string{"401"},
+		[]string{"I10"}),
+	elixhauserValueSet(ElixhauserHypertensionWithComplication,
+		icd9Range(402, 405),
+		concat(icd10Range("I", 11, 13), []string{"I15"})),
+	elixhauserValueSet(ElixhauserParalysis,
+		concat([]string{"334.1", "342", "343", "344.9"}, subcodeRange("344", 0, 6)),
+		concat([]string{"G04.1", "G11.4", "G80.1", "G80.2", "G81", "G82", "G83.9"}, subcodeRange("G83", 0, 4))),
+	elixhauserValueSet(ElixhauserOtherNeurological,
+		[]string{"331.9", "332.0", "332.1", "333.4", "333.5", "333.92", "334", "335", "336.2", "340", "341", "345", "348.1",
+			"348.3", "780.3", "784.3"},
+		concat(icd10Range("G", 10, 13), icd10Range("G", 20, 22), icd10Range("G", 35, 37), []string{"G25.4", "G25.5",
+			"G31.2", "G31.8", "G31.9", "G32", "G40", "G41", "G93.1", "G93.4", "R47.0", "R56"})),
+	elixhauserValueSet(ElixhauserChronicPulmonary,
+		concat([]string{"416.8", "416.9", "506.4", "508.1", "508.8"}, icd9Range(490, 505)),
+		concat([]string{"I27.8", "I27.9", "J68.4", "J70.1", "J70.3"}, icd10Range("J", 40, 47), icd10Range("J", 60, 67))),
+	elixhauserValueSet(ElixhauserDiabetes,
+		subcodeRange("250", 0, 3),
+		withSuffixes(icd10Range("E", 10, 14), ".0", ".1", ".9")),
+	elixhauserValueSet(ElixhauserDiabetesWithComplications,
+		subcodeRange("250", 4, 9),
+		withSuffixes(icd10Range("E", 10, 14), ".2", ".3", ".4", ".5", ".6", ".7", ".8")),
+	elixhauserValueSet(ElixhauserHypothyroidism,
+		[]string{"240.9", "243", "244", "246.1", "246.8"},
+		concat(icd10Range("E", 0, 3), []string{"E89.0"})),
+	elixhauserValueSet(ElixhauserRenalFailure,
+		[]string{"403.01", "403.11", "403.91", "404.02", "404.03", "404.12", "404.13", "404.92", "404.93", "585", "586",
+			"588.0", "V42.0", "V45.1", "V56"},
+		[]string{"I12.0", "I13.1", "N18", "N19", "N25.0", "Z49.0", "Z49.1", "Z49.2", "Z94.0", "Z99.2"}),
+	elixhauserValueSet(ElixhauserLiverDisease,
+		concat([]string{"070.22", "070.23", "070.32", "070.33", "070.44", "070.54", "070.6", "070.9", "570", "571", "573.3",
+			"573.4", "573.8", "573.9", "V42.7"}, subcodeRange("456", 0, 2), subcodeRange("572", 2, 8)),
+		concat([]string{"B18", "I85", "I86.4", "I98.2", "K70", "K71.1", "K71.7", "K76.0", "Z94.4"}, subcodeRange("K71", 3, 5),
+			icd10Range("K", 72, 74), subcodeRange("K76", 2, 9))),
+	elixhauserValueSet(ElixhauserPepticUlcer,
+		withSuffixes(icd9Range(531, 534), ".7", ".9"),
+		withSuffixes(icd10Range("K", 25, 28), ".7", ".9")),
+	elixhauserValueSet(ElixhauserAIDS,
+		icd9Range(42, 44),
+		[]string{"B20", "B21", "B22", "B24"}),
+	elixhauserValueSet(ElixhauserLymphoma,
+		concat(icd9Range(200, 202), []string{"203.0", "238.6"}),
+		concat(icd10Range("C", 81, 85), []string{"C88", "C96", "C90.0", "C90.2"})),
+	elixhauserValueSet(ElixhauserMetastaticCancer,
+		icd9Range(196, 199),
+		icd10Range("C", 77, 80)),
+	elixhauserValueSet(ElixhauserSolidTumor,
+		concat(icd9Range(140, 172), icd9Range(174, 195)),
+		concat(icd10Range("C", 0, 26), icd10Range("C", 30, 34), icd10Range("C", 37, 41), []string{"C43"},
+			icd10Range("C", 45, 58), icd10Range("C", 60, 76), []string{"C97"})),
+	elixhauserValueSet(ElixhauserRheumatoidArthritis,
+		concat([]string{"446", "701.0", "710.8", "710.9", "711.2", "714", "719.3", "720", "725", "728.5", "728.89",
+			"729.30"}, subcodeRange("710", 0, 4)),
+		concat([]string{"L94.0", "L94.1", "L94.3", "M05", "M06", "M08", "M12.0", "M12.3", "M30", "M45", "M46.1", "M46.8",
+			"M46.9"}, subcodeRange("M31", 0, 3), icd10Range("M", 32, 35))),
+	elixhauserValueSet(ElixhauserCoagulopathy,
+		concat([]string{"286", "287.1"}, subcodeRange("287", 3, 5)),
+		concat(icd10Range("D", 65, 68), []string{"D69.1"}, subcodeRange("D69", 3, 6))),
+	elixhauserValueSet(ElixhauserObesity,
+		[]string{"278.0"},
+		[]string{"E66"}),
+	elixhauserValueSet(ElixhauserWeightLoss,
+		concat(icd9Range(260, 263), []string{"783.2", "799.4"}),
+		concat(icd10Range("E", 40, 46), []string{"R63.4", "R64"})),
+	elixhauserValueSet(ElixhauserFluidElectrolyte,
+		[]string{"253.6", "276"},
+		[]string{"E22.2", "E86", "E87"}),
+	elixhauserValueSet(ElixhauserBloodLossAnemia,
+		[]string{"280.0"},
+		[]string{"D50.0"}),
+	elixhauserValueSet(ElixhauserDeficiencyAnemia,
+		concat(subcodeRange("280", 1, 9), []string{"281"}),
+		concat([]string{"D50.8", "D50.9"}, icd10Range("D", 51, 53))),
+	elixhauserValueSet(ElixhauserAlcoholAbuse,
+		concat([]string{"265.2", "303.0", "303.9", "305.0", "357.5", "425.5", "535.3", "980", "V11.3"},
+			subcodeRange("291", 1, 3), subcodeRange("291", 5, 9), subcodeRange("571", 0, 3)),
+		[]string{"F10", "E52", "G62.1", "I42.6", "K29.2", "K70.0", "K70.3", "K70.9", "T51", "Z50.2", "Z71.4", "Z72.1"}),
+	elixhauserValueSet(ElixhauserDrugAbuse,
+		concat([]string{"292", "304", "V65.42"}, subcodeRange("305", 2, 9)),
+		concat(icd10Range("F", 11, 16), []string{"F18", "F19", "Z71.5", "Z72.2"})),
+	elixhauserValueSet(ElixhauserPsychoses,
+		[]string{"293.8", "295", "296.04", "296.14", "296.44", "296.54", "297", "298"},
+		concat([]string{"F20", "F28", "F29", "F30.2", "F31.2", "F31.5"}, icd10Range("F", 22, 25))),
+	elixhauserValueSet(ElixhauserDepression,
+		[]string{"296.2", "296.3", "296.5", "300.4", "309", "311"},
+		concat([]string{"F20.4", "F32", "F33", "F34.1", "F41.2", "F43.2"}, subcodeRange("F31", 3, 5))),
+}
+
+// elixhauserValueSet returns the value set for an Elixhauser category with the given ICD-9 and ICD-10 codes
+func elixhauserValueSet(category string, icd9Codes, icd10Codes []string) *models.ValueSet {
+	return terminology.NewValueSet(ElixhauserValueSetPrefix+category, map[string][]string{
+		terminology.ICD9System:    icd9Codes,
+		terminology.ICD10System:   icd10Codes,
+		terminology.ICD10CMSystem: icd10Codes,
+	})
+}
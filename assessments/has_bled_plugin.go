@@ -0,0 +1,267 @@
+package assessments
+
+import (
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/intervention-engine/riskservice/terminology"
+)
+
+// HASBLEDPlugin is a risk calculation service implementing the HAS-BLED Score for Major Bleeding Risk in Patients
+// with Atrial Fibrillation: https://en.wikipedia.org/wiki/HAS-BLED
+//
+// Each factor comes from the patient's record as follows:
+//   - Hypertension: a hypertension diagnosis (the score is meant to count only uncontrolled hypertension, but blood
+//     pressures aren't considered)
+//   - Abnormal renal and liver function: chronic dialysis, a renal transplant or end-stage renal disease, and
+//     cirrhosis, one point each
+//   - Stroke: a history of stroke (including TIA and thromboembolism)
+//   - Bleeding: a history of major bleeding
+//   - Labile INR: a time in therapeutic range (INR 2-3) under 60% over the INRs of the last six months
+//   - Elderly: older than 65
+//   - Drugs and alcohol: a current antiplatelet or NSAID, and alcohol abuse or dependence, one point each
+type HASBLEDPlugin struct {
+}
+
+// NewHASBLEDPlugin returns a new HASBLEDPlugin
+func NewHASBLEDPlugin() *HASBLEDPlugin {
+	return &HASBLEDPlugin{}
+}
+
+// INRCodes are the LOINC codes for INR results
+var INRCodes = []string{"6301-6", "34714-6", "46418-0"}
+
+// Config provides the configuration parameters for the HASBLEDPlugin
+func (h *HASBLEDPlugin) Config() plugin.RiskServicePluginConfig {
+	return plugin.RiskServicePluginConfig{
+		Name: "HAS-BLED score",
+		Method: models.CodeableConcept{
+			Coding: []models.Coding{{System: "http://interventionengine.org/risk-assessments", Code: "HASBLED"}},
+			Text:   "HAS-BLED score",
+		},
+		PredictedOutcome: models.CodeableConcept{Text: "Major Bleeding"},
+		DefaultPieSlices: []plugin.Slice{
+			{Name: "Hypertension", Weight: 11, MaxValue: 1},
+			{Name: "Abnormal Renal/Liver Function", Weight: 22, MaxValue: 2},
+			{Name: "Stroke", Weight: 11, MaxValue: 1},
+			{Name: "Bleeding", Weight: 11, MaxValue: 1},
+			{Name: "Labile INR", Weight: 11, MaxValue: 1},
+			{Name: "Elderly", Weight: 11, MaxValue: 1},
+			{Name: "Drugs/Alcohol", Weight: 22, MaxValue: 2},
+		},
+		RequiredResourceTypes:    []string{"Condition", "MedicationStatement", "Observation"},
+		RequiredObservationCodes: INRCodes,
+		SignificantBirthdays:     []int{66},
+		// A history of stroke or bleeding is a risk factor by definition, and the other conditions are chronic, so
+		// they all count once diagnosed
+		ResolvedConditions: plugin.ResolvedConditionPolicy{CountsByDefault: true},
+	}
+}
+
+// Calculate takes a stream of events and returns a slice of corresponding risk calculation results
+func (h *HASBLEDPlugin) Calculate(es *plugin.EventStream, fhirEndpointURL string) ([]plugin.RiskServiceCalculationResult, error) {
+	var results []plugin.RiskServiceCalculationResult
+
+	// Like CHA2DS2-VASc, this score is only meant for patients with AFIB
+	if !es.EverHad(terminology.Default.MustValueSet(AtrialFibrillation)) {
+		return nil, plugin.NewNotApplicableError("HAS-BLED is only applicable to patients with Atrial Fibrillation")
+	}
+
+	pie := plugin.NewPie(fhirEndpointURL + "/Patient/" + es.Patient.Id)
+	pie.Slices = h.Config().DefaultPieSlices
+
+	// Keep track of the factors that are made up of more than one thing, and the current antiplatelets and NSAIDs
+	// (counted by medication, so that overlapping statements for the same medication don't end it early)
+	var hasAfib, renal, liver, alcohol, labile bool
+	drugs := make(map[string]int)
+	var inrs []inrResult
+
+	// Whether the INR is labile also changes when INRs age out of the six-month window, so check it again as each
+	// one does, whether or not anything else happens then
+	var expiries []time.Time
+	recheckLabile := func(until time.Time) {
+		for len(expiries) > 0 && !expiries[0].After(until) {
+			asOf := expiries[0]
+			expiries = expiries[1:]
+			if nowLabile := labileINR(inrs, asOf); nowLabile != labile {
+				labile = nowLabile
+				pie = pie.Clone(true)
+				pie.UpdateSliceValue("Labile INR", boolToInt(labile))
+				if hasAfib {
+					results = append(results, bleedingResult(pie, asOf, false))
+				}
+			}
+		}
+	}
+
+	for _, event := range es.Events {
+		// NOTE: guard against future dates (for example, our patient generator can create future events)
+		if event.Date.Local().After(time.Now()) {
+			continue
+		}
+		recheckLabile(event.Date)
+
+		var isFactor bool
+		pie = pie.Clone(true)
+		switch r := event.Value.(type) {
+		case *models.Condition:
+			if event.End {
+				continue
+			}
+			if hasCondition(AtrialFibrillation, r) {
+				// Found atrial fibrillation, so all events from here on should produce scores
+				hasAfib = true
+				isFactor = true
+			} else if hasCondition(Hypertension, r) {
+				pie.UpdateSliceValue("Hypertension", 1)
+				isFactor = true
+			} else if hasCondition(RenalDisease, r) {
+				renal = true
+				isFactor = true
+			} else if hasCondition(LiverDisease, r) {
+				liver = true
+				isFactor = true
+			} else if hasCondition(Stroke, r) {
+				pie.UpdateSliceValue("Stroke", 1)
+				isFactor = true
+			} else if hasCondition(MajorBleeding, r) {
+				pie.UpdateSliceValue("Bleeding", 1)
+				isFactor = true
+			} else if hasCondition(AlcoholAbuse, r) {
+				alcohol = true
+				isFactor = true
+			}
+		case *models.Observation:
+			if event.End || !plugin.ContainsConcept(plugin.Codes{plugin.LOINCSystem: INRCodes}, r.Code) {
+				continue
+			}
+			q, ok := event.Quantity()
+			if !ok {
+				continue
+			}
+			inrs = append(inrs, inrResult{Date: event.Date, Value: *q.Value})
+			expiries = append(expiries, event.Date.AddDate(0, 6, 1))
+			if nowLabile := labileINR(inrs, event.Date); nowLabile != labile {
+				labile = nowLabile
+				isFactor = true
+			}
+		case int:
+			if event.Type == "Age" && r > 65 {
+				pie.UpdateSliceValue("Elderly", 1)
+				isFactor = true
+			}
+		default:
+			medication, ok := event.Medication()
+			if !ok || !plugin.ContainsConcept(terminology.Default.MustValueSet(AntiplateletsAndNSAIDs), medication) {
+				continue
+			}
+			key := plugin.MedicationKey(medication)
+			if !event.End {
+				drugs[key]++
+			} else if drugs[key] > 0 {
+				drugs[key]--
+			}
+			isFactor = true
+		}
+		pie.UpdateSliceValue("Abnormal Renal/Liver Function", boolToInt(renal)+boolToInt(liver))
+		pie.UpdateSliceValue("Labile INR", boolToInt(labile))
+		pie.UpdateSliceValue("Drugs/Alcohol", boolToInt(calculateCount(drugs) > 0)+boolToInt(alcohol))
+		if hasAfib && isFactor {
+			results = append(results, bleedingResult(pie, event.Date, event.Approximate()))
+		}
+	}
+	recheckLabile(time.Now())
+
+	return results, nil
+}
+
+// bleedingResult returns the result for the pie, with the bleeding risk for its score if there is one
+func bleedingResult(pie *plugin.Pie, asOf time.Time, approximate bool) plugin.RiskServiceCalculationResult {
+	score := pie.TotalValues()
+	result := plugin.RiskServiceCalculationResult{
+		AsOf:        asOf,
+		Score:       &score,
+		Pie:         pie,
+		Approximate: approximate,
+	}
+	if percent, ok := ScoreToBleedingRisk[score]; ok {
+		result.ProbabilityDecimal = &percent
+	}
+	return result
+}
+
+// ScoreToBleedingRisk maps the HAS-BLED score to the annual risk of major bleeding.  There isn't enough data to
+// estimate the risk for scores over 5.
+// See: Pisters R, et al. A novel user-friendly score (HAS-BLED) to assess 1-year risk of major bleeding in patients
+// with atrial fibrillation.  Chest 2010;138(5):1093-1100.
+var ScoreToBleedingRisk = map[int]float64{0: 1.13, 1: 1.02, 2: 1.88, 3: 3.74, 4: 8.70, 5: 12.50}
+
+// inrResult is an INR value and when it was measured
+type inrResult struct {
+	Date  time.Time
+	Value float64
+}
+
+// labileINR returns true if the patient's time in the therapeutic INR range (2-3) over the six months up to the
+// given time is under 60%.  The time in range is calculated with the Rosendaal method, which assumes the INR
+// changed linearly between results.  It takes at least three results in the window, so that the INR isn't judged
+// by a single interval.  The results must be sorted by date.
+func labileINR(inrs []inrResult, asOf time.Time) bool {
+	from := asOf.AddDate(0, -6, 0)
+	var window []inrResult
+	for _, inr := range inrs {
+		if !inr.Date.Before(from) && !inr.Date.After(asOf) {
+			window = append(window, inr)
+		}
+	}
+	if len(window) < 3 {
+		return false
+	}
+	var inRange, total float64
+	for i := 1; i < len(window); i++ {
+		days := window[i].Date.Sub(window[i-1].Date).Hours() / 24
+		total += days
+		inRange += days * fractionInRange(window[i-1].Value, window[i].Value, 2, 3)
+	}
+	return total > 0 && inRange/total < 0.6
+}
+
+// fractionInRange returns the fraction of a linear change from one value to another that is within the range
+func fractionInRange(from, to, low, high float64) float64 {
+	if from > to {
+		from, to = to, from
+	}
+	if from == to {
+		if from >= low && from <= high {
+			return 1
+		}
+		return 0
+	}
+	overlap := minFloat(to, high) - maxFloat(from, low)
+	if overlap <= 0 {
+		return 0
+	}
+	return overlap / (to - from)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
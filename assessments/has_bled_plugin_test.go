@@ -0,0 +1,188 @@
+package assessments
+
+import (
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	. "gopkg.in/check.v1"
+)
+
+type HASBLEDPluginSuite struct {
+	Plugin          *HASBLEDPlugin
+	FHIREndpointURL string
+}
+
+var _ = Suite(&HASBLEDPluginSuite{})
+
+func (hs *HASBLEDPluginSuite) SetUpSuite(c *C) {
+	hs.Plugin = &HASBLEDPlugin{}
+	hs.FHIREndpointURL = "http://example.org/fhir"
+}
+
+func (hs *HASBLEDPluginSuite) TearDownSuite(c *C) {
+	hs.Plugin = nil
+}
+
+func (hs *HASBLEDPluginSuite) TestAFibOnly(c *C) {
+	es := plugin.NewEventStream(hs.patient(1980))
+	es.Events = append(es.Events, conditionEvent("1", "Atrial Fibrillation", "427.31", time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	results, err := hs.Plugin.Calculate(es, hs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	hs.assertResult(c, results[0], time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC), 0, 1.13, 0, 0, 0, 0, 0, 0, 0)
+}
+
+func (hs *HASBLEDPluginSuite) TestEveryFactor(c *C) {
+	es := plugin.NewEventStream(hs.patient(1940))
+	es.Events = append(es.Events, conditionEvent("1", "Hypertension", "401.9", time.Date(2000, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, ageEvent("2", 66, time.Date(2006, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, conditionEvent("3", "Atrial Fibrillation", "427.31", time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("4", "End-Stage Renal Disease", "http://hl7.org/fhir/sid/icd-10-cm", "N18.6", time.Date(2010, time.March, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, conditionEvent("5", "Alcoholic Cirrhosis", "571.2", time.Date(2010, time.April, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, conditionEvent("6", "Cerebral Infarction", "434.91", time.Date(2010, time.May, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, codedConditionEvent("7", "Gastrointestinal Hemorrhage", "http://snomed.info/sct", "74474003", time.Date(2010, time.June, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, medicationEvent("8", "Aspirin", "1191", time.Date(2010, time.July, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, conditionEvent("9", "Alcohol Dependence", "303.90", time.Date(2010, time.August, 15, 15, 0, 0, 0, time.UTC)))
+	// A stable INR, then one that is out of range more often than not
+	es.Events = append(es.Events, inrEvent("10", 2.5, time.Date(2010, time.September, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, inrEvent("11", 2.5, time.Date(2010, time.September, 15, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, inrEvent("12", 2.5, time.Date(2010, time.September, 29, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, inrEvent("13", 4.5, time.Date(2010, time.November, 24, 0, 0, 0, 0, time.UTC)))
+	results, err := hs.Plugin.Calculate(es, hs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 9)
+	hs.assertResult(c, results[0], time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC), 2, 1.88, 1, 0, 0, 0, 0, 1, 0)
+	hs.assertResult(c, results[1], time.Date(2010, time.March, 15, 15, 0, 0, 0, time.UTC), 3, 3.74, 1, 1, 0, 0, 0, 1, 0)
+	hs.assertResult(c, results[2], time.Date(2010, time.April, 15, 15, 0, 0, 0, time.UTC), 4, 8.70, 1, 2, 0, 0, 0, 1, 0)
+	hs.assertResult(c, results[3], time.Date(2010, time.May, 15, 15, 0, 0, 0, time.UTC), 5, 12.50, 1, 2, 1, 0, 0, 1, 0)
+	// There isn't a bleeding risk estimate for scores over 5
+	c.Assert(*results[4].Score, Equals, 6)
+	c.Assert(results[4].ProbabilityDecimal, IsNil)
+	hs.assertPie(c, results[4].Pie, 1, 2, 1, 1, 0, 1, 0)
+	hs.assertPie(c, results[5].Pie, 1, 2, 1, 1, 0, 1, 1)
+	hs.assertPie(c, results[6].Pie, 1, 2, 1, 1, 0, 1, 2)
+	c.Assert(results[7].AsOf, DeepEquals, time.Date(2010, time.November, 24, 0, 0, 0, 0, time.UTC))
+	c.Assert(*results[7].Score, Equals, 9)
+	hs.assertPie(c, results[7].Pie, 1, 2, 1, 1, 1, 1, 2)
+	// Once the September INRs age out, there are too few left to call the INR labile
+	c.Assert(results[8].AsOf, DeepEquals, time.Date(2011, time.March, 16, 0, 0, 0, 0, time.UTC))
+	c.Assert(*results[8].Score, Equals, 8)
+	hs.assertPie(c, results[8].Pie, 1, 2, 1, 1, 0, 1, 2)
+}
+
+func (hs *HASBLEDPluginSuite) TestDrugsOnlyCountWhileTaken(c *C) {
+	es := plugin.NewEventStream(hs.patient(1980))
+	es.Events = append(es.Events, conditionEvent("1", "Atrial Fibrillation", "427.31", time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	start, end := medicationStartAndEndEvents("2", "Clopidogrel", "32968", time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC), time.Date(2011, time.August, 15, 15, 0, 0, 0, time.UTC))
+	es.Events = append(es.Events, start, end)
+	// Not an antiplatelet or NSAID
+	es.Events = append(es.Events, medicationEvent("3", "Warfarin", "11289", time.Date(2011, time.March, 15, 15, 0, 0, 0, time.UTC)))
+	results, err := hs.Plugin.Calculate(es, hs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 3)
+	hs.assertResult(c, results[0], time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC), 0, 1.13, 0, 0, 0, 0, 0, 0, 0)
+	hs.assertResult(c, results[1], time.Date(2011, time.February, 15, 15, 0, 0, 0, time.UTC), 1, 1.02, 0, 0, 0, 0, 0, 0, 1)
+	hs.assertResult(c, results[2], time.Date(2011, time.August, 15, 15, 0, 0, 0, time.UTC), 0, 1.13, 0, 0, 0, 0, 0, 0, 0)
+}
+
+func (hs *HASBLEDPluginSuite) TestLabileINRRecovers(c *C) {
+	es := plugin.NewEventStream(hs.patient(1980))
+	es.Events = append(es.Events, conditionEvent("1", "Atrial Fibrillation", "427.31", time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, inrEvent("2", 1.5, time.Date(2010, time.March, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, inrEvent("3", 1.5, time.Date(2010, time.April, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, inrEvent("4", 2.5, time.Date(2010, time.May, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, inrEvent("5", 2.5, time.Date(2010, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	results, err := hs.Plugin.Calculate(es, hs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 3)
+	hs.assertResult(c, results[0], time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC), 0, 1.13, 0, 0, 0, 0, 0, 0, 0)
+	// Out of range for 1 month, then in range for half of the next
+	hs.assertResult(c, results[1], time.Date(2010, time.May, 1, 0, 0, 0, 0, time.UTC), 1, 1.02, 0, 0, 0, 0, 1, 0, 0)
+	// Two more months in range bring the time in range over 60%, and it stays there as the early INRs age out
+	hs.assertResult(c, results[2], time.Date(2010, time.July, 1, 0, 0, 0, 0, time.UTC), 0, 1.13, 0, 0, 0, 0, 0, 0, 0)
+}
+
+func (hs *HASBLEDPluginSuite) TestLabileINRClearsWithoutNewINRs(c *C) {
+	es := plugin.NewEventStream(hs.patient(1980))
+	es.Events = append(es.Events, conditionEvent("1", "Atrial Fibrillation", "427.31", time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, inrEvent("2", 1.5, time.Date(2010, time.March, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, inrEvent("3", 1.5, time.Date(2010, time.April, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, inrEvent("4", 2.5, time.Date(2010, time.May, 1, 0, 0, 0, 0, time.UTC)))
+	results, err := hs.Plugin.Calculate(es, hs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 3)
+	hs.assertResult(c, results[1], time.Date(2010, time.May, 1, 0, 0, 0, 0, time.UTC), 1, 1.02, 0, 0, 0, 0, 1, 0, 0)
+	// Six months after the first INR, there are too few left in the window to call the INR labile
+	hs.assertResult(c, results[2], time.Date(2010, time.September, 2, 0, 0, 0, 0, time.UTC), 0, 1.13, 0, 0, 0, 0, 0, 0, 0)
+
+	// Later events don't bring the flag back
+	es.Events = append(es.Events, conditionEvent("5", "Hypertension", "401.9", time.Date(2011, time.January, 1, 0, 0, 0, 0, time.UTC)))
+	results, err = hs.Plugin.Calculate(es, hs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 4)
+	hs.assertResult(c, results[3], time.Date(2011, time.January, 1, 0, 0, 0, 0, time.UTC), 1, 1.02, 1, 0, 0, 0, 0, 0, 0)
+}
+
+func (hs *HASBLEDPluginSuite) TestFractionInRange(c *C) {
+	c.Assert(fractionInRange(2.5, 2.5, 2, 3), Equals, 1.0)
+	c.Assert(fractionInRange(1.5, 1.5, 2, 3), Equals, 0.0)
+	c.Assert(fractionInRange(1.5, 2.5, 2, 3), Equals, 0.5)
+	c.Assert(fractionInRange(4, 1, 2, 3), Equals, 1.0/3)
+	c.Assert(fractionInRange(3.5, 4.5, 2, 3), Equals, 0.0)
+}
+
+func (hs *HASBLEDPluginSuite) TestElderlyIsOlderThan65(c *C) {
+	es := plugin.NewEventStream(hs.patient(1940))
+	es.Events = append(es.Events, conditionEvent("1", "Atrial Fibrillation", "427.31", time.Date(2005, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	// Turning 65 isn't enough, so only turning 66 counts
+	es.Events = append(es.Events, ageEvent("2", 65, time.Date(2005, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, ageEvent("3", 66, time.Date(2006, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	results, err := hs.Plugin.Calculate(es, hs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 2)
+	hs.assertResult(c, results[0], time.Date(2005, time.February, 15, 15, 0, 0, 0, time.UTC), 0, 1.13, 0, 0, 0, 0, 0, 0, 0)
+	hs.assertResult(c, results[1], time.Date(2006, time.July, 1, 0, 0, 0, 0, time.UTC), 1, 1.02, 0, 0, 0, 0, 0, 1, 0)
+}
+
+func (hs *HASBLEDPluginSuite) TestNoAFib(c *C) {
+	es := plugin.NewEventStream(hs.patient(1940))
+	es.Events = append(es.Events, conditionEvent("1", "Hypertension", "401.9", time.Date(2000, time.February, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, ageEvent("2", 66, time.Date(2006, time.July, 1, 0, 0, 0, 0, time.UTC)))
+	results, err := hs.Plugin.Calculate(es, hs.FHIREndpointURL)
+
+	c.Assert(err, NotNil)
+	c.Assert(err, FitsTypeOf, plugin.NotApplicableError{})
+	c.Assert(err.Error(), Equals, "HAS-BLED is only applicable to patients with Atrial Fibrillation")
+	c.Assert(results, HasLen, 0)
+}
+
+func (hs *HASBLEDPluginSuite) patient(birthYear int) *models.Patient {
+	birthDate := &models.FHIRDateTime{Time: time.Date(birthYear, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	patient := &models.Patient{Gender: "male", BirthDate: birthDate}
+	patient.Id = "1223"
+	return patient
+}
+
+func (hs *HASBLEDPluginSuite) assertResult(c *C, result plugin.RiskServiceCalculationResult, asOf time.Time, score int, pct float64, hypertension, renalLiver, stroke, bleeding, labileINR, elderly, drugsAlcohol int) {
+	c.Assert(result.AsOf, DeepEquals, asOf)
+	c.Assert(*result.Score, Equals, score)
+	c.Assert(*result.ProbabilityDecimal, Equals, pct)
+	hs.assertPie(c, result.Pie, hypertension, renalLiver, stroke, bleeding, labileINR, elderly, drugsAlcohol)
+}
+
+func (hs *HASBLEDPluginSuite) assertPie(c *C, pie *plugin.Pie, hypertension, renalLiver, stroke, bleeding, labileINR, elderly, drugsAlcohol int) {
+	c.Assert(pie, NotNil)
+	c.Assert(pie.Patient, Equals, hs.FHIREndpointURL+"/Patient/1223")
+	c.Assert(pie.Slices, HasLen, 7)
+	names := []string{"Hypertension", "Abnormal Renal/Liver Function", "Stroke", "Bleeding", "Labile INR", "Elderly", "Drugs/Alcohol"}
+	values := []int{hypertension, renalLiver, stroke, bleeding, labileINR, elderly, drugsAlcohol}
+	for i := range pie.Slices {
+		c.Assert(pie.Slices[i].Name, Equals, names[i])
+		c.Assert(pie.Slices[i].Value, Equals, values[i])
+	}
+}
+
+func inrEvent(id string, value float64, effective time.Time) plugin.Event {
+	return observationEvent(id, "INR", "6301-6", models.Quantity{Value: &value}, effective)
+}
@@ -0,0 +1,156 @@
+package assessments
+
+import (
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// LACEPlugin is a risk calculation service implementing the LACE index for the risk of death or unplanned
+// readmission within 30 days of discharge from the hospital.
+// See: van Walraven C, et al. Derivation and validation of an index to predict early death or unplanned readmission
+// after discharge from hospital to the community.  CMAJ 2010;182(6):551-557.
+//
+// There is a result at each discharge from an inpatient stay, from:
+//   - Length of stay: the days between admission and discharge
+//   - Acuity: whether the admission was emergent, which is either recorded on the encounter (see
+//     plugin.EmergentAdmission) or apparent from an emergency department visit starting within a day before it
+//   - Comorbidity: the patient's Charlson Comorbidity Index, without the age points, as of discharge
+//   - Emergency department visits: the number of visits in the six months before the admission, not counting a
+//     visit that led to it
+type LACEPlugin struct {
+}
+
+// NewLACEPlugin returns a new LACEPlugin
+func NewLACEPlugin() *LACEPlugin {
+	return &LACEPlugin{}
+}
+
+// Config provides the configuration parameters for the LACEPlugin
+func (l *LACEPlugin) Config() plugin.RiskServicePluginConfig {
+	return plugin.RiskServicePluginConfig{
+		Name: "LACE index",
+		Method: models.CodeableConcept{
+			Coding: []models.Coding{{System: "http://interventionengine.org/risk-assessments", Code: "LACE"}},
+			Text:   "LACE index",
+		},
+		PredictedOutcome: models.CodeableConcept{Text: "Death or Unplanned Readmission Within 30 Days"},
+		DefaultPieSlices: []plugin.Slice{
+			{Name: "Length of Stay", Weight: 37, MaxValue: 7},
+			{Name: "Acuity", Weight: 16, MaxValue: 3},
+			{Name: "Comorbidity", Weight: 26, MaxValue: 5},
+			{Name: "ED Visits", Weight: 21, MaxValue: 4},
+		},
+		RequiredResourceTypes: []string{"Encounter", "Condition"},
+		// Like the Charlson index, comorbidities count once they've been diagnosed
+		ResolvedConditions: plugin.ResolvedConditionPolicy{CountsByDefault: true},
+	}
+}
+
+// Calculate takes a stream of events and returns a slice of corresponding risk calculation results
+func (l *LACEPlugin) Calculate(es *plugin.EventStream, fhirEndpointURL string) ([]plugin.RiskServiceCalculationResult, error) {
+	var results []plugin.RiskServiceCalculationResult
+
+	// Keep track of the Charlson categories the patient is in as of each discharge
+	categories := make(map[string]bool)
+
+	for _, event := range es.Events {
+		// NOTE: guard against future dates (for example, our patient generator can create future events)
+		if event.Date.Local().After(time.Now()) {
+			continue
+		}
+
+		switch r := event.Value.(type) {
+		case *models.Condition:
+			if event.End {
+				continue
+			}
+			for _, category := range charlsonCategories {
+				if hasCondition(CharlsonValueSetPrefix+category.Name, r) {
+					categories[category.Name] = true
+				}
+			}
+		case *models.Encounter:
+			// Only discharges from inpatient stays produce results
+			if !event.End || plugin.EncounterClass(r) != plugin.InpatientEncounter || r.Period == nil || r.Period.Start == nil {
+				continue
+			}
+			los, ok := plugin.LengthOfStay(r)
+			if !ok {
+				continue
+			}
+			admitted := r.Period.Start.Time
+
+			// An emergency department visit in the day before the admission (or at the same time) is the one that led
+			// to it, so it makes the admission emergent instead of counting as a prior visit
+			leadingVisit := es.CountEncounters(plugin.EmergencyEncounter, admitted.Add(-24*time.Hour), admitted.Add(time.Nanosecond)) > 0
+			priorVisits := es.CountEncounters(plugin.EmergencyEncounter, admitted.AddDate(0, -6, 0), admitted.Add(-24*time.Hour))
+
+			pie := plugin.NewPie(fhirEndpointURL + "/Patient/" + es.Patient.Id)
+			pie.Slices = l.Config().DefaultPieSlices
+			pie.UpdateSliceValue("Length of Stay", laceLengthOfStayPoints(los))
+			if plugin.EmergentAdmission(r) || leadingVisit {
+				pie.UpdateSliceValue("Acuity", 3)
+			}
+			pie.UpdateSliceValue("Comorbidity", laceComorbidityPoints(comorbidityPoints(charlsonCategories, categories)))
+			pie.UpdateSliceValue("ED Visits", laceVisitPoints(priorVisits))
+
+			score := pie.TotalValues()
+			percent := ScoreToReadmissionRisk[score]
+			results = append(results, plugin.RiskServiceCalculationResult{
+				AsOf:               event.Date,
+				Score:              &score,
+				ProbabilityDecimal: &percent,
+				Pie:                pie,
+				Approximate:        event.Approximate(),
+			})
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, plugin.NewNotApplicableError("LACE is only applicable to patients who have been discharged from an inpatient stay")
+	}
+	return results, nil
+}
+
+// ScoreToReadmissionRisk maps the LACE index to the expected risk of death or unplanned readmission within 30
+// days of discharge, as a percentage.  The paper reports expected risks from 2.0% for an index of 0 to 43.7% for
+// an index of 19, from a logistic model of the index.  The risks in between are on the logistic curve through
+// those two points (logit = -3.8918 + 0.1915 * index), rounded to a tenth of a percent.
+var ScoreToReadmissionRisk = map[int]float64{
+	0: 2.0, 1: 2.4, 2: 2.9, 3: 3.5, 4: 4.2, 5: 5.0, 6: 6.0, 7: 7.2, 8: 8.6, 9: 10.3, 10: 12.2, 11: 14.4, 12: 16.9,
+	13: 19.7, 14: 23.0, 15: 26.5, 16: 30.4, 17: 34.6, 18: 39.1, 19: 43.7,
+}
+
+// laceLengthOfStayPoints returns the points for the length of stay in days
+func laceLengthOfStayPoints(days int) int {
+	switch {
+	case days < 1:
+		return 0
+	case days <= 3:
+		return days
+	case days <= 6:
+		return 4
+	case days <= 13:
+		return 5
+	default:
+		return 7
+	}
+}
+
+// laceComorbidityPoints returns the points for the Charlson Comorbidity Index
+func laceComorbidityPoints(index int) int {
+	if index >= 4 {
+		return 5
+	}
+	return index
+}
+
+// laceVisitPoints returns the points for the number of emergency department visits
+func laceVisitPoints(visits int) int {
+	if visits >= 4 {
+		return 4
+	}
+	return visits
+}
@@ -0,0 +1,131 @@
+package assessments
+
+import (
+	"math"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	. "gopkg.in/check.v1"
+)
+
+type LACEPluginSuite struct {
+	Plugin          *LACEPlugin
+	FHIREndpointURL string
+}
+
+var _ = Suite(&LACEPluginSuite{})
+
+func (ls *LACEPluginSuite) SetUpSuite(c *C) {
+	ls.Plugin = &LACEPlugin{}
+	ls.FHIREndpointURL = "http://example.org/fhir"
+}
+
+func (ls *LACEPluginSuite) TearDownSuite(c *C) {
+	ls.Plugin = nil
+}
+
+func (ls *LACEPluginSuite) TestResultAtEachDischarge(c *C) {
+	es := plugin.NewEventStream(ls.patient())
+	es.Events = append(es.Events, conditionEvent("1", "Congestive Heart Failure", "428.0", time.Date(2014, time.June, 15, 15, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, conditionEvent("2", "Diabetes with Renal Manifestations", "250.40", time.Date(2014, time.August, 15, 15, 0, 0, 0, time.UTC)))
+	ls.appendEncounter(es, "3", plugin.EmergencyEncounter, time.Date(2015, time.January, 10, 8, 0, 0, 0, time.UTC), time.Date(2015, time.January, 10, 12, 0, 0, 0, time.UTC))
+	ls.appendEncounter(es, "4", plugin.EmergencyEncounter, time.Date(2015, time.February, 20, 8, 0, 0, 0, time.UTC), time.Date(2015, time.February, 20, 12, 0, 0, 0, time.UTC))
+	// An emergency department visit that leads to an admission
+	ls.appendEncounter(es, "5", plugin.EmergencyEncounter, time.Date(2015, time.March, 1, 8, 0, 0, 0, time.UTC), time.Date(2015, time.March, 1, 14, 0, 0, 0, time.UTC))
+	ls.appendEncounter(es, "6", plugin.InpatientEncounter, time.Date(2015, time.March, 1, 14, 0, 0, 0, time.UTC), time.Date(2015, time.March, 6, 10, 0, 0, 0, time.UTC))
+	// Outpatient visits don't count
+	ls.appendEncounter(es, "7", plugin.AmbulatoryEncounter, time.Date(2015, time.April, 1, 8, 0, 0, 0, time.UTC), time.Date(2015, time.April, 1, 9, 0, 0, 0, time.UTC))
+	es.Events = append(es.Events, conditionEvent("8", "Secondary Malignant Neoplasm of Bone", "198.5", time.Date(2015, time.May, 15, 15, 0, 0, 0, time.UTC)))
+	// An elective admission
+	ls.appendEncounter(es, "9", plugin.InpatientEncounter, time.Date(2015, time.June, 1, 7, 0, 0, 0, time.UTC), time.Date(2015, time.June, 2, 10, 0, 0, 0, time.UTC))
+	plugin.SortEventsByDate(es.Events)
+	results, err := ls.Plugin.Calculate(es, ls.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 2)
+	// 5 days, emergent, Charlson 3, and 2 prior visits
+	ls.assertResult(c, results[0], time.Date(2015, time.March, 6, 10, 0, 0, 0, time.UTC), 12, 16.9, 4, 3, 3, 2)
+	// 1 day, elective, Charlson 9, and 3 prior visits
+	ls.assertResult(c, results[1], time.Date(2015, time.June, 2, 10, 0, 0, 0, time.UTC), 9, 10.3, 1, 0, 5, 3)
+}
+
+func (ls *LACEPluginSuite) TestRecordedEmergentAdmission(c *C) {
+	es := plugin.NewEventStream(ls.patient())
+	for i := 0; i < 5; i++ {
+		ls.appendEncounter(es, "ed", plugin.EmergencyEncounter, time.Date(2015, time.January, 1+i, 8, 0, 0, 0, time.UTC), time.Date(2015, time.January, 1+i, 12, 0, 0, 0, time.UTC))
+	}
+	start, end := encounterStartAndEndEvents("1", plugin.InpatientEncounter, time.Date(2015, time.March, 1, 8, 0, 0, 0, time.UTC), time.Date(2015, time.March, 1, 20, 0, 0, 0, time.UTC))
+	start.Value.(*models.Encounter).Priority = &models.CodeableConcept{Coding: []models.Coding{{System: "http://hl7.org/fhir/v3/ActPriority", Code: "EM"}}}
+	es.Events = append(es.Events, start, end)
+	results, err := ls.Plugin.Calculate(es, ls.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	// Same day discharge, emergent, no comorbidities, and 5 prior visits
+	ls.assertResult(c, results[0], time.Date(2015, time.March, 1, 20, 0, 0, 0, time.UTC), 7, 7.2, 0, 3, 0, 4)
+}
+
+func (ls *LACEPluginSuite) TestNoInpatientStays(c *C) {
+	es := plugin.NewEventStream(ls.patient())
+	es.Events = append(es.Events, conditionEvent("1", "Congestive Heart Failure", "428.0", time.Date(2014, time.June, 15, 15, 0, 0, 0, time.UTC)))
+	ls.appendEncounter(es, "2", plugin.EmergencyEncounter, time.Date(2015, time.January, 10, 8, 0, 0, 0, time.UTC), time.Date(2015, time.January, 10, 12, 0, 0, 0, time.UTC))
+	// Still in the hospital
+	start, _ := encounterStartAndEndEvents("3", plugin.InpatientEncounter, time.Date(2015, time.January, 10, 12, 0, 0, 0, time.UTC), time.Time{})
+	es.Events = append(es.Events, start)
+	results, err := ls.Plugin.Calculate(es, ls.FHIREndpointURL)
+
+	c.Assert(err, NotNil)
+	c.Assert(err, FitsTypeOf, plugin.NotApplicableError{})
+	c.Assert(err.Error(), Equals, "LACE is only applicable to patients who have been discharged from an inpatient stay")
+	c.Assert(results, HasLen, 0)
+}
+
+func (ls *LACEPluginSuite) TestPoints(c *C) {
+	for days, points := range map[int]int{0: 0, 1: 1, 3: 3, 4: 4, 6: 4, 7: 5, 13: 5, 14: 7, 30: 7} {
+		c.Assert(laceLengthOfStayPoints(days), Equals, points, Commentf("%d days", days))
+	}
+	c.Assert(laceComorbidityPoints(3), Equals, 3)
+	c.Assert(laceComorbidityPoints(4), Equals, 5)
+	c.Assert(laceVisitPoints(2), Equals, 2)
+	c.Assert(laceVisitPoints(7), Equals, 4)
+}
+
+func (ls *LACEPluginSuite) TestScoreToReadmissionRisk(c *C) {
+	c.Assert(ScoreToReadmissionRisk, HasLen, 20)
+	// The expected risks the paper reports for the lowest and highest indexes
+	c.Assert(ScoreToReadmissionRisk[0], Equals, 2.0)
+	c.Assert(ScoreToReadmissionRisk[19], Equals, 43.7)
+	// The rest are on the logistic curve through them
+	for score := 0; score <= 19; score++ {
+		risk := 100 / (1 + math.Exp(3.8918-0.1915*float64(score)))
+		c.Assert(math.Abs(ScoreToReadmissionRisk[score]-risk) <= 0.05, Equals, true, Commentf("LACE index %d", score))
+		if score > 0 {
+			c.Assert(ScoreToReadmissionRisk[score] > ScoreToReadmissionRisk[score-1], Equals, true)
+		}
+	}
+}
+
+func (ls *LACEPluginSuite) patient() *models.Patient {
+	birthDate := &models.FHIRDateTime{Time: time.Date(1940, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	patient := &models.Patient{Gender: "female", BirthDate: birthDate}
+	patient.Id = "1223"
+	return patient
+}
+
+func (ls *LACEPluginSuite) appendEncounter(es *plugin.EventStream, id, class string, start, end time.Time) {
+	startEvent, endEvent := encounterStartAndEndEvents(id, class, start, end)
+	es.Events = append(es.Events, startEvent, endEvent)
+}
+
+func (ls *LACEPluginSuite) assertResult(c *C, result plugin.RiskServiceCalculationResult, asOf time.Time, score int, pct float64, lengthOfStay, acuity, comorbidity, visits int) {
+	c.Assert(result.AsOf, DeepEquals, asOf)
+	c.Assert(*result.Score, Equals, score)
+	c.Assert(*result.ProbabilityDecimal, Equals, pct)
+	c.Assert(result.Pie, NotNil)
+	c.Assert(result.Pie.Patient, Equals, ls.FHIREndpointURL+"/Patient/1223")
+	c.Assert(result.Pie.Slices, DeepEquals, []plugin.Slice{
+		{Name: "Length of Stay", Weight: 37, MaxValue: 7, Value: lengthOfStay},
+		{Name: "Acuity", Weight: 16, MaxValue: 3, Value: acuity},
+		{Name: "Comorbidity", Weight: 26, MaxValue: 5, Value: comorbidity},
+		{Name: "ED Visits", Weight: 21, MaxValue: 4, Value: visits},
+	})
+}
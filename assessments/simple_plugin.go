@@ -10,12 +10,20 @@ import (
 // SimplePlugin is a simple UNPROVEN risk calculation service based on a patient's count of active conditions and
 // active medications.  The idea being that the higher this number is, the more likely the patient is to experience
 // a negative outcome.  It is a PROOF-OF-CONCEPT only and should NOT be used in any real clinical setting.
+//
+// Medications may come from statements, orders, dispenses or administrations.  They are merged into drug eras
+// before they're counted, so exposures to the same medication that are no more than DrugEraGap apart count as one
+// continuous exposure.
 type SimplePlugin struct {
+	DrugEraGap time.Duration
 }
 
+// DefaultDrugEraGap is the drug era gap NewSimplePlugin uses
+const DefaultDrugEraGap = 30 * 24 * time.Hour
+
 // NewSimplePlugin returns a new SimplePlugin
 func NewSimplePlugin() *SimplePlugin {
-	return &SimplePlugin{}
+	return &SimplePlugin{DrugEraGap: DefaultDrugEraGap}
 }
 
 // Config provides the configuration parameters for the SimplePlugin
@@ -31,7 +39,7 @@ func (c *SimplePlugin) Config() plugin.RiskServicePluginConfig {
 			{Name: "Conditions", Weight: 50, MaxValue: 5},
 			{Name: "Medications", Weight: 50, MaxValue: 5},
 		},
-		RequiredResourceTypes: []string{"Condition", "MedicationStatement"},
+		RequiredResourceTypes: []string{"Condition", "MedicationStatement", "MedicationOrder", "MedicationDispense", "MedicationAdministration"},
 	}
 }
 
@@ -48,7 +56,7 @@ func (c *SimplePlugin) Calculate(es *plugin.EventStream, fhirEndpointURL string)
 	pie.Slices = c.Config().DefaultPieSlices
 
 	// Now go through the event stream, updating the pie
-	for _, event := range es.Events {
+	for _, event := range withDrugEras(es.Events, plugin.DrugEraConfig{Gap: c.DrugEraGap}) {
 		// NOTE: guard against future dates (for example, our patient generator can create future events)
 		if event.Date.Local().After(time.Now()) {
 			continue
@@ -70,12 +78,9 @@ func (c *SimplePlugin) Calculate(es *plugin.EventStream, fhirEndpointURL string)
 				cMap[key] = count - 1
 			}
 			pie.UpdateSliceValue("Conditions", calculateCount(cMap))
-		case *models.MedicationStatement:
-			if r.MedicationCodeableConcept == nil || len(r.MedicationCodeableConcept.Coding) == 0 {
-				continue
-			}
+		case *plugin.DrugEra:
 			isFactor = true
-			key := r.MedicationCodeableConcept.Coding[0].System + "|" + r.MedicationCodeableConcept.Coding[0].Code
+			key := r.Ingredient
 			count := mMap[key]
 			if !event.End {
 				mMap[key] = count + 1
@@ -91,6 +96,7 @@ func (c *SimplePlugin) Calculate(es *plugin.EventStream, fhirEndpointURL string)
 				Score:              &score,
 				ProbabilityDecimal: nil,
 				Pie:                pie,
+				Approximate:        event.Approximate(),
 			})
 		}
 	}
@@ -109,6 +115,19 @@ func (c *SimplePlugin) Calculate(es *plugin.EventStream, fhirEndpointURL string)
 	return results, nil
 }
 
+// withDrugEras replaces the medication events with the start and end events of the drug eras they make up
+func withDrugEras(events []plugin.Event, config plugin.DrugEraConfig) []plugin.Event {
+	var merged []plugin.Event
+	for _, event := range events {
+		if _, ok := event.Medication(); !ok {
+			merged = append(merged, event)
+		}
+	}
+	merged = append(merged, plugin.DrugEraEvents(plugin.BuildDrugEras(events, config))...)
+	plugin.SortEventsByDate(merged)
+	return merged
+}
+
 // Calculates the count of unique conditions or medications with an upper limit of 5 (maxValue for slice)
 func calculateCount(cMap map[string]int) int {
 	count := 0
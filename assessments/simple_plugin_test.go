@@ -110,6 +110,23 @@ func (cs *SimplePluginSuite) TestPatientWithEndingConditionsAndEndingMeds(c *C)
 	cs.assertResult(c, results[5], time.Date(2015, time.May, 15, 15, 30, 0, 0, time.UTC), 2, "1223", 1, 1)
 }
 
+func (cs *SimplePluginSuite) TestPatientWithDispensedMeds(c *C) {
+	birthDate := &models.FHIRDateTime{Time: time.Date(1940, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	patient := &models.Patient{Gender: "female", BirthDate: birthDate}
+	patient.Id = "1223"
+	es := plugin.NewEventStream(patient)
+	aspirinStart, aspirinEnd := dispenseStartAndEndEvents("1", "Aspirin", "1191", time.Date(2015, time.February, 1, 10, 0, 0, 0, time.UTC), 30)
+	lisinoprilStart, lisinoprilEnd := dispenseStartAndEndEvents("2", "Lisinopril", "104377", time.Date(2015, time.February, 15, 10, 0, 0, 0, time.UTC), 90)
+	es.Events = append(es.Events, aspirinStart, lisinoprilStart, aspirinEnd, lisinoprilEnd)
+	results, err := cs.Plugin.Calculate(es, cs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 4)
+	cs.assertResult(c, results[0], time.Date(2015, time.February, 1, 10, 0, 0, 0, time.UTC), 1, "1223", 0, 1)
+	cs.assertResult(c, results[1], time.Date(2015, time.February, 15, 10, 0, 0, 0, time.UTC), 2, "1223", 0, 2)
+	cs.assertResult(c, results[2], time.Date(2015, time.March, 3, 10, 0, 0, 0, time.UTC), 1, "1223", 0, 1)
+	cs.assertResult(c, results[3], time.Date(2015, time.May, 16, 10, 0, 0, 0, time.UTC), 0, "1223", 0, 0)
+}
+
 func (cs *SimplePluginSuite) TestPatientWithDuplicates(c *C) {
 	birthDate := &models.FHIRDateTime{Time: time.Date(1940, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
 	patient := &models.Patient{Gender: "female", BirthDate: birthDate}
@@ -124,13 +141,65 @@ func (cs *SimplePluginSuite) TestPatientWithDuplicates(c *C) {
 
 	results, err := cs.Plugin.Calculate(es, cs.FHIREndpointURL)
 	c.Assert(err, IsNil)
-	c.Assert(results, HasLen, 6)
+	// The duplicate Lisinopril is merged into the same drug era, so it doesn't get a result of its own
+	c.Assert(results, HasLen, 5)
 	cs.assertResult(c, results[0], time.Date(2010, time.February, 15, 15, 0, 0, 0, time.UTC), 1, "1223", 1, 0)
 	cs.assertResult(c, results[1], time.Date(2010, time.February, 15, 15, 30, 0, 0, time.UTC), 2, "1223", 1, 1)
 	cs.assertResult(c, results[2], time.Date(2015, time.April, 15, 15, 0, 0, 0, time.UTC), 3, "1223", 2, 1)
 	cs.assertResult(c, results[3], time.Date(2015, time.April, 15, 15, 30, 0, 0, time.UTC), 4, "1223", 2, 2)
 	cs.assertResult(c, results[4], time.Date(2015, time.May, 1, 15, 0, 0, 0, time.UTC), 4, "1223", 2, 2)
-	cs.assertResult(c, results[5], time.Date(2015, time.May, 1, 15, 30, 0, 0, time.UTC), 4, "1223", 2, 2)
+}
+
+func (cs *SimplePluginSuite) TestDispensesWithinTheGapAreOneExposure(c *C) {
+	birthDate := &models.FHIRDateTime{Time: time.Date(1940, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	patient := &models.Patient{Gender: "female", BirthDate: birthDate}
+	patient.Id = "1223"
+	es := plugin.NewEventStream(patient)
+	firstStart, firstEnd := dispenseStartAndEndEvents("1", "Lisinopril", "104377", time.Date(2015, time.February, 1, 10, 0, 0, 0, time.UTC), 30)
+	// The refill is picked up a week after the first supply runs out
+	refillStart, refillEnd := dispenseStartAndEndEvents("2", "Lisinopril", "104377", time.Date(2015, time.March, 10, 10, 0, 0, 0, time.UTC), 30)
+	es.Events = append(es.Events, firstStart, firstEnd, refillStart, refillEnd)
+
+	results, err := (&SimplePlugin{DrugEraGap: 14 * 24 * time.Hour}).Calculate(es, cs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 2)
+	cs.assertResult(c, results[0], time.Date(2015, time.February, 1, 10, 0, 0, 0, time.UTC), 1, "1223", 0, 1)
+	cs.assertResult(c, results[1], time.Date(2015, time.April, 9, 10, 0, 0, 0, time.UTC), 0, "1223", 0, 0)
+
+	// Without a gap, the week between the supplies breaks the exposure in two
+	results, err = cs.Plugin.Calculate(es, cs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 4)
+	cs.assertResult(c, results[1], time.Date(2015, time.March, 3, 10, 0, 0, 0, time.UTC), 0, "1223", 0, 0)
+	cs.assertResult(c, results[2], time.Date(2015, time.March, 10, 10, 0, 0, 0, time.UTC), 1, "1223", 0, 1)
+}
+
+func (cs *SimplePluginSuite) TestAdministeredMedsDontCountForever(c *C) {
+	birthDate := &models.FHIRDateTime{Time: time.Date(1940, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	patient := &models.Patient{Gender: "female", BirthDate: birthDate}
+	patient.Id = "1223"
+	es := plugin.NewEventStream(patient)
+	es.Events = append(es.Events, administrationEvent("1", "Heparin", "5224", time.Date(2015, time.January, 1, 10, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, administrationEvent("2", "Heparin", "5224", time.Date(2015, time.January, 10, 10, 0, 0, 0, time.UTC)))
+	es.Events = append(es.Events, administrationEvent("3", "Heparin", "5224", time.Date(2015, time.April, 1, 10, 0, 0, 0, time.UTC)))
+
+	// Each administration counts for the two week gap after it, so the first two are one exposure
+	results, err := (&SimplePlugin{DrugEraGap: 14 * 24 * time.Hour}).Calculate(es, cs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 4)
+	cs.assertResult(c, results[0], time.Date(2015, time.January, 1, 10, 0, 0, 0, time.UTC), 1, "1223", 0, 1)
+	cs.assertResult(c, results[1], time.Date(2015, time.January, 24, 10, 0, 0, 0, time.UTC), 0, "1223", 0, 0)
+	cs.assertResult(c, results[2], time.Date(2015, time.April, 1, 10, 0, 0, 0, time.UTC), 1, "1223", 0, 1)
+	cs.assertResult(c, results[3], time.Date(2015, time.April, 15, 10, 0, 0, 0, time.UTC), 0, "1223", 0, 0)
+
+	// Without a gap, each one counts for a day, so no two results are as of the same time
+	results, err = cs.Plugin.Calculate(es, cs.FHIREndpointURL)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 6)
+	cs.assertResult(c, results[0], time.Date(2015, time.January, 1, 10, 0, 0, 0, time.UTC), 1, "1223", 0, 1)
+	cs.assertResult(c, results[1], time.Date(2015, time.January, 2, 10, 0, 0, 0, time.UTC), 0, "1223", 0, 0)
+	cs.assertResult(c, results[4], time.Date(2015, time.April, 1, 10, 0, 0, 0, time.UTC), 1, "1223", 0, 1)
+	cs.assertResult(c, results[5], time.Date(2015, time.April, 2, 10, 0, 0, 0, time.UTC), 0, "1223", 0, 0)
 }
 
 func (cs *SimplePluginSuite) TestFutureEventsAreIgnored(c *C) {
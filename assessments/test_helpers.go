@@ -17,11 +17,15 @@ func ageEvent(id string, age int, effective time.Time) plugin.Event {
 }
 
 func conditionEvent(id, name, icd9Code string, onset time.Time) plugin.Event {
+	return codedConditionEvent(id, name, "http://hl7.org/fhir/sid/icd-9", icd9Code, onset)
+}
+
+func codedConditionEvent(id, name, system, code string, onset time.Time) plugin.Event {
 	condition := new(models.Condition)
 	condition.Id = id
 	condition.Code = &models.CodeableConcept{
 		Coding: []models.Coding{
-			models.Coding{System: "http://hl7.org/fhir/sid/icd-9", Code: icd9Code, Display: name},
+			models.Coding{System: system, Code: code, Display: name},
 		},
 		Text: name,
 	}
@@ -78,6 +82,52 @@ func medicationStartAndEndEvents(id, name, rxNormCode string, active time.Time,
 	return start, end
 }
 
+func dispenseStartAndEndEvents(id, name, rxNormCode string, handedOver time.Time, daysSupply int) (plugin.Event, plugin.Event) {
+	dispense := new(models.MedicationDispense)
+	dispense.Id = id
+	dispense.MedicationCodeableConcept = &models.CodeableConcept{
+		Coding: []models.Coding{
+			models.Coding{System: "http://www.nlm.nih.gov/research/umls/rxnorm/", Code: rxNormCode, Display: name},
+		},
+		Text: name,
+	}
+	dispense.WhenHandedOver = &models.FHIRDateTime{Time: handedOver, Precision: models.Timestamp}
+	days := float64(daysSupply)
+	dispense.DaysSupply = &models.Quantity{Value: &days, Unit: "days"}
+	dispense.Status = "completed"
+
+	start := plugin.Event{
+		Date:  handedOver,
+		Type:  "MedicationDispense",
+		End:   false,
+		Value: dispense,
+	}
+	end := start
+	end.Date = handedOver.AddDate(0, 0, daysSupply)
+	end.End = true
+	return start, end
+}
+
+func administrationEvent(id, name, rxNormCode string, given time.Time) plugin.Event {
+	administration := new(models.MedicationAdministration)
+	administration.Id = id
+	administration.MedicationCodeableConcept = &models.CodeableConcept{
+		Coding: []models.Coding{
+			models.Coding{System: "http://www.nlm.nih.gov/research/umls/rxnorm/", Code: rxNormCode, Display: name},
+		},
+		Text: name,
+	}
+	administration.EffectiveTimeDateTime = &models.FHIRDateTime{Time: given, Precision: models.Timestamp}
+	administration.Status = "completed"
+
+	return plugin.Event{
+		Date:  given,
+		Type:  "MedicationAdministration",
+		End:   false,
+		Value: administration,
+	}
+}
+
 func observationEvent(id, name, loincCode string, value models.Quantity, effective time.Time) plugin.Event {
 	observation := new(models.Observation)
 	observation.Id = id
@@ -122,3 +172,25 @@ func encounterEvent(id, name, snomedCode string, start time.Time) plugin.Event {
 		Value: encounter,
 	}
 }
+
+func encounterStartAndEndEvents(id, class string, start, end time.Time) (plugin.Event, plugin.Event) {
+	encounter := new(models.Encounter)
+	encounter.Id = id
+	encounter.Class = class
+	encounter.Period = &models.Period{
+		Start: &models.FHIRDateTime{Time: start, Precision: models.Timestamp},
+		End:   &models.FHIRDateTime{Time: end, Precision: models.Timestamp},
+	}
+	encounter.Status = "finished"
+
+	startEvent := plugin.Event{
+		Date:  start,
+		Type:  "Encounter",
+		End:   false,
+		Value: encounter,
+	}
+	endEvent := startEvent
+	endEvent.Date = end
+	endEvent.End = true
+	return startEvent, endEvent
+}
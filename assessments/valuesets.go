@@ -0,0 +1,166 @@
+package assessments
+
+import (
+	"fmt"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/intervention-engine/riskservice/terminology"
+)
+
+// The names of the value sets the built-in plugins use to recognize the patient's conditions.  They are added to
+// terminology.Default, where a site can replace them with its own value sets of the same names.
+const (
+	AtrialFibrillation     = "Atrial Fibrillation"
+	CongestiveHeartFailure = "Congestive Heart Failure"
+	Hypertension           = "Hypertension"
+	Diabetes               = "Diabetes"
+	Stroke                 = "Stroke, TIA or Thromboembolism"
+	VascularDisease        = "Vascular Disease"
+	RenalDisease           = "Chronic Dialysis, Renal Transplant or End-Stage Renal Disease"
+	LiverDisease           = "Cirrhosis"
+	MajorBleeding          = "Major Bleeding"
+	AlcoholAbuse           = "Alcohol Abuse or Dependence"
+	AntiplateletsAndNSAIDs = "Antiplatelets and NSAIDs"
+	Antihypertensives      = "Antihypertensives"
+)
+
+// builtInValueSets are the value sets for the conditions the built-in plugins look for, each including the listed
+// codes and their descendants.  The ICD-9 and ICD-10-CM hierarchies follow the codes, but there is no SNOMED CT
+// hierarchy built in, so the SNOMED CT codes are the common ones for each condition and only match exactly.  Stroke
+// includes TIA and systemic thromboembolism, and vascular disease includes prior MI, as CHA2DS2-VASc counts them.
+// The antiplatelets, NSAIDs and antihypertensives are RxNorm ingredients, so a site whose medications are coded as
+// products (or in another code system) needs a concept map to its ingredients or its own value set.
+var builtInValueSets = []*models.ValueSet{
+	terminology.NewValueSet(AtrialFibrillation, map[string][]string{
+		terminology.ICD9System:    {"427.31"},
+		terminology.ICD10CMSystem: {"I48.0", "I48.1", "I48.2", "I48.91"},
+		terminology.SNOMEDSystem:  {"49436004", "282825002", "440059007", "440028005", "426749004"},
+	}),
+	terminology.NewValueSet(CongestiveHeartFailure, map[string][]string{
+		terminology.ICD9System:    {"428"},
+		terminology.ICD10CMSystem: {"I50"},
+		terminology.SNOMEDSystem:  {"84114007", "42343007", "85232009", "10633002", "88805009"},
+	}),
+	terminology.NewValueSet(Hypertension, map[string][]string{
+		terminology.ICD9System:    {"401"},
+		terminology.ICD10CMSystem: {"I10"},
+		terminology.SNOMEDSystem:  {"38341003", "59621000", "1201005"},
+	}),
+	terminology.NewValueSet(Diabetes, map[string][]string{
+		terminology.ICD9System:    {"250"},
+		terminology.ICD10CMSystem: {"E08", "E09", "E10", "E11", "E13"},
+		terminology.SNOMEDSystem:  {"73211009", "46635009", "44054006"},
+	}),
+	terminology.NewValueSet(Stroke, map[string][]string{
+		terminology.ICD9System:    {"433.01", "433.11", "433.21", "433.31", "433.81", "433.91", "434", "435", "444", "V12.54"},
+		terminology.ICD10CMSystem: {"I63", "G45.0", "G45.1", "G45.2", "G45.8", "G45.9", "I74", "I69.3", "Z86.73"},
+		terminology.SNOMEDSystem:  {"230690007", "422504002", "432504007", "371041009", "266257000"},
+	}),
+	terminology.NewValueSet(VascularDisease, map[string][]string{
+		terminology.ICD9System:    {"443", "410", "412", "440.0", "440.2"},
+		terminology.ICD10CMSystem: {"I73", "I21", "I22", "I25.2", "I70.0", "I70.2"},
+		terminology.SNOMEDSystem:  {"400047006", "840580004", "22298006", "1755008", "399211009"},
+	}),
+	terminology.NewValueSet(RenalDisease, map[string][]string{
+		terminology.ICD9System:    {"585.5", "585.6", "V42.0", "V45.11", "V56"},
+		terminology.ICD10CMSystem: {"N18.5", "N18.6", "Z94.0", "Z99.2", "Z49"},
+		terminology.SNOMEDSystem:  {"46177005", "433146000", "236138007", "105502003"},
+	}),
+	terminology.NewValueSet(LiverDisease, map[string][]string{
+		terminology.ICD9System:    {"571.2", "571.5", "571.6"},
+		terminology.ICD10CMSystem: {"K70.3", "K74.3", "K74.4", "K74.5", "K74.6"},
+		terminology.SNOMEDSystem:  {"19943007", "420054005", "31712002"},
+	}),
+	terminology.NewValueSet(MajorBleeding, map[string][]string{
+		terminology.ICD9System:    {"430", "431", "432", "578", "459.0", "285.1"},
+		terminology.ICD10CMSystem: {"I60", "I61", "I62", "K92.0", "K92.1", "K92.2", "R58", "D62"},
+		terminology.SNOMEDSystem:  {"1386000", "274100004", "74474003", "131148009"},
+	}),
+	terminology.NewValueSet(AlcoholAbuse, map[string][]string{
+		terminology.ICD9System:    {"303", "305.0"},
+		terminology.ICD10CMSystem: {"F10.1", "F10.2"},
+		terminology.SNOMEDSystem:  {"7200002", "15167005", "66590003"},
+	}),
+	terminology.NewValueSet(AntiplateletsAndNSAIDs, map[string][]string{
+		plugin.RxNormSystem: {
+			// Antiplatelets: aspirin, clopidogrel, prasugrel, ticagrelor, ticlopidine, dipyridamole, cilostazol
+			"1191", "32968", "613391", "1116632", "10594", "3521", "21107",
+			// NSAIDs: ibuprofen, naproxen, diclofenac, celecoxib, meloxicam, indomethacin, ketorolac, etodolac,
+			// nabumetone, piroxicam
+			"5640", "7258", "3355", "140587", "41493", "5781", "35827", "24605", "31448", "8356",
+		},
+	}),
+	terminology.NewValueSet(Antihypertensives, map[string][]string{
+		plugin.RxNormSystem: {
+			// ACE inhibitors: lisinopril, enalapril, ramipril, benazepril
+			"29046", "3827", "35296", "18867",
+			// Angiotensin receptor blockers: losartan, valsartan, olmesartan, irbesartan
+			"52175", "69749", "321064", "83818",
+			// Calcium channel blockers: amlodipine, diltiazem, nifedipine
+			"17767", "3443", "7417",
+			// Diuretics: hydrochlorothiazide, chlorthalidone, spironolactone
+			"5487", "2409", "9997",
+			// Beta blockers: metoprolol, atenolol, carvedilol, propranolol
+			"6918", "1202", "20352", "8787",
+			// Others: hydralazine, clonidine
+			"5470", "2599",
+		},
+	}),
+}
+
+func init() {
+	for _, valueSets := range [][]*models.ValueSet{builtInValueSets, charlsonValueSets, elixhauserValueSets} {
+		for _, vs := range valueSets {
+			terminology.Default.AddValueSet(vs)
+		}
+	}
+}
+
+// icd9Range returns the three digit ICD-9 codes from one number to another, inclusive
+func icd9Range(from, to int) []string {
+	var codes []string
+	for i := from; i <= to; i++ {
+		codes = append(codes, fmt.Sprintf("%03d", i))
+	}
+	return codes
+}
+
+// icd10Range returns the three character ICD-10 codes in a chapter from one number to another, inclusive (e.g.,
+// "I60" through "I69")
+func icd10Range(chapter string, from, to int) []string {
+	var codes []string
+	for i := from; i <= to; i++ {
+		codes = append(codes, fmt.Sprintf("%s%02d", chapter, i))
+	}
+	return codes
+}
+
+// subcodeRange returns the subcodes of a code from one digit to another, inclusive (e.g., "425.4" through "425.9")
+func subcodeRange(code string, from, to int) []string {
+	var codes []string
+	for i := from; i <= to; i++ {
+		codes = append(codes, fmt.Sprintf("%s.%d", code, i))
+	}
+	return codes
+}
+
+// withSuffixes returns each of the codes with each of the suffixes
+func withSuffixes(codes []string, suffixes ...string) []string {
+	var suffixed []string
+	for _, code := range codes {
+		for _, suffix := range suffixes {
+			suffixed = append(suffixed, code+suffix)
+		}
+	}
+	return suffixed
+}
+
+// concat returns the codes in all of the lists
+func concat(lists ...[]string) []string {
+	var all []string
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	return all
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/intervention-engine/riskservice/assessments"
+	"github.com/intervention-engine/riskservice/offline"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/intervention-engine/riskservice/service"
+	"github.com/intervention-engine/riskservice/terminology"
+)
+
+// runCalc implements the "calc" subcommand, which scores patient bundles from files on disk without a FHIR server
+// or database, e.g.:
+//
+//	riskservice calc --in patients.ndjson --out results.ndjson --plugins CHADS,Simple
+func runCalc(args []string) int {
+	flags := flag.NewFlagSet("calc", flag.ExitOnError)
+	in := flags.String("in", "-", "Bundle JSON or NDJSON file to read patients from (- for stdin)")
+	out := flags.String("out", "-", "File to write results to (- for stdout)")
+	format := flags.String("format", "", "Output format: ndjson or csv (defaults to the extension of -out, or ndjson)")
+	plugins := flags.String("plugins", "", "Comma-separated list of plugin method codes to run (defaults to all)")
+	asOf := flags.String("asOf", "", "Only use data up to this FHIR date or dateTime")
+	pieURL := flags.String("pieURL", "pies", "Base URL used to reference pies from risk assessments")
+	undated := flags.String("undated", string(service.DropUndated), "What to do with conditions, medication statements and observations that have no usable date: drop, birth (present since birth) or lastUpdated.  Other undated resources are always dropped")
+	centerApproximateDates := flags.Bool("centerApproximateDates", false, "Place events whose dates are only known to the year or month in the middle of the year or month instead of at its start")
+	terminologyDir := flags.String("terminology", "", "Directory of FHIR ValueSet and ConceptMap JSON files to use in addition to (or instead of) the built-in value sets")
+	flags.Parse(args)
+
+	svc := service.NewReferenceRiskService(nil)
+	policy, err := service.ParseUndatedPolicy(*undated)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	if *terminologyDir != "" {
+		if err := terminology.Default.Load(*terminologyDir); err != nil {
+			log.Println(err)
+			return 2
+		}
+	}
+	svc.SetUndatedPolicy(policy)
+	svc.SetCenterApproximateDates(*centerApproximateDates)
+	selected, err := offline.SelectPlugins(allPlugins(), *plugins)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	for _, p := range selected {
+		svc.RegisterPlugin(p)
+	}
+
+	var options service.CalculationOptions
+	if *asOf != "" {
+		t, err := service.ParseAsOf(*asOf)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		options.AsOf = &t
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+		if *format == "" && filepath.Ext(*out) == ".csv" {
+			*format = "csv"
+		}
+	}
+	if *format == "" {
+		*format = "ndjson"
+	}
+	rw, err := offline.NewResultWriter(w, *format)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	summary, err := offline.Score(svc, r, rw, *pieURL, options)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	log.Printf("Scored %d of %d patients", summary.Patients-summary.Failed, summary.Patients)
+	if summary.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// allPlugins returns every plugin that the risk service knows how to run.
+func allPlugins() []plugin.RiskServicePlugin {
+	return []plugin.RiskServicePlugin{
+		assessments.NewASCVDPlugin(),
+		assessments.NewCHA2DS2VAScPlugin(),
+		assessments.NewCharlsonPlugin(),
+		assessments.NewElixhauserPlugin(),
+		assessments.NewHASBLEDPlugin(),
+		assessments.NewLACEPlugin(),
+		assessments.NewSimplePlugin(),
+	}
+}
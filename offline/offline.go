@@ -0,0 +1,91 @@
+package offline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/intervention-engine/riskservice/service"
+)
+
+// ReadBundles reads FHIR bundles from r, calling fn with each one.  The input can either be a single bundle in JSON
+// format or newline-delimited JSON (NDJSON) with one bundle per line.  Reading stops at the first error returned
+// by fn.
+func ReadBundles(r io.Reader, fn func(*models.Bundle) error) error {
+	decoder := json.NewDecoder(r)
+	for i := 1; ; i++ {
+		var data json.RawMessage
+		if err := decoder.Decode(&data); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Unable to read bundle %d: %v", i, err)
+		}
+		bundle, err := service.UnmarshalBundle(data)
+		if err != nil {
+			return fmt.Errorf("Unable to read bundle %d: %v", i, err)
+		}
+		if err := fn(bundle); err != nil {
+			return err
+		}
+	}
+}
+
+// SelectPlugins returns the plugins whose method codes are in the comma-separated list of codes (e.g.,
+// "CHADS,Simple").  If codes is empty, all of the plugins are returned.
+func SelectPlugins(plugins []plugin.RiskServicePlugin, codes string) ([]plugin.RiskServicePlugin, error) {
+	if codes == "" {
+		return plugins, nil
+	}
+	var selected []plugin.RiskServicePlugin
+	for _, code := range strings.Split(codes, ",") {
+		code = strings.TrimSpace(code)
+		p := findPlugin(plugins, code)
+		if p == nil {
+			return nil, fmt.Errorf("No risk assessment plugin is registered for method: %s", code)
+		}
+		selected = append(selected, p)
+	}
+	return selected, nil
+}
+
+func findPlugin(plugins []plugin.RiskServicePlugin, code string) plugin.RiskServicePlugin {
+	for _, p := range plugins {
+		for _, coding := range p.Config().Method.Coding {
+			if strings.EqualFold(coding.Code, code) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// Summary counts the patients processed by Score.
+type Summary struct {
+	Patients int
+	Failed   int
+}
+
+// Score evaluates each patient bundle read from r using the risk service and writes the results to w.  Nothing is
+// saved to a FHIR server or database.  A bundle that can't be scored is logged and counted as failed, but doesn't
+// stop the run; only errors reading the input or writing the output do.
+func Score(svc *service.ReferenceRiskService, r io.Reader, w ResultWriter, basisPieURL string, options service.CalculationOptions) (Summary, error) {
+	var summary Summary
+	err := ReadBundles(r, func(bundle *models.Bundle) error {
+		summary.Patients++
+		results, _, err := svc.Evaluate(bundle, basisPieURL, options)
+		if err != nil {
+			// Results from plugins that succeeded are still written
+			log.Printf("Unable to score bundle %d: %v", summary.Patients, err)
+			summary.Failed++
+		}
+		return w.Write(results)
+	})
+	if err != nil {
+		return summary, err
+	}
+	return summary, w.Flush()
+}
@@ -0,0 +1,158 @@
+package offline
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/assessments"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/intervention-engine/riskservice/service"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+)
+
+type OfflineSuite struct {
+	Bundle  []byte
+	Service *service.ReferenceRiskService
+}
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&OfflineSuite{})
+
+func (o *OfflineSuite) SetUpSuite(c *C) {
+	data, err := ioutil.ReadFile("../service/fixtures/brad_bradworth_event_source_bundle.json")
+	util.CheckErr(err)
+	o.Bundle = data
+}
+
+func (o *OfflineSuite) SetUpTest(c *C) {
+	o.Service = service.NewReferenceRiskService(nil)
+	o.Service.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
+}
+
+func (o *OfflineSuite) TestReadSingleBundle(c *C) {
+	var bundles []*models.Bundle
+	err := ReadBundles(bytes.NewReader(o.Bundle), func(b *models.Bundle) error {
+		bundles = append(bundles, b)
+		return nil
+	})
+	util.CheckErr(err)
+	c.Assert(bundles, HasLen, 1)
+	c.Assert(bundles[0].Entry, Not(HasLen), 0)
+}
+
+func (o *OfflineSuite) TestReadNDJSONBundles(c *C) {
+	var bundles []*models.Bundle
+	err := ReadBundles(strings.NewReader(o.ndjson(3)), func(b *models.Bundle) error {
+		bundles = append(bundles, b)
+		return nil
+	})
+	util.CheckErr(err)
+	c.Assert(bundles, HasLen, 3)
+}
+
+func (o *OfflineSuite) TestReadBadBundle(c *C) {
+	err := ReadBundles(strings.NewReader(o.ndjson(1)+"{not json}\n"), func(b *models.Bundle) error { return nil })
+	c.Assert(err, ErrorMatches, "Unable to read bundle 2: .*")
+}
+
+func (o *OfflineSuite) TestSelectPlugins(c *C) {
+	all := []plugin.RiskServicePlugin{assessments.NewCHA2DS2VAScPlugin(), assessments.NewSimplePlugin()}
+
+	selected, err := SelectPlugins(all, "")
+	util.CheckErr(err)
+	c.Assert(selected, HasLen, 2)
+
+	selected, err = SelectPlugins(all, "Simple, CHADS")
+	util.CheckErr(err)
+	c.Assert(selected, HasLen, 2)
+	c.Assert(selected[0].Config().Method.Coding[0].Code, Equals, "Simple")
+	c.Assert(selected[1].Config().Method.Coding[0].Code, Equals, "CHADS")
+
+	selected, err = SelectPlugins(all, "chads")
+	util.CheckErr(err)
+	c.Assert(selected, HasLen, 1)
+
+	_, err = SelectPlugins(all, "CHADS,Foo")
+	c.Assert(err, ErrorMatches, "No risk assessment plugin is registered for method: Foo")
+}
+
+func (o *OfflineSuite) TestScoreNDJSON(c *C) {
+	var out bytes.Buffer
+	summary, err := Score(o.Service, strings.NewReader(o.ndjson(2)), NewNDJSONWriter(&out), "pies", service.CalculationOptions{})
+	util.CheckErr(err)
+	c.Assert(summary, Equals, Summary{Patients: 2})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, HasLen, 8)
+	var record Record
+	util.CheckErr(json.Unmarshal([]byte(lines[3]), &record))
+	c.Assert(record.Patient, Equals, "Patient/507f1f77bcf86cd799439001")
+	c.Assert(record.Method, Equals, "CHADS")
+	c.Assert(*record.RiskAssessment.Prediction[0].ProbabilityDecimal, Equals, 6.7)
+	c.Assert(record.RiskAssessment.Basis[0].Reference, Equals, "pies/"+record.Pie.Id.Hex())
+	c.Assert(record.Pie.Slices, HasLen, 7)
+}
+
+func (o *OfflineSuite) TestScoreCSV(c *C) {
+	var out bytes.Buffer
+	summary, err := Score(o.Service, bytes.NewReader(o.Bundle), NewCSVWriter(&out), "pies", service.CalculationOptions{})
+	util.CheckErr(err)
+	c.Assert(summary, Equals, Summary{Patients: 1})
+
+	rows, err := csv.NewReader(&out).ReadAll()
+	util.CheckErr(err)
+	c.Assert(rows, HasLen, 5)
+	c.Assert(rows[0], DeepEquals, CSVHeader)
+	last := rows[4]
+	c.Assert(last[0], Equals, "Patient/507f1f77bcf86cd799439001")
+	c.Assert(last[1], Equals, "CHADS")
+	c.Assert(last[3], Equals, "6.7")
+	c.Assert(last[4], Equals, "true")
+	c.Assert(rows[1][4], Equals, "false")
+	c.Assert(strings.HasPrefix(last[6], "Congestive Heart Failure="), Equals, true)
+}
+
+func (o *OfflineSuite) TestCSVRowWithNegativeSlice(c *C) {
+	pie := plugin.NewPie("Patient/1")
+	pie.Slices = []plugin.Slice{
+		{Name: "Congestive Heart Failure", Weight: 6, MaxValue: 7, Value: 7},
+		{Name: "Obesity", Weight: 4, MaxValue: 4, Value: 4, Negative: true},
+	}
+	row := csvRow(Record{Patient: "Patient/1", Method: "Elixhauser", RiskAssessment: &models.RiskAssessment{}, Pie: pie})
+	c.Assert(row[6], Equals, "Congestive Heart Failure=7;Obesity=-4")
+}
+
+func (o *OfflineSuite) TestScoreContinuesAfterBadBundle(c *C) {
+	// A bundle without a patient can't be scored, but the next one can
+	in := `{"resourceType": "Bundle", "type": "collection", "entry": []}` + "\n" + o.ndjson(1)
+	var out bytes.Buffer
+	summary, err := Score(o.Service, strings.NewReader(in), NewNDJSONWriter(&out), "pies", service.CalculationOptions{})
+	util.CheckErr(err)
+	c.Assert(summary, Equals, Summary{Patients: 2, Failed: 1})
+	c.Assert(strings.Count(out.String(), "\n"), Equals, 4)
+}
+
+func (o *OfflineSuite) TestCSVHeaderWithoutResults(c *C) {
+	var out bytes.Buffer
+	w, err := NewResultWriter(&out, "CSV")
+	util.CheckErr(err)
+	util.CheckErr(w.Flush())
+	c.Assert(out.String(), Equals, strings.Join(CSVHeader, ",")+"\n")
+
+	_, err = NewResultWriter(&out, "xml")
+	c.Assert(err, ErrorMatches, "Unsupported output format: xml")
+}
+
+// ndjson returns the fixture bundle repeated n times as NDJSON.
+func (o *OfflineSuite) ndjson(n int) string {
+	var compact bytes.Buffer
+	util.CheckErr(json.Compact(&compact, o.Bundle))
+	return strings.Repeat(compact.String()+"\n", n)
+}
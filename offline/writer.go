@@ -0,0 +1,166 @@
+package offline
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/intervention-engine/riskservice/service"
+)
+
+// ResultWriter writes the results of scoring a patient to an output file.
+type ResultWriter interface {
+	Write(results []service.PluginResults) error
+	Flush() error
+}
+
+// NewResultWriter returns a writer for the given format, which must be "ndjson" or "csv".
+func NewResultWriter(w io.Writer, format string) (ResultWriter, error) {
+	switch strings.ToLower(format) {
+	case "ndjson":
+		return NewNDJSONWriter(w), nil
+	case "csv":
+		return NewCSVWriter(w), nil
+	}
+	return nil, fmt.Errorf("Unsupported output format: %s", format)
+}
+
+// Record pairs a risk assessment with the pie that it is based on.  Not applicable risk assessments don't have a
+// pie.
+type Record struct {
+	Patient        string                 `json:"patient"`
+	Method         string                 `json:"method"`
+	RiskAssessment *models.RiskAssessment `json:"riskAssessment"`
+	Pie            *plugin.Pie            `json:"pie,omitempty"`
+}
+
+// Records flattens the results into one record per risk assessment.
+func Records(results []service.PluginResults) []Record {
+	var records []Record
+	for _, pr := range results {
+		for i, ra := range pr.RiskAssessments {
+			record := Record{RiskAssessment: ra}
+			if ra.Subject != nil {
+				record.Patient = ra.Subject.Reference
+			}
+			if ra.Method != nil && len(ra.Method.Coding) > 0 {
+				record.Method = ra.Method.Coding[0].Code
+			}
+			if i < len(pr.Pies) {
+				record.Pie = pr.Pies[i]
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// NDJSONWriter writes each record as a line of JSON.
+type NDJSONWriter struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+// NewNDJSONWriter returns a new NDJSONWriter writing to w.
+func NewNDJSONWriter(w io.Writer) *NDJSONWriter {
+	bw := bufio.NewWriter(w)
+	return &NDJSONWriter{w: bw, encoder: json.NewEncoder(bw)}
+}
+
+// Write writes the records for the results.
+func (n *NDJSONWriter) Write(results []service.PluginResults) error {
+	for _, record := range Records(results) {
+		if err := n.encoder.Encode(&record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (n *NDJSONWriter) Flush() error {
+	return n.w.Flush()
+}
+
+// CSVHeader is the header row written by a CSVWriter.
+var CSVHeader = []string{"patient", "method", "date", "probability", "mostRecent", "pie", "slices"}
+
+// CSVWriter writes each record as a row of comma-separated values.  The probability is the decimal probability
+// (which is the score for most plugins) or the text of the coded probability (e.g., "Not applicable").  The slices
+// of the pie are flattened into a single column of name=value pairs, separated by semicolons, where the values of
+// negative slices are negated.
+type CSVWriter struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+// NewCSVWriter returns a new CSVWriter writing to w.
+func NewCSVWriter(w io.Writer) *CSVWriter {
+	return &CSVWriter{w: csv.NewWriter(w)}
+}
+
+// Write writes the rows for the results, preceded by the header if this is the first write.
+func (c *CSVWriter) Write(results []service.PluginResults) error {
+	if !c.headerWritten {
+		if err := c.w.Write(CSVHeader); err != nil {
+			return err
+		}
+		c.headerWritten = true
+	}
+	for _, record := range Records(results) {
+		if err := c.w.Write(csvRow(record)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes any buffered data to the underlying writer.  The header is written even if there were no results.
+func (c *CSVWriter) Flush() error {
+	if !c.headerWritten {
+		if err := c.Write(nil); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func csvRow(record Record) []string {
+	ra := record.RiskAssessment
+	var date, probability, mostRecent, pie, slices string
+	if ra.Date != nil {
+		date = ra.Date.Time.Format(time.RFC3339)
+	}
+	if len(ra.Prediction) > 0 {
+		if p := ra.Prediction[0].ProbabilityDecimal; p != nil {
+			probability = strconv.FormatFloat(*p, 'f', -1, 64)
+		} else if p := ra.Prediction[0].ProbabilityCodeableConcept; p != nil {
+			probability = p.Text
+		}
+	}
+	mostRecent = "false"
+	if ra.Meta != nil {
+		for _, tag := range ra.Meta.Tag {
+			if tag.Code == "MOST_RECENT" {
+				mostRecent = "true"
+			}
+		}
+	}
+	if record.Pie != nil {
+		pie = record.Pie.Id.Hex()
+		pairs := make([]string, len(record.Pie.Slices))
+		for i, slice := range record.Pie.Slices {
+			pairs[i] = fmt.Sprintf("%s=%d", slice.Name, slice.SignedValue())
+		}
+		slices = strings.Join(pairs, ";")
+	}
+	return []string{record.Patient, record.Method, date, probability, mostRecent, pie, slices}
+}
@@ -0,0 +1,35 @@
+package plugin
+
+import "github.com/intervention-engine/fhir/models"
+
+// ResolvedClinicalStatus returns true if the condition's clinical status says it is no longer active (resolved,
+// in remission or inactive), or if it is marked as abated without a date.
+func ResolvedClinicalStatus(condition *models.Condition) bool {
+	switch condition.ClinicalStatus {
+	case "resolved", "remission", "inactive":
+		return true
+	}
+	return condition.AbatementBoolean != nil && *condition.AbatementBoolean
+}
+
+// ResolvedConditionPolicy decides whether a plugin still counts a condition once it has resolved (i.e., whether a
+// history of the condition is a risk factor, or only an active condition is).  Categories maps condition category
+// codes (e.g., "diagnosis" or "symptom") to whether resolved conditions in that category still count, and
+// CountsByDefault applies to conditions whose category isn't in the map.  The zero value counts conditions only
+// while they are active.
+type ResolvedConditionPolicy struct {
+	CountsByDefault bool
+	Categories      map[string]bool
+}
+
+// HistoryCounts returns true if the condition should still count after it has resolved.
+func (p ResolvedConditionPolicy) HistoryCounts(condition *models.Condition) bool {
+	if condition.Category != nil {
+		for _, coding := range condition.Category.Coding {
+			if counts, ok := p.Categories[coding.Code]; ok {
+				return counts
+			}
+		}
+	}
+	return p.CountsByDefault
+}
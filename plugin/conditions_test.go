@@ -0,0 +1,44 @@
+package plugin
+
+import (
+	"github.com/intervention-engine/fhir/models"
+	. "gopkg.in/check.v1"
+)
+
+type ConditionsSuite struct {
+}
+
+var _ = Suite(&ConditionsSuite{})
+
+func (s *ConditionsSuite) TestResolvedClinicalStatus(c *C) {
+	statuses := map[string]bool{
+		"active":    false,
+		"relapse":   false,
+		"":          false,
+		"resolved":  true,
+		"remission": true,
+		"inactive":  true,
+	}
+	for status, expected := range statuses {
+		c.Assert(ResolvedClinicalStatus(&models.Condition{ClinicalStatus: status}), Equals, expected, Commentf("status %s", status))
+	}
+
+	abated := true
+	c.Assert(ResolvedClinicalStatus(&models.Condition{ClinicalStatus: "active", AbatementBoolean: &abated}), Equals, true)
+}
+
+func (s *ConditionsSuite) TestResolvedConditionPolicy(c *C) {
+	category := func(code string) *models.Condition {
+		return &models.Condition{Category: &models.CodeableConcept{Coding: []models.Coding{{System: "http://hl7.org/fhir/condition-category", Code: code}}}}
+	}
+
+	// The zero value only counts active conditions
+	var policy ResolvedConditionPolicy
+	c.Assert(policy.HistoryCounts(category("diagnosis")), Equals, false)
+	c.Assert(policy.HistoryCounts(&models.Condition{}), Equals, false)
+
+	policy = ResolvedConditionPolicy{CountsByDefault: true, Categories: map[string]bool{"symptom": false}}
+	c.Assert(policy.HistoryCounts(category("diagnosis")), Equals, true)
+	c.Assert(policy.HistoryCounts(category("symptom")), Equals, false)
+	c.Assert(policy.HistoryCounts(&models.Condition{}), Equals, true)
+}
@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// The broad classes of encounters that risk calculations usually care about
+const (
+	InpatientEncounter  = "inpatient"
+	EmergencyEncounter  = "emergency"
+	AmbulatoryEncounter = "ambulatory"
+	OtherEncounter      = "other"
+)
+
+// EncounterClass returns the broad class of an encounter: InpatientEncounter, EmergencyEncounter,
+// AmbulatoryEncounter, or OtherEncounter.  It understands the FHIR encounter class codes as well as the
+// HL7 v3 ActEncounterCode codes (e.g., "IMP" and "EMER") that some systems put in the class instead.
+func EncounterClass(encounter *models.Encounter) string {
+	switch strings.ToLower(encounter.Class) {
+	case "inpatient", "imp", "acute", "nonac":
+		return InpatientEncounter
+	case "emergency", "emer":
+		return EmergencyEncounter
+	case "ambulatory", "outpatient", "daytime", "amb", "ss":
+		return AmbulatoryEncounter
+	default:
+		return OtherEncounter
+	}
+}
+
+// EmergentAdmission returns true if the encounter says it was an emergent or urgent admission: either it was admitted
+// from the emergency department (the "emd" admit source), or its priority is immediate, emergency or urgent (the FHIR
+// encounter priority codes, or the HL7 v3 ActPriority codes "EM" and "UR").  An admission that followed an emergency
+// department visit is also emergent, but that takes the patient's other encounters to tell.
+func EmergentAdmission(encounter *models.Encounter) bool {
+	if h := encounter.Hospitalization; h != nil && h.AdmitSource != nil {
+		for _, coding := range h.AdmitSource.Coding {
+			if strings.ToLower(coding.Code) == "emd" {
+				return true
+			}
+		}
+	}
+	if encounter.Priority != nil {
+		for _, coding := range encounter.Priority.Coding {
+			switch strings.ToLower(coding.Code) {
+			case "imm", "emg", "urg", "em", "ur":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LengthOfStay returns the number of days (i.e., nights) between the start and end of an encounter, counting
+// calendar days in the encounter's time zone.  If the encounter's period doesn't have both a start and an end, the
+// encounter's length is used instead, as long as it is in a unit of time.  The second return value is false if
+// the length of stay can't be determined.
+func LengthOfStay(encounter *models.Encounter) (int, bool) {
+	if p := encounter.Period; p != nil && p.Start != nil && p.End != nil {
+		start, end := p.Start.Time, p.End.Time.In(p.Start.Time.Location())
+		startDay := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+		endDay := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC)
+		if endDay.Before(startDay) {
+			return 0, false
+		}
+		return int(endDay.Sub(startDay).Hours() / 24), true
+	}
+	if encounter.Length != nil {
+		if days, ok := QuantityDays(encounter.Length); ok {
+			return int(days), true
+		}
+	}
+	return 0, false
+}
+
+// QuantityDays converts a quantity of time (e.g., an encounter's length or a dispense's days supply) to days.  It
+// returns false if the quantity doesn't have a value or isn't in days, hours or minutes.
+func QuantityDays(q *models.Quantity) (float64, bool) {
+	if q.Value == nil {
+		return 0, false
+	}
+	unit := q.Code
+	if unit == "" {
+		unit = q.Unit
+	}
+	switch strings.ToLower(unit) {
+	case "d", "day", "days":
+		return *q.Value, true
+	case "h", "hour", "hours":
+		return *q.Value / 24, true
+	case "min", "minute", "minutes":
+		return *q.Value / (24 * 60), true
+	default:
+		return 0, false
+	}
+}
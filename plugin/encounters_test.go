@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	. "gopkg.in/check.v1"
+)
+
+type EncountersSuite struct {
+}
+
+var _ = Suite(&EncountersSuite{})
+
+func (e *EncountersSuite) TestEncounterClass(c *C) {
+	classes := map[string]string{
+		"inpatient":  InpatientEncounter,
+		"IMP":        InpatientEncounter,
+		"emergency":  EmergencyEncounter,
+		"EMER":       EmergencyEncounter,
+		"ambulatory": AmbulatoryEncounter,
+		"outpatient": AmbulatoryEncounter,
+		"AMB":        AmbulatoryEncounter,
+		"home":       OtherEncounter,
+		"":           OtherEncounter,
+	}
+	for class, expected := range classes {
+		c.Assert(EncounterClass(&models.Encounter{Class: class}), Equals, expected, Commentf("class %s", class))
+	}
+}
+
+func (e *EncountersSuite) TestEmergentAdmission(c *C) {
+	c.Assert(EmergentAdmission(&models.Encounter{Class: "inpatient"}), Equals, false)
+	fromED := &models.Encounter{Hospitalization: &models.EncounterHospitalizationComponent{
+		AdmitSource: &models.CodeableConcept{Coding: []models.Coding{{System: "http://hl7.org/fhir/admit-source", Code: "emd"}}},
+	}}
+	c.Assert(EmergentAdmission(fromED), Equals, true)
+	fromED.Hospitalization.AdmitSource.Coding[0].Code = "gp"
+	c.Assert(EmergentAdmission(fromED), Equals, false)
+	for code, expected := range map[string]bool{"emg": true, "urg": true, "EM": true, "no-urg": false, "R": false} {
+		urgent := &models.Encounter{Priority: &models.CodeableConcept{Coding: []models.Coding{{Code: code}}}}
+		c.Assert(EmergentAdmission(urgent), Equals, expected, Commentf("priority %s", code))
+	}
+}
+
+func (e *EncountersSuite) TestLengthOfStayFromPeriod(c *C) {
+	loc := time.FixedZone("-0500", -5*60*60)
+	encounter := &models.Encounter{Period: &models.Period{
+		Start: &models.FHIRDateTime{Time: time.Date(2015, time.March, 1, 23, 0, 0, 0, loc), Precision: models.Timestamp},
+		End:   &models.FHIRDateTime{Time: time.Date(2015, time.March, 5, 6, 0, 0, 0, loc), Precision: models.Timestamp},
+	}}
+	los, ok := LengthOfStay(encounter)
+	c.Assert(ok, Equals, true)
+	c.Assert(los, Equals, 4)
+
+	// Same day discharges have a length of stay of 0
+	encounter.Period.End.Time = time.Date(2015, time.March, 1, 23, 30, 0, 0, loc)
+	los, ok = LengthOfStay(encounter)
+	c.Assert(ok, Equals, true)
+	c.Assert(los, Equals, 0)
+}
+
+func (e *EncountersSuite) TestLengthOfStayFromLength(c *C) {
+	hours := float64(60)
+	encounter := &models.Encounter{Length: &models.Quantity{Value: &hours, Unit: "hours"}}
+	los, ok := LengthOfStay(encounter)
+	c.Assert(ok, Equals, true)
+	c.Assert(los, Equals, 2)
+
+	encounter.Length.Unit = "furlongs"
+	_, ok = LengthOfStay(encounter)
+	c.Assert(ok, Equals, false)
+}
+
+func (e *EncountersSuite) TestLengthOfStayUnknown(c *C) {
+	encounter := &models.Encounter{Period: &models.Period{
+		Start: &models.FHIRDateTime{Time: time.Date(2015, time.March, 1, 8, 0, 0, 0, time.UTC), Precision: models.Timestamp},
+	}}
+	_, ok := LengthOfStay(encounter)
+	c.Assert(ok, Equals, false)
+}
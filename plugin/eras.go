@@ -0,0 +1,166 @@
+package plugin
+
+import (
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// RxNormSystem is the code system for RxNorm codes, which identify most medications
+const RxNormSystem = "http://www.nlm.nih.gov/research/umls/rxnorm"
+
+// Medication returns the medication of the event's MedicationStatement, MedicationOrder, MedicationDispense or
+// MedicationAdministration.  It returns false if the event isn't for one of those or the medication is only a
+// reference to a Medication resource.
+func (e Event) Medication() (*models.CodeableConcept, bool) {
+	var medication *models.CodeableConcept
+	switch r := e.Value.(type) {
+	case *models.MedicationStatement:
+		medication = r.MedicationCodeableConcept
+	case *models.MedicationOrder:
+		medication = r.MedicationCodeableConcept
+	case *models.MedicationDispense:
+		medication = r.MedicationCodeableConcept
+	case *models.MedicationAdministration:
+		medication = r.MedicationCodeableConcept
+	}
+	return medication, medication != nil
+}
+
+// MedicationKey identifies a medication by its RxNorm code if it has one, or otherwise its first code, in the form
+// system|code.  It returns "" if the medication isn't coded.
+func MedicationKey(medication *models.CodeableConcept) string {
+	for _, coding := range medication.Coding {
+		if strings.TrimSuffix(coding.System, "/") == RxNormSystem {
+			return RxNormSystem + "|" + coding.Code
+		}
+	}
+	if len(medication.Coding) > 0 {
+		return medication.Coding[0].System + "|" + medication.Coding[0].Code
+	}
+	return ""
+}
+
+// DrugEraConfig customizes how drug eras are built.  Gap is the longest time between one exposure ending and the
+// next one starting that still counts as continuous exposure (e.g., a refill that was picked up a few days late).
+// Ingredient groups the medications into eras; it defaults to MedicationKey, so each distinct medication gets its
+// own eras, but it can map products to their ingredients instead.  Medications it returns "" for are ignored.
+type DrugEraConfig struct {
+	Gap        time.Duration
+	Ingredient func(medication *models.CodeableConcept) string
+}
+
+// DrugEra is a span of time during which the patient was continuously exposed to an ingredient.  End is the zero
+// time if the exposure is ongoing.  Medication is the medication from the first exposure in the era, and Exposures
+// is the number of exposures that were merged into the era.  StartPrecision and EndPrecision are the precisions of
+// the dates the start and end came from.
+type DrugEra struct {
+	Ingredient     string
+	Medication     *models.CodeableConcept
+	Start          time.Time
+	End            time.Time
+	Exposures      int
+	StartPrecision models.Precision
+	EndPrecision   models.Precision
+}
+
+// Ongoing returns true if the era hasn't ended.
+func (d *DrugEra) Ongoing() bool {
+	return d.End.IsZero()
+}
+
+// MinAdministrationExposure is the shortest time an administration without an end counts as exposure, so that a
+// single dose doesn't make an era that ends the moment it starts.
+const MinAdministrationExposure = 24 * time.Hour
+
+// BuildDrugEras merges the patient's medication exposures into drug eras.  The exposures come from the start and
+// end events of MedicationStatements, MedicationOrders, MedicationDispenses and MedicationAdministrations.  An
+// exposure without an end event is ongoing, except for an administration, which counts as exposure for the gap
+// after it was given (or MinAdministrationExposure, if that's longer).  The events must already be sorted, and the
+// eras are sorted by start date.
+func BuildDrugEras(events []Event, config DrugEraConfig) []DrugEra {
+	ingredient := config.Ingredient
+	if ingredient == nil {
+		ingredient = MedicationKey
+	}
+
+	administrationExposure := config.Gap
+	if administrationExposure < MinAdministrationExposure {
+		administrationExposure = MinAdministrationExposure
+	}
+
+	type exposure struct {
+		ingredient                   string
+		medication                   *models.CodeableConcept
+		start, end                   time.Time
+		startPrecision, endPrecision models.Precision
+	}
+	var exposures []*exposure
+	byResource := make(map[interface{}]*exposure)
+	for _, e := range events {
+		medication, ok := e.Medication()
+		if !ok {
+			continue
+		}
+		if e.End {
+			if x := byResource[e.Value]; x != nil {
+				x.end, x.endPrecision = e.Date, e.Precision
+			}
+			continue
+		}
+		key := ingredient(medication)
+		if key == "" {
+			continue
+		}
+		x := &exposure{ingredient: key, medication: medication, start: e.Date, startPrecision: e.Precision}
+		if _, ok := e.Value.(*models.MedicationAdministration); ok {
+			x.end, x.endPrecision = e.Date.Add(administrationExposure), e.Precision
+		}
+		byResource[e.Value] = x
+		exposures = append(exposures, x)
+	}
+
+	var eras []DrugEra
+	current := make(map[string]int)
+	for _, x := range exposures {
+		if i, ok := current[x.ingredient]; ok {
+			era := &eras[i]
+			if era.Ongoing() || !x.start.After(era.End.Add(config.Gap)) {
+				era.Exposures++
+				if x.end.IsZero() {
+					era.End, era.EndPrecision = time.Time{}, ""
+				} else if !era.Ongoing() && x.end.After(era.End) {
+					era.End, era.EndPrecision = x.end, x.endPrecision
+				}
+				continue
+			}
+		}
+		current[x.ingredient] = len(eras)
+		eras = append(eras, DrugEra{
+			Ingredient:     x.ingredient,
+			Medication:     x.medication,
+			Start:          x.start,
+			End:            x.end,
+			Exposures:      1,
+			StartPrecision: x.startPrecision,
+			EndPrecision:   x.endPrecision,
+		})
+	}
+	return eras
+}
+
+// DrugEraEvents returns the start and end events for the drug eras, sorted by date.  The events have the type
+// "DrugEra", a *DrugEra value and the precision of the era's start or end.  Ongoing eras only have a start event.
+func DrugEraEvents(eras []DrugEra) []Event {
+	events := make([]Event, 0, 2*len(eras))
+	for i := range eras {
+		era := &eras[i]
+		events = append(events, Event{Date: era.Start, Type: "DrugEra", End: false, Value: era, Precision: era.StartPrecision})
+		if !era.Ongoing() {
+			events = append(events, Event{Date: era.End, Type: "DrugEra", End: true, Value: era, Precision: era.EndPrecision})
+		}
+	}
+	SortEventsByDate(events)
+	return events
+}
@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	. "gopkg.in/check.v1"
+)
+
+type ErasSuite struct {
+}
+
+var _ = Suite(&ErasSuite{})
+
+func (e *ErasSuite) TestBuildDrugErasMergesNearbyDispenses(c *C) {
+	// Three 30 day fills of warfarin, the second picked up 5 days late and the third 20 days late
+	first := time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+	var events []Event
+	events = append(events, dispenseEvents("11289", first, 30)...)
+	events = append(events, dispenseEvents("11289", first.AddDate(0, 0, 35), 30)...)
+	events = append(events, dispenseEvents("11289", first.AddDate(0, 0, 85), 30)...)
+	SortEventsByDate(events)
+
+	eras := BuildDrugEras(events, DrugEraConfig{Gap: 7 * 24 * time.Hour})
+	c.Assert(eras, HasLen, 2)
+	c.Assert(eras[0].Ingredient, Equals, RxNormSystem+"|11289")
+	c.Assert(eras[0].Start, Equals, first)
+	c.Assert(eras[0].End, Equals, first.AddDate(0, 0, 65))
+	c.Assert(eras[0].Exposures, Equals, 2)
+	c.Assert(eras[1].Start, Equals, first.AddDate(0, 0, 85))
+	c.Assert(eras[1].End, Equals, first.AddDate(0, 0, 115))
+	c.Assert(eras[1].Exposures, Equals, 1)
+
+	// With a big enough gap, it's all one era
+	eras = BuildDrugEras(events, DrugEraConfig{Gap: 30 * 24 * time.Hour})
+	c.Assert(eras, HasLen, 1)
+	c.Assert(eras[0].Exposures, Equals, 3)
+	c.Assert(eras[0].End, Equals, first.AddDate(0, 0, 115))
+}
+
+func (e *ErasSuite) TestBuildDrugErasWithOngoingExposures(c *C) {
+	start := time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+	statement := &models.MedicationStatement{MedicationCodeableConcept: rxNorm("11289")}
+	administration := &models.MedicationAdministration{MedicationCodeableConcept: rxNorm("1191")}
+	events := []Event{
+		{Date: start, Type: "MedicationAdministration", Value: administration},
+		{Date: start.AddDate(0, 1, 0), Type: "MedicationStatement", Value: statement, Precision: YearMonth},
+	}
+	events = append(events, dispenseEvents("11289", start.AddDate(0, 2, 0), 30)...)
+
+	eras := BuildDrugEras(events, DrugEraConfig{})
+	c.Assert(eras, HasLen, 2)
+	// An administration doesn't last, but it counts for at least a day so that its era isn't empty
+	c.Assert(eras[0].Ingredient, Equals, RxNormSystem+"|1191")
+	c.Assert(eras[0].Ongoing(), Equals, false)
+	c.Assert(eras[0].End, Equals, start.Add(MinAdministrationExposure))
+	// A statement without an end is ongoing, and swallows the dispense
+	c.Assert(eras[1].Ingredient, Equals, RxNormSystem+"|11289")
+	c.Assert(eras[1].Ongoing(), Equals, true)
+	c.Assert(eras[1].Exposures, Equals, 2)
+
+	eraEvents := DrugEraEvents(eras)
+	c.Assert(eraEvents, HasLen, 3)
+	c.Assert(eraEvents[0].Value, Equals, &eras[0])
+	c.Assert(eraEvents[1].Value, Equals, &eras[0])
+	c.Assert(eraEvents[1].End, Equals, true)
+	c.Assert(eraEvents[2].Value, Equals, &eras[1])
+	c.Assert(eraEvents[2].Type, Equals, "DrugEra")
+	// The era events keep the precision of the dates they came from
+	c.Assert(eraEvents[2].Approximate(), Equals, true)
+
+	// With a longer gap, the administration counts for the whole gap
+	eras = BuildDrugEras(events, DrugEraConfig{Gap: 7 * 24 * time.Hour})
+	c.Assert(eras[0].End, Equals, start.AddDate(0, 0, 7))
+}
+
+func (e *ErasSuite) TestBuildDrugErasByIngredient(c *C) {
+	// Brand and generic warfarin dispenses should be one era when grouped by ingredient
+	start := time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+	var events []Event
+	events = append(events, dispenseEvents("855332", start, 30)...)
+	events = append(events, dispenseEvents("855288", start.AddDate(0, 0, 30), 30)...)
+	ingredients := map[string]string{"855332": "11289", "855288": "11289"}
+
+	eras := BuildDrugEras(events, DrugEraConfig{})
+	c.Assert(eras, HasLen, 2)
+	eras = BuildDrugEras(events, DrugEraConfig{Ingredient: func(medication *models.CodeableConcept) string {
+		return ingredients[medication.Coding[0].Code]
+	}})
+	c.Assert(eras, HasLen, 1)
+	c.Assert(eras[0].Ingredient, Equals, "11289")
+	c.Assert(eras[0].End, Equals, start.AddDate(0, 0, 60))
+}
+
+func (e *ErasSuite) TestMedicationKey(c *C) {
+	medication := &models.CodeableConcept{Coding: []models.Coding{
+		{System: "http://hl7.org/fhir/sid/ndc", Code: "0056-0172-70"},
+		{System: RxNormSystem + "/", Code: "855332"},
+	}}
+	c.Assert(MedicationKey(medication), Equals, RxNormSystem+"|855332")
+	medication.Coding = medication.Coding[:1]
+	c.Assert(MedicationKey(medication), Equals, "http://hl7.org/fhir/sid/ndc|0056-0172-70")
+	c.Assert(MedicationKey(&models.CodeableConcept{Text: "Warfarin"}), Equals, "")
+}
+
+func rxNorm(code string) *models.CodeableConcept {
+	return &models.CodeableConcept{Coding: []models.Coding{{System: RxNormSystem, Code: code}}}
+}
+
+func dispenseEvents(rxNormCode string, handedOver time.Time, daysSupply int) []Event {
+	dispense := &models.MedicationDispense{Status: "completed", MedicationCodeableConcept: rxNorm(rxNormCode)}
+	return []Event{
+		{Date: handedOver, Type: "MedicationDispense", Value: dispense},
+		{Date: handedOver.AddDate(0, 0, daysSupply), Type: "MedicationDispense", End: true, Value: dispense},
+	}
+}
@@ -7,18 +7,117 @@ import (
 	"github.com/intervention-engine/fhir/models"
 )
 
-// Event represents an event that may be of importance to a risk calculation
+// The precisions of dates that are only known to the year or month (e.g., an onset recorded as just "2009").  The
+// FHIR models only parse full dates and timestamps, so these are set by the service when it decodes a bundle.
+const (
+	Year      models.Precision = "year"
+	YearMonth models.Precision = "year-month"
+)
+
+// Event represents an event that may be of importance to a risk calculation.  Precision is the precision of the
+// date the event came from (e.g., Year for an onset recorded as just "2009").  The Date of an event with an
+// imprecise date is usually the start of its year or month, but it may have been placed elsewhere in the period
+// (see Midpoint).  An empty Precision means the Date is exact.
 type Event struct {
-	Date  time.Time
-	Type  string
-	End   bool
-	Value interface{}
+	Date      time.Time
+	Type      string
+	End       bool
+	Value     interface{}
+	Precision models.Precision
+}
+
+// Approximate returns true if the event's date is only known to the year or month.
+func (e Event) Approximate() bool {
+	return e.Precision == Year || e.Precision == YearMonth
+}
+
+// Interval returns the period of time the event's date could be in, based on its precision (e.g., all of 2009 for
+// a date recorded as just "2009").  The end is exclusive.  The interval of an exact date is just the date itself.
+func (e Event) Interval() (start, end time.Time) {
+	d := e.Date
+	switch e.Precision {
+	case Year:
+		start = time.Date(d.Year(), time.January, 1, 0, 0, 0, 0, d.Location())
+		return start, start.AddDate(1, 0, 0)
+	case YearMonth:
+		start = time.Date(d.Year(), d.Month(), 1, 0, 0, 0, 0, d.Location())
+		return start, start.AddDate(0, 1, 0)
+	case models.Date:
+		start = time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, d.Location())
+		return start, start.AddDate(0, 0, 1)
+	default:
+		return d, d
+	}
+}
+
+// Midpoint returns the middle of the event's interval, which is a better single guess at when an approximate
+// event happened than the start of its year or month.
+func (e Event) Midpoint() time.Time {
+	start, end := e.Interval()
+	return start.Add(end.Sub(start) / 2)
+}
+
+// LOINCSystem is the code system for LOINC codes, which identify most observations
+const LOINCSystem = "http://loinc.org"
+
+// Observation returns the event's observation, or false if the event isn't for an observation.
+func (e Event) Observation() (*models.Observation, bool) {
+	o, ok := e.Value.(*models.Observation)
+	return o, ok && o != nil
+}
+
+// Quantity returns the quantity value of the event's observation (e.g., a lab result).  It returns false if the
+// event isn't for an observation or the observation doesn't have a quantity value.
+func (e Event) Quantity() (*models.Quantity, bool) {
+	o, ok := e.Observation()
+	if !ok || o.ValueQuantity == nil || o.ValueQuantity.Value == nil {
+		return nil, false
+	}
+	return o.ValueQuantity, true
+}
+
+// CodeableConcept returns the codeable concept value of the event's observation (e.g., a smoking status).  It
+// returns false if the event isn't for an observation or the observation doesn't have a codeable concept value.
+func (e Event) CodeableConcept() (*models.CodeableConcept, bool) {
+	o, ok := e.Observation()
+	if !ok || o.ValueCodeableConcept == nil {
+		return nil, false
+	}
+	return o.ValueCodeableConcept, true
+}
+
+// Component returns the component of the event's observation with the given LOINC code (e.g., the systolic
+// reading of a blood pressure).  It returns false if the event isn't for an observation or the observation doesn't
+// have the component.
+func (e Event) Component(loincCode string) (*models.ObservationComponentComponent, bool) {
+	o, ok := e.Observation()
+	if !ok {
+		return nil, false
+	}
+	for i := range o.Component {
+		if o.Component[i].Code != nil && o.Component[i].Code.MatchesCode(LOINCSystem, loincCode) {
+			return &o.Component[i], true
+		}
+	}
+	return nil, false
+}
+
+// ComponentQuantity returns the quantity value of the component of the event's observation with the given LOINC
+// code.  It returns false if there is no such component or it doesn't have a quantity value.
+func (e Event) ComponentQuantity(loincCode string) (*models.Quantity, bool) {
+	component, ok := e.Component(loincCode)
+	if !ok || component.ValueQuantity == nil || component.ValueQuantity.Value == nil {
+		return nil, false
+	}
+	return component.ValueQuantity, true
 }
 
-// EventStream represents a patient and an ordered stream of events
+// EventStream represents a patient and an ordered stream of events.  Besides walking the events, plugins can query
+// the stream (e.g., ActiveConditionsAt or LatestObservation), which uses an index built from the events.
 type EventStream struct {
 	Patient *models.Patient
 	Events  []Event
+	index   *eventIndex
 }
 
 // NewEventStream creates a new EventStream for the given patient, initialized to 0 events
@@ -51,3 +51,85 @@ func (p *PieSuite) TestEventStreamClone(c *C) {
 	clone.Events[1].End = true
 	c.Assert(es.Events[1].End, Equals, false)
 }
+
+func (p *EventsSuite) TestObservationValues(c *C) {
+	value, systolic := 1.2, 120.0
+	observation := &models.Observation{
+		ValueQuantity:        &models.Quantity{Value: &value, Unit: "mg/dL"},
+		ValueCodeableConcept: &models.CodeableConcept{Text: "Positive"},
+		Component: []models.ObservationComponentComponent{
+			{
+				Code:          &models.CodeableConcept{Coding: []models.Coding{{System: LOINCSystem, Code: "8480-6"}}},
+				ValueQuantity: &models.Quantity{Value: &systolic, Unit: "mm[Hg]"},
+			},
+		},
+	}
+	e := Event{Type: "Observation", Value: observation}
+
+	o, ok := e.Observation()
+	c.Assert(ok, Equals, true)
+	c.Assert(o, Equals, observation)
+	q, ok := e.Quantity()
+	c.Assert(ok, Equals, true)
+	c.Assert(*q.Value, Equals, 1.2)
+	cc, ok := e.CodeableConcept()
+	c.Assert(ok, Equals, true)
+	c.Assert(cc.Text, Equals, "Positive")
+	component, ok := e.Component("8480-6")
+	c.Assert(ok, Equals, true)
+	c.Assert(component, Equals, &observation.Component[0])
+	q, ok = e.ComponentQuantity("8480-6")
+	c.Assert(ok, Equals, true)
+	c.Assert(*q.Value, Equals, 120.0)
+	_, ok = e.ComponentQuantity("8462-4")
+	c.Assert(ok, Equals, false)
+}
+
+func (p *EventsSuite) TestObservationValuesForOtherEvents(c *C) {
+	e := Event{Type: "Condition", Value: &models.Condition{}}
+	_, ok := e.Observation()
+	c.Assert(ok, Equals, false)
+	_, ok = e.Quantity()
+	c.Assert(ok, Equals, false)
+	_, ok = e.CodeableConcept()
+	c.Assert(ok, Equals, false)
+	_, ok = e.Component("8480-6")
+	c.Assert(ok, Equals, false)
+
+	// An observation without a value of the right type doesn't have one either
+	e = Event{Type: "Observation", Value: &models.Observation{}}
+	_, ok = e.Quantity()
+	c.Assert(ok, Equals, false)
+	_, ok = e.CodeableConcept()
+	c.Assert(ok, Equals, false)
+}
+
+func (p *EventsSuite) TestEventPrecision(c *C) {
+	date := time.Date(2009, time.February, 1, 0, 0, 0, 0, time.UTC)
+	e := Event{Date: date, Type: "Condition", Precision: Year}
+	c.Assert(e.Approximate(), Equals, true)
+	start, end := e.Interval()
+	c.Assert(start, Equals, time.Date(2009, time.January, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(end, Equals, time.Date(2010, time.January, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(e.Midpoint(), Equals, time.Date(2009, time.July, 2, 12, 0, 0, 0, time.UTC))
+
+	e.Precision = YearMonth
+	c.Assert(e.Approximate(), Equals, true)
+	start, end = e.Interval()
+	c.Assert(start, Equals, date)
+	c.Assert(end, Equals, time.Date(2009, time.March, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(e.Midpoint(), Equals, time.Date(2009, time.February, 15, 0, 0, 0, 0, time.UTC))
+
+	e.Precision = models.Date
+	c.Assert(e.Approximate(), Equals, false)
+	c.Assert(e.Midpoint(), Equals, time.Date(2009, time.February, 1, 12, 0, 0, 0, time.UTC))
+
+	// An exact date (or one with no precision) is its own interval
+	for _, precision := range []models.Precision{models.Timestamp, ""} {
+		e.Precision = precision
+		c.Assert(e.Approximate(), Equals, false)
+		start, end = e.Interval()
+		c.Assert(start, Equals, date)
+		c.Assert(end, Equals, date)
+	}
+}
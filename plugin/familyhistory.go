@@ -0,0 +1,48 @@
+package plugin
+
+import "github.com/intervention-engine/fhir/models"
+
+// RoleCodeSystem is the code system for the HL7 v3 RoleCode codes used for family member relationships
+const RoleCodeSystem = "http://hl7.org/fhir/v3/RoleCode"
+
+// firstDegreeRelationships are the RoleCode codes for parents, siblings and children: the natural relationships
+// (e.g., NFTH), and the general ones (e.g., FTH) that most family histories use.  The general codes don't say
+// whether the relationship is by birth, so they also cover adoptive and step relatives recorded with them.
+var firstDegreeRelationships = []string{
+	"PRN", "NPRN", "FTH", "NFTH", "MTH", "NMTH",
+	"SIB", "NSIB", "BRO", "NBRO", "SIS", "NSIS", "TWIN", "TWINBRO", "TWINSIS", "FTWIN", "FTWINBRO", "FTWINSIS",
+	"ITWIN", "ITWINBRO", "ITWINSIS",
+	"CHILD", "NCHILD", "SON", "SONC", "DAU", "DAUC",
+}
+
+// FamilyMemberHistory returns the event's family member history, or false if the event isn't for one.
+func (e Event) FamilyMemberHistory() (*models.FamilyMemberHistory, bool) {
+	h, ok := e.Value.(*models.FamilyMemberHistory)
+	return h, ok && h != nil
+}
+
+// FirstDegreeRelative returns true if the family member is the patient's parent, sibling or child.  Relatives
+// recorded with the adoptive, step, foster or in-law codes (e.g., ADOPTF or STPFTH) don't count, but ones recorded
+// with the general codes do, since they usually mean relatives by birth.
+func FirstDegreeRelative(history *models.FamilyMemberHistory) bool {
+	if history.Relationship == nil {
+		return false
+	}
+	for _, code := range firstDegreeRelationships {
+		if history.Relationship.MatchesCode(RoleCodeSystem, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// FamilyMemberConditions returns the family member's conditions with the given code.
+func FamilyMemberConditions(history *models.FamilyMemberHistory, system, code string) []models.FamilyMemberHistoryConditionComponent {
+	var conditions []models.FamilyMemberHistoryConditionComponent
+	for _, condition := range history.Condition {
+		if condition.Code != nil && condition.Code.MatchesCode(system, code) {
+			conditions = append(conditions, condition)
+		}
+	}
+	return conditions
+}
@@ -0,0 +1,39 @@
+package plugin
+
+import (
+	"github.com/intervention-engine/fhir/models"
+	. "gopkg.in/check.v1"
+)
+
+type FamilyHistorySuite struct {
+}
+
+var _ = Suite(&FamilyHistorySuite{})
+
+func (f *FamilyHistorySuite) TestFirstDegreeRelative(c *C) {
+	history := &models.FamilyMemberHistory{}
+	c.Assert(FirstDegreeRelative(history), Equals, false)
+
+	for code, expected := range map[string]bool{"FTH": true, "NFTH": true, "SIS": true, "SON": true, "GRMTH": false, "UNCLE": false, "STPFTH": false, "ADOPTF": false} {
+		history.Relationship = &models.CodeableConcept{Coding: []models.Coding{{System: RoleCodeSystem, Code: code}}}
+		c.Assert(FirstDegreeRelative(history), Equals, expected, Commentf("relationship %s", code))
+	}
+}
+
+func (f *FamilyHistorySuite) TestFamilyMemberConditions(c *C) {
+	history := &models.FamilyMemberHistory{Condition: []models.FamilyMemberHistoryConditionComponent{
+		{Code: &models.CodeableConcept{Coding: []models.Coding{{System: "http://snomed.info/sct", Code: "22298006"}}, Text: "Myocardial infarction"}},
+		{Code: &models.CodeableConcept{Coding: []models.Coding{{System: "http://snomed.info/sct", Code: "44054006"}}, Text: "Diabetes"}},
+	}}
+	conditions := FamilyMemberConditions(history, "http://snomed.info/sct", "22298006")
+	c.Assert(conditions, HasLen, 1)
+	c.Assert(conditions[0].Code.Text, Equals, "Myocardial infarction")
+	c.Assert(FamilyMemberConditions(history, "http://snomed.info/sct", "38341003"), HasLen, 0)
+
+	e := Event{Type: "FamilyMemberHistory", Value: history}
+	h, ok := e.FamilyMemberHistory()
+	c.Assert(ok, Equals, true)
+	c.Assert(h, Equals, history)
+	_, ok = Event{Type: "Age", Value: 65}.FamilyMemberHistory()
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,67 @@
+package plugin
+
+import "github.com/intervention-engine/fhir/models"
+
+// RaceCodeSystem is the code system for the CDC Race & Ethnicity codes used by the US Core race extension
+const RaceCodeSystem = "urn:oid:2.16.840.1.113883.6.238"
+
+// The race codes for the OMB race categories
+const (
+	AmericanIndianOrAlaskaNative         = "1002-5"
+	Asian                                = "2028-9"
+	BlackOrAfricanAmerican               = "2054-5"
+	NativeHawaiianOrOtherPacificIslander = "2076-8"
+	White                                = "2106-3"
+)
+
+// raceExtensionURLs are the URLs the US Core race extension has gone by.  Later versions of the extension nest the
+// race codes in extensions of their own, which the FHIR models don't support, so only the race codes that are the
+// value of the extension itself are found.
+var raceExtensionURLs = []string{
+	"http://hl7.org/fhir/StructureDefinition/us-core-race",
+	"http://hl7.org/fhir/us/core/StructureDefinition/us-core-race",
+}
+
+// RaceCodes returns the race codes in the patient's US Core race extensions, or nil if the patient doesn't have
+// any.
+func RaceCodes(patient *models.Patient) []string {
+	if patient == nil {
+		return nil
+	}
+	var codes []string
+	for _, extension := range patient.Extension {
+		if !raceExtension(extension.Url) {
+			continue
+		}
+		if extension.ValueCoding != nil && extension.ValueCoding.System == RaceCodeSystem {
+			codes = append(codes, extension.ValueCoding.Code)
+		}
+		if extension.ValueCodeableConcept != nil {
+			for _, coding := range extension.ValueCodeableConcept.Coding {
+				if coding.System == RaceCodeSystem {
+					codes = append(codes, coding.Code)
+				}
+			}
+		}
+	}
+	return codes
+}
+
+// HasRace returns true if the patient's US Core race extensions include the race code
+func HasRace(patient *models.Patient, code string) bool {
+	for _, c := range RaceCodes(patient) {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func raceExtension(url string) bool {
+	for _, u := range raceExtensionURLs {
+		if url == u {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package plugin
+
+import (
+	"github.com/intervention-engine/fhir/models"
+	. "gopkg.in/check.v1"
+)
+
+type PatientSuite struct {
+}
+
+var _ = Suite(&PatientSuite{})
+
+func (p *PatientSuite) TestRaceCodes(c *C) {
+	patient := &models.Patient{}
+	c.Assert(RaceCodes(patient), HasLen, 0)
+	c.Assert(HasRace(patient, BlackOrAfricanAmerican), Equals, false)
+
+	patient.Extension = []models.Extension{
+		{
+			Url:                  "http://hl7.org/fhir/StructureDefinition/us-core-race",
+			ValueCodeableConcept: &models.CodeableConcept{Coding: []models.Coding{{System: RaceCodeSystem, Code: BlackOrAfricanAmerican}}},
+		},
+		{
+			Url:         "http://hl7.org/fhir/us/core/StructureDefinition/us-core-race",
+			ValueCoding: &models.Coding{System: RaceCodeSystem, Code: White},
+		},
+		// Not a race extension
+		{
+			Url:         "http://hl7.org/fhir/StructureDefinition/us-core-ethnicity",
+			ValueCoding: &models.Coding{System: RaceCodeSystem, Code: "2135-2"},
+		},
+	}
+	c.Assert(RaceCodes(patient), DeepEquals, []string{BlackOrAfricanAmerican, White})
+	c.Assert(HasRace(patient, BlackOrAfricanAmerican), Equals, true)
+	c.Assert(HasRace(patient, Asian), Equals, false)
+	c.Assert(RaceCodes(nil), HasLen, 0)
+}
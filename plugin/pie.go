@@ -17,12 +17,25 @@ type Pie struct {
 }
 
 // Slice represents a component that factors into the overall risk assessment
-// algorithm.  In the chart, it appears as a slice in the pie.
+// algorithm.  In the chart, it appears as a slice in the pie.  A Negative slice
+// is a component that lowers the score (e.g., a comorbidity with a negative
+// weight).  Its Value and MaxValue are still the magnitudes (from 0 to MaxValue),
+// so it can be drawn like any other slice, but it is subtracted from the total.
 type Slice struct {
 	Name     string `json:"name"`
 	Weight   int    `json:"weight"`
 	Value    int    `json:"value"`
 	MaxValue int    `json:"maxValue,omitempty"`
+	Negative bool   `json:"negative,omitempty"`
+}
+
+// SignedValue returns the slice's contribution to the total: its value, or the
+// negated value if it is a negative slice.
+func (s Slice) SignedValue() int {
+	if s.Negative {
+		return -s.Value
+	}
+	return s.Value
 }
 
 // NewPie constructs a new pie for the given patient, sets the Create time to
@@ -59,11 +72,12 @@ func (p *Pie) UpdateSliceValue(name string, value int) {
 	}
 }
 
-// TotalValues sums up all the values in the slices.
+// TotalValues sums up all the values in the slices, subtracting the values of
+// the negative slices.
 func (p *Pie) TotalValues() int {
 	total := 0
 	for i := range p.Slices {
-		total += p.Slices[i].Value
+		total += p.Slices[i].SignedValue()
 	}
 	return total
 }
@@ -33,6 +33,14 @@ func (p *PieSuite) TestTotalValues(c *C) {
 	c.Assert(p.Pie.TotalValues(), Equals, 4)
 }
 
+func (p *PieSuite) TestTotalValuesWithNegativeSlice(c *C) {
+	p.Pie.Slices = append(p.Pie.Slices, Slice{Name: "Kale", Weight: 25, MaxValue: 4, Value: 3, Negative: true})
+	c.Assert(p.Pie.Slices[2].SignedValue(), Equals, -3)
+	c.Assert(p.Pie.TotalValues(), Equals, 1)
+	p.Pie.UpdateSliceValue("Apple", 0)
+	c.Assert(p.Pie.TotalValues(), Equals, -2)
+}
+
 func (p *PieSuite) TestUpdateSliceValue(c *C) {
 	p.Pie.UpdateSliceValue("Apple", 5)
 	c.Assert(p.Pie.Slices, DeepEquals, []Slice{
@@ -21,25 +21,34 @@ type RiskServicePlugin interface {
 	Calculate(es *EventStream, fhirEndpointURL string) ([]RiskServiceCalculationResult, error)
 }
 
-// RiskServicePluginConfig represents key information about the risk service plugin.
+// RiskServicePluginConfig represents key information about the risk service plugin.  If the RequiredResourceTypes
+// include "Observation", RequiredObservationCodes may list the LOINC codes of the observations the plugin uses, so
+// that the risk service doesn't have to get every one of the patient's observations.  Leave it empty to get all of
+// them.  ResolvedConditions says whether the plugin still counts the patient's conditions once they have resolved; if
+// it does, the plugin doesn't get the end events for those conditions.
 type RiskServicePluginConfig struct {
-	Name                  string
-	Method                models.CodeableConcept
-	PredictedOutcome      models.CodeableConcept
-	DefaultPieSlices      []Slice
-	RequiredResourceTypes []string
-	SignificantBirthdays  []int
+	Name                     string
+	Method                   models.CodeableConcept
+	PredictedOutcome         models.CodeableConcept
+	DefaultPieSlices         []Slice
+	RequiredResourceTypes    []string
+	RequiredObservationCodes []string
+	SignificantBirthdays     []int
+	ResolvedConditions       ResolvedConditionPolicy
 }
 
 // RiskServiceCalculationResult represents risk assessment info for a given point
 // in time.  The Score indicates a raw score from the algorithm (if applicable),
 // while the ProbabilityDecimal represents a percentage probability of the predicted
-// outcome.  Since it is a percentage, the value should never exceed 100.
+// outcome.  Since it is a percentage, the value should never exceed 100.  Approximate indicates that the AsOf date
+// is only approximately known, because the event that changed the risk has a date with only a year or month (see
+// Event.Approximate).
 type RiskServiceCalculationResult struct {
 	AsOf               time.Time
 	Score              *int
 	ProbabilityDecimal *float64
 	Pie                *Pie
+	Approximate        bool
 }
 
 // GetProbabilityDecimalOrScore returns the ProbabilityDecimal value if it exists, otherwise it returns the score.
@@ -54,8 +63,15 @@ func (r *RiskServiceCalculationResult) GetProbabilityDecimalOrScore() *float64 {
 	return nil
 }
 
+// ApproximateRationale is the rationale given in the prediction of a risk assessment with an approximate date
+const ApproximateRationale = "Date is approximate"
+
 // ToRiskAssessment converts the RiskServiceCalculationResult to a FHIR RiskAssessment.
 func (r *RiskServiceCalculationResult) ToRiskAssessment(patientId string, basisPieURL string, config RiskServicePluginConfig) *models.RiskAssessment {
+	var rationale string
+	if r.Approximate {
+		rationale = ApproximateRationale
+	}
 	return &models.RiskAssessment{
 		Subject: &models.Reference{Reference: "Patient/" + patientId},
 		Method:  &config.Method,
@@ -64,6 +80,7 @@ func (r *RiskServiceCalculationResult) ToRiskAssessment(patientId string, basisP
 			{
 				ProbabilityDecimal: r.GetProbabilityDecimalOrScore(),
 				Outcome:            &config.PredictedOutcome,
+				Rationale:          rationale,
 			},
 		},
 		Basis: []models.Reference{
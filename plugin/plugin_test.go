@@ -84,6 +84,12 @@ func (p *PluginSuite) TestToRiskAssessment(c *C) {
 	ra = result.ToRiskAssessment("abc", "http://foo.org/pie", myConfig)
 	expected.Prediction[0].ProbabilityDecimal = ptrToFlt(float64(123))
 	c.Assert(ra, DeepEquals, expected)
+
+	// An approximate result says so in the prediction's rationale
+	result.Approximate = true
+	ra = result.ToRiskAssessment("abc", "http://foo.org/pie", myConfig)
+	expected.Prediction[0].Rationale = ApproximateRationale
+	c.Assert(ra, DeepEquals, expected)
 }
 
 func (p *PluginSuite) TestSortByAsOf(c *C) {
@@ -0,0 +1,233 @@
+package plugin
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// CodeSet is a set of codes, such as a value set, that the event stream queries can look for.
+type CodeSet interface {
+	Contains(system, code string) bool
+}
+
+// Codes is a CodeSet that lists the codes in each code system, e.g., Codes{"http://loinc.org": {"2160-0"}}.
+type Codes map[string][]string
+
+// Contains returns true if the code is listed for the code system.
+func (c Codes) Contains(system, code string) bool {
+	for _, listed := range c[system] {
+		if listed == code {
+			return true
+		}
+	}
+	return false
+}
+
+// CodePrefixes is a CodeSet that contains the codes starting with any of the prefixes listed for their code system,
+// which suits hierarchical code systems like ICD-9 (e.g., "428" for every heart failure code).
+type CodePrefixes map[string][]string
+
+// Contains returns true if the code starts with one of the prefixes listed for the code system.
+func (c CodePrefixes) Contains(system, code string) bool {
+	for _, prefix := range c[system] {
+		if strings.HasPrefix(code, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsConcept returns true if any of the concept's codings are in the code set.
+func ContainsConcept(codes CodeSet, concept *models.CodeableConcept) bool {
+	if concept == nil {
+		return false
+	}
+	for _, coding := range concept.Coding {
+		if codes.Contains(coding.System, coding.Code) {
+			return true
+		}
+	}
+	return false
+}
+
+// Occurrence is the span of time during which a resource in the event stream was in effect, from its start event to
+// its end event.  End is the zero time if there is no end event (i.e., it is ongoing).
+type Occurrence struct {
+	Start Event
+	End   time.Time
+}
+
+// ActiveAt returns true if the occurrence had started by the given time and not yet ended.
+func (o *Occurrence) ActiveAt(t time.Time) bool {
+	return !o.Start.Date.After(t) && (o.End.IsZero() || o.End.After(t))
+}
+
+// eventIndex pairs up the start and end events in an event stream and groups the resulting occurrences by event
+// type (and observations by LOINC code), each sorted by start date.  A query only looks at the occurrences of the
+// type it's asking about, and finds the ones that started by a given time with a binary search, but then scans them
+// in order; it isn't an interval tree, so a query at the end of a long history still scans all of that type.
+type eventIndex struct {
+	events       []Event
+	byType       map[string][]*Occurrence
+	observations map[string][]*Occurrence
+}
+
+func newEventIndex(events []Event) *eventIndex {
+	idx := &eventIndex{
+		events:       append([]Event(nil), events...),
+		byType:       make(map[string][]*Occurrence),
+		observations: make(map[string][]*Occurrence),
+	}
+	open := make(map[interface{}]*Occurrence)
+	for _, e := range events {
+		// Only values that can be map keys (e.g., resource pointers) can be paired with their end events
+		comparable := e.Value != nil && reflect.TypeOf(e.Value).Comparable()
+		if e.End {
+			if comparable {
+				if o := open[e.Value]; o != nil {
+					o.End = e.Date
+					delete(open, e.Value)
+				}
+			}
+			continue
+		}
+		o := &Occurrence{Start: e}
+		if comparable {
+			open[e.Value] = o
+		}
+		idx.byType[e.Type] = append(idx.byType[e.Type], o)
+		if obs, ok := e.Observation(); ok && obs.Code != nil {
+			for _, coding := range obs.Code.Coding {
+				if strings.TrimSuffix(coding.System, "/") == LOINCSystem {
+					idx.observations[coding.Code] = append(idx.observations[coding.Code], o)
+				}
+			}
+		}
+	}
+	return idx
+}
+
+// startedBy returns the occurrences that started at or before the given time.
+func startedBy(occurrences []*Occurrence, t time.Time) []*Occurrence {
+	n := sort.Search(len(occurrences), func(i int) bool { return occurrences[i].Start.Date.After(t) })
+	return occurrences[:n]
+}
+
+// indexed returns the event stream's index, building it first if there isn't one yet or the events have changed
+// since it was built.  Events are added, removed, replaced and sorted directly on es.Events, so the index keeps a
+// copy of the events it was built from and compares them on every query, which is much cheaper than rebuilding it.
+// The resources the events point to aren't copied, so changing a resource (e.g., an observation's code) in place
+// isn't noticed.
+func (es *EventStream) indexed() *eventIndex {
+	if es.index == nil || !sameEvents(es.index.events, es.Events) {
+		es.index = newEventIndex(es.Events)
+	}
+	return es.index
+}
+
+// sameEvents returns true if the two lists have the same events in the same order.
+func sameEvents(a, b []Event) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameEvent(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameEvent returns true if the events are the same.  Values that can't be compared with == (e.g., slices) are
+// compared deeply.
+func sameEvent(a, b Event) bool {
+	if !a.Date.Equal(b.Date) || a.Type != b.Type || a.End != b.End || a.Precision != b.Precision {
+		return false
+	}
+	if a.Value == nil || b.Value == nil || reflect.TypeOf(a.Value) != reflect.TypeOf(b.Value) {
+		return a.Value == nil && b.Value == nil
+	}
+	if reflect.TypeOf(a.Value).Comparable() {
+		return a.Value == b.Value
+	}
+	return reflect.DeepEqual(a.Value, b.Value)
+}
+
+// Occurrences returns the occurrences of the given event type, sorted by start date.  The events must already be
+// sorted.
+func (es *EventStream) Occurrences(eventType string) []*Occurrence {
+	return es.indexed().byType[eventType]
+}
+
+// ActiveAt returns the occurrences of the given event type that were active at the given time.
+func (es *EventStream) ActiveAt(eventType string, t time.Time) []*Occurrence {
+	var active []*Occurrence
+	for _, o := range startedBy(es.Occurrences(eventType), t) {
+		if o.ActiveAt(t) {
+			active = append(active, o)
+		}
+	}
+	return active
+}
+
+// ActiveConditionsAt returns the patient's conditions that had started by the given time and not yet ended.
+func (es *EventStream) ActiveConditionsAt(t time.Time) []*models.Condition {
+	var conditions []*models.Condition
+	for _, o := range es.ActiveAt("Condition", t) {
+		if c, ok := o.Start.Value.(*models.Condition); ok {
+			conditions = append(conditions, c)
+		}
+	}
+	return conditions
+}
+
+// LatestObservation returns the event for the patient's most recent observation with the given LOINC code as of the
+// given time.  It returns false if there isn't one.
+func (es *EventStream) LatestObservation(loincCode string, asOf time.Time) (Event, bool) {
+	observations := startedBy(es.indexed().observations[loincCode], asOf)
+	if len(observations) == 0 {
+		return Event{}, false
+	}
+	return observations[len(observations)-1].Start, true
+}
+
+// CountEncounters returns the number of the patient's encounters of the given class (see EncounterClass) that
+// started in the window from the first time up to, but not including, the second.  An empty class counts every
+// encounter.
+func (es *EventStream) CountEncounters(class string, from, to time.Time) int {
+	var count int
+	for _, o := range startedBy(es.Occurrences("Encounter"), to) {
+		if o.Start.Date.Before(from) || !o.Start.Date.Before(to) {
+			continue
+		}
+		if enc, ok := o.Start.Value.(*models.Encounter); ok && (class == "" || EncounterClass(enc) == class) {
+			count++
+		}
+	}
+	return count
+}
+
+// EverHad returns true if the patient has ever had a condition with a code in the code set, resolved or not.
+func (es *EventStream) EverHad(codes CodeSet) bool {
+	return anyCondition(codes, es.Occurrences("Condition"))
+}
+
+// HadBy returns true if the patient had a condition with a code in the code set at or before the given time,
+// resolved or not.
+func (es *EventStream) HadBy(codes CodeSet, t time.Time) bool {
+	return anyCondition(codes, startedBy(es.Occurrences("Condition"), t))
+}
+
+// anyCondition returns true if any of the occurrences is of a condition with a code in the code set.
+func anyCondition(codes CodeSet, occurrences []*Occurrence) bool {
+	for _, o := range occurrences {
+		if c, ok := o.Start.Value.(*models.Condition); ok && ContainsConcept(codes, c.Code) {
+			return true
+		}
+	}
+	return false
+}
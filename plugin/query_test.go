@@ -0,0 +1,148 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	. "gopkg.in/check.v1"
+)
+
+type QuerySuite struct {
+	es          *EventStream
+	afib        *models.Condition
+	pneumonia   *models.Condition
+	creatinine1 *models.Observation
+	creatinine2 *models.Observation
+}
+
+var _ = Suite(&QuerySuite{})
+
+func (q *QuerySuite) SetUpTest(c *C) {
+	q.afib = queryCondition("427.31")
+	q.pneumonia = queryCondition("486")
+	q.creatinine1 = queryObservation("2160-0")
+	q.creatinine2 = queryObservation("2160-0")
+	q.es = NewEventStream(&models.Patient{})
+	q.es.Events = []Event{
+		{Date: day(2015, time.January, 1), Type: "Condition", Value: q.afib},
+		{Date: day(2015, time.February, 1), Type: "Encounter", Value: &models.Encounter{Class: "inpatient"}},
+		{Date: day(2015, time.February, 1), Type: "Condition", Value: q.pneumonia},
+		{Date: day(2015, time.February, 2), Type: "Observation", Value: q.creatinine1},
+		{Date: day(2015, time.February, 10), Type: "Condition", End: true, Value: q.pneumonia},
+		{Date: day(2015, time.March, 1), Type: "Encounter", Value: &models.Encounter{Class: "ambulatory"}},
+		{Date: day(2015, time.April, 1), Type: "Observation", Value: q.creatinine2},
+		{Date: day(2015, time.May, 1), Type: "Encounter", Value: &models.Encounter{Class: "emergency"}},
+	}
+}
+
+func (q *QuerySuite) TestCodeSets(c *C) {
+	codes := Codes{"http://hl7.org/fhir/sid/icd-9": {"427.31", "428.0"}}
+	c.Assert(codes.Contains("http://hl7.org/fhir/sid/icd-9", "428.0"), Equals, true)
+	c.Assert(codes.Contains("http://hl7.org/fhir/sid/icd-9", "428.1"), Equals, false)
+	c.Assert(codes.Contains("http://snomed.info/sct", "428.0"), Equals, false)
+
+	prefixes := CodePrefixes{"http://hl7.org/fhir/sid/icd-9": {"428"}}
+	c.Assert(prefixes.Contains("http://hl7.org/fhir/sid/icd-9", "428.1"), Equals, true)
+	c.Assert(prefixes.Contains("http://hl7.org/fhir/sid/icd-9", "427.31"), Equals, false)
+
+	c.Assert(ContainsConcept(codes, q.afib.Code), Equals, true)
+	c.Assert(ContainsConcept(prefixes, q.afib.Code), Equals, false)
+	c.Assert(ContainsConcept(codes, nil), Equals, false)
+}
+
+func (q *QuerySuite) TestOccurrences(c *C) {
+	conditions := q.es.Occurrences("Condition")
+	c.Assert(conditions, HasLen, 2)
+	c.Assert(conditions[0].Start.Value, Equals, q.afib)
+	c.Assert(conditions[0].End.IsZero(), Equals, true)
+	c.Assert(conditions[1].Start.Value, Equals, q.pneumonia)
+	c.Assert(conditions[1].End, Equals, day(2015, time.February, 10))
+	c.Assert(q.es.Occurrences("Procedure"), HasLen, 0)
+}
+
+func (q *QuerySuite) TestActiveConditionsAt(c *C) {
+	c.Assert(q.es.ActiveConditionsAt(day(2014, time.December, 31)), HasLen, 0)
+	c.Assert(q.es.ActiveConditionsAt(day(2015, time.January, 1)), DeepEquals, []*models.Condition{q.afib})
+	c.Assert(q.es.ActiveConditionsAt(day(2015, time.February, 5)), DeepEquals, []*models.Condition{q.afib, q.pneumonia})
+	// The end date is exclusive
+	c.Assert(q.es.ActiveConditionsAt(day(2015, time.February, 10)), DeepEquals, []*models.Condition{q.afib})
+}
+
+func (q *QuerySuite) TestLatestObservation(c *C) {
+	_, ok := q.es.LatestObservation("2160-0", day(2015, time.February, 1))
+	c.Assert(ok, Equals, false)
+	e, ok := q.es.LatestObservation("2160-0", day(2015, time.March, 31))
+	c.Assert(ok, Equals, true)
+	c.Assert(e.Value, Equals, q.creatinine1)
+	e, ok = q.es.LatestObservation("2160-0", day(2015, time.April, 1))
+	c.Assert(ok, Equals, true)
+	c.Assert(e.Value, Equals, q.creatinine2)
+	_, ok = q.es.LatestObservation("718-7", day(2016, time.January, 1))
+	c.Assert(ok, Equals, false)
+}
+
+func (q *QuerySuite) TestCountEncounters(c *C) {
+	c.Assert(q.es.CountEncounters("", day(2015, time.January, 1), day(2016, time.January, 1)), Equals, 3)
+	c.Assert(q.es.CountEncounters(InpatientEncounter, day(2015, time.January, 1), day(2016, time.January, 1)), Equals, 1)
+	// The window includes its start but not its end
+	c.Assert(q.es.CountEncounters("", day(2015, time.March, 1), day(2015, time.May, 1)), Equals, 1)
+}
+
+func (q *QuerySuite) TestEverHad(c *C) {
+	c.Assert(q.es.EverHad(CodePrefixes{"http://hl7.org/fhir/sid/icd-9": {"48"}}), Equals, true)
+	c.Assert(q.es.EverHad(Codes{"http://hl7.org/fhir/sid/icd-9": {"428.0"}}), Equals, false)
+	c.Assert(q.es.HadBy(Codes{"http://hl7.org/fhir/sid/icd-9": {"486"}}, day(2015, time.January, 31)), Equals, false)
+	c.Assert(q.es.HadBy(Codes{"http://hl7.org/fhir/sid/icd-9": {"486"}}, day(2015, time.February, 1)), Equals, true)
+}
+
+func (q *QuerySuite) TestIndexIsRebuilt(c *C) {
+	c.Assert(q.es.Occurrences("Procedure"), HasLen, 0)
+
+	// Adding events is noticed automatically
+	q.es.Events = append(q.es.Events, Event{Date: day(2015, time.June, 1), Type: "Procedure", Value: &models.Procedure{}})
+	c.Assert(q.es.Occurrences("Procedure"), HasLen, 1)
+
+	// So are changes to events in place
+	q.es.Events[len(q.es.Events)-1].Type = "Immunization"
+	c.Assert(q.es.Occurrences("Immunization"), HasLen, 1)
+	c.Assert(q.es.Occurrences("Procedure"), HasLen, 0)
+
+	// And replacing the events with the same number of others
+	procedure := &models.Procedure{}
+	events := make([]Event, len(q.es.Events))
+	copy(events, q.es.Events)
+	events[len(events)-1] = Event{Date: day(2015, time.June, 1), Type: "Procedure", Value: procedure}
+	q.es.Events = events
+	c.Assert(q.es.Occurrences("Immunization"), HasLen, 0)
+	c.Assert(q.es.Occurrences("Procedure"), HasLen, 1)
+
+	// Or removing one event and adding another, and sorting them
+	q.es.Events = append(q.es.Events[:len(q.es.Events)-1], Event{Date: day(2014, time.June, 1), Type: "Procedure", Value: procedure})
+	SortEventsByDate(q.es.Events)
+	occurrences := q.es.Occurrences("Procedure")
+	c.Assert(occurrences, HasLen, 1)
+	c.Assert(occurrences[0].Start.Date, Equals, day(2014, time.June, 1))
+
+	// As is ending an occurrence
+	q.es.Events = append(q.es.Events, Event{Date: day(2014, time.July, 1), Type: "Procedure", End: true, Value: procedure})
+	SortEventsByDate(q.es.Events)
+	c.Assert(q.es.ActiveAt("Procedure", day(2014, time.December, 1)), HasLen, 0)
+}
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func queryCondition(icd9 string) *models.Condition {
+	return &models.Condition{
+		Code:               &models.CodeableConcept{Coding: []models.Coding{{System: "http://hl7.org/fhir/sid/icd-9", Code: icd9}}},
+		VerificationStatus: "confirmed",
+	}
+}
+
+func queryObservation(loinc string) *models.Observation {
+	return &models.Observation{
+		Code:   &models.CodeableConcept{Coding: []models.Coding{{System: LOINCSystem, Code: loinc}}},
+		Status: "final",
+	}
+}
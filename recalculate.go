@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/intervention-engine/riskservice/server"
+	"github.com/intervention-engine/riskservice/service"
+	"github.com/intervention-engine/riskservice/terminology"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// runRecalculate implements the "recalculate" subcommand, which recalculates the risks for every patient on a FHIR
+// server, e.g.:
+//
+//	riskservice recalculate --fhirEndpointUrl http://localhost:3001
+//
+// The calculations go through the same calculation queue as the server's, so they don't overlap the server's
+// calculations for the same patients (and this command's workers also pick up the server's pending jobs).  Running
+// jobs are leased to the process running them, so neither takes over the other's calculations while it's alive.  Progress
+// is stored in the database.  If the recalculation is interrupted (e.g., with Ctrl-C), it can be picked up where it
+// left off by passing its ID to --resume.
+func runRecalculate(args []string) int {
+	config := server.DefaultRecalculationConfig()
+	flags := flag.NewFlagSet("recalculate", flag.ExitOnError)
+	fhirEndpointURL := flags.String("fhirEndpointUrl", "", "FHIR server whose patients should be recalculated")
+	resume := flags.String("resume", "", "ID of an interrupted recalculation to resume")
+	pieURL := flags.String("pieURL", "", "Base URL used to reference pies from risk assessments (defaults to this host's pies URL)")
+	resultsWebhook := flags.String("resultsWebhook", "", "Also post every plugin's results as JSON to the specified URL")
+	resultsFile := flags.String("resultsFile", "", "Also append every plugin's results as NDJSON to the specified file")
+	undated := flags.String("undated", string(service.DropUndated), "What to do with conditions, medication statements and observations that have no usable date: drop, birth (present since birth) or lastUpdated.  Other undated resources are always dropped")
+	centerApproximateDates := flags.Bool("centerApproximateDates", false, "Place events whose dates are only known to the year or month in the middle of the year or month instead of at its start")
+	terminologyDir := flags.String("terminology", "", "Directory of FHIR ValueSet and ConceptMap JSON files to use in addition to (or instead of) the built-in value sets")
+	maxDataPages := flags.Int("maxDataPages", service.DefaultMaxPages, "Maximum number of pages of data to retrieve for each patient (0 for no limit)")
+	flags.IntVar(&config.PageSize, "pageSize", config.PageSize, "Number of patients to request from the FHIR server at a time")
+	flags.IntVar(&config.Concurrency, "concurrency", config.Concurrency, "Maximum number of patients to queue and calculate at the same time")
+	flags.Parse(args)
+
+	if (*fhirEndpointURL == "") == (*resume == "") {
+		log.Println("Exactly one of -fhirEndpointUrl or -resume is required")
+		return 2
+	}
+	if *resume != "" && !bson.IsObjectIdHex(*resume) {
+		log.Println("Bad ID format for -resume. Should be a BSON Id")
+		return 2
+	}
+	policy, err := service.ParseUndatedPolicy(*undated)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	if *terminologyDir != "" {
+		if err := terminology.Default.Load(*terminologyDir); err != nil {
+			log.Println(err)
+			return 2
+		}
+	}
+	if *pieURL == "" {
+		*pieURL = discoverSelf() + "pies"
+	}
+
+	session, err := mgo.Dial(mongoHost())
+	if err != nil {
+		log.Println("Can't connect to the database")
+		return 1
+	}
+	defer session.Close()
+
+	db := session.DB("riskservice")
+	svc := service.NewReferenceRiskService(db)
+	svc.SetMaxDataPages(*maxDataPages)
+	svc.SetUndatedPolicy(policy)
+	svc.SetCenterApproximateDates(*centerApproximateDates)
+	for _, p := range allPlugins() {
+		svc.RegisterPlugin(p)
+	}
+	sink, closeSink, err := newResultSink(db, *resultsWebhook, *resultsFile)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer closeSink()
+	svc.UseResultSink(sink)
+	queueConfig := server.DefaultQueueConfig()
+	queueConfig.Workers = config.Concurrency
+	queue := server.NewCalculationQueue(db, svc, queueConfig)
+	if err := queue.Start(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer queue.Stop()
+	recalculator := server.NewRecalculator(db, queue, config)
+
+	var id bson.ObjectId
+	if *resume != "" {
+		id = bson.ObjectIdHex(*resume)
+	} else {
+		rc, err := recalculator.Create(*fhirEndpointURL, *pieURL)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		id = rc.Id
+	}
+	log.Printf("Running recalculation %s", id.Hex())
+
+	// Interrupt the recalculation cleanly so that it can be resumed
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		log.Printf("Interrupting recalculation.  Resume it with: -resume %s", id.Hex())
+		recalculator.Stop()
+	}()
+
+	rc, err := recalculator.Run(id)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	log.Printf("Recalculation %s %s: %d done, %d failed, %d total", rc.Id.Hex(), rc.Status, rc.Done, rc.Failed, rc.Total)
+	if rc.Status != server.RecalculationCompleted || rc.Failed > 0 {
+		return 1
+	}
+	return 0
+}
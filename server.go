@@ -6,27 +6,45 @@ import (
 	"log"
 	"net"
 	"os"
-	"time"
 
 	"github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/fhir/upload"
-	"github.com/intervention-engine/riskservice/assessments"
 	"github.com/intervention-engine/riskservice/server"
 	"github.com/intervention-engine/riskservice/service"
+	"github.com/intervention-engine/riskservice/terminology"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"gopkg.in/mgo.v2"
 )
 
 func main() {
-	// Check for a linked MongoDB container if we are running in Docker
-	mongoHost := os.Getenv("MONGO_PORT_27017_TCP_ADDR")
-	if mongoHost == "" {
-		mongoHost = "localhost"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "calc":
+			os.Exit(runCalc(os.Args[2:]))
+		case "recalculate":
+			os.Exit(runRecalculate(os.Args[2:]))
+		}
 	}
+
 	registerURL := flag.String("registerURL", "", "Register a FHIR Subscription to the specified URL")
 	registerENV := flag.String("registerENV", "", "Register a FHIR Subscription to the the Docker environment variable IE_PORT_3001_TCP*")
+	resultsWebhook := flag.String("resultsWebhook", "", "Also post every plugin's results as JSON to the specified URL")
+	resultsFile := flag.String("resultsFile", "", "Also append every plugin's results as NDJSON to the specified file")
+	undated := flag.String("undated", string(service.DropUndated), "What to do with resources that have no usable date: drop, birth (present since birth) or lastUpdated")
+	centerApproximateDates := flag.Bool("centerApproximateDates", false, "Place events whose dates are only known to the year or month in the middle of the year or month instead of at its start")
+	terminologyDir := flag.String("terminology", "", "Directory of FHIR ValueSet and ConceptMap JSON files to use in addition to (or instead of) the built-in value sets")
+	maxDataPages := flag.Int("maxDataPages", service.DefaultMaxPages, "Maximum number of pages of data to retrieve for each patient (0 for no limit)")
 	flag.Parse()
+	policy, err := service.ParseUndatedPolicy(*undated)
+	if err != nil {
+		panic(err)
+	}
+	if *terminologyDir != "" {
+		if err := terminology.Default.Load(*terminologyDir); err != nil {
+			panic(err)
+		}
+	}
 	parsedURL := *registerURL
 	if parsedURL != "" {
 		registerServer(parsedURL)
@@ -36,7 +54,7 @@ func main() {
 	}
 
 	e := echo.New()
-	session, err := mgo.Dial(mongoHost)
+	session, err := mgo.Dial(mongoHost())
 	if err != nil {
 		panic("Can't connect to the database")
 	}
@@ -45,14 +63,61 @@ func main() {
 	basePieURL := discoverSelf() + "pies"
 	db := session.DB("riskservice")
 	svc := service.NewReferenceRiskService(db)
-	svc.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
-	svc.RegisterPlugin(assessments.NewSimplePlugin())
-	fnDelayer := server.NewFunctionDelayer(3 * time.Second)
-	server.RegisterRoutes(e, db, basePieURL, svc, fnDelayer)
+	svc.SetMaxDataPages(*maxDataPages)
+	svc.SetUndatedPolicy(policy)
+	svc.SetCenterApproximateDates(*centerApproximateDates)
+	for _, p := range allPlugins() {
+		svc.RegisterPlugin(p)
+	}
+	sink, closeSink, err := newResultSink(db, *resultsWebhook, *resultsFile)
+	if err != nil {
+		panic("Can't open the results file")
+	}
+	defer closeSink()
+	svc.UseResultSink(sink)
+	queue := server.NewCalculationQueue(db, svc, server.DefaultQueueConfig())
+	if err := queue.Start(); err != nil {
+		panic("Can't start the calculation queue")
+	}
+	defer queue.Stop()
+	recalculator := server.NewRecalculator(db, queue, server.DefaultRecalculationConfig())
+	if err := recalculator.Start(); err != nil {
+		panic("Can't start the recalculator")
+	}
+	defer recalculator.Stop()
+	server.RegisterRoutes(e, db, basePieURL, svc, queue, recalculator)
 	e.Use(middleware.Logger())
 	e.Run(":9000")
 }
 
+// newResultSink returns a sink that writes results to the FHIR server and pies to the database, and then to the
+// webhook and file (if they are not empty).  The returned function closes the file.
+func newResultSink(db *mgo.Database, webhookURL, filePath string) (service.MultiSink, func(), error) {
+	sink := service.DefaultResultSink(db)
+	if webhookURL != "" {
+		sink = append(sink, service.NewWebhookSink(webhookURL))
+	}
+	closeSink := func() {}
+	if filePath != "" {
+		f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		sink = append(sink, service.NewNDJSONSink(f))
+		closeSink = func() { f.Close() }
+	}
+	return sink, closeSink, nil
+}
+
+// mongoHost returns the host of the MongoDB server, checking for a linked MongoDB container if we are running in
+// Docker.
+func mongoHost() string {
+	if host := os.Getenv("MONGO_PORT_27017_TCP_ADDR"); host != "" {
+		return host
+	}
+	return "localhost"
+}
+
 func discoverSelf() string {
 	var ip net.IP
 	var selfURL string
@@ -0,0 +1,416 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/riskservice/service"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The states that a CalculationJob moves through.  A job starts out debouncing, and each new request for the same
+// patient and FHIR endpoint pushes its run time back.  Once a worker picks it up, it is running, and leased to the
+// worker's queue until the calculation is done.  If the calculation fails (or the lease expires because the queue
+// stopped renewing it), it goes back to retrying (with backoff) until it runs out of attempts, at which point it is
+// dead-lettered as failed.
+const (
+	JobDebouncing = "debouncing"
+	JobRetrying   = "retrying"
+	JobRunning    = "running"
+	JobSucceeded  = "succeeded"
+	JobFailed     = "failed"
+)
+
+// CalculationJob represents a persisted request to calculate the risk scores for a patient.
+type CalculationJob struct {
+	Id              bson.ObjectId               `bson:"_id" json:"id"`
+	Key             string                      `bson:"key" json:"key"`
+	PatientID       string                      `bson:"patientId" json:"patientId"`
+	FHIREndpointURL string                      `bson:"fhirEndpointUrl" json:"fhirEndpointUrl"`
+	BasisPieURL     string                      `bson:"basisPieUrl" json:"basisPieUrl"`
+	Status          string                      `bson:"status" json:"status"`
+	Attempts        int                         `bson:"attempts" json:"attempts"`
+	LastError       string                      `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	Outcome         *service.CalculationOutcome `bson:"outcome,omitempty" json:"outcome,omitempty"`
+	RunAt           time.Time                   `bson:"runAt" json:"runAt"`
+	Created         time.Time                   `bson:"created" json:"created"`
+	Updated         time.Time                   `bson:"updated" json:"updated"`
+	Started         *time.Time                  `bson:"started,omitempty" json:"started,omitempty"`
+	Finished        *time.Time                  `bson:"finished,omitempty" json:"finished,omitempty"`
+	// Owner identifies the queue that claimed the job, and LeaseExpires is when another queue may take it over if
+	// the owner hasn't renewed the lease by then
+	Owner        string     `bson:"owner,omitempty" json:"owner,omitempty"`
+	LeaseExpires *time.Time `bson:"leaseExpires,omitempty" json:"leaseExpires,omitempty"`
+	// PendingKey is the job's key while it is debouncing.  It has a unique index, so no matter how many processes
+	// are enqueuing calculations, there is only ever one debouncing job per key.
+	PendingKey string `bson:"pendingKey,omitempty" json:"-"`
+}
+
+// JobKey returns the key used to debounce calculation requests for the same patient on the same FHIR server.
+func JobKey(patientID, fhirEndpointURL string) string {
+	return fmt.Sprintf("%s@%s", patientID, fhirEndpointURL)
+}
+
+// QueueConfig contains the settings that control debouncing, concurrency, and retries in a CalculationQueue.
+type QueueConfig struct {
+	// Debounce is how long to wait after the most recent request for a patient before calculating
+	Debounce time.Duration
+	// PollInterval is how long an idle worker waits before checking for due jobs again
+	PollInterval time.Duration
+	// Workers is the maximum number of calculations that run at the same time
+	Workers int
+	// MaxAttempts is the number of times a job is tried before it is dead-lettered
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry.  It doubles on each subsequent retry.
+	RetryBackoff time.Duration
+	// MaxRetryBackoff caps the delay between retries
+	MaxRetryBackoff time.Duration
+	// Lease is how long a running job is reserved for the queue that claimed it.  The queue renews the lease while
+	// the calculation runs, so it only expires if the queue's process stops (e.g., it crashes).
+	Lease time.Duration
+}
+
+// DefaultQueueConfig returns the configuration used by the risk service server.
+func DefaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		Debounce:        3 * time.Second,
+		PollInterval:    500 * time.Millisecond,
+		Workers:         4,
+		MaxAttempts:     5,
+		RetryBackoff:    10 * time.Second,
+		MaxRetryBackoff: 10 * time.Minute,
+		Lease:           time.Minute,
+	}
+}
+
+// CalculationQueue is a persistent, MongoDB-backed queue of calculation jobs.  It debounces requests for the same
+// patient and FHIR endpoint, so a burst of notifications about a patient results in a single calculation.  For
+// example, with a debounce of 3 seconds, a request for "foo" followed by another request for "foo" 2 seconds later
+// results in one calculation, 3 seconds after the second request.  Pending jobs are stored in the database, so they
+// survive restarts.  Jobs are processed by a bounded pool of workers, retried with exponential backoff when the
+// calculation fails, and dead-lettered (marked as failed) when they run out of attempts.  More than one process can
+// work on the same queue (e.g., the server and the recalculate command): each claimed job is leased to the queue
+// that claimed it, and a patient's jobs never run in two places at once.
+type CalculationQueue struct {
+	sync.Mutex
+	db      *mgo.Database
+	service service.RiskService
+	config  QueueConfig
+	owner   string
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewCalculationQueue creates a new CalculationQueue, stored in the "calculationjobs" collection of the passed in
+// database, which invokes the passed in risk service to do the calculations.  The queue does not process any jobs
+// until Start is called.
+func NewCalculationQueue(db *mgo.Database, svc service.RiskService, config QueueConfig) *CalculationQueue {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = 1
+	}
+	if config.Lease <= 0 {
+		config.Lease = DefaultQueueConfig().Lease
+	}
+	host, _ := os.Hostname()
+	return &CalculationQueue{
+		db:      db,
+		service: svc,
+		config:  config,
+		owner:   fmt.Sprintf("%s/%d/%s", host, os.Getpid(), bson.NewObjectId().Hex()),
+	}
+}
+
+// Enqueue schedules a calculation for the given patient after the queue's debounce period.  If a calculation for
+// the same patient and FHIR endpoint is already debouncing, its timer is reset rather than scheduling another job.
+// If one is waiting to be retried, it is shared as is, keeping its attempts and backoff, since it will get the
+// latest data when it runs.  A job that is already running is left alone, so a new job is scheduled to pick up the
+// latest data.
+func (q *CalculationQueue) Enqueue(patientID, fhirEndpointURL, basisPieURL string) (*CalculationJob, error) {
+	return q.enqueue(patientID, fhirEndpointURL, basisPieURL, q.config.Debounce)
+}
+
+// enqueue schedules a calculation for the given patient after the delay, sharing a job that is already waiting to
+// run for the same patient and FHIR endpoint.
+func (q *CalculationQueue) enqueue(patientID, fhirEndpointURL, basisPieURL string, delay time.Duration) (*CalculationJob, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now()
+	key := JobKey(patientID, fhirEndpointURL)
+	c := q.db.C("calculationjobs")
+	job := new(CalculationJob)
+
+	// Resetting a retrying job would cancel its backoff, and a patient whose calculation keeps failing would never
+	// be dead-lettered as long as notifications about them kept coming
+	_, err := c.Find(bson.M{"key": key, "status": JobRetrying}).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"basisPieUrl": basisPieURL, "updated": now}},
+		ReturnNew: true,
+	}, job)
+	if err == nil {
+		return job, nil
+	} else if err != mgo.ErrNotFound {
+		return nil, err
+	}
+
+	debounce := func() error {
+		_, err := c.Find(bson.M{"key": key, "status": JobDebouncing}).Apply(mgo.Change{
+			Update: bson.M{
+				"$set": bson.M{
+					"basisPieUrl": basisPieURL,
+					"runAt":       now.Add(delay),
+					"updated":     now,
+				},
+				"$setOnInsert": bson.M{
+					"patientId":       patientID,
+					"fhirEndpointUrl": fhirEndpointURL,
+					"pendingKey":      key,
+					"attempts":        0,
+					"created":         now,
+				},
+			},
+			Upsert:    true,
+			ReturnNew: true,
+		}, job)
+		return err
+	}
+	// If another process inserted the debouncing job first, the second try resets its timer instead
+	if err = debounce(); mgo.IsDup(err) {
+		err = debounce()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Job returns the job with the given ID.  If there is no such job, it returns mgo.ErrNotFound.
+func (q *CalculationQueue) Job(id bson.ObjectId) (*CalculationJob, error) {
+	job := new(CalculationJob)
+	if err := q.db.C("calculationjobs").FindId(id).One(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// PatientJobs returns the jobs for the given patient, most recent first.  If fhirEndpointURL is not empty, only
+// the jobs for that FHIR endpoint are returned.
+func (q *CalculationQueue) PatientJobs(patientID, fhirEndpointURL string) ([]CalculationJob, error) {
+	query := bson.M{"patientId": patientID}
+	if fhirEndpointURL != "" {
+		query["fhirEndpointUrl"] = fhirEndpointURL
+	}
+	jobs := []CalculationJob{}
+	if err := q.db.C("calculationjobs").Find(query).Sort("-created").All(&jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Start ensures the queue's indexes exist, reschedules any running jobs whose leases have expired (e.g., because
+// the server died in the middle of them), and starts the workers.  Jobs that another process is still running are
+// left alone.
+func (q *CalculationQueue) Start() error {
+	c := q.db.C("calculationjobs")
+	for _, index := range [][]string{{"key", "status"}, {"status", "runAt"}, {"patientId", "-created"}} {
+		if err := c.EnsureIndexKey(index...); err != nil {
+			return err
+		}
+	}
+	if err := c.EnsureIndex(mgo.Index{Key: []string{"pendingKey"}, Unique: true, Sparse: true}); err != nil {
+		return err
+	}
+
+	if err := reclaimExpired(c, time.Now()); err != nil {
+		return err
+	}
+
+	q.stop = make(chan struct{})
+	for i := 0; i < q.config.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return nil
+}
+
+// Stop signals the workers to stop and waits for any running calculations to finish.
+func (q *CalculationQueue) Stop() {
+	close(q.stop)
+	q.wg.Wait()
+}
+
+func (q *CalculationQueue) work() {
+	defer q.wg.Done()
+
+	// Each worker gets its own session so that slow calculations don't contend over a single socket
+	session := q.db.Session.Copy()
+	defer session.Close()
+	c := session.DB(q.db.Name).C("calculationjobs")
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+
+		job, err := q.claim(c)
+		if err != nil {
+			log.Printf("Unable to claim calculation job: %v", err)
+		}
+		if job != nil {
+			q.run(c, job)
+			continue
+		}
+
+		select {
+		case <-q.stop:
+			return
+		case <-time.After(q.config.PollInterval):
+		}
+	}
+}
+
+// claim atomically marks the next due job as running, leases it to this queue, and returns it.  Jobs for patients
+// that already have a calculation running (in any process) are skipped so that two calculations never overwrite
+// each other's results.  If no jobs are due, it returns nil.
+func (q *CalculationQueue) claim(c *mgo.Collection) (*CalculationJob, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now()
+	if err := reclaimExpired(c, now); err != nil {
+		return nil, err
+	}
+	var running []string
+	if err := c.Find(bson.M{"status": JobRunning}).Distinct("key", &running); err != nil {
+		return nil, err
+	}
+
+	job := new(CalculationJob)
+	_, err := c.Find(bson.M{
+		"key":    bson.M{"$nin": running},
+		"status": bson.M{"$in": []string{JobDebouncing, JobRetrying}},
+		"runAt":  bson.M{"$lte": now},
+	}).Sort("runAt").Apply(mgo.Change{
+		Update: bson.M{
+			"$set":   bson.M{"status": JobRunning, "updated": now, "started": now, "owner": q.owner, "leaseExpires": now.Add(q.config.Lease)},
+			"$unset": bson.M{"finished": "", "pendingKey": ""},
+			"$inc":   bson.M{"attempts": 1},
+		},
+		ReturnNew: true,
+	}, job)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Another process may have claimed a job for the same patient since the running jobs were checked, in which
+	// case this one waits for it
+	others, err := c.Find(bson.M{"key": job.Key, "status": JobRunning, "_id": bson.M{"$ne": job.Id}}).Count()
+	if err == nil && others > 0 {
+		err = c.Update(bson.M{"_id": job.Id, "owner": q.owner, "status": JobRunning}, bson.M{
+			"$set":   bson.M{"status": JobRetrying, "runAt": now.Add(q.config.PollInterval), "updated": now},
+			"$unset": bson.M{"owner": "", "leaseExpires": ""},
+			"$inc":   bson.M{"attempts": -1},
+		})
+		return nil, err
+	}
+	return job, err
+}
+
+// reclaimExpired reschedules the running jobs whose leases have expired, which means the queue that claimed them
+// stopped renewing them.  Jobs claimed before leases were recorded don't have one, so they're treated as expired.
+func reclaimExpired(c *mgo.Collection, now time.Time) error {
+	_, err := c.UpdateAll(bson.M{
+		"status": JobRunning,
+		"$or":    []bson.M{{"leaseExpires": bson.M{"$lt": now}}, {"leaseExpires": bson.M{"$exists": false}}},
+	}, bson.M{
+		"$set":   bson.M{"status": JobRetrying, "runAt": now, "updated": now},
+		"$unset": bson.M{"owner": "", "leaseExpires": ""},
+	})
+	return err
+}
+
+// run invokes the calculation for a claimed job, renewing its lease until the calculation is done, and records the
+// outcome.
+func (q *CalculationQueue) run(c *mgo.Collection, job *CalculationJob) {
+	done := make(chan struct{})
+	go q.renewLease(c, job, done)
+	outcome, err := q.calculate(job)
+	close(done)
+
+	now := time.Now()
+	update := bson.M{"updated": now, "finished": now, "outcome": outcome}
+	if err == nil {
+		update["status"] = JobSucceeded
+		update["lastError"] = ""
+	} else if job.Attempts >= q.config.MaxAttempts {
+		log.Printf("Calculation for %s failed after %d attempts: %v", job.Key, job.Attempts, err)
+		update["status"] = JobFailed
+		update["lastError"] = err.Error()
+	} else {
+		update["status"] = JobRetrying
+		update["lastError"] = err.Error()
+		update["runAt"] = now.Add(q.backoff(job.Attempts))
+	}
+	// If the lease was lost, the job has been rescheduled and its new run will record the outcome
+	err = c.Update(bson.M{"_id": job.Id, "owner": q.owner, "status": JobRunning}, bson.M{
+		"$set":   update,
+		"$unset": bson.M{"leaseExpires": ""},
+	})
+	if err == mgo.ErrNotFound {
+		log.Printf("Calculation job %s lost its lease before it finished", job.Id.Hex())
+	} else if err != nil {
+		log.Printf("Unable to update calculation job %s: %v", job.Id.Hex(), err)
+	}
+}
+
+// renewLease extends the lease on a running job every third of the lease period until done is closed.
+func (q *CalculationQueue) renewLease(c *mgo.Collection, job *CalculationJob, done chan struct{}) {
+	ticker := time.NewTicker(q.config.Lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := c.Update(bson.M{"_id": job.Id, "owner": q.owner, "status": JobRunning}, bson.M{
+				"$set": bson.M{"leaseExpires": time.Now().Add(q.config.Lease)},
+			})
+			if err != nil {
+				log.Printf("Unable to renew the lease on calculation job %s: %v", job.Id.Hex(), err)
+			}
+		}
+	}
+}
+
+// calculate invokes the risk service, converting a panic into an error so that a bad record can't take down the
+// worker or leave the job stuck in the running state.
+func (q *CalculationQueue) calculate(job *CalculationJob) (outcome *service.CalculationOutcome, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Calculation panicked: %v", r)
+		}
+	}()
+	return q.service.Calculate(job.PatientID, job.FHIREndpointURL, job.BasisPieURL)
+}
+
+// backoff returns how long to wait before retrying a job that has failed the given number of times.
+func (q *CalculationQueue) backoff(attempts int) time.Duration {
+	d := q.config.RetryBackoff
+	for i := 1; i < attempts && d < q.config.MaxRetryBackoff; i++ {
+		d *= 2
+	}
+	if q.config.MaxRetryBackoff > 0 && d > q.config.MaxRetryBackoff {
+		d = q.config.MaxRetryBackoff
+	}
+	return d
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"errors"
+	"os/exec"
+	"time"
+
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+)
+
+type QueueSuite struct {
+	DBServer    *dbtest.DBServer
+	Database    *mgo.Database
+	MockService *MockService
+	Queue       *CalculationQueue
+}
+
+var _ = Suite(&QueueSuite{})
+
+func (q *QueueSuite) SetUpSuite(c *C) {
+	if _, err := exec.LookPath("mongod"); err != nil {
+		c.Skip("mongod is not installed")
+	}
+
+	q.DBServer = &dbtest.DBServer{}
+	q.DBServer.SetPath(c.MkDir())
+}
+
+func (q *QueueSuite) SetUpTest(c *C) {
+	q.Database = q.DBServer.Session().DB("test")
+	q.MockService = &MockService{}
+	q.Queue = NewCalculationQueue(q.Database, q.MockService, testQueueConfig(100*time.Millisecond))
+}
+
+func (q *QueueSuite) TearDownTest(c *C) {
+	if q.Queue.stop != nil {
+		q.Queue.Stop()
+	}
+	q.Database.Session.Close()
+	q.DBServer.Wipe()
+}
+
+func (q *QueueSuite) TearDownSuite(c *C) {
+	if q.DBServer != nil {
+		q.DBServer.Stop()
+	}
+}
+
+func (q *QueueSuite) TestSingleDelay(c *C) {
+	util.CheckErr(q.Queue.Start())
+	q.enqueue(c, "abc")
+	time.Sleep(75 * time.Millisecond)
+	// After 75ms, it shouldn't have been called yet
+	q.assertCalls(c)
+	time.Sleep(75 * time.Millisecond)
+	// After 150 ms, it should have been called
+	q.assertCalls(c, "abc")
+	time.Sleep(100 * time.Millisecond)
+	// After another 100 ms, it should still only have one call
+	q.assertCalls(c, "abc")
+	q.assertStatus(c, "abc", JobSucceeded)
+}
+
+func (q *QueueSuite) TestMultipleDelays(c *C) {
+	util.CheckErr(q.Queue.Start())
+	first := q.enqueue(c, "abc")
+	time.Sleep(75 * time.Millisecond)
+	// After 75ms, it shouldn't have been called yet
+	q.assertCalls(c)
+	// Reset the timer by enqueuing it again
+	second := q.enqueue(c, "abc")
+	c.Assert(second.Id, Equals, first.Id)
+	time.Sleep(75 * time.Millisecond)
+	q.assertCalls(c)
+	time.Sleep(75 * time.Millisecond)
+	// After 225 ms total, it should have been called
+	q.assertCalls(c, "abc")
+}
+
+func (q *QueueSuite) TestLateDelay(c *C) {
+	util.CheckErr(q.Queue.Start())
+	first := q.enqueue(c, "abc")
+	time.Sleep(75 * time.Millisecond)
+	// After 75ms, it shouldn't have been called yet
+	q.assertCalls(c)
+	time.Sleep(75 * time.Millisecond)
+	// After 150ms, it should have been called
+	q.assertCalls(c, "abc")
+	// Enqueuing the same key should trigger a new job
+	second := q.enqueue(c, "abc")
+	c.Assert(second.Id, Not(Equals), first.Id)
+	time.Sleep(125 * time.Millisecond)
+	// After 125 ms more, it should have been called again
+	q.assertCalls(c, "abc", "abc")
+}
+
+func (q *QueueSuite) TestMultipleKeysAndDelays(c *C) {
+	util.CheckErr(q.Queue.Start())
+	q.enqueue(c, "abc") // triggers at 100ms
+	q.enqueue(c, "def") // triggers at 100ms
+	time.Sleep(75 * time.Millisecond)
+	// After 75ms, nothing should have been called yet
+	q.assertCalls(c)
+	// Reset the timer for "abc" by enqueuing it again
+	q.enqueue(c, "abc") // now triggers at 175ms
+	time.Sleep(75 * time.Millisecond)
+	// After 150 ms total, only "def" should have been called
+	q.assertCalls(c, "def")
+	// Enqueue a new key: "ghi"
+	q.enqueue(c, "ghi") // triggers at 250ms
+	time.Sleep(75 * time.Millisecond)
+	// After 225 ms total, "def" and "abc" should have been called
+	q.assertCalls(c, "def", "abc")
+	time.Sleep(75 * time.Millisecond)
+	// After 300ms total, "ghi" should be called too
+	q.assertCalls(c, "def", "abc", "ghi")
+}
+
+func (q *QueueSuite) TestJobsSurviveRestart(c *C) {
+	// Enqueue a job without any workers running, as if the server went down before it was due
+	q.enqueue(c, "abc")
+	time.Sleep(150 * time.Millisecond)
+	q.assertCalls(c)
+
+	// A new queue on the same database should pick it up
+	q.Queue = NewCalculationQueue(q.Database, q.MockService, testQueueConfig(100*time.Millisecond))
+	util.CheckErr(q.Queue.Start())
+	time.Sleep(100 * time.Millisecond)
+	q.assertCalls(c, "abc")
+	q.assertStatus(c, "abc", JobSucceeded)
+}
+
+func (q *QueueSuite) TestRunningJobsAreRecoveredOnStart(c *C) {
+	// Simulate a job that was running when the server crashed, from before jobs were leased
+	now := time.Now()
+	err := q.Database.C("calculationjobs").Insert(&CalculationJob{
+		Id:              bson.NewObjectId(),
+		Key:             JobKey("abc", "http://example.org/fhir"),
+		PatientID:       "abc",
+		FHIREndpointURL: "http://example.org/fhir",
+		BasisPieURL:     "http://foo.com",
+		Status:          JobRunning,
+		Attempts:        1,
+		RunAt:           now.Add(-time.Minute),
+		Created:         now.Add(-time.Minute),
+		Updated:         now.Add(-time.Minute),
+	})
+	util.CheckErr(err)
+
+	util.CheckErr(q.Queue.Start())
+	time.Sleep(100 * time.Millisecond)
+	q.assertCalls(c, "abc")
+	job := q.assertStatus(c, "abc", JobSucceeded)
+	c.Assert(job.Attempts, Equals, 2)
+}
+
+func (q *QueueSuite) TestJobsLeasedElsewhereAreLeftAlone(c *C) {
+	// Simulate a job that another process (e.g., the recalculate command) is running
+	q.insertRunningJob(c, "abc", time.Now().Add(time.Hour))
+
+	util.CheckErr(q.Queue.Start())
+	// A new request for the same patient has to wait for it
+	q.enqueue(c, "abc")
+	time.Sleep(200 * time.Millisecond)
+	q.assertCalls(c)
+	count, err := q.Database.C("calculationjobs").Find(bson.M{"status": JobRunning, "owner": "elsewhere"}).Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+}
+
+func (q *QueueSuite) TestExpiredLeasesAreReclaimed(c *C) {
+	// Simulate a job whose process died, so it stopped renewing the lease
+	q.insertRunningJob(c, "abc", time.Now().Add(100*time.Millisecond))
+
+	util.CheckErr(q.Queue.Start())
+	time.Sleep(50 * time.Millisecond)
+	q.assertCalls(c)
+	time.Sleep(150 * time.Millisecond)
+	q.assertCalls(c, "abc")
+	job := q.assertStatus(c, "abc", JobSucceeded)
+	c.Assert(job.Attempts, Equals, 2)
+	c.Assert(job.Owner, Equals, q.Queue.owner)
+	c.Assert(job.LeaseExpires, IsNil)
+}
+
+func (q *QueueSuite) TestLeasesAreRenewedWhileRunning(c *C) {
+	config := testQueueConfig(10 * time.Millisecond)
+	config.Lease = 60 * time.Millisecond
+	q.MockService.Delay = 250 * time.Millisecond
+	q.Queue = NewCalculationQueue(q.Database, q.MockService, config)
+	util.CheckErr(q.Queue.Start())
+	// A second queue on the same database, as if it were in another process
+	other := NewCalculationQueue(q.Database, q.MockService, config)
+	util.CheckErr(other.Start())
+	defer other.Stop()
+
+	q.enqueue(c, "abc")
+	time.Sleep(400 * time.Millisecond)
+	// The calculation outlasts its lease period, but it was renewed, so it only ran once
+	q.assertCalls(c, "abc")
+	job := q.assertStatus(c, "abc", JobSucceeded)
+	c.Assert(job.Attempts, Equals, 1)
+}
+
+func (q *QueueSuite) TestRetryThenSucceed(c *C) {
+	q.MockService.Errors = []error{errors.New("FHIR server unavailable")}
+	util.CheckErr(q.Queue.Start())
+	q.enqueue(c, "abc")
+	time.Sleep(150 * time.Millisecond)
+	// The first attempt should have failed and be waiting to retry
+	q.assertCalls(c, "abc")
+	job := q.assertStatus(c, "abc", JobRetrying)
+	c.Assert(job.Attempts, Equals, 1)
+	c.Assert(job.LastError, Equals, "FHIR server unavailable")
+
+	// After the backoff, it should be retried and succeed
+	time.Sleep(150 * time.Millisecond)
+	q.assertCalls(c, "abc", "abc")
+	job = q.assertStatus(c, "abc", JobSucceeded)
+	c.Assert(job.Attempts, Equals, 2)
+	c.Assert(job.LastError, Equals, "")
+}
+
+func (q *QueueSuite) TestDeadLetter(c *C) {
+	q.MockService.Errors = []error{errors.New("first"), errors.New("second"), errors.New("third")}
+	util.CheckErr(q.Queue.Start())
+	q.enqueue(c, "abc")
+	time.Sleep(600 * time.Millisecond)
+	// The job should have been tried MaxAttempts times and then given up on
+	q.assertCalls(c, "abc", "abc", "abc")
+	job := q.assertStatus(c, "abc", JobFailed)
+	c.Assert(job.Attempts, Equals, 3)
+	c.Assert(job.LastError, Equals, "third")
+
+	// It should not be tried again
+	time.Sleep(300 * time.Millisecond)
+	q.assertCalls(c, "abc", "abc", "abc")
+}
+
+func (q *QueueSuite) TestEnqueueKeepsRetryingJob(c *C) {
+	q.MockService.Errors = []error{errors.New("FHIR server unavailable")}
+	q.Queue.config.RetryBackoff = time.Hour
+	util.CheckErr(q.Queue.Start())
+	first := q.enqueue(c, "abc")
+	time.Sleep(150 * time.Millisecond)
+	q.assertStatus(c, "abc", JobRetrying)
+
+	// A new request for the patient shares the retrying job, without resetting its attempts or backoff
+	second := q.enqueue(c, "abc")
+	c.Assert(second.Id, Equals, first.Id)
+	c.Assert(second.Status, Equals, JobRetrying)
+	c.Assert(second.Attempts, Equals, 1)
+	time.Sleep(150 * time.Millisecond)
+	q.assertCalls(c, "abc")
+	q.assertStatus(c, "abc", JobRetrying)
+}
+
+func (q *QueueSuite) TestDeadLetterDespiteNotifications(c *C) {
+	q.MockService.Errors = []error{errors.New("first"), errors.New("second"), errors.New("third")}
+	util.CheckErr(q.Queue.Start())
+	q.enqueue(c, "abc")
+	// Keep notifying about the patient while the job fails
+	for i := 0; i < 12; i++ {
+		time.Sleep(50 * time.Millisecond)
+		q.enqueue(c, "abc")
+	}
+	job := new(CalculationJob)
+	util.CheckErr(q.Database.C("calculationjobs").Find(bson.M{"status": JobFailed}).One(job))
+	c.Assert(job.Attempts, Equals, 3)
+	c.Assert(job.LastError, Equals, "third")
+}
+
+func (q *QueueSuite) TestOneDebouncingJobPerKey(c *C) {
+	util.CheckErr(q.Queue.Start())
+	q.enqueue(c, "abc")
+	// Another process can't add a second debouncing job for the same key
+	err := q.Database.C("calculationjobs").Insert(bson.M{
+		"_id":        bson.NewObjectId(),
+		"key":        JobKey("abc", "http://example.org/fhir"),
+		"status":     JobDebouncing,
+		"pendingKey": JobKey("abc", "http://example.org/fhir"),
+	})
+	c.Assert(mgo.IsDup(err), Equals, true)
+
+	// Once the job is claimed, a new one can debounce
+	time.Sleep(150 * time.Millisecond)
+	q.assertCalls(c, "abc")
+	q.enqueue(c, "abc")
+	count, err := q.Database.C("calculationjobs").Find(bson.M{"pendingKey": JobKey("abc", "http://example.org/fhir")}).Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+}
+
+func (q *QueueSuite) TestBackoff(c *C) {
+	queue := NewCalculationQueue(nil, nil, QueueConfig{RetryBackoff: time.Second, MaxRetryBackoff: 5 * time.Second})
+	c.Assert(queue.backoff(1), Equals, time.Second)
+	c.Assert(queue.backoff(2), Equals, 2*time.Second)
+	c.Assert(queue.backoff(3), Equals, 4*time.Second)
+	c.Assert(queue.backoff(4), Equals, 5*time.Second)
+	c.Assert(queue.backoff(20), Equals, 5*time.Second)
+}
+
+func (q *QueueSuite) enqueue(c *C, patientID string) *CalculationJob {
+	job, err := q.Queue.Enqueue(patientID, "http://example.org/fhir", "http://foo.com")
+	util.CheckErr(err)
+	return job
+}
+
+func (q *QueueSuite) assertCalls(c *C, patientIDs ...string) {
+	calls := make([]MockServiceCallParams, len(patientIDs))
+	for i := range patientIDs {
+		calls[i] = MockServiceCallParams{patientID: patientIDs[i], fhirEndpointURL: "http://example.org/fhir", basePieURL: "http://foo.com"}
+	}
+	q.MockService.AssertCalls(c, calls...)
+}
+
+func (q *QueueSuite) assertStatus(c *C, patientID string, status string) *CalculationJob {
+	job := new(CalculationJob)
+	err := q.Database.C("calculationjobs").Find(bson.M{"patientId": patientID}).Sort("-created").One(job)
+	util.CheckErr(err)
+	c.Assert(job.Status, Equals, status)
+	return job
+}
+
+func (q *QueueSuite) insertRunningJob(c *C, patientID string, leaseExpires time.Time) {
+	now := time.Now()
+	err := q.Database.C("calculationjobs").Insert(&CalculationJob{
+		Id:              bson.NewObjectId(),
+		Key:             JobKey(patientID, "http://example.org/fhir"),
+		PatientID:       patientID,
+		FHIREndpointURL: "http://example.org/fhir",
+		BasisPieURL:     "http://foo.com",
+		Status:          JobRunning,
+		Attempts:        1,
+		RunAt:           now.Add(-time.Minute),
+		Created:         now.Add(-time.Minute),
+		Updated:         now.Add(-time.Minute),
+		Owner:           "elsewhere",
+		LeaseExpires:    &leaseExpires,
+	})
+	util.CheckErr(err)
+}
+
+func testQueueConfig(debounce time.Duration) QueueConfig {
+	return QueueConfig{
+		Debounce:        debounce,
+		PollInterval:    10 * time.Millisecond,
+		Workers:         2,
+		MaxAttempts:     3,
+		RetryBackoff:    100 * time.Millisecond,
+		MaxRetryBackoff: 200 * time.Millisecond,
+		Lease:           time.Second,
+	}
+}
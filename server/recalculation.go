@@ -0,0 +1,422 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/service"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The states that a Recalculation moves through.  A recalculation is pending until it is started.  One that was
+// running when it was stopped (or when the server went down) is interrupted.  One that couldn't retrieve the
+// patients from the FHIR server has failed.  Interrupted and failed recalculations can be resumed from where they
+// left off.
+const (
+	RecalculationPending     = "pending"
+	RecalculationRunning     = "running"
+	RecalculationInterrupted = "interrupted"
+	RecalculationCompleted   = "completed"
+	RecalculationFailed      = "failed"
+)
+
+// Recalculation tracks the progress of recalculating the risks for every patient on a FHIR server.  Patients are
+// enumerated a page at a time.  PageURL is the page currently being worked on, PageJobs lists the calculation jobs
+// queued for the patients on that page, and PagePatients lists the patients on that page whose jobs have finished,
+// so an interrupted recalculation can pick up where it left off without queueing or counting anyone twice.
+type Recalculation struct {
+	Id              bson.ObjectId      `bson:"_id" json:"id"`
+	FHIREndpointURL string             `bson:"fhirEndpointUrl" json:"fhirEndpointUrl"`
+	BasisPieURL     string             `bson:"basisPieUrl" json:"basisPieUrl"`
+	Status          string             `bson:"status" json:"status"`
+	Total           int                `bson:"total" json:"total"`
+	Done            int                `bson:"done" json:"done"`
+	Failed          int                `bson:"failed" json:"failed"`
+	PageURL         string             `bson:"pageUrl,omitempty" json:"pageUrl,omitempty"`
+	PageCounted     bool               `bson:"pageCounted" json:"-"`
+	PageJobs        []RecalculationJob `bson:"pageJobs" json:"-"`
+	PagePatients    []string           `bson:"pagePatients" json:"-"`
+	LastError       string             `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	Created         time.Time          `bson:"created" json:"created"`
+	Updated         time.Time          `bson:"updated" json:"updated"`
+	Finished        *time.Time         `bson:"finished,omitempty" json:"finished,omitempty"`
+}
+
+// RecalculationJob is the calculation job queued for a patient during a recalculation.
+type RecalculationJob struct {
+	PatientID string        `bson:"patientId"`
+	JobID     bson.ObjectId `bson:"jobId"`
+}
+
+// RecalculationConfig contains the settings that control how a Recalculator works through the patients.
+type RecalculationConfig struct {
+	// PageSize is the number of patients requested from the FHIR server at a time
+	PageSize int
+	// Concurrency is the maximum number of patients waiting on the calculation queue at the same time
+	Concurrency int
+}
+
+// DefaultRecalculationConfig returns the configuration used by the risk service server.
+func DefaultRecalculationConfig() RecalculationConfig {
+	return RecalculationConfig{
+		PageSize:    100,
+		Concurrency: 4,
+	}
+}
+
+// Recalculator recalculates the risks for every patient on a FHIR server, e.g. after a plugin is added or changed.
+// The calculations go through a CalculationQueue like any other request, so they never run at the same time as
+// another calculation for the same patient, failures are retried, and the jobs show up with the patient's other
+// jobs.  Its progress is stored in the "recalculations" collection, so a recalculation that is interrupted can be
+// resumed.
+type Recalculator struct {
+	sync.Mutex
+	db      *mgo.Database
+	queue   *CalculationQueue
+	config  RecalculationConfig
+	running map[bson.ObjectId]chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewRecalculator creates a new Recalculator, storing its progress in the passed in database and queueing the
+// calculations on the passed in queue, which must be started for the recalculations to make progress.
+func NewRecalculator(db *mgo.Database, queue *CalculationQueue, config RecalculationConfig) *Recalculator {
+	if config.PageSize < 1 {
+		config.PageSize = 1
+	}
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+	return &Recalculator{
+		db:      db,
+		queue:   queue,
+		config:  config,
+		running: make(map[bson.ObjectId]chan struct{}),
+	}
+}
+
+// Start marks any recalculations that were left running when the server last stopped as interrupted, so that they
+// can be resumed.
+func (r *Recalculator) Start() error {
+	_, err := r.db.C("recalculations").UpdateAll(bson.M{"status": RecalculationRunning}, bson.M{
+		"$set": bson.M{"status": RecalculationInterrupted, "updated": time.Now()},
+	})
+	return err
+}
+
+// Stop interrupts the running recalculations and waits for their in-progress calculations to finish.
+func (r *Recalculator) Stop() {
+	r.Lock()
+	for _, stop := range r.running {
+		close(stop)
+	}
+	r.running = make(map[bson.ObjectId]chan struct{})
+	r.Unlock()
+	r.wg.Wait()
+}
+
+// Create stores a new recalculation of every patient on the FHIR endpoint.  It doesn't start working on it; use
+// Run or Go for that.
+func (r *Recalculator) Create(fhirEndpointURL, basisPieURL string) (*Recalculation, error) {
+	now := time.Now()
+	rc := &Recalculation{
+		Id:              bson.NewObjectId(),
+		FHIREndpointURL: fhirEndpointURL,
+		BasisPieURL:     basisPieURL,
+		Status:          RecalculationPending,
+		PageURL:         fmt.Sprintf("%s/Patient?_count=%d", strings.TrimSuffix(fhirEndpointURL, "/"), r.config.PageSize),
+		PageJobs:        []RecalculationJob{},
+		PagePatients:    []string{},
+		Created:         now,
+		Updated:         now,
+	}
+	if err := r.db.C("recalculations").Insert(rc); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Recalculation returns the recalculation with the given ID.  If there is no such recalculation, it returns
+// mgo.ErrNotFound.
+func (r *Recalculator) Recalculation(id bson.ObjectId) (*Recalculation, error) {
+	rc := new(Recalculation)
+	if err := r.db.C("recalculations").FindId(id).One(rc); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Go starts (or resumes) the recalculation with the given ID in the background and returns it.
+func (r *Recalculator) Go(id bson.ObjectId) (*Recalculation, error) {
+	rc, stop, err := r.begin(id)
+	if err != nil {
+		return nil, err
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		if err := r.run(rc, stop); err != nil {
+			log.Printf("Recalculation %s failed: %v", rc.Id.Hex(), err)
+		}
+	}()
+	return rc, nil
+}
+
+// Run starts (or resumes) the recalculation with the given ID and waits for it to finish.
+func (r *Recalculator) Run(id bson.ObjectId) (*Recalculation, error) {
+	rc, stop, err := r.begin(id)
+	if err != nil {
+		return nil, err
+	}
+	r.wg.Add(1)
+	defer r.wg.Done()
+	if err := r.run(rc, stop); err != nil {
+		return nil, err
+	}
+	return r.Recalculation(id)
+}
+
+// ErrRecalculationNotResumable indicates that a recalculation is already running or has completed.
+var ErrRecalculationNotResumable = errors.New("Only pending, interrupted, or failed recalculations can be started")
+
+// begin atomically marks a pending, interrupted, or failed recalculation as running.
+func (r *Recalculator) begin(id bson.ObjectId) (*Recalculation, chan struct{}, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	rc := new(Recalculation)
+	_, err := r.db.C("recalculations").Find(bson.M{
+		"_id":    id,
+		"status": bson.M{"$in": []string{RecalculationPending, RecalculationInterrupted, RecalculationFailed}},
+	}).Apply(mgo.Change{
+		Update: bson.M{
+			"$set":   bson.M{"status": RecalculationRunning, "updated": time.Now()},
+			"$unset": bson.M{"lastError": "", "finished": ""},
+		},
+		ReturnNew: true,
+	}, rc)
+	if err == mgo.ErrNotFound {
+		if _, err := r.Recalculation(id); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrRecalculationNotResumable
+	} else if err != nil {
+		return nil, nil, err
+	}
+	stop := make(chan struct{})
+	r.running[id] = stop
+	return rc, stop, nil
+}
+
+// run works through the pages of patients until there are no more pages or it is stopped.
+func (r *Recalculator) run(rc *Recalculation, stop chan struct{}) error {
+	// Each recalculation gets its own session since it runs alongside the request handlers
+	session := r.db.Session.Copy()
+	defer session.Close()
+	c := session.DB(r.db.Name).C("recalculations")
+
+	defer func() {
+		r.Lock()
+		delete(r.running, rc.Id)
+		r.Unlock()
+	}()
+
+	for rc.PageURL != "" {
+		select {
+		case <-stop:
+			return c.UpdateId(rc.Id, bson.M{"$set": bson.M{"status": RecalculationInterrupted, "updated": time.Now()}})
+		default:
+		}
+
+		bundle, err := getPatientPage(rc.PageURL)
+		if err != nil {
+			now := time.Now()
+			c.UpdateId(rc.Id, bson.M{"$set": bson.M{
+				"status": RecalculationFailed, "lastError": err.Error(), "updated": now, "finished": now,
+			}})
+			return err
+		}
+		patientIDs := patientIDsInPage(bundle)
+
+		if !rc.PageCounted {
+			update := bson.M{"$set": bson.M{"pageCounted": true, "updated": time.Now()}}
+			if bundle.Total != nil {
+				update["$set"].(bson.M)["total"] = int(*bundle.Total)
+			} else {
+				update["$inc"] = bson.M{"total": len(patientIDs)}
+			}
+			if err := c.UpdateId(rc.Id, update); err != nil {
+				return err
+			}
+		}
+
+		if stopped := r.calculatePage(c, rc, patientIDs, stop); stopped {
+			continue
+		}
+
+		// Move on to the next page
+		rc.PageURL = service.NextPageURL(bundle)
+		rc.PageCounted = false
+		rc.PageJobs = []RecalculationJob{}
+		rc.PagePatients = []string{}
+		if err := c.UpdateId(rc.Id, bson.M{"$set": bson.M{
+			"pageUrl": rc.PageURL, "pageCounted": false, "pageJobs": rc.PageJobs, "pagePatients": rc.PagePatients,
+			"updated": time.Now(),
+		}}); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	return c.UpdateId(rc.Id, bson.M{"$set": bson.M{"status": RecalculationCompleted, "updated": now, "finished": now}})
+}
+
+// calculatePage queues calculations for the patients on a page that haven't already been calculated and waits for
+// them to finish, with up to the configured number of patients waiting on the queue at a time.  It returns true if
+// it was stopped before finishing the page.  The jobs it already queued are left to run, and are waited on again
+// when the recalculation is resumed.
+func (r *Recalculator) calculatePage(c *mgo.Collection, rc *Recalculation, patientIDs []string, stop chan struct{}) (stopped bool) {
+	alreadyDone := make(map[string]bool, len(rc.PagePatients))
+	for _, id := range rc.PagePatients {
+		alreadyDone[id] = true
+	}
+	queued := make(map[string]bson.ObjectId, len(rc.PageJobs))
+	for _, job := range rc.PageJobs {
+		queued[job.PatientID] = job.JobID
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, r.config.Concurrency)
+	for _, patientID := range patientIDs {
+		if alreadyDone[patientID] {
+			continue
+		}
+		select {
+		case <-stop:
+			stopped = true
+		case sem <- struct{}{}:
+		}
+		if stopped {
+			break
+		}
+
+		// A bulk recalculation doesn't need debouncing, so the job is due right away
+		jobID, ok := queued[patientID]
+		if !ok {
+			job, err := r.queue.enqueue(patientID, rc.FHIREndpointURL, rc.BasisPieURL, 0)
+			if err != nil {
+				log.Printf("Recalculation %s: unable to queue the calculation for patient %s: %v", rc.Id.Hex(), patientID, err)
+				r.finishPatient(c, rc, patientID, false)
+				<-sem
+				continue
+			}
+			jobID = job.Id
+			err = c.UpdateId(rc.Id, bson.M{
+				"$push": bson.M{"pageJobs": RecalculationJob{PatientID: patientID, JobID: jobID}},
+				"$set":  bson.M{"updated": time.Now()},
+			})
+			if err != nil {
+				log.Printf("Unable to update recalculation %s: %v", rc.Id.Hex(), err)
+			}
+		}
+
+		wg.Add(1)
+		go func(patientID string, jobID bson.ObjectId) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if succeeded, finished := r.wait(rc, patientID, jobID, stop); finished {
+				r.finishPatient(c, rc, patientID, succeeded)
+			}
+		}(patientID, jobID)
+	}
+	wg.Wait()
+
+	// Waiting on the jobs may have been stopped after the last one was queued
+	select {
+	case <-stop:
+		stopped = true
+	default:
+	}
+	return stopped
+}
+
+// wait polls the patient's calculation job until it has succeeded or been dead-lettered, and returns whether it
+// succeeded.  It returns false for finished if it was stopped first.
+func (r *Recalculator) wait(rc *Recalculation, patientID string, jobID bson.ObjectId, stop chan struct{}) (succeeded, finished bool) {
+	for {
+		job, err := r.queue.Job(jobID)
+		switch {
+		case err == mgo.ErrNotFound:
+			log.Printf("Recalculation %s: the calculation job for patient %s is missing", rc.Id.Hex(), patientID)
+			return false, true
+		case err != nil:
+			log.Printf("Recalculation %s: unable to check the calculation job for patient %s: %v", rc.Id.Hex(), patientID, err)
+		case job.Status == JobSucceeded:
+			return true, true
+		case job.Status == JobFailed:
+			log.Printf("Recalculation %s: calculation for patient %s failed: %s", rc.Id.Hex(), patientID, job.LastError)
+			return false, true
+		}
+
+		select {
+		case <-stop:
+			return false, false
+		case <-time.After(r.queue.config.PollInterval):
+		}
+	}
+}
+
+// finishPatient records that the patient's calculation has finished, counting it as done or failed.
+func (r *Recalculator) finishPatient(c *mgo.Collection, rc *Recalculation, patientID string, succeeded bool) {
+	counter := "done"
+	if !succeeded {
+		counter = "failed"
+	}
+	err := c.UpdateId(rc.Id, bson.M{
+		"$inc":  bson.M{counter: 1},
+		"$push": bson.M{"pagePatients": patientID},
+		"$set":  bson.M{"updated": time.Now()},
+	})
+	if err != nil {
+		log.Printf("Unable to update recalculation %s: %v", rc.Id.Hex(), err)
+	}
+}
+
+// getPatientPage retrieves a page of Patient search results.
+func getPatientPage(pageURL string) (*models.Bundle, error) {
+	response, err := http.Get(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("Unable to retrieve patients from %s.  Received response code: %d", pageURL, response.StatusCode)
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	return service.UnmarshalBundle(data)
+}
+
+// patientIDsInPage returns the IDs of the patients in a page of search results.  Any other resources (e.g.,
+// included resources or operation outcomes) are ignored.
+func patientIDsInPage(bundle *models.Bundle) []string {
+	var ids []string
+	for _, entry := range bundle.Entry {
+		if p, ok := entry.Resource.(*models.Patient); ok && p.Id != "" {
+			ids = append(ids, p.Id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+)
+
+type RecalculationSuite struct {
+	DBServer     *dbtest.DBServer
+	Database     *mgo.Database
+	MockService  *MockService
+	Queue        *CalculationQueue
+	FHIRServer   *httptest.Server
+	PatientIDs   []string
+	Recalculator *Recalculator
+}
+
+var _ = Suite(&RecalculationSuite{})
+
+func (r *RecalculationSuite) SetUpSuite(c *C) {
+	if _, err := exec.LookPath("mongod"); err != nil {
+		c.Skip("mongod is not installed")
+	}
+
+	r.DBServer = &dbtest.DBServer{}
+	r.DBServer.SetPath(c.MkDir())
+}
+
+func (r *RecalculationSuite) SetUpTest(c *C) {
+	r.Database = r.DBServer.Session().DB("test")
+	r.MockService = &MockService{}
+	r.PatientIDs = []string{"p1", "p2", "p3", "p4", "p5"}
+	r.FHIRServer = httptest.NewServer(http.HandlerFunc(r.servePatients))
+	// Don't retry, so that a failure is counted right away
+	config := testQueueConfig(500 * time.Millisecond)
+	config.MaxAttempts = 1
+	r.Queue = NewCalculationQueue(r.Database, r.MockService, config)
+	util.CheckErr(r.Queue.Start())
+	r.Recalculator = NewRecalculator(r.Database, r.Queue, RecalculationConfig{PageSize: 2, Concurrency: 2})
+}
+
+func (r *RecalculationSuite) TearDownTest(c *C) {
+	r.Recalculator.Stop()
+	r.Queue.Stop()
+	r.FHIRServer.Close()
+	r.Database.Session.Close()
+	r.DBServer.Wipe()
+}
+
+func (r *RecalculationSuite) TearDownSuite(c *C) {
+	if r.DBServer != nil {
+		r.DBServer.Stop()
+	}
+}
+
+func (r *RecalculationSuite) TestRecalculateAllPatients(c *C) {
+	rc, err := r.Recalculator.Create(r.FHIRServer.URL, "http://foo.com")
+	util.CheckErr(err)
+	c.Assert(rc.Status, Equals, RecalculationPending)
+
+	rc, err = r.Recalculator.Run(rc.Id)
+	util.CheckErr(err)
+	c.Assert(rc.Status, Equals, RecalculationCompleted)
+	c.Assert(rc.Total, Equals, 5)
+	c.Assert(rc.Done, Equals, 5)
+	c.Assert(rc.Failed, Equals, 0)
+	c.Assert(rc.PageURL, Equals, "")
+	c.Assert(rc.Finished, NotNil)
+	c.Assert(r.calledPatients(), DeepEquals, []string{"p1", "p2", "p3", "p4", "p5"})
+}
+
+func (r *RecalculationSuite) TestRecalculationGoesThroughQueue(c *C) {
+	rc, err := r.Recalculator.Create(r.FHIRServer.URL, "http://foo.com")
+	util.CheckErr(err)
+	rc, err = r.Recalculator.Run(rc.Id)
+	util.CheckErr(err)
+
+	// Each patient has a job, which wasn't debounced
+	for _, patientID := range r.PatientIDs {
+		jobs, err := r.Queue.PatientJobs(patientID, r.FHIRServer.URL)
+		util.CheckErr(err)
+		c.Assert(jobs, HasLen, 1)
+		c.Assert(jobs[0].Status, Equals, JobSucceeded)
+		c.Assert(jobs[0].BasisPieURL, Equals, "http://foo.com")
+		c.Assert(jobs[0].Started.Sub(jobs[0].Created) < 500*time.Millisecond, Equals, true)
+	}
+	c.Assert(rc.PageJobs, HasLen, 0)
+}
+
+func (r *RecalculationSuite) TestRecalculationRetriesFailures(c *C) {
+	r.Queue.Stop()
+	r.Queue = NewCalculationQueue(r.Database, r.MockService, testQueueConfig(500*time.Millisecond))
+	util.CheckErr(r.Queue.Start())
+	r.Recalculator = NewRecalculator(r.Database, r.Queue, RecalculationConfig{PageSize: 2, Concurrency: 1})
+
+	r.MockService.Errors = []error{errors.New("FHIR server unavailable")}
+	rc, err := r.Recalculator.Create(r.FHIRServer.URL, "http://foo.com")
+	util.CheckErr(err)
+
+	rc, err = r.Recalculator.Run(rc.Id)
+	util.CheckErr(err)
+	c.Assert(rc.Status, Equals, RecalculationCompleted)
+	c.Assert(rc.Done, Equals, 5)
+	c.Assert(rc.Failed, Equals, 0)
+	c.Assert(r.calledPatients(), DeepEquals, []string{"p1", "p1", "p2", "p3", "p4", "p5"})
+}
+
+func (r *RecalculationSuite) TestRecalculationCountsFailures(c *C) {
+	r.MockService.Errors = []error{errors.New("FHIR server unavailable")}
+	rc, err := r.Recalculator.Create(r.FHIRServer.URL, "http://foo.com")
+	util.CheckErr(err)
+
+	rc, err = r.Recalculator.Run(rc.Id)
+	util.CheckErr(err)
+	c.Assert(rc.Status, Equals, RecalculationCompleted)
+	c.Assert(rc.Done, Equals, 4)
+	c.Assert(rc.Failed, Equals, 1)
+}
+
+func (r *RecalculationSuite) TestResumeInterruptedRecalculation(c *C) {
+	// Simulate a recalculation that was interrupted part way through the second page
+	rc := &Recalculation{
+		Id:              bson.NewObjectId(),
+		FHIREndpointURL: r.FHIRServer.URL,
+		BasisPieURL:     "http://foo.com",
+		Status:          RecalculationRunning,
+		Total:           5,
+		Done:            3,
+		PageURL:         r.FHIRServer.URL + "/Patient?_count=2&_offset=2",
+		PageCounted:     true,
+		PagePatients:    []string{"p3"},
+		Created:         time.Now(),
+		Updated:         time.Now(),
+	}
+	util.CheckErr(r.Database.C("recalculations").Insert(rc))
+
+	// It can't be resumed until the recalculator notices that it's no longer running
+	_, err := r.Recalculator.Run(rc.Id)
+	c.Assert(err, Equals, ErrRecalculationNotResumable)
+	util.CheckErr(r.Recalculator.Start())
+
+	rc, err = r.Recalculator.Run(rc.Id)
+	util.CheckErr(err)
+	c.Assert(rc.Status, Equals, RecalculationCompleted)
+	c.Assert(rc.Total, Equals, 5)
+	c.Assert(rc.Done, Equals, 5)
+	c.Assert(r.calledPatients(), DeepEquals, []string{"p4", "p5"})
+}
+
+func (r *RecalculationSuite) TestResumeWaitsForQueuedJobs(c *C) {
+	// Simulate a recalculation that was interrupted after queueing p4, which has since been calculated
+	now := time.Now()
+	job := &CalculationJob{
+		Id:              bson.NewObjectId(),
+		Key:             JobKey("p4", r.FHIRServer.URL),
+		PatientID:       "p4",
+		FHIREndpointURL: r.FHIRServer.URL,
+		BasisPieURL:     "http://foo.com",
+		Status:          JobSucceeded,
+		Attempts:        1,
+		RunAt:           now,
+		Created:         now,
+		Updated:         now,
+	}
+	util.CheckErr(r.Database.C("calculationjobs").Insert(job))
+	rc := &Recalculation{
+		Id:              bson.NewObjectId(),
+		FHIREndpointURL: r.FHIRServer.URL,
+		BasisPieURL:     "http://foo.com",
+		Status:          RecalculationInterrupted,
+		Total:           5,
+		Done:            3,
+		PageURL:         r.FHIRServer.URL + "/Patient?_count=2&_offset=2",
+		PageCounted:     true,
+		PageJobs:        []RecalculationJob{{PatientID: "p4", JobID: job.Id}},
+		PagePatients:    []string{"p3"},
+		Created:         now,
+		Updated:         now,
+	}
+	util.CheckErr(r.Database.C("recalculations").Insert(rc))
+
+	rc, err := r.Recalculator.Run(rc.Id)
+	util.CheckErr(err)
+	c.Assert(rc.Status, Equals, RecalculationCompleted)
+	c.Assert(rc.Done, Equals, 5)
+	c.Assert(r.calledPatients(), DeepEquals, []string{"p5"})
+}
+
+func (r *RecalculationSuite) TestCompletedRecalculationCannotBeRestarted(c *C) {
+	rc, err := r.Recalculator.Create(r.FHIRServer.URL, "http://foo.com")
+	util.CheckErr(err)
+	_, err = r.Recalculator.Run(rc.Id)
+	util.CheckErr(err)
+
+	_, err = r.Recalculator.Run(rc.Id)
+	c.Assert(err, Equals, ErrRecalculationNotResumable)
+	_, err = r.Recalculator.Run(bson.NewObjectId())
+	c.Assert(err, Equals, mgo.ErrNotFound)
+}
+
+func (r *RecalculationSuite) TestRecalculationFailsWhenPatientsUnavailable(c *C) {
+	rc, err := r.Recalculator.Create(r.FHIRServer.URL+"/missing", "http://foo.com")
+	util.CheckErr(err)
+
+	_, err = r.Recalculator.Run(rc.Id)
+	c.Assert(err, NotNil)
+	rc, err = r.Recalculator.Recalculation(rc.Id)
+	util.CheckErr(err)
+	c.Assert(rc.Status, Equals, RecalculationFailed)
+	c.Assert(rc.LastError, Matches, "Unable to retrieve patients from .*404")
+
+	// Once the FHIR server is fixed, it can be resumed
+	rc.PageURL = r.FHIRServer.URL + "/Patient?_count=2"
+	util.CheckErr(r.Database.C("recalculations").UpdateId(rc.Id, bson.M{"$set": bson.M{"pageUrl": rc.PageURL}}))
+	rc, err = r.Recalculator.Run(rc.Id)
+	util.CheckErr(err)
+	c.Assert(rc.Status, Equals, RecalculationCompleted)
+	c.Assert(rc.LastError, Equals, "")
+	c.Assert(rc.Done, Equals, 5)
+}
+
+func (r *RecalculationSuite) TestGoRunsInBackground(c *C) {
+	rc, err := r.Recalculator.Create(r.FHIRServer.URL, "http://foo.com")
+	util.CheckErr(err)
+	rc, err = r.Recalculator.Go(rc.Id)
+	util.CheckErr(err)
+	c.Assert(rc.Status, Equals, RecalculationRunning)
+
+	time.Sleep(200 * time.Millisecond)
+	rc, err = r.Recalculator.Recalculation(rc.Id)
+	util.CheckErr(err)
+	c.Assert(rc.Status, Equals, RecalculationCompleted)
+	c.Assert(rc.Done, Equals, 5)
+}
+
+func (r *RecalculationSuite) TestPatientIDsInPage(c *C) {
+	patient := &models.Patient{}
+	patient.Id = "p1"
+	bundle := &models.Bundle{Entry: []models.BundleEntryComponent{
+		{Resource: patient},
+		{Resource: &models.OperationOutcome{}},
+		{Resource: &models.Patient{}},
+	}}
+	c.Assert(patientIDsInPage(bundle), DeepEquals, []string{"p1"})
+}
+
+// servePatients is a fake FHIR server that serves the suite's patients in pages, linking each page to the next.
+// The total is deliberately left out so that the recalculator has to count the patients itself.
+func (r *RecalculationSuite) servePatients(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/Patient" {
+		http.NotFound(w, req)
+		return
+	}
+	count, _ := strconv.Atoi(req.URL.Query().Get("_count"))
+	offset, _ := strconv.Atoi(req.URL.Query().Get("_offset"))
+	bundle := &models.Bundle{Type: "searchset"}
+	for i := offset; i < offset+count && i < len(r.PatientIDs); i++ {
+		patient := &models.Patient{}
+		patient.Id = r.PatientIDs[i]
+		bundle.Entry = append(bundle.Entry, models.BundleEntryComponent{Resource: patient})
+	}
+	if offset+count < len(r.PatientIDs) {
+		bundle.Link = []models.BundleLinkComponent{{
+			Relation: "next",
+			Url:      fmt.Sprintf("%s/Patient?_count=%d&_offset=%d", r.FHIRServer.URL, count, offset+count),
+		}}
+	}
+	json.NewEncoder(w).Encode(bundle)
+}
+
+// calledPatients returns the sorted IDs of the patients that were calculated, since the order depends on the
+// concurrent calculations.
+func (r *RecalculationSuite) calledPatients() []string {
+	r.MockService.Lock()
+	defer r.MockService.Unlock()
+	ids := []string{}
+	for _, call := range r.MockService.Calls {
+		ids = append(ids, call.patientID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// PatientPageSuite tests the retrieval of patient pages, which doesn't need MongoDB.
+type PatientPageSuite struct{}
+
+var _ = Suite(&PatientPageSuite{})
+
+func (p *PatientPageSuite) TestPatientPageKeepsPartialBirthDates(c *C) {
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"resourceType": "Bundle", "type": "searchset", "entry": [`+
+			`{"resource": {"resourceType": "Patient", "id": "p1", "birthDate": "1950"}}]}`)
+	}))
+	defer fhirServer.Close()
+
+	bundle, err := getPatientPage(fhirServer.URL + "/Patient")
+	util.CheckErr(err)
+	c.Assert(patientIDsInPage(bundle), DeepEquals, []string{"p1"})
+	patient := bundle.Entry[0].Resource.(*models.Patient)
+	c.Assert(patient.BirthDate.Time.Year(), Equals, 1950)
+	c.Assert(patient.BirthDate.Precision, Equals, plugin.Year)
+}
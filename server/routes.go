@@ -1,7 +1,7 @@
 package server
 
 import (
-	"fmt"
+	"io/ioutil"
 
 	"github.com/intervention-engine/riskservice/plugin"
 	"github.com/intervention-engine/riskservice/service"
@@ -11,7 +11,7 @@ import (
 )
 
 // RegisterRoutes sets up the http request handlers with Echo
-func RegisterRoutes(e *echo.Echo, db *mgo.Database, basePieURL string, service service.RiskService, fnDelayer *FunctionDelayer) {
+func RegisterRoutes(e *echo.Echo, db *mgo.Database, basePieURL string, svc service.RiskService, queue *CalculationQueue, recalculator *Recalculator) {
 	e.Get("/pies/:id", func(c *echo.Context) (err error) {
 		pie := &plugin.Pie{}
 		id := c.Param("id")
@@ -30,10 +30,156 @@ func RegisterRoutes(e *echo.Echo, db *mgo.Database, basePieURL string, service s
 	e.Post("/calculate", func(c *echo.Context) (err error) {
 		patientID := c.Form("patientId")
 		fhirEndpointURL := c.Form("fhirEndpointUrl")
-		key := fmt.Sprintf("%s@%s", patientID, fhirEndpointURL)
-		fnDelayer.Delay(key, func() {
-			service.Calculate(patientID, fhirEndpointURL, basePieURL)
-		})
+		job, err := queue.Enqueue(patientID, fhirEndpointURL, basePieURL)
+		if err == nil {
+			c.JSON(200, job)
+		}
+		return
+	})
+
+	e.Get("/jobs/:id", func(c *echo.Context) (err error) {
+		id := c.Param("id")
+		if bson.IsObjectIdHex(id) {
+			job, err := queue.Job(bson.ObjectIdHex(id))
+			if err == mgo.ErrNotFound {
+				return c.String(404, "Job not found")
+			} else if err != nil {
+				return err
+			}
+			c.JSON(200, job)
+		} else {
+			c.String(400, "Bad ID format for requested Job. Should be a BSON Id")
+		}
+		return
+	})
+
+	e.Get("/jobs", func(c *echo.Context) (err error) {
+		patientID := c.Query("patientId")
+		if patientID == "" {
+			return c.String(400, "The patientId parameter is required")
+		}
+		jobs, err := queue.PatientJobs(patientID, c.Query("fhirEndpointUrl"))
+		if err == nil {
+			c.JSON(200, jobs)
+		}
+		return
+	})
+
+	// Recalculations recalculate the risks for every patient on a FHIR server (e.g., after a plugin changes).  They
+	// run in the background, so these routes only start, resume, and report on them.
+	e.Post("/admin/recalculations", func(c *echo.Context) (err error) {
+		fhirEndpointURL := c.Form("fhirEndpointUrl")
+		if fhirEndpointURL == "" {
+			return c.String(400, "The fhirEndpointUrl parameter is required")
+		}
+		rc, err := recalculator.Create(fhirEndpointURL, basePieURL)
+		if err != nil {
+			return err
+		}
+		rc, err = recalculator.Go(rc.Id)
+		if err == nil {
+			c.JSON(200, rc)
+		}
+		return
+	})
+
+	e.Get("/admin/recalculations/:id", func(c *echo.Context) (err error) {
+		id := c.Param("id")
+		if !bson.IsObjectIdHex(id) {
+			return c.String(400, "Bad ID format for requested Recalculation. Should be a BSON Id")
+		}
+		rc, err := recalculator.Recalculation(bson.ObjectIdHex(id))
+		if err == mgo.ErrNotFound {
+			return c.String(404, "Recalculation not found")
+		} else if err == nil {
+			c.JSON(200, rc)
+		}
+		return
+	})
+
+	e.Post("/admin/recalculations/:id/resume", func(c *echo.Context) (err error) {
+		id := c.Param("id")
+		if !bson.IsObjectIdHex(id) {
+			return c.String(400, "Bad ID format for requested Recalculation. Should be a BSON Id")
+		}
+		rc, err := recalculator.Go(bson.ObjectIdHex(id))
+		if err == mgo.ErrNotFound {
+			return c.String(404, "Recalculation not found")
+		} else if err == ErrRecalculationNotResumable {
+			return c.String(409, err.Error())
+		} else if err == nil {
+			c.JSON(200, rc)
+		}
+		return
+	})
+
+	// The $risk-assessment operation synchronously calculates the risks for a patient and returns the resulting
+	// risk assessments and pies in a bundle.  Passing persist=false does a dry run that doesn't save anything.
+	riskAssessmentOperation := func(c *echo.Context) (err error) {
+		fhirEndpointURL := c.Form("fhirEndpointUrl")
+		if fhirEndpointURL == "" {
+			return c.String(400, "The fhirEndpointUrl parameter is required")
+		}
+		options := service.CalculationOptions{Method: c.Form("method")}
+		switch c.Form("persist") {
+		case "", "true":
+		case "false":
+			options.DryRun = true
+		default:
+			return c.String(400, "The persist parameter must be true or false")
+		}
+		if asOf := c.Form("asOf"); asOf != "" {
+			t, err := service.ParseAsOf(asOf)
+			if err != nil {
+				return c.String(400, err.Error())
+			}
+			// Saving results as of a past date would replace the patient's current risk assessments
+			if !options.DryRun {
+				return c.String(400, "The asOf parameter can only be used when persist=false")
+			}
+			options.AsOf = &t
+		}
+
+		results, _, err := svc.CalculateWithOptions(c.Param("id"), fhirEndpointURL, basePieURL, options)
+		if _, ok := err.(service.UnknownMethodError); ok {
+			return c.String(400, err.Error())
+		} else if err != nil {
+			return c.String(500, err.Error())
+		}
+		c.JSON(200, service.ResultsBundle(results, basePieURL))
+		return
+	}
+	e.Get("/Patient/:id/$risk-assessment", riskAssessmentOperation)
+	e.Post("/Patient/:id/$risk-assessment", riskAssessmentOperation)
+
+	// The $evaluate operation calculates the risks for the patient in the posted bundle, without using a FHIR
+	// server, and returns the resulting risk assessments and pies in a bundle.  Nothing is saved.
+	e.Post("/$evaluate", func(c *echo.Context) (err error) {
+		data, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		bundle, err := service.UnmarshalBundle(data)
+		if err != nil {
+			return c.String(400, "The request body must be a FHIR bundle")
+		}
+		options := service.CalculationOptions{Method: c.Query("method")}
+		if asOf := c.Query("asOf"); asOf != "" {
+			t, err := service.ParseAsOf(asOf)
+			if err != nil {
+				return c.String(400, err.Error())
+			}
+			options.AsOf = &t
+		}
+
+		results, outcome, err := svc.Evaluate(bundle, basePieURL, options)
+		if err != nil && outcome.Err() == nil {
+			// The plugins didn't fail, so the problem is with the request (e.g., an unknown method or a bad bundle)
+			return c.String(400, err.Error())
+		} else if err != nil {
+			return c.String(500, err.Error())
+		}
+		c.JSON(200, service.ResultsBundle(results, basePieURL))
 		return
 	})
 }
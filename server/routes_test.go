@@ -2,28 +2,36 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os/exec"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/intervention-engine/riskservice/service"
 	"github.com/labstack/echo"
 	"github.com/pebbe/util"
 	. "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/mgo.v2/dbtest"
 )
 
 type RoutesSuite struct {
-	DBServer    *dbtest.DBServer
-	Database    *mgo.Database
-	Server      *httptest.Server
-	MockService *MockService
+	DBServer     *dbtest.DBServer
+	Database     *mgo.Database
+	Server       *httptest.Server
+	MockService  *MockService
+	Queue        *CalculationQueue
+	Recalculator *Recalculator
 }
 
 func Test(t *testing.T) { TestingT(t) }
@@ -31,6 +39,10 @@ func Test(t *testing.T) { TestingT(t) }
 var _ = Suite(&RoutesSuite{})
 
 func (r *RoutesSuite) SetUpSuite(c *C) {
+	if _, err := exec.LookPath("mongod"); err != nil {
+		c.Skip("mongod is not installed")
+	}
+
 	r.DBServer = &dbtest.DBServer{}
 	r.DBServer.SetPath(c.MkDir())
 }
@@ -40,17 +52,24 @@ func (r *RoutesSuite) SetUpTest(c *C) {
 	r.MockService = &MockService{}
 	e := echo.New()
 	r.Server = httptest.NewServer(e)
-	RegisterRoutes(e, r.Database, "http://foo.com", r.MockService, NewFunctionDelayer(500*time.Millisecond))
+	r.Queue = NewCalculationQueue(r.Database, r.MockService, testQueueConfig(500*time.Millisecond))
+	util.CheckErr(r.Queue.Start())
+	r.Recalculator = NewRecalculator(r.Database, r.Queue, DefaultRecalculationConfig())
+	RegisterRoutes(e, r.Database, "http://foo.com", r.MockService, r.Queue, r.Recalculator)
 }
 
 func (r *RoutesSuite) TearDownTest(c *C) {
+	r.Queue.Stop()
+	r.Recalculator.Stop()
 	r.Server.Close()
 	r.Database.Session.Close()
 	r.DBServer.Wipe()
 }
 
 func (r *RoutesSuite) TearDownSuite(c *C) {
-	r.DBServer.Stop()
+	if r.DBServer != nil {
+		r.DBServer.Stop()
+	}
 }
 
 func (r *RoutesSuite) TestPieRoute(c *C) {
@@ -115,7 +134,267 @@ func (r *RoutesSuite) TestMultipleCalculateRequests(c *C) {
 
 }
 
-func (r *RoutesSuite) postCalculate(c *C, patientID, fhirEndpointURL string) {
+func (r *RoutesSuite) TestCalculateRouteReturnsJob(c *C) {
+	job := r.postCalculate(c, "123", "http://example.org/fhir")
+	c.Assert(job.Id.Valid(), Equals, true)
+	c.Assert(job.PatientID, Equals, "123")
+	c.Assert(job.FHIREndpointURL, Equals, "http://example.org/fhir")
+	c.Assert(job.Status, Equals, JobDebouncing)
+	c.Assert(job.Outcome, IsNil)
+
+	// Another request for the same patient should return the same job
+	job2 := r.postCalculate(c, "123", "http://example.org/fhir")
+	c.Assert(job2.Id, Equals, job.Id)
+}
+
+func (r *RoutesSuite) TestJobRoute(c *C) {
+	job := r.postCalculate(c, "123", "http://example.org/fhir")
+
+	// It should be debouncing right away
+	fetched := r.getJob(c, job.Id.Hex())
+	c.Assert(fetched.Status, Equals, JobDebouncing)
+	c.Assert(fetched.Started, IsNil)
+	c.Assert(fetched.Finished, IsNil)
+
+	// After the calculation, it should report success along with the plugin outcomes
+	time.Sleep(600 * time.Millisecond)
+	fetched = r.getJob(c, job.Id.Hex())
+	c.Assert(fetched.Status, Equals, JobSucceeded)
+	c.Assert(fetched.Attempts, Equals, 1)
+	c.Assert(fetched.LastError, Equals, "")
+	c.Assert(fetched.Started, NotNil)
+	c.Assert(fetched.Finished, NotNil)
+	c.Assert(fetched.Finished.Before(*fetched.Started), Equals, false)
+	c.Assert(fetched.Outcome, NotNil)
+	c.Assert(fetched.Outcome.Plugins, DeepEquals, []service.PluginOutcome{
+		{Name: "Mock", Method: "Mock", Status: service.PluginScored, Results: 1},
+	})
+}
+
+func (r *RoutesSuite) TestJobRouteWithError(c *C) {
+	r.MockService.Errors = []error{errors.New("Boom")}
+	// Make sure it doesn't retry before we check on it
+	r.Queue.config.RetryBackoff = time.Hour
+	job := r.postCalculate(c, "123", "http://example.org/fhir")
+
+	time.Sleep(600 * time.Millisecond)
+	fetched := r.getJob(c, job.Id.Hex())
+	c.Assert(fetched.Status, Equals, JobRetrying)
+	c.Assert(fetched.Attempts, Equals, 1)
+	c.Assert(fetched.LastError, Equals, "Boom")
+	c.Assert(fetched.Outcome.Plugins, DeepEquals, []service.PluginOutcome{
+		{Name: "Mock", Method: "Mock", Status: service.PluginError, Error: "Boom"},
+	})
+}
+
+func (r *RoutesSuite) TestJobRouteBadRequests(c *C) {
+	resp, err := http.Get(r.Server.URL + "/jobs/foo")
+	util.CheckErr(err)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	resp, err = http.Get(r.Server.URL + "/jobs/507f1f77bcf86cd799439001")
+	util.CheckErr(err)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+	resp, err = http.Get(r.Server.URL + "/jobs")
+	util.CheckErr(err)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (r *RoutesSuite) TestPatientJobsRoute(c *C) {
+	first := r.postCalculate(c, "123", "http://example.org/fhir")
+	r.postCalculate(c, "456", "http://example.org/fhir")
+	time.Sleep(600 * time.Millisecond)
+	second := r.postCalculate(c, "123", "http://example.org/fhir")
+	third := r.postCalculate(c, "123", "http://example.org/fhir2")
+
+	jobs := r.getJobs(c, "patientId=123")
+	c.Assert(jobs, HasLen, 3)
+	c.Assert(jobs[0].Id, Equals, third.Id)
+	c.Assert(jobs[0].Status, Equals, JobDebouncing)
+	c.Assert(jobs[1].Id, Equals, second.Id)
+	c.Assert(jobs[1].Status, Equals, JobDebouncing)
+	c.Assert(jobs[2].Id, Equals, first.Id)
+	c.Assert(jobs[2].Status, Equals, JobSucceeded)
+
+	jobs = r.getJobs(c, "patientId=123&fhirEndpointUrl="+url.QueryEscape("http://example.org/fhir2"))
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(jobs[0].Id, Equals, third.Id)
+
+	jobs = r.getJobs(c, "patientId=789")
+	c.Assert(jobs, HasLen, 0)
+}
+
+func (r *RoutesSuite) TestRecalculationRoutes(c *C) {
+	// A FHIR server without any patients
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(&models.Bundle{Type: "searchset"})
+	}))
+	defer fhirServer.Close()
+
+	resp, err := http.PostForm(r.Server.URL+"/admin/recalculations", url.Values{"fhirEndpointUrl": {fhirServer.URL}})
+	util.CheckErr(err)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	rc := new(Recalculation)
+	util.CheckErr(json.NewDecoder(resp.Body).Decode(rc))
+	resp.Body.Close()
+	c.Assert(rc.FHIREndpointURL, Equals, fhirServer.URL)
+	c.Assert(rc.BasisPieURL, Equals, "http://foo.com")
+	c.Assert(rc.Status, Equals, RecalculationRunning)
+
+	time.Sleep(100 * time.Millisecond)
+	resp, err = http.Get(r.Server.URL + "/admin/recalculations/" + rc.Id.Hex())
+	util.CheckErr(err)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	util.CheckErr(json.NewDecoder(resp.Body).Decode(rc))
+	resp.Body.Close()
+	c.Assert(rc.Status, Equals, RecalculationCompleted)
+	c.Assert(rc.Total, Equals, 0)
+
+	// A completed recalculation can't be resumed
+	resp, err = http.PostForm(r.Server.URL+"/admin/recalculations/"+rc.Id.Hex()+"/resume", nil)
+	util.CheckErr(err)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusConflict)
+}
+
+func (r *RoutesSuite) TestRecalculationRoutesBadRequests(c *C) {
+	resp, err := http.PostForm(r.Server.URL+"/admin/recalculations", nil)
+	util.CheckErr(err)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	resp, err = http.Get(r.Server.URL + "/admin/recalculations/foo")
+	util.CheckErr(err)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	resp, err = http.Get(r.Server.URL + "/admin/recalculations/" + bson.NewObjectId().Hex())
+	util.CheckErr(err)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+	resp, err = http.PostForm(r.Server.URL+"/admin/recalculations/"+bson.NewObjectId().Hex()+"/resume", nil)
+	util.CheckErr(err)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (r *RoutesSuite) TestRiskAssessmentOperation(c *C) {
+	params := url.Values{}
+	params.Set("fhirEndpointUrl", "http://example.org/fhir")
+	params.Set("method", "CHADS")
+	params.Set("persist", "false")
+	params.Set("asOf", "2015-01-01")
+	resp, err := http.Get(r.Server.URL + "/Patient/123/$risk-assessment?" + params.Encode())
+	util.CheckErr(err)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	// It should have calculated right away, without waiting for the queue
+	r.MockService.AssertCalls(c,
+		MockServiceCallParams{patientID: "123", fhirEndpointURL: "http://example.org/fhir", basePieURL: "http://foo.com"})
+	c.Assert(r.MockService.Options, HasLen, 1)
+	options := r.MockService.Options[0]
+	c.Assert(options.Method, Equals, "CHADS")
+	c.Assert(options.DryRun, Equals, true)
+	c.Assert(options.AsOf, NotNil)
+	c.Assert(options.AsOf.Equal(time.Date(2015, time.January, 2, 0, 0, 0, 0, time.Local).Add(-time.Nanosecond)), Equals, true)
+
+	// The bundle should contain the risk assessment and the pie it references
+	bundle := new(models.Bundle)
+	util.CheckErr(json.NewDecoder(resp.Body).Decode(bundle))
+	c.Assert(bundle.Type, Equals, "collection")
+	c.Assert(bundle.Entry, HasLen, 2)
+	ra, ok := bundle.Entry[0].Resource.(*models.RiskAssessment)
+	c.Assert(ok, Equals, true)
+	c.Assert(ra.Subject.Reference, Equals, "Patient/123")
+	c.Assert(*ra.Prediction[0].ProbabilityDecimal, Equals, float64(1))
+	c.Assert(ra.Basis, HasLen, 1)
+	c.Assert(bundle.Entry[1].FullUrl, Equals, ra.Basis[0].Reference)
+}
+
+func (r *RoutesSuite) TestRiskAssessmentOperationWithPost(c *C) {
+	formData := url.Values{}
+	formData.Set("fhirEndpointUrl", "http://example.org/fhir")
+	resp, err := http.PostForm(r.Server.URL+"/Patient/123/$risk-assessment", formData)
+	util.CheckErr(err)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(r.MockService.Options, DeepEquals, []service.CalculationOptions{{}})
+}
+
+func (r *RoutesSuite) TestRiskAssessmentOperationBadRequests(c *C) {
+	for _, query := range []string{
+		"",
+		"fhirEndpointUrl=http://example.org/fhir&persist=maybe",
+		"fhirEndpointUrl=http://example.org/fhir&persist=false&asOf=yesterday",
+		"fhirEndpointUrl=http://example.org/fhir&asOf=2015-01-01",
+	} {
+		resp, err := http.Get(r.Server.URL + "/Patient/123/$risk-assessment?" + query)
+		util.CheckErr(err)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+	}
+	r.MockService.AssertCalls(c)
+}
+
+func (r *RoutesSuite) TestRiskAssessmentOperationWithError(c *C) {
+	r.MockService.Errors = []error{errors.New("Boom")}
+	resp, err := http.Get(r.Server.URL + "/Patient/123/$risk-assessment?fhirEndpointUrl=http://example.org/fhir")
+	util.CheckErr(err)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusInternalServerError)
+}
+
+func (r *RoutesSuite) TestEvaluateOperation(c *C) {
+	patient := &models.Patient{Gender: "male"}
+	patient.Id = "123"
+	bundle := &models.Bundle{
+		Type:  "collection",
+		Entry: []models.BundleEntryComponent{{Resource: patient}},
+	}
+	data, err := json.Marshal(bundle)
+	util.CheckErr(err)
+	resp, err := http.Post(r.Server.URL+"/$evaluate?method=CHADS&asOf=2015-01-01T00:00:00Z", "application/json", bytes.NewBuffer(data))
+	util.CheckErr(err)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	r.MockService.AssertCalls(c, MockServiceCallParams{patientID: "123", fhirEndpointURL: "", basePieURL: "http://foo.com"})
+	c.Assert(r.MockService.Options, HasLen, 1)
+	c.Assert(r.MockService.Options[0].Method, Equals, "CHADS")
+	c.Assert(r.MockService.Options[0].AsOf.Equal(time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)), Equals, true)
+
+	results := new(models.Bundle)
+	util.CheckErr(json.NewDecoder(resp.Body).Decode(results))
+	c.Assert(results.Type, Equals, "collection")
+	c.Assert(results.Entry, HasLen, 2)
+	ra, ok := results.Entry[0].Resource.(*models.RiskAssessment)
+	c.Assert(ok, Equals, true)
+	c.Assert(ra.Subject.Reference, Equals, "Patient/123")
+	c.Assert(results.Entry[1].FullUrl, Equals, ra.Basis[0].Reference)
+}
+
+func (r *RoutesSuite) TestEvaluateOperationBadRequests(c *C) {
+	// Not a bundle
+	resp, err := http.Post(r.Server.URL+"/$evaluate", "application/json", strings.NewReader("Hello!"))
+	util.CheckErr(err)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	// No patient
+	resp, err = http.Post(r.Server.URL+"/$evaluate", "application/json", strings.NewReader(`{"resourceType": "Bundle", "type": "collection"}`))
+	util.CheckErr(err)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+	r.MockService.AssertCalls(c)
+}
+
+func (r *RoutesSuite) postCalculate(c *C, patientID, fhirEndpointURL string) *CalculationJob {
 	// Post the calculate request
 	calcURL := fmt.Sprintf("%s/calculate", r.Server.URL)
 	formData := url.Values{}
@@ -123,21 +402,105 @@ func (r *RoutesSuite) postCalculate(c *C, patientID, fhirEndpointURL string) {
 	formData.Set("fhirEndpointUrl", fhirEndpointURL)
 	resp, err := http.PostForm(calcURL, formData)
 	util.CheckErr(err)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	job := new(CalculationJob)
+	util.CheckErr(json.NewDecoder(resp.Body).Decode(job))
+	return job
+}
+
+func (r *RoutesSuite) getJob(c *C, id string) *CalculationJob {
+	resp, err := http.Get(fmt.Sprintf("%s/jobs/%s", r.Server.URL, id))
+	util.CheckErr(err)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	job := new(CalculationJob)
+	util.CheckErr(json.NewDecoder(resp.Body).Decode(job))
+	return job
+}
+
+func (r *RoutesSuite) getJobs(c *C, query string) []CalculationJob {
+	resp, err := http.Get(fmt.Sprintf("%s/jobs?%s", r.Server.URL, query))
+	util.CheckErr(err)
+	defer resp.Body.Close()
 	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	var jobs []CalculationJob
+	util.CheckErr(json.NewDecoder(resp.Body).Decode(&jobs))
+	return jobs
 }
 
 type MockService struct {
 	sync.Mutex
 	Calls []MockServiceCallParams
+	// Errors are returned (in order) by the first calls to Calculate
+	Errors []error
+	// Options records the options passed to each call to CalculateWithOptions
+	Options []service.CalculationOptions
+	// Delay is how long each call to Calculate takes
+	Delay time.Duration
 }
 
 // Calculate makes MockService fulfill the RiskService interface
-func (m *MockService) Calculate(patientID string, fhirEndpointURL string, basePieURL string) error {
+func (m *MockService) Calculate(patientID string, fhirEndpointURL string, basePieURL string) (*service.CalculationOutcome, error) {
 	params := MockServiceCallParams{patientID: patientID, fhirEndpointURL: fhirEndpointURL, basePieURL: basePieURL}
+	time.Sleep(m.Delay)
 	m.Lock()
 	defer m.Unlock()
 	m.Calls = append(m.Calls, params)
-	return nil
+	outcome := &service.CalculationOutcome{
+		Plugins: []service.PluginOutcome{{Name: "Mock", Method: "Mock", Status: service.PluginScored, Results: 1}},
+	}
+	if len(m.Errors) > 0 {
+		err := m.Errors[0]
+		m.Errors = m.Errors[1:]
+		outcome.Plugins[0] = service.PluginOutcome{Name: "Mock", Method: "Mock", Status: service.PluginError, Error: err.Error()}
+		return outcome, err
+	}
+	return outcome, nil
+}
+
+// CalculateWithOptions makes MockService fulfill the RiskService interface.  It returns a single result with one
+// risk assessment and its pie.
+func (m *MockService) CalculateWithOptions(patientID string, fhirEndpointURL string, basePieURL string, options service.CalculationOptions) ([]service.PluginResults, *service.CalculationOutcome, error) {
+	outcome, err := m.Calculate(patientID, fhirEndpointURL, basePieURL)
+	m.Lock()
+	defer m.Unlock()
+	m.Options = append(m.Options, options)
+	if err != nil {
+		return nil, outcome, err
+	}
+	score := 1
+	result := plugin.RiskServiceCalculationResult{
+		AsOf:  time.Date(2014, time.January, 17, 20, 35, 0, 0, time.UTC),
+		Score: &score,
+		Pie:   plugin.NewPie(fhirEndpointURL + "/Patient/" + patientID),
+	}
+	config := plugin.RiskServicePluginConfig{
+		Name:   "Mock",
+		Method: models.CodeableConcept{Coding: []models.Coding{{System: "http://example.org", Code: "Mock"}}},
+	}
+	return []service.PluginResults{
+		{
+			Name:            "Mock",
+			RiskAssessments: []*models.RiskAssessment{result.ToRiskAssessment(patientID, basePieURL, config)},
+			Pies:            []*plugin.Pie{result.Pie},
+		},
+	}, outcome, nil
+}
+
+// Evaluate makes MockService fulfill the RiskService interface.  It records the call using the patient in the
+// bundle and an empty FHIR endpoint URL.
+func (m *MockService) Evaluate(bundle *models.Bundle, basePieURL string, options service.CalculationOptions) ([]service.PluginResults, *service.CalculationOutcome, error) {
+	var patientID string
+	for _, entry := range bundle.Entry {
+		if patient, ok := entry.Resource.(*models.Patient); ok {
+			patientID = patient.Id
+		}
+	}
+	if patientID == "" {
+		return nil, new(service.CalculationOutcome), errors.New("The bundle must contain a patient")
+	}
+	return m.CalculateWithOptions(patientID, "", basePieURL, options)
 }
 
 func (m *MockService) reset() {
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// UnmarshalBundle decodes a bundle from its JSON.  Unlike decoding directly into a models.Bundle, dates that are
+// only known to the year or month (e.g., an onset of "2009" or "2009-04") aren't lost.  The FHIR models can't parse
+// them, so they're decoded as the start of the year or month, with the plugin.Year or plugin.YearMonth precision.
+func UnmarshalBundle(data []byte) (*models.Bundle, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var raw interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	var partials []partialDate
+	raw = findPartialDates(raw, bundleType, nil, &partials)
+	if len(partials) > 0 {
+		var err error
+		if data, err = json.Marshal(raw); err != nil {
+			return nil, err
+		}
+	}
+	bundle := new(models.Bundle)
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return nil, err
+	}
+	for _, p := range partials {
+		if date, ok := p.in(reflect.ValueOf(bundle)); ok {
+			date.Precision = p.precision
+		}
+	}
+	return bundle, nil
+}
+
+// RoundTripBundle converts a bundle (or anything with a bundle's JSON, like a data access layer's search results)
+// to a *models.Bundle through JSON.  The FHIR models write dates with the plugin.Year or plugin.YearMonth precision
+// as full dates, so those precisions are found in the original and restored in the copy.
+func RoundTripBundle(v interface{}) (*models.Bundle, error) {
+	var partials []partialDate
+	findImpreciseDates(reflect.ValueOf(v), nil, &partials)
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := UnmarshalBundle(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range partials {
+		if date, ok := p.in(reflect.ValueOf(bundle)); ok {
+			date.Precision = p.precision
+		}
+	}
+	return bundle, nil
+}
+
+var (
+	bundleType       = reflect.TypeOf(models.Bundle{})
+	fhirDateTimeType = reflect.TypeOf(models.FHIRDateTime{})
+	partialDateRegex = regexp.MustCompile(`^\d{4}(-\d{2})?$`)
+)
+
+// partialDate is a date in a bundle's JSON that's only known to the year or month.  Path is where it is, as the
+// JSON names of the fields and the indexes of the array elements on the way to it.
+type partialDate struct {
+	path      []interface{}
+	precision models.Precision
+}
+
+// in returns the date in the decoded bundle, or false if it isn't there.
+func (p partialDate) in(v reflect.Value) (*models.FHIRDateTime, bool) {
+	for _, step := range p.path {
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return nil, false
+			}
+			v = v.Elem()
+		}
+		switch step := step.(type) {
+		case string:
+			if v.Kind() != reflect.Struct {
+				return nil, false
+			}
+			field, ok := jsonField(v.Type(), step)
+			if !ok {
+				return nil, false
+			}
+			v = v.FieldByIndex(field.Index)
+		case int:
+			if v.Kind() != reflect.Slice || step >= v.Len() {
+				return nil, false
+			}
+			v = v.Index(step)
+		}
+	}
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil, false
+	}
+	date, ok := v.Interface().(*models.FHIRDateTime)
+	return date, ok
+}
+
+// findPartialDates walks the JSON of a value of type t, replacing the dates that are only known to the year or
+// month with the first day of the year or month, and recording where they were.  It returns the JSON with the
+// dates replaced.  Only the JSON of FHIRDateTime fields is replaced, so a code or string that happens to look like
+// a year is left alone.
+func findPartialDates(raw interface{}, t reflect.Type, path []interface{}, partials *[]partialDate) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == fhirDateTimeType {
+		s, ok := raw.(string)
+		if !ok || !partialDateRegex.MatchString(s) {
+			return raw
+		}
+		precision, layout := plugin.Year, "2006"
+		if len(s) > 4 {
+			precision, layout = plugin.YearMonth, "2006-01"
+		}
+		date, err := time.Parse(layout, s)
+		if err != nil {
+			return raw
+		}
+		*partials = append(*partials, partialDate{path: append([]interface{}(nil), path...), precision: precision})
+		return date.Format("2006-01-02")
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if m, ok := raw.(map[string]interface{}); ok {
+			for name, value := range m {
+				if field, ok := jsonField(t, name); ok {
+					m[name] = findPartialDates(value, field.Type, append(path, name), partials)
+				}
+			}
+		}
+	case reflect.Slice:
+		if a, ok := raw.([]interface{}); ok {
+			for i, value := range a {
+				a[i] = findPartialDates(value, t.Elem(), append(path, i), partials)
+			}
+		}
+	case reflect.Interface:
+		// Resources (e.g., a bundle entry's resource or a contained resource) are decoded by their resourceType
+		if m, ok := raw.(map[string]interface{}); ok {
+			if resourceType, ok := m["resourceType"].(string); ok {
+				if resource := models.MapToResource(map[string]interface{}{"resourceType": resourceType}, true); resource != nil {
+					return findPartialDates(raw, reflect.TypeOf(resource), path, partials)
+				}
+			}
+		}
+	}
+	return raw
+}
+
+// findImpreciseDates walks a value, recording where the dates with the plugin.Year or plugin.YearMonth precision
+// are in its JSON.
+func findImpreciseDates(v reflect.Value, path []interface{}, partials *[]partialDate) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if v.Type() == fhirDateTimeType {
+			if precision := v.Interface().(models.FHIRDateTime).Precision; precision == plugin.Year || precision == plugin.YearMonth {
+				*partials = append(*partials, partialDate{path: append([]interface{}(nil), path...), precision: precision})
+			}
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if field.PkgPath != "" || name == "-" {
+				continue
+			}
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				findImpreciseDates(v.Field(i), path, partials)
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			findImpreciseDates(v.Field(i), append(path, name), partials)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			findImpreciseDates(v.Index(i), append(path, i), partials)
+		}
+	}
+}
+
+// jsonField returns the field of the struct type with the given JSON name, including the fields of embedded
+// structs (e.g., a resource's DomainResource).
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tagName := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.Anonymous && tagName == "" && field.Type.Kind() == reflect.Struct {
+			if embedded, ok := jsonField(field.Type, name); ok {
+				embedded.Index = append([]int{i}, embedded.Index...)
+				return embedded, true
+			}
+			continue
+		}
+		if tagName == name || (tagName == "" && field.Name == name) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
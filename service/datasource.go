@@ -0,0 +1,293 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// PatientDataSource provides the data that the plugins need to calculate a patient's risks.
+type PatientDataSource interface {
+	// PatientData returns a bundle containing the patient and the patient's resources of the given types.  If the
+	// data source had to stop before getting all of the data (e.g., because it hit a limit on the number of pages),
+	// the bundle has a "next" link to the data that was left out.
+	PatientData(patientID string, resourceTypes []string) (*models.Bundle, error)
+}
+
+// ObservationDataSource is implemented by data sources that can get just the patient's observations with
+// particular LOINC codes.  The risk service uses it when every plugin that needs observations says which ones it
+// needs, so it doesn't have to get all of the patient's vital signs and lab results.
+type ObservationDataSource interface {
+	// PatientObservations returns a bundle containing the patient's observations with any of the given LOINC codes.
+	PatientObservations(patientID string, loincCodes []string) (*models.Bundle, error)
+}
+
+// DefaultMaxPages is the default limit on the number of pages of search results that a data source retrieves for
+// a single patient.  It keeps a misbehaving server (e.g., one whose next links go around in circles) from tying up
+// a calculation forever.
+const DefaultMaxPages = 50
+
+// FHIRDataSource gets patient data from a FHIR server over HTTP, using a Patient search with _revinclude
+// parameters for the required resource types.  Paged search results are followed until there are no more pages
+// or MaxPages pages have been retrieved.
+type FHIRDataSource struct {
+	FHIREndpointURL string
+	MaxPages        int
+}
+
+// NewFHIRDataSource returns a data source for the patients on the FHIR server at the given URL.
+func NewFHIRDataSource(fhirEndpointURL string) *FHIRDataSource {
+	return &FHIRDataSource{FHIREndpointURL: fhirEndpointURL, MaxPages: DefaultMaxPages}
+}
+
+// PatientData fulfills the PatientDataSource interface.
+func (f *FHIRDataSource) PatientData(patientID string, resourceTypes []string) (*models.Bundle, error) {
+	queryURL, err := url.Parse(f.FHIREndpointURL + "/Patient")
+	if err != nil {
+		return nil, err
+	}
+	queryURL.RawQuery = patientDataQuery(patientID, resourceTypes).Encode()
+	return f.search(patientID, queryURL)
+}
+
+// PatientObservations fulfills the ObservationDataSource interface.
+func (f *FHIRDataSource) PatientObservations(patientID string, loincCodes []string) (*models.Bundle, error) {
+	queryURL, err := url.Parse(f.FHIREndpointURL + "/Observation")
+	if err != nil {
+		return nil, err
+	}
+	queryURL.RawQuery = observationQuery(patientID, loincCodes).Encode()
+	return f.search(patientID, queryURL)
+}
+
+func (f *FHIRDataSource) search(patientID string, queryURL *url.URL) (*models.Bundle, error) {
+	return getAllPages(queryURL.String(), f.MaxPages, func(pageURL string) (*models.Bundle, error) {
+		response, err := http.Get(pageURL)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != 200 {
+			return nil, fmt.Errorf("Unable to retrieve data for patient %s.  Received response code: %d", patientID, response.StatusCode)
+		}
+		data, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+		return UnmarshalBundle(data)
+	})
+}
+
+// DataAccessLayerDataSource gets patient data directly from a FHIR server's data access layer.  This allows the
+// risk service to be embedded in the same process as the FHIR server.  Like the FHIRDataSource, it follows paged
+// search results until there are no more pages or MaxPages pages have been retrieved.
+type DataAccessLayerDataSource struct {
+	DAL      server.DataAccessLayer
+	MaxPages int
+}
+
+// NewDataAccessLayerDataSource returns a data source backed by the given data access layer.
+func NewDataAccessLayerDataSource(dal server.DataAccessLayer) *DataAccessLayerDataSource {
+	return &DataAccessLayerDataSource{DAL: dal, MaxPages: DefaultMaxPages}
+}
+
+// PatientData fulfills the PatientDataSource interface.
+func (d *DataAccessLayerDataSource) PatientData(patientID string, resourceTypes []string) (*models.Bundle, error) {
+	return d.searchAllPages("Patient", patientDataQuery(patientID, resourceTypes))
+}
+
+// PatientObservations fulfills the ObservationDataSource interface.
+func (d *DataAccessLayerDataSource) PatientObservations(patientID string, loincCodes []string) (*models.Bundle, error) {
+	return d.searchAllPages("Observation", observationQuery(patientID, loincCodes))
+}
+
+func (d *DataAccessLayerDataSource) searchAllPages(resource string, params url.Values) (*models.Bundle, error) {
+	firstPage := resource + "?" + params.Encode()
+	return getAllPages(firstPage, d.MaxPages, func(pageURL string) (*models.Bundle, error) {
+		// The data access layer's paging links only carry the search parameters, so that's all we need
+		u, err := url.Parse(pageURL)
+		if err != nil {
+			return nil, err
+		}
+		return d.search(search.Query{Resource: resource, Query: u.RawQuery})
+	})
+}
+
+func (d *DataAccessLayerDataSource) search(query search.Query) (*models.Bundle, error) {
+	result, err := d.DAL.Search(url.URL{}, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Searches with _revinclude return the patient as a PatientPlus (with its related resources attached), so
+	// round-trip the bundle through JSON to get the same resource types that a FHIR server would return
+	return RoundTripBundle(result)
+}
+
+// FileDataSource gets patient data from bundles stored in a directory, one per patient.  The bundle for a patient
+// is expected to be in a file named with the patient's ID and a .json extension.  Resources that aren't of the
+// requested types are left out, so plugins see the same data they would get from a FHIR server.
+type FileDataSource struct {
+	Dir string
+}
+
+// NewFileDataSource returns a data source for the patient bundles in the given directory.
+func NewFileDataSource(dir string) *FileDataSource {
+	return &FileDataSource{Dir: dir}
+}
+
+// PatientData fulfills the PatientDataSource interface.
+func (f *FileDataSource) PatientData(patientID string, resourceTypes []string) (*models.Bundle, error) {
+	bundle, err := f.readBundle(patientID)
+	if err != nil {
+		return nil, err
+	}
+	return filterBundle(bundle, resourceTypes), nil
+}
+
+// PatientObservations fulfills the ObservationDataSource interface.
+func (f *FileDataSource) PatientObservations(patientID string, loincCodes []string) (*models.Bundle, error) {
+	bundle, err := f.readBundle(patientID)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]models.BundleEntryComponent, 0, len(bundle.Entry))
+	for _, entry := range bundle.Entry {
+		if o, ok := entry.Resource.(*models.Observation); ok && observationHasCode(o, loincCodes) {
+			entries = append(entries, entry)
+		}
+	}
+	bundle.Entry = entries
+	return bundle, nil
+}
+
+func (f *FileDataSource) readBundle(patientID string) (*models.Bundle, error) {
+	// Don't allow the patient ID to escape the directory
+	if patientID == "" || filepath.Base(patientID) != patientID {
+		return nil, fmt.Errorf("Invalid patient ID: %s", patientID)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(f.Dir, patientID+".json"))
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalBundle(data)
+}
+
+// getAllPages gets the first page of search results and follows the next links, combining the entries from each
+// page into the first page's bundle.  Resources that show up on more than one page are only included once.  If
+// maxPages pages are retrieved and there are still more, the combined bundle keeps the link to the next page.
+func getAllPages(firstPageURL string, maxPages int, getPage func(pageURL string) (*models.Bundle, error)) (*models.Bundle, error) {
+	bundle, err := getPage(firstPageURL)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	entries := uniqueEntries(bundle.Entry, seen, nil)
+
+	next := NextPageURL(bundle)
+	for pages := 1; next != "" && (maxPages <= 0 || pages < maxPages); pages++ {
+		page, err := getPage(next)
+		if err != nil {
+			return nil, err
+		}
+		entries = uniqueEntries(page.Entry, seen, entries)
+		next = NextPageURL(page)
+	}
+
+	bundle.Entry = entries
+	bundle.Link = nil
+	if next != "" {
+		bundle.Link = []models.BundleLinkComponent{{Relation: "next", Url: next}}
+	}
+	return bundle, nil
+}
+
+// uniqueEntries appends the entries for resources that haven't been seen yet.
+func uniqueEntries(page []models.BundleEntryComponent, seen map[string]bool, entries []models.BundleEntryComponent) []models.BundleEntryComponent {
+	for _, entry := range page {
+		if entry.Resource != nil {
+			if key := resourceKey(entry.Resource); key != "" {
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// resourceKey returns the type and ID of a resource (e.g., "Patient/123"), or "" if it doesn't have an ID.
+func resourceKey(resource interface{}) string {
+	v := reflect.ValueOf(resource)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return ""
+	}
+	id := v.Elem().FieldByName("Id")
+	if !id.IsValid() || id.Kind() != reflect.String || id.String() == "" {
+		return ""
+	}
+	return v.Elem().Type().Name() + "/" + id.String()
+}
+
+// filterBundle removes the entries that aren't the patient or one of the given resource types.
+func filterBundle(bundle *models.Bundle, resourceTypes []string) *models.Bundle {
+	keep := map[string]bool{"Patient": true}
+	for _, t := range resourceTypes {
+		keep[t] = true
+	}
+	entries := make([]models.BundleEntryComponent, 0, len(bundle.Entry))
+	for _, entry := range bundle.Entry {
+		if entry.Resource != nil && keep[reflect.TypeOf(entry.Resource).Elem().Name()] {
+			entries = append(entries, entry)
+		}
+	}
+	bundle.Entry = entries
+	return bundle
+}
+
+// patientDataQuery returns the Patient search parameters for the patient and its resources of the given types.
+func patientDataQuery(patientID string, resourceTypes []string) url.Values {
+	params := url.Values{}
+	params.Set("_id", patientID)
+	for _, t := range resourceTypes {
+		params.Add("_revinclude", t+":patient")
+	}
+	return params
+}
+
+// observationQuery returns the Observation search parameters for the patient's observations with any of the given
+// LOINC codes.
+func observationQuery(patientID string, loincCodes []string) url.Values {
+	codes := make([]string, len(loincCodes))
+	for i := range loincCodes {
+		codes[i] = plugin.LOINCSystem + "|" + loincCodes[i]
+	}
+	params := url.Values{}
+	params.Set("patient", patientID)
+	params.Set("code", strings.Join(codes, ","))
+	return params
+}
+
+// observationHasCode returns true if the observation has any of the given LOINC codes.
+func observationHasCode(observation *models.Observation, loincCodes []string) bool {
+	if observation.Code == nil {
+		return false
+	}
+	for _, code := range loincCodes {
+		if observation.Code.MatchesCode(plugin.LOINCSystem, code) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,534 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// EventConverter converts a resource to the events that it represents.  A converter may return no events (e.g.,
+// for a condition that was refuted).  If it returns an error, the resource can't be used at all.  If the resource
+// doesn't have a usable date, the converter should return a start event with a zero Date; the conversion's
+// UndatedPolicy decides what happens to it.
+type EventConverter func(resource interface{}) ([]plugin.Event, error)
+
+var converters = struct {
+	sync.RWMutex
+	m map[string]EventConverter
+}{m: make(map[string]EventConverter)}
+
+func init() {
+	RegisterEventConverter("Condition", convertCondition)
+	RegisterEventConverter("MedicationStatement", convertMedicationStatement)
+	RegisterEventConverter("Observation", convertObservation)
+	RegisterEventConverter("Encounter", convertEncounter)
+	RegisterEventConverter("Procedure", convertProcedure)
+	RegisterEventConverter("AllergyIntolerance", convertAllergyIntolerance)
+	RegisterEventConverter("Immunization", convertImmunization)
+	RegisterEventConverter("FamilyMemberHistory", convertFamilyMemberHistory)
+	RegisterEventConverter("MedicationOrder", convertMedicationOrder)
+	RegisterEventConverter("MedicationDispense", convertMedicationDispense)
+	RegisterEventConverter("MedicationAdministration", convertMedicationAdministration)
+}
+
+// RegisterEventConverter registers the converter used to convert resources of the given type (e.g., "Encounter")
+// to events, replacing any converter that was previously registered for the type.  Registering a converter also
+// allows plugins to list the type in their required resource types.  Registering a nil converter makes the type
+// unsupported again.
+func RegisterEventConverter(resourceType string, converter EventConverter) {
+	converters.Lock()
+	defer converters.Unlock()
+	if converter == nil {
+		delete(converters.m, resourceType)
+		return
+	}
+	converters.m[resourceType] = converter
+}
+
+// eventConverter returns the converter registered for the given resource type, or nil if there isn't one.
+func eventConverter(resourceType string) EventConverter {
+	converters.RLock()
+	defer converters.RUnlock()
+	return converters.m[resourceType]
+}
+
+// UndatedPolicy says what to do with resources that don't have a usable date (e.g., problem list entries migrated
+// from a legacy system without their onset dates).
+type UndatedPolicy string
+
+// The supported policies for undated resources.  DropUndated leaves them out, which is the default.
+// UndatedSinceBirth treats them as present since the patient's birth, and UndatedAsOfLastUpdated dates them when
+// they were last updated (meta.lastUpdated).  If the date the policy calls for isn't available, the resource is
+// left out.  The policy only applies to the resource types in undatedPolicyTypes; undated resources of any other
+// type are always left out.
+const (
+	DropUndated            UndatedPolicy = "drop"
+	UndatedSinceBirth      UndatedPolicy = "birth"
+	UndatedAsOfLastUpdated UndatedPolicy = "lastUpdated"
+)
+
+// undatedPolicyTypes are the resource types the undated policy applies to.  They describe something the patient
+// has (a problem, a medication they take or a finding), which can sensibly be assumed present since birth or as of
+// the last update.  Undated encounters, procedures and the like are events that happened at some unknown time, and
+// dating them (e.g., an admission at birth) would only mislead the plugins.
+var undatedPolicyTypes = []string{"Condition", "MedicationStatement", "Observation"}
+
+// ParseUndatedPolicy returns the policy with the given name, or an error if there isn't one.
+func ParseUndatedPolicy(name string) (UndatedPolicy, error) {
+	switch policy := UndatedPolicy(name); policy {
+	case DropUndated, UndatedSinceBirth, UndatedAsOfLastUpdated:
+		return policy, nil
+	}
+	return "", fmt.Errorf("Unknown undated policy: %s.  Should be drop, birth or lastUpdated", name)
+}
+
+// ConversionOptions customizes how a bundle is converted to an EventStream.
+type ConversionOptions struct {
+	// Tolerant skips resources that can't be converted (because there is no converter registered for their type or
+	// because their converter failed) instead of failing the whole conversion.  The skipped resources are recorded
+	// in the conversion report.
+	Tolerant bool
+	// Undated is the policy for resources without a usable date.  The zero value drops them.
+	Undated UndatedPolicy
+	// CenterApproximateDates places events whose dates are only known to the year or month in the middle of the
+	// year or month instead of at its start, so their effects don't all pile up on January 1st or the 1st of the
+	// month.
+	CenterApproximateDates bool
+}
+
+// ConversionReport records the resources that were skipped when converting a bundle in tolerant mode.
+// Unsupported counts the skipped resources of each type that has no converter, and Warnings describes the
+// resources whose converter failed.  Undated lists the resources that didn't have a usable date, whatever the
+// undated policy did with them.
+type ConversionReport struct {
+	Unsupported map[string]int    `bson:"unsupported,omitempty" json:"unsupported,omitempty"`
+	Warnings    []string          `bson:"warnings,omitempty" json:"warnings,omitempty"`
+	Undated     []UndatedResource `bson:"undated,omitempty" json:"undated,omitempty"`
+}
+
+// UndatedResource records what happened to a resource without a usable date.  Resource identifies the resource
+// (e.g., "Condition/123"), Date is the date it was given (if any), and Dropped is true if it was left out.  End is
+// the date of the resource's end (e.g., a condition's abatement), if it had one; when the resource is dropped, its
+// end is dropped with it.
+type UndatedResource struct {
+	Resource string     `bson:"resource" json:"resource"`
+	Date     *time.Time `bson:"date,omitempty" json:"date,omitempty"`
+	Dropped  bool       `bson:"dropped,omitempty" json:"dropped,omitempty"`
+	End      *time.Time `bson:"end,omitempty" json:"end,omitempty"`
+}
+
+// Empty returns true if nothing was skipped and every resource had a date.
+func (r *ConversionReport) Empty() bool {
+	return len(r.Unsupported) == 0 && len(r.Warnings) == 0 && len(r.Undated) == 0
+}
+
+// String summarizes the report for logging, e.g. "skipped 2 Encounter, 1 Procedure".
+func (r *ConversionReport) String() string {
+	var types []string
+	for t := range r.Unsupported {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	s := "skipped"
+	for i, t := range types {
+		if i > 0 {
+			s += ","
+		}
+		s += fmt.Sprintf(" %d %s", r.Unsupported[t], t)
+	}
+	for i, w := range r.Warnings {
+		if i > 0 || len(types) > 0 {
+			s += ";"
+		}
+		s += " " + w
+	}
+	if len(r.Undated) > 0 {
+		if len(types) > 0 || len(r.Warnings) > 0 {
+			s += ";"
+		}
+		dropped := 0
+		for _, u := range r.Undated {
+			if u.Dropped {
+				dropped++
+			}
+		}
+		s += fmt.Sprintf(" %d undated (%d dropped)", len(r.Undated), dropped)
+	}
+	return s
+}
+
+// BundleToEventStream takes a bundle of resources and converts them to an EventStream.  Only the resource types
+// with a registered EventConverter are supported, with unsupported resource types resulting in an error.  If
+// the bundle contains more than one patient, this is also considered an error.
+func BundleToEventStream(bundle *models.Bundle) (es *plugin.EventStream, err error) {
+	es, _, err = BundleToEventStreamWithOptions(bundle, ConversionOptions{})
+	return es, err
+}
+
+// BundleToEventStreamWithOptions converts a bundle of resources to an EventStream like BundleToEventStream, but
+// in tolerant mode it skips the resources that can't be converted and reports them instead of failing.  More than
+// one patient is still an error, since there is no way to know whose data the bundle contains.
+func BundleToEventStreamWithOptions(bundle *models.Bundle, options ConversionOptions) (*plugin.EventStream, *ConversionReport, error) {
+	report := &ConversionReport{}
+	var patient *models.Patient
+	// The undated start events, each with the end events of the same resource, which go wherever the start does
+	type undatedEvent struct {
+		start plugin.Event
+		ends  []plugin.Event
+	}
+	var undated []undatedEvent
+	events := make([]plugin.Event, 0, len(bundle.Entry))
+	for i, entry := range bundle.Entry {
+		if entry.Resource == nil {
+			if !options.Tolerant {
+				return nil, report, fmt.Errorf("Entry %d has no resource", i)
+			}
+			report.Warnings = append(report.Warnings, fmt.Sprintf("Entry %d has no resource", i))
+			continue
+		}
+		if p, ok := entry.Resource.(*models.Patient); ok {
+			if patient != nil {
+				return nil, report, errors.New("Found more than one patient in resources")
+			}
+			patient = p
+			continue
+		}
+
+		resourceType := reflect.TypeOf(entry.Resource).Elem().Name()
+		convert := eventConverter(resourceType)
+		if convert == nil {
+			if !options.Tolerant {
+				return nil, report, fmt.Errorf("Unsupported: Converting %s to Event", resourceType)
+			}
+			if report.Unsupported == nil {
+				report.Unsupported = make(map[string]int)
+			}
+			report.Unsupported[resourceType]++
+			continue
+		}
+		converted, err := convert(entry.Resource)
+		if err != nil {
+			if !options.Tolerant {
+				return nil, report, err
+			}
+			report.Warnings = append(report.Warnings, fmt.Sprintf("Unable to convert %s: %v", describeResource(entry.Resource), err))
+			continue
+		}
+		var starts []undatedEvent
+		var ends []plugin.Event
+		for _, e := range converted {
+			if options.CenterApproximateDates && e.Approximate() {
+				e.Date = e.Midpoint()
+			}
+			switch {
+			case !e.End && e.Date.IsZero():
+				starts = append(starts, undatedEvent{start: e})
+			case e.End:
+				ends = append(ends, e)
+			default:
+				events = append(events, e)
+			}
+		}
+		// If the resource has a dated start, its ends belong to that; otherwise they share the undated start's fate
+		if len(starts) > 0 && len(starts) == len(converted)-len(ends) {
+			starts[0].ends = ends
+		} else {
+			events = append(events, ends...)
+		}
+		undated = append(undated, starts...)
+	}
+	for _, e := range undated {
+		u := UndatedResource{Resource: describeResource(e.start.Value)}
+		if len(e.ends) > 0 {
+			end := e.ends[0].Date
+			u.End = &end
+		}
+		if date, ok := undatedEventDate(e.start.Value, patient, options.Undated); ok {
+			e.start.Date = date
+			u.Date = &date
+			events = append(events, e.start)
+			events = append(events, e.ends...)
+		} else {
+			u.Dropped = true
+		}
+		report.Undated = append(report.Undated, u)
+	}
+	es := plugin.NewEventStream(patient)
+	plugin.SortEventsByDate(events)
+	es.Events = events
+	return es, report, nil
+}
+
+// undatedEventDate returns the date the undated policy gives an undated resource, or false if it should be left
+// out.
+func undatedEventDate(resource interface{}, patient *models.Patient, policy UndatedPolicy) (time.Time, bool) {
+	if !containsString(undatedPolicyTypes, reflect.TypeOf(resource).Elem().Name()) {
+		return time.Time{}, false
+	}
+	switch policy {
+	case UndatedSinceBirth:
+		if patient != nil && patient.BirthDate != nil {
+			return patient.BirthDate.Time, true
+		}
+	case UndatedAsOfLastUpdated:
+		v := reflect.ValueOf(resource)
+		if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			break
+		}
+		if field := v.Elem().FieldByName("Meta"); field.IsValid() {
+			if meta, ok := field.Interface().(*models.Meta); ok && meta != nil && meta.LastUpdated != nil {
+				return meta.LastUpdated.Time, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// describeResource identifies a resource for a warning, e.g. "Condition/123" (or just "Condition" if it has no
+// ID).
+func describeResource(resource interface{}) string {
+	if key := resourceKey(resource); key != "" {
+		return key
+	}
+	return reflect.TypeOf(resource).Elem().Name()
+}
+
+func convertCondition(resource interface{}) ([]plugin.Event, error) {
+	r := resource.(*models.Condition)
+	if r.VerificationStatus != "confirmed" {
+		return nil, nil
+	}
+	var events []plugin.Event
+	onset, _ := findDate(false, r.OnsetDateTime, r.OnsetPeriod, r.DateRecorded)
+	events = append(events, plugin.Event{Date: onset.Time, Type: "Condition", End: false, Value: r, Precision: onset.Precision})
+	if abatement, err := findDate(true, r.AbatementDateTime, r.AbatementPeriod); err == nil {
+		events = append(events, plugin.Event{Date: abatement.Time, Type: "Condition", End: true, Value: r, Precision: abatement.Precision})
+	} else if plugin.ResolvedClinicalStatus(r) {
+		// It's resolved but we don't know when, so the best we can do is when it was recorded or last updated
+		if resolved := resolutionDate(onset, r.DateRecorded, lastUpdated(r.Meta)); !resolved.Time.IsZero() {
+			events = append(events, plugin.Event{Date: resolved.Time, Type: "Condition", End: true, Value: r, Precision: resolved.Precision})
+		}
+	}
+	return events, nil
+}
+
+// resolutionDate returns the date to use as the end of something that resolved without saying when: the first of
+// the candidates (e.g., when a condition was recorded or last updated) that's there.  Since it can't have ended
+// before it started, candidates before the onset are skipped, and the onset is used if none are left.
+func resolutionDate(onset models.FHIRDateTime, candidates ...*models.FHIRDateTime) models.FHIRDateTime {
+	for _, date := range candidates {
+		if date != nil && !date.Time.Before(onset.Time) {
+			return *date
+		}
+	}
+	return onset
+}
+
+// lastUpdated returns when a resource was last updated, or nil if it doesn't say.
+func lastUpdated(meta *models.Meta) *models.FHIRDateTime {
+	if meta == nil {
+		return nil
+	}
+	return meta.LastUpdated
+}
+
+func convertMedicationStatement(resource interface{}) ([]plugin.Event, error) {
+	r := resource.(*models.MedicationStatement)
+	if r.Status == "" || r.Status == "entered-in-error" {
+		return nil, nil
+	}
+	var events []plugin.Event
+	active, _ := findDate(false, r.EffectiveDateTime, r.EffectivePeriod, r.DateAsserted)
+	events = append(events, plugin.Event{Date: active.Time, Type: "MedicationStatement", End: false, Value: r, Precision: active.Precision})
+	if inactive, err := findDate(true, r.EffectivePeriod); err == nil {
+		events = append(events, plugin.Event{Date: inactive.Time, Type: "MedicationStatement", End: true, Value: r, Precision: inactive.Precision})
+	}
+	return events, nil
+}
+
+func convertMedicationOrder(resource interface{}) ([]plugin.Event, error) {
+	r := resource.(*models.MedicationOrder)
+	if r.Status == "" || r.Status == "draft" || r.Status == "entered-in-error" {
+		return nil, nil
+	}
+	var events []plugin.Event
+	written, _ := findDate(false, r.DateWritten)
+	events = append(events, plugin.Event{Date: written.Time, Type: "MedicationOrder", End: false, Value: r, Precision: written.Precision})
+	if ended, err := findDate(false, r.DateEnded); err == nil {
+		events = append(events, plugin.Event{Date: ended.Time, Type: "MedicationOrder", End: true, Value: r, Precision: ended.Precision})
+	} else if days, ok := orderSupplyDays(r); ok && !written.Time.IsZero() {
+		// Without a date ended, the order runs out once its expected supply (and any refills) has been used up
+		runOut := written.Time.Add(time.Duration(days * float64(24*time.Hour)))
+		events = append(events, plugin.Event{Date: runOut, Type: "MedicationOrder", End: true, Value: r, Precision: written.Precision})
+	}
+	return events, nil
+}
+
+// orderSupplyDays returns the number of days the order's expected supply lasts, including the repeats it allows.
+// It returns false if the order doesn't have an expected supply duration in days, hours or minutes.
+func orderSupplyDays(r *models.MedicationOrder) (float64, bool) {
+	if r.DispenseRequest == nil || r.DispenseRequest.ExpectedSupplyDuration == nil {
+		return 0, false
+	}
+	days, ok := plugin.QuantityDays(r.DispenseRequest.ExpectedSupplyDuration)
+	if !ok {
+		return 0, false
+	}
+	if r.DispenseRequest.NumberOfRepeatsAllowed != nil {
+		days *= float64(*r.DispenseRequest.NumberOfRepeatsAllowed + 1)
+	}
+	return days, true
+}
+
+func convertMedicationDispense(resource interface{}) ([]plugin.Event, error) {
+	r := resource.(*models.MedicationDispense)
+	if r.Status != "completed" {
+		return nil, nil
+	}
+	var events []plugin.Event
+	handedOver, err := findDate(false, r.WhenHandedOver, r.WhenPrepared)
+	events = append(events, plugin.Event{Date: handedOver.Time, Type: "MedicationDispense", End: false, Value: r, Precision: handedOver.Precision})
+	// The supply runs out after the days supply (which is assumed to be in days if it has no unit)
+	if err == nil && r.DaysSupply != nil && r.DaysSupply.Value != nil {
+		days, ok := plugin.QuantityDays(r.DaysSupply)
+		if !ok && r.DaysSupply.Unit == "" && r.DaysSupply.Code == "" {
+			days, ok = *r.DaysSupply.Value, true
+		}
+		if ok {
+			runOut := handedOver.Time.Add(time.Duration(days * float64(24*time.Hour)))
+			events = append(events, plugin.Event{Date: runOut, Type: "MedicationDispense", End: true, Value: r, Precision: handedOver.Precision})
+		}
+	}
+	return events, nil
+}
+
+func convertMedicationAdministration(resource interface{}) ([]plugin.Event, error) {
+	r := resource.(*models.MedicationAdministration)
+	if r.Status == "" || r.Status == "on-hold" || r.Status == "entered-in-error" || (r.WasNotGiven != nil && *r.WasNotGiven) {
+		return nil, nil
+	}
+	var events []plugin.Event
+	started, _ := findDate(false, r.EffectiveTimeDateTime, r.EffectiveTimePeriod)
+	events = append(events, plugin.Event{Date: started.Time, Type: "MedicationAdministration", End: false, Value: r, Precision: started.Precision})
+	if finished, err := findDate(true, r.EffectiveTimePeriod); err == nil {
+		events = append(events, plugin.Event{Date: finished.Time, Type: "MedicationAdministration", End: true, Value: r, Precision: finished.Precision})
+	}
+	return events, nil
+}
+
+func convertObservation(resource interface{}) ([]plugin.Event, error) {
+	r := resource.(*models.Observation)
+	if r.Status != "final" && r.Status != "amended" && r.Status != "preliminary" && r.Status != "registered" {
+		return nil, nil
+	}
+	var events []plugin.Event
+	effective, _ := findDate(false, r.EffectiveDateTime, r.EffectivePeriod, r.Issued)
+	events = append(events, plugin.Event{Date: effective.Time, Type: "Observation", End: false, Value: r, Precision: effective.Precision})
+	if ineffective, err := findDate(true, r.EffectivePeriod); err == nil {
+		events = append(events, plugin.Event{Date: ineffective.Time, Type: "Observation", End: true, Value: r, Precision: ineffective.Precision})
+	}
+	return events, nil
+}
+
+func convertEncounter(resource interface{}) ([]plugin.Event, error) {
+	r := resource.(*models.Encounter)
+	// Planned and cancelled encounters never actually happened
+	if r.Status == "planned" || r.Status == "cancelled" {
+		return nil, nil
+	}
+	var events []plugin.Event
+	start, _ := findDate(false, r.Period)
+	events = append(events, plugin.Event{Date: start.Time, Type: "Encounter", End: false, Value: r, Precision: start.Precision})
+	if end, err := findDate(true, r.Period); err == nil {
+		events = append(events, plugin.Event{Date: end.Time, Type: "Encounter", End: true, Value: r, Precision: end.Precision})
+	}
+	return events, nil
+}
+
+func convertProcedure(resource interface{}) ([]plugin.Event, error) {
+	r := resource.(*models.Procedure)
+	if (r.Status != "completed" && r.Status != "in-progress") || (r.NotPerformed != nil && *r.NotPerformed) {
+		return nil, nil
+	}
+	var events []plugin.Event
+	performed, _ := findDate(false, r.PerformedDateTime, r.PerformedPeriod)
+	events = append(events, plugin.Event{Date: performed.Time, Type: "Procedure", End: false, Value: r, Precision: performed.Precision})
+	if finished, err := findDate(true, r.PerformedPeriod); err == nil {
+		events = append(events, plugin.Event{Date: finished.Time, Type: "Procedure", End: true, Value: r, Precision: finished.Precision})
+	}
+	return events, nil
+}
+
+func convertAllergyIntolerance(resource interface{}) ([]plugin.Event, error) {
+	r := resource.(*models.AllergyIntolerance)
+	if r.Status == "" || r.Status == "unconfirmed" || r.Status == "refuted" || r.Status == "entered-in-error" {
+		return nil, nil
+	}
+	var events []plugin.Event
+	onset, _ := findDate(false, r.Onset, r.RecordedDate)
+	events = append(events, plugin.Event{Date: onset.Time, Type: "AllergyIntolerance", End: false, Value: r, Precision: onset.Precision})
+	if r.Status == "resolved" || r.Status == "inactive" {
+		// Allergies don't record when they ended, so the best we can do is when it was last updated
+		if resolved := resolutionDate(onset, lastUpdated(r.Meta)); !resolved.Time.IsZero() {
+			events = append(events, plugin.Event{Date: resolved.Time, Type: "AllergyIntolerance", End: true, Value: r, Precision: resolved.Precision})
+		}
+	}
+	return events, nil
+}
+
+func convertImmunization(resource interface{}) ([]plugin.Event, error) {
+	r := resource.(*models.Immunization)
+	if r.Status != "completed" || (r.WasNotGiven != nil && *r.WasNotGiven) {
+		return nil, nil
+	}
+	var events []plugin.Event
+	given, _ := findDate(false, r.Date)
+	events = append(events, plugin.Event{Date: given.Time, Type: "Immunization", End: false, Value: r, Precision: given.Precision})
+	return events, nil
+}
+
+func convertFamilyMemberHistory(resource interface{}) ([]plugin.Event, error) {
+	r := resource.(*models.FamilyMemberHistory)
+	if r.Status == "entered-in-error" || r.Status == "health-unknown" {
+		return nil, nil
+	}
+	// The family member's conditions are what matter, but they don't have dates in the patient's timeline, so the
+	// event is when the history was recorded
+	var events []plugin.Event
+	recorded, _ := findDate(false, r.Date)
+	events = append(events, plugin.Event{Date: recorded.Time, Type: "FamilyMemberHistory", End: false, Value: r, Precision: recorded.Precision})
+	return events, nil
+}
+
+func findDate(usePeriodEnd bool, datesAndPeriods ...interface{}) (models.FHIRDateTime, error) {
+	for _, t := range datesAndPeriods {
+		switch t := t.(type) {
+		case models.FHIRDateTime:
+			return t, nil
+		case *models.FHIRDateTime:
+			if t != nil {
+				return *t, nil
+			}
+		case models.Period:
+			if !usePeriodEnd && t.Start != nil {
+				return *t.Start, nil
+			} else if usePeriodEnd && t.End != nil {
+				return *t.End, nil
+			}
+		case *models.Period:
+			if !usePeriodEnd && t != nil && t.Start != nil {
+				return *t.Start, nil
+			} else if usePeriodEnd && t != nil && t.End != nil {
+				return *t.End, nil
+			}
+		}
+	}
+
+	return models.FHIRDateTime{}, errors.New("No date found")
+}
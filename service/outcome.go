@@ -0,0 +1,47 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The possible outcomes of running a plugin for a patient.
+const (
+	PluginScored        = "scored"
+	PluginNotApplicable = "not applicable"
+	PluginError         = "error"
+)
+
+// CalculationOutcome summarizes what happened when a risk service calculated the risks for a patient.  It is
+// intended to help answer questions like "why doesn't this patient have a stroke score?"  Truncated is set when
+// the patient had more data than the data source was allowed to retrieve, so the plugins only saw part of it.
+// Conversion reports the patient's resources that couldn't be converted to events and were left out.
+type CalculationOutcome struct {
+	Plugins    []PluginOutcome   `bson:"plugins" json:"plugins"`
+	Truncated  bool              `bson:"truncated,omitempty" json:"truncated,omitempty"`
+	Conversion *ConversionReport `bson:"conversion,omitempty" json:"conversion,omitempty"`
+}
+
+// PluginOutcome records the result of running a single plugin.  Results is the number of risk assessments that
+// were produced, and Error contains the error text when the Status is PluginError.
+type PluginOutcome struct {
+	Name    string `bson:"name" json:"name"`
+	Method  string `bson:"method" json:"method"`
+	Status  string `bson:"status" json:"status"`
+	Results int    `bson:"results" json:"results"`
+	Error   string `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// Err returns an error describing every plugin that failed, or nil if none of them did.
+func (o *CalculationOutcome) Err() error {
+	var msgs []string
+	for _, p := range o.Plugins {
+		if p.Status == PluginError {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", p.Name, p.Error))
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Risk calculation failed for %s", strings.Join(msgs, "; "))
+}
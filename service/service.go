@@ -5,9 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
-	"reflect"
+	"strings"
 	"time"
 
 	"gopkg.in/mgo.v2"
@@ -20,20 +21,77 @@ import (
 // RiskService is an interface for the functions that must be supported by a risk service used in our
 // reference implementation risk service server.
 type RiskService interface {
-	Calculate(patientID string, fhirEndpointURL string, basisPieURL string) error
+	Calculate(patientID string, fhirEndpointURL string, basisPieURL string) (*CalculationOutcome, error)
+	CalculateWithOptions(patientID string, fhirEndpointURL string, basisPieURL string, options CalculationOptions) ([]PluginResults, *CalculationOutcome, error)
+	Evaluate(bundle *models.Bundle, basisPieURL string, options CalculationOptions) ([]PluginResults, *CalculationOutcome, error)
 }
 
 // ReferenceRiskService is a container for risk service plugins that can handle the details of getting data needed
 // for the plugins, invoking the calculations on the plugins, posting the new results back to the FHIR server, and
 // saving the risk pies to the database.
 type ReferenceRiskService struct {
-	plugins []plugin.RiskServicePlugin
-	db      *mgo.Database
+	plugins    []plugin.RiskServicePlugin
+	db         *mgo.Database
+	dataSource func(fhirEndpointURL string) PatientDataSource
+	sink       ResultSink
+	maxPages   int
+	undated    UndatedPolicy
+	center     bool
 }
 
-// NewReferenceRiskService creates a new risk service backed by the passed in MongoDB instance
+// NewReferenceRiskService creates a new risk service backed by the passed in MongoDB instance.  By default, patient
+// data is retrieved from the FHIR endpoint passed in with each calculation, and the results are posted back to
+// that FHIR endpoint with the pies stored in the database.
 func NewReferenceRiskService(db *mgo.Database) *ReferenceRiskService {
-	return &ReferenceRiskService{db: db}
+	rs := &ReferenceRiskService{
+		db:       db,
+		sink:     DefaultResultSink(db),
+		maxPages: DefaultMaxPages,
+	}
+	rs.dataSource = func(fhirEndpointURL string) PatientDataSource {
+		return &FHIRDataSource{FHIREndpointURL: fhirEndpointURL, MaxPages: rs.maxPages}
+	}
+	return rs
+}
+
+// DefaultResultSink returns the sink used by a new risk service: it posts the risk assessments to the patient's
+// FHIR server and then stores the pies in the passed in database.
+func DefaultResultSink(db *mgo.Database) MultiSink {
+	return MultiSink{NewFHIRSink(), NewPieSink(db)}
+}
+
+// UseResultSink sets the risk service to write results to the passed in sink instead of the default sink.  To
+// write results to additional destinations, pass a MultiSink that includes the DefaultResultSink.
+func (rs *ReferenceRiskService) UseResultSink(sink ResultSink) {
+	rs.sink = sink
+}
+
+// UseDataSource sets the risk service to get patient data from the passed in data source instead of the FHIR
+// endpoint passed in with each calculation.  The FHIR endpoint is still used to post the results (unless doing a
+// dry run).
+func (rs *ReferenceRiskService) UseDataSource(ds PatientDataSource) {
+	rs.dataSource = func(string) PatientDataSource { return ds }
+}
+
+// SetMaxDataPages limits the number of pages of search results retrieved from the FHIR endpoint for each patient
+// (DefaultMaxPages by default).  If a patient has more data than that, the calculation uses what it got and the
+// outcome is marked as truncated.  A limit of 0 follows every page.  It does not affect a data source passed to
+// UseDataSource, which has its own limit.
+func (rs *ReferenceRiskService) SetMaxDataPages(n int) {
+	rs.maxPages = n
+}
+
+// SetUndatedPolicy sets what the risk service does with the patient's resources that don't have a usable date.  By
+// default they are dropped, and undated resources that the policy doesn't apply to (see undatedPolicyTypes) always
+// are.  Either way, they are listed in the calculation outcome.
+func (rs *ReferenceRiskService) SetUndatedPolicy(policy UndatedPolicy) {
+	rs.undated = policy
+}
+
+// SetCenterApproximateDates sets whether the risk service places the events for resources whose dates are only
+// known to the year or month in the middle of the year or month (instead of at its start) before calculating.
+func (rs *ReferenceRiskService) SetCenterApproximateDates(center bool) {
+	rs.center = center
 }
 
 // RegisterPlugin registers a plugin for use by the risk service
@@ -43,69 +101,207 @@ func (rs *ReferenceRiskService) RegisterPlugin(plugin plugin.RiskServicePlugin)
 
 // Calculate invokes the register plugins to calculate scores for the given patient and post them back to FHIR.
 // This deletes all previous risk assessment instances for the patient and replaces them with new instances.
-func (rs *ReferenceRiskService) Calculate(patientID string, fhirEndpointURL string, basisPieURL string) error {
-	// Get and post the query to retrieve all of the data needed by the risk service plugins
-	queryURL, err := rs.getRequiredDataQueryURL(patientID, fhirEndpointURL)
+// A failing plugin does not prevent the other plugins from running; the returned outcome reports what happened
+// with each plugin, and the returned error summarizes any plugin failures.
+func (rs *ReferenceRiskService) Calculate(patientID string, fhirEndpointURL string, basisPieURL string) (*CalculationOutcome, error) {
+	_, outcome, err := rs.CalculateWithOptions(patientID, fhirEndpointURL, basisPieURL, CalculationOptions{})
+	return outcome, err
+}
+
+// CalculationOptions customizes a calculation.  The zero value runs every plugin against all of the patient's data
+// and saves the results, just like Calculate.
+type CalculationOptions struct {
+	// Method, if set, restricts the calculation to the plugin whose method has this code.  It may also be specified
+	// as a FHIR token (system|code).
+	Method string
+	// AsOf, if set, ignores any data (and therefore any results) after the given time
+	AsOf *time.Time
+	// DryRun skips posting the risk assessments to the FHIR server and storing the pies
+	DryRun bool
+}
+
+// PluginResults contains the risk assessments and pies that a plugin produced for a patient.  The risk assessments
+// reference the pies in their basis.  If the plugin is not applicable to the patient, there is a single "Not
+// applicable" risk assessment and no pies.
+type PluginResults struct {
+	Name            string                   `json:"name"`
+	Method          models.CodeableConcept   `json:"method"`
+	PatientID       string                   `json:"patientId"`
+	FHIREndpointURL string                   `json:"fhirEndpointUrl,omitempty"`
+	NotApplicable   bool                     `json:"notApplicable,omitempty"`
+	RiskAssessments []*models.RiskAssessment `json:"riskAssessments"`
+	Pies            []*plugin.Pie            `json:"pies"`
+}
+
+// CalculateWithOptions invokes the registered plugins selected by the options to calculate scores for the given
+// patient.  Unless the options specify a dry run, the results replace the patient's previous risk assessments and
+// pies, as in Calculate.  It returns the results from every plugin that didn't fail, along with the outcome of
+// the calculation.
+func (rs *ReferenceRiskService) CalculateWithOptions(patientID string, fhirEndpointURL string, basisPieURL string, options CalculationOptions) ([]PluginResults, *CalculationOutcome, error) {
+	outcome := new(CalculationOutcome)
+
+	plugins, err := rs.selectPlugins(options.Method)
 	if err != nil {
-		return err
+		return nil, outcome, err
 	}
-	response, err := http.Get(queryURL)
+
+	// Get all of the data needed by the risk service plugins
+	resourceTypes, err := requiredResourceTypes(plugins)
 	if err != nil {
-		return err
+		return nil, outcome, err
 	}
-	defer response.Body.Close()
-	bundle := &models.Bundle{}
-	if err = json.NewDecoder(response.Body).Decode(bundle); err != nil {
-		return err
+	bundle, err := patientData(rs.dataSource(fhirEndpointURL), patientID, resourceTypes, requiredObservationCodes(plugins))
+	if err != nil {
+		return nil, outcome, err
+	}
+	if NextPageURL(bundle) != "" {
+		log.Printf("Data for patient %s was truncated; the remaining data is at %s", patientID, NextPageURL(bundle))
+		outcome.Truncated = true
 	}
 
 	// Convert the data bundle and significant birthdays into an EventStream
-	es, err := BundleToEventStream(bundle)
+	es, err := rs.convertBundle(bundle, patientID, outcome)
 	if err != nil {
-		return err
+		return nil, outcome, err
 	}
 
-	// Now do the calculations for each plugin
-	for _, p := range rs.plugins {
-		if len(p.Config().Method.Coding) == 0 {
-			return errors.New("Risk Assessment Plugins MUST provide a method with a coding")
+	allResults := rs.calculatePlugins(plugins, es, patientID, fhirEndpointURL, basisPieURL, options, outcome)
+	return allResults, outcome, outcome.Err()
+}
+
+// Evaluate invokes the registered plugins selected by the options to calculate scores for the patient in the
+// given bundle.  Unlike CalculateWithOptions, it does not use a FHIR server at all: the bundle must contain all of
+// the patient's data, and nothing is saved (regardless of the DryRun option).
+func (rs *ReferenceRiskService) Evaluate(bundle *models.Bundle, basisPieURL string, options CalculationOptions) ([]PluginResults, *CalculationOutcome, error) {
+	outcome := new(CalculationOutcome)
+
+	plugins, err := rs.selectPlugins(options.Method)
+	if err != nil {
+		return nil, outcome, err
+	}
+
+	es, err := rs.convertBundle(bundle, "", outcome)
+	if err != nil {
+		return nil, outcome, err
+	}
+	if es.Patient == nil {
+		return nil, outcome, errors.New("The bundle must contain a patient")
+	}
+
+	options.DryRun = true
+	allResults := rs.calculatePlugins(plugins, es, es.Patient.Id, "", basisPieURL, options, outcome)
+	return allResults, outcome, outcome.Err()
+}
+
+// convertBundle converts the patient's data to an EventStream, skipping any resources that can't be converted so
+// that one unexpected resource doesn't keep the patient from being scored.  The skipped resources, and the ones
+// without dates, are recorded in the outcome.
+func (rs *ReferenceRiskService) convertBundle(bundle *models.Bundle, patientID string, outcome *CalculationOutcome) (*plugin.EventStream, error) {
+	es, report, err := BundleToEventStreamWithOptions(bundle, ConversionOptions{Tolerant: true, Undated: rs.undated, CenterApproximateDates: rs.center})
+	if err != nil {
+		return nil, err
+	}
+	if !report.Empty() {
+		if patientID == "" && es.Patient != nil {
+			patientID = es.Patient.Id
 		}
+		log.Printf("Converting data for patient %s %s", patientID, report)
+		outcome.Conversion = report
+	}
+	return es, nil
+}
+
+// calculatePlugins does the calculations for each plugin, recording what happened in the outcome.  Unless the
+// options specify a dry run, the results are posted to the FHIR server and the pies are stored.  It returns the
+// results from every plugin that didn't fail.
+func (rs *ReferenceRiskService) calculatePlugins(plugins []plugin.RiskServicePlugin, es *plugin.EventStream, patientID, fhirEndpointURL, basisPieURL string, options CalculationOptions, outcome *CalculationOutcome) []PluginResults {
+	var allResults []PluginResults
+	for _, p := range plugins {
+		config := p.Config()
+		po := PluginOutcome{Name: config.Name}
+		if len(config.Method.Coding) == 0 {
+			po.Status = PluginError
+			po.Error = "Risk Assessment Plugins MUST provide a method with a coding"
+			outcome.Plugins = append(outcome.Plugins, po)
+			continue
+		}
+		po.Method = config.Method.Coding[0].Code
 
 		// Copy the event stream since we'll add significant birthday events based on plugin config
 		esClone := es.Clone()
-		addSignificantBirthdayEvents(esClone, p.Config().SignificantBirthdays)
+		addSignificantBirthdayEvents(esClone, config.SignificantBirthdays)
+		esClone.Events = removeCountedConditionEnds(esClone.Events, config.ResolvedConditions)
+		if options.AsOf != nil {
+			esClone.Events = eventsAsOf(esClone.Events, *options.AsOf)
+		}
 
 		// Calculate the results
+		var raBundle *models.Bundle
 		results, err := p.Calculate(esClone, fhirEndpointURL)
-		if err != nil {
-			if _, ok := err.(plugin.NotApplicableError); ok {
-				UpdateRiskAssessmentsAndPies(fhirEndpointURL, patientID, results, rs.db.C("pies"), basisPieURL, p.Config(), true)
-				continue
-			} else {
-				return err
+		if _, ok := err.(plugin.NotApplicableError); ok {
+			po.Status = PluginNotApplicable
+			results = nil
+			raBundle = buildNARiskAssessmentBundle(patientID, config)
+			err = nil
+		} else if err == nil {
+			results = sortAndConsolidate(results)
+			if options.AsOf != nil {
+				results = resultsAsOf(results, *options.AsOf)
 			}
+			po.Status = PluginScored
+			po.Results = len(results)
+			raBundle = buildRiskAssessmentBundle(patientID, results, basisPieURL, config)
 		}
-		results = sortAndConsolidate(results)
-
-		UpdateRiskAssessmentsAndPies(fhirEndpointURL, patientID, results, rs.db.C("pies"), basisPieURL, p.Config(), false)
+		var pr PluginResults
+		if err == nil {
+			pr = toPluginResults(patientID, fhirEndpointURL, config, raBundle, results, po.Status == PluginNotApplicable)
+			if !options.DryRun {
+				err = rs.sink.Write(pr)
+			}
+		}
+		if err != nil {
+			po.Status = PluginError
+			po.Results = 0
+			po.Error = err.Error()
+		} else {
+			allResults = append(allResults, pr)
+		}
+		outcome.Plugins = append(outcome.Plugins, po)
 	}
+	return allResults
+}
 
-	return nil
+// selectPlugins returns the registered plugins whose method matches the given code or token.  If the method is
+// empty, all plugins are returned.
+func (rs *ReferenceRiskService) selectPlugins(method string) ([]plugin.RiskServicePlugin, error) {
+	if method == "" {
+		return rs.plugins, nil
+	}
+	system, code := "", method
+	if i := strings.Index(method, "|"); i >= 0 {
+		system, code = method[:i], method[i+1:]
+	}
+	for _, p := range rs.plugins {
+		for _, coding := range p.Config().Method.Coding {
+			if coding.Code == code && (system == "" || coding.System == system) {
+				return []plugin.RiskServicePlugin{p}, nil
+			}
+		}
+	}
+	return nil, UnknownMethodError{method: method}
 }
 
-// UpdateRiskAssessmentsAndPies removes existing risk assessments from the FHIR server and replaces them with new ones.
-// It also removes old pies from the Mongo database and replaces them with new ones.
-func UpdateRiskAssessmentsAndPies(fhirEndpoint string, patientID string, results []plugin.RiskServiceCalculationResult, pieCollection *mgo.Collection, basisPieURL string, config plugin.RiskServicePluginConfig, notApplicable bool) error {
-	var raBundle *models.Bundle
+// UnknownMethodError indicates that no registered plugin uses the requested method.
+type UnknownMethodError struct {
+	method string
+}
 
-	if notApplicable {
-		raBundle = buildNARiskAssessmentBundle(patientID, config)
-	} else {
-		// Build up the bundle with risk assessments to delete and add
-		raBundle = buildRiskAssessmentBundle(patientID, results, basisPieURL, config)
-	}
+func (e UnknownMethodError) Error() string {
+	return fmt.Sprintf("No risk assessment plugin is registered for method: %s", e.method)
+}
 
-	// Submit the risk assessment bundle
+// postRiskAssessmentBundle submits the transaction bundle of risk assessments to the FHIR server.
+func postRiskAssessmentBundle(fhirEndpoint string, raBundle *models.Bundle) error {
 	data, err := json.Marshal(raBundle)
 	if err != nil {
 		return err
@@ -119,117 +315,201 @@ func UpdateRiskAssessmentsAndPies(fhirEndpoint string, patientID string, results
 	if response.StatusCode != 200 {
 		return fmt.Errorf("Risk assessments did not post properly.  Received response code: %d", response.StatusCode)
 	}
+	return nil
+}
 
+// replacePies removes the patient's old pies for the method from the Mongo database and stores the new pies.
+func replacePies(fhirEndpoint string, patientID string, pies []*plugin.Pie, pieCollection *mgo.Collection, method models.CodeableConcept) error {
 	// Delete the old pies
-	method := config.Method.Coding[0]
+	coding := method.Coding[0]
 	pieCollection.RemoveAll(bson.M{
 		"patient":       fhirEndpoint + "/Patient/" + patientID,
-		"method.coding": bson.M{"$elemMatch": bson.M{"system": method.System, "code": method.Code}},
+		"method.coding": bson.M{"$elemMatch": bson.M{"system": coding.System, "code": coding.Code}},
 	})
 
 	// Store the new pies along with their method (to identify by patient and method)
-	for i := range results {
-		method := config.Method
+	for _, pie := range pies {
 		pieWithMethod := struct {
 			plugin.Pie `bson:",inline"`
 			Method     *models.CodeableConcept `bson:"method"`
 		}{
-			*results[i].Pie,
+			*pie,
 			&method,
 		}
-		if err = pieCollection.Insert(&pieWithMethod); err != nil {
+		if err := pieCollection.Insert(&pieWithMethod); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// toPluginResults pulls the risk assessments out of a risk assessment transaction bundle and pairs them with the
+// pies from the results.
+func toPluginResults(patientID, fhirEndpointURL string, config plugin.RiskServicePluginConfig, raBundle *models.Bundle, results []plugin.RiskServiceCalculationResult, notApplicable bool) PluginResults {
+	pr := PluginResults{
+		Name:            config.Name,
+		Method:          config.Method,
+		PatientID:       patientID,
+		FHIREndpointURL: fhirEndpointURL,
+		NotApplicable:   notApplicable,
+	}
+	for _, entry := range raBundle.Entry {
+		if ra, ok := entry.Resource.(*models.RiskAssessment); ok {
+			pr.RiskAssessments = append(pr.RiskAssessments, ra)
+		}
+	}
+	for i := range results {
+		pr.Pies = append(pr.Pies, results[i].Pie)
+	}
+	return pr
+}
+
+// ResultsBundle builds a FHIR collection bundle containing the risk assessments and pies from the given results.
+// Each pie's full URL is the same as the reference to it in its risk assessment's basis, so the references can be
+// resolved within the bundle.
+func ResultsBundle(allResults []PluginResults, basisPieURL string) *models.Bundle {
+	bundle := &models.Bundle{}
+	bundle.Type = "collection"
+	bundle.Entry = make([]models.BundleEntryComponent, 0)
+	for _, pr := range allResults {
+		for _, ra := range pr.RiskAssessments {
+			bundle.Entry = append(bundle.Entry, models.BundleEntryComponent{Resource: ra})
+		}
+		for _, pie := range pr.Pies {
+			bundle.Entry = append(bundle.Entry, models.BundleEntryComponent{
+				FullUrl:  basisPieURL + "/" + pie.Id.Hex(),
+				Resource: pie,
+			})
+		}
+	}
+	return bundle
+}
+
+// NextPageURL returns the URL of the next page of a paged search result bundle, or "" if it is the last page.
+func NextPageURL(bundle *models.Bundle) string {
+	for _, link := range bundle.Link {
+		if link.Relation == "next" {
+			return link.Url
+		}
+	}
+	return ""
+}
+
 // getRequiredDataQueryURL constructs the URL to use for identifying all risk assessments for a given patient
 // using a given method.  This is used to delete the old set of assessments before adding the new set.
 func (rs *ReferenceRiskService) getRequiredDataQueryURL(patientID, fhirEndpointURL string) (string, error) {
-	// Build up the query by finding all the resources we must _revinclude
-	revIncludeMap := make(map[string]string)
-	for _, p := range rs.plugins {
-		for _, resource := range p.Config().RequiredResourceTypes {
-			switch resource {
-			default:
-				return "", fmt.Errorf("Unsupported required resource type: %s", resource)
-			// NOTE: This only supports those resources we currently need in our reference implementation plugins
-			case "Condition", "MedicationStatement":
-				revIncludeMap[resource] = "patient"
-			}
-		}
+	return getRequiredDataQueryURL(rs.plugins, patientID, fhirEndpointURL)
+}
+
+func getRequiredDataQueryURL(plugins []plugin.RiskServicePlugin, patientID, fhirEndpointURL string) (string, error) {
+	resourceTypes, err := requiredResourceTypes(plugins)
+	if err != nil {
+		return "", err
 	}
 	queryURL, err := url.Parse(fhirEndpointURL + "/Patient")
 	if err != nil {
 		return "", err
 	}
-	params := url.Values{}
-	params.Set("_id", patientID)
-	for resource, property := range revIncludeMap {
-		params.Add("_revinclude", fmt.Sprintf("%s:%s", resource, property))
-	}
-	queryURL.RawQuery = params.Encode()
-
+	queryURL.RawQuery = patientDataQuery(patientID, resourceTypes).Encode()
 	return queryURL.String(), nil
 }
 
-// BundleToEventStream takes a bundle of resources and converts them to an EventStream.  Currently only a
-// limited set of resource types are supported, with unsupported resource types resulting in an error.  If
-// the bundle contains more than one patient, this is also considered an error.
-func BundleToEventStream(bundle *models.Bundle) (es *plugin.EventStream, err error) {
-	var patient *models.Patient
-	events := make([]plugin.Event, 0, len(bundle.Entry))
-	for _, entry := range bundle.Entry {
-		switch r := entry.Resource.(type) {
-		default:
-			err = fmt.Errorf("Unsupported: Converting %s to Event", reflect.TypeOf(r).Elem().Name())
-			return
-		case *models.Patient:
-			if patient != nil {
-				err = errors.New("Found more than one patient in resources")
-				return
-			}
-			patient = r
-		case *models.Condition:
-			if r.VerificationStatus != "confirmed" {
-				continue
-			}
-			if onset, err := findDate(false, r.OnsetDateTime, r.OnsetPeriod, r.DateRecorded); err == nil {
-				events = append(events, plugin.Event{Date: onset, Type: "Condition", End: false, Value: r})
-			}
-			if abatement, err := findDate(true, r.AbatementDateTime, r.AbatementPeriod); err == nil {
-				events = append(events, plugin.Event{Date: abatement, Type: "Condition", End: true, Value: r})
-			}
-			// TODO: What happens if there is no date at all?
-		case *models.MedicationStatement:
-			if r.Status == "" || r.Status == "entered-in-error" {
-				continue
-			}
-			if active, err := findDate(false, r.EffectiveDateTime, r.EffectivePeriod, r.DateAsserted); err == nil {
-				events = append(events, plugin.Event{Date: active, Type: "MedicationStatement", End: false, Value: r})
-			}
-			if inactive, err := findDate(true, r.EffectivePeriod); err == nil {
-				events = append(events, plugin.Event{Date: inactive, Type: "MedicationStatement", End: true, Value: r})
+// requiredResourceTypes returns the distinct resource types required by the plugins.
+func requiredResourceTypes(plugins []plugin.RiskServicePlugin) ([]string, error) {
+	var resourceTypes []string
+	found := make(map[string]bool)
+	for _, p := range plugins {
+		for _, resource := range p.Config().RequiredResourceTypes {
+			// Only the resources that can be converted to events are any use to the plugins
+			if eventConverter(resource) == nil {
+				return nil, fmt.Errorf("Unsupported required resource type: %s", resource)
 			}
-			// TODO: What happens if there is no date at all?
-		case *models.Observation:
-			if r.Status != "final" && r.Status != "amended" && r.Status != "preliminary" && r.Status != "registered" {
-				continue
+			if !found[resource] {
+				found[resource] = true
+				resourceTypes = append(resourceTypes, resource)
 			}
-			if effective, err := findDate(false, r.EffectiveDateTime, r.EffectivePeriod, r.Issued); err == nil {
-				events = append(events, plugin.Event{Date: effective, Type: "Observation", End: false, Value: r})
+		}
+	}
+	return resourceTypes, nil
+}
+
+// requiredObservationCodes returns the distinct LOINC codes of the observations required by the plugins.  If any
+// plugin requires observations without saying which ones, it returns nil, meaning that all observations are
+// required.
+func requiredObservationCodes(plugins []plugin.RiskServicePlugin) []string {
+	var codes []string
+	found := make(map[string]bool)
+	for _, p := range plugins {
+		config := p.Config()
+		if !containsString(config.RequiredResourceTypes, "Observation") {
+			continue
+		}
+		if len(config.RequiredObservationCodes) == 0 {
+			return nil
+		}
+		for _, code := range config.RequiredObservationCodes {
+			if !found[code] {
+				found[code] = true
+				codes = append(codes, code)
 			}
-			if ineffective, err := findDate(true, r.EffectivePeriod); err == nil {
-				events = append(events, plugin.Event{Date: ineffective, Type: "Observation", End: true, Value: r})
+		}
+	}
+	return codes
+}
+
+// patientData gets the patient's resources of the given types from the data source.  If observationCodes is set,
+// only the observations with those LOINC codes are needed.  Data sources that can search for them get just those
+// observations; otherwise all of the observations are retrieved and the rest are left out.
+func patientData(ds PatientDataSource, patientID string, resourceTypes, observationCodes []string) (*models.Bundle, error) {
+	if len(observationCodes) == 0 || !containsString(resourceTypes, "Observation") {
+		return ds.PatientData(patientID, resourceTypes)
+	}
+
+	ods, ok := ds.(ObservationDataSource)
+	if !ok {
+		bundle, err := ds.PatientData(patientID, resourceTypes)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]models.BundleEntryComponent, 0, len(bundle.Entry))
+		for _, entry := range bundle.Entry {
+			if o, ok := entry.Resource.(*models.Observation); !ok || observationHasCode(o, observationCodes) {
+				entries = append(entries, entry)
 			}
-			// TODO: What happens if there is no date at all?
 		}
+		bundle.Entry = entries
+		return bundle, nil
 	}
-	es = plugin.NewEventStream(patient)
-	plugin.SortEventsByDate(events)
-	es.Events = events
-	return es, nil
+
+	var otherTypes []string
+	for _, t := range resourceTypes {
+		if t != "Observation" {
+			otherTypes = append(otherTypes, t)
+		}
+	}
+	bundle, err := ds.PatientData(patientID, otherTypes)
+	if err != nil {
+		return nil, err
+	}
+	observations, err := ods.PatientObservations(patientID, observationCodes)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	bundle.Entry = uniqueEntries(observations.Entry, seen, uniqueEntries(bundle.Entry, seen, nil))
+	if NextPageURL(bundle) == "" && NextPageURL(observations) != "" {
+		bundle.Link = append(bundle.Link, models.BundleLinkComponent{Relation: "next", Url: NextPageURL(observations)})
+	}
+	return bundle, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 func addSignificantBirthdayEvents(es *plugin.EventStream, birthdays []int) {
@@ -247,70 +527,86 @@ func addSignificantBirthdayEvents(es *plugin.EventStream, birthdays []int) {
 	plugin.SortEventsByDate(es.Events)
 }
 
-func findDate(usePeriodEnd bool, datesAndPeriods ...interface{}) (time.Time, error) {
-	for _, t := range datesAndPeriods {
-		switch t := t.(type) {
-		case models.FHIRDateTime:
-			return t.Time, nil
-		case *models.FHIRDateTime:
-			if t != nil {
-				return t.Time, nil
-			}
-		case models.Period:
-			if !usePeriodEnd && t.Start != nil {
-				return t.Start.Time, nil
-			} else if usePeriodEnd && t.End != nil {
-				return t.End.Time, nil
-			}
-		case *models.Period:
-			if !usePeriodEnd && t != nil && t.Start != nil {
-				return t.Start.Time, nil
-			} else if usePeriodEnd && t != nil && t.End != nil {
-				return t.End.Time, nil
-			}
-		}
+// ParseAsOf parses an asOf parameter, which may be a FHIR date or dateTime.  Since a date covers an entire day,
+// it is treated as the very end of that day.
+func ParseAsOf(asOf string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, asOf); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", asOf, time.Local); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
 	}
+	return time.Time{}, errors.New("Bad asOf format. Should be a FHIR date or dateTime")
+}
 
-	return time.Time{}, errors.New("No date found")
+// removeCountedConditionEnds removes the end events of the conditions that the plugin's policy says still count
+// after they have resolved, so the plugin sees them as ongoing.
+func removeCountedConditionEnds(events []plugin.Event, policy plugin.ResolvedConditionPolicy) []plugin.Event {
+	kept := make([]plugin.Event, 0, len(events))
+	for _, e := range events {
+		if c, ok := e.Value.(*models.Condition); ok && e.End && policy.HistoryCounts(c) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
 }
 
-func buildRiskAssessmentBundle(patientID string, results []plugin.RiskServiceCalculationResult, basisPieURL string, config plugin.RiskServicePluginConfig) *models.Bundle {
-	raBundle := &models.Bundle{}
-	raBundle.Type = "transaction"
-	raBundle.Entry = make([]models.BundleEntryComponent, len(results)+1)
-	raBundle.Entry[0].Request = &models.BundleEntryRequestComponent{
-		Method: "DELETE",
-		Url:    getRiskAssessmentDeleteURL(config.Method, patientID),
+// eventsAsOf returns the events that occurred on or before the given time.  The events must already be sorted.
+func eventsAsOf(events []plugin.Event, asOf time.Time) []plugin.Event {
+	for i := range events {
+		if events[i].Date.After(asOf) {
+			return events[:i]
+		}
 	}
+	return events
+}
+
+// resultsAsOf returns the results that are as of the given time or earlier.  The results must already be sorted.
+func resultsAsOf(results []plugin.RiskServiceCalculationResult, asOf time.Time) []plugin.RiskServiceCalculationResult {
 	for i := range results {
-		raBundle.Entry[i+1].Request = &models.BundleEntryRequestComponent{
-			Method: "POST",
-			Url:    "RiskAssessment",
+		if results[i].AsOf.After(asOf) {
+			return results[:i]
 		}
-		ra := results[i].ToRiskAssessment(patientID, basisPieURL, config)
+	}
+	return results
+}
+
+func buildRiskAssessmentBundle(patientID string, results []plugin.RiskServiceCalculationResult, basisPieURL string, config plugin.RiskServicePluginConfig) *models.Bundle {
+	ras := make([]*models.RiskAssessment, len(results))
+	for i := range results {
+		ras[i] = results[i].ToRiskAssessment(patientID, basisPieURL, config)
 		if (i + 1) == len(results) {
-			ra.Meta = &models.Meta{
+			ras[i].Meta = &models.Meta{
 				Tag: []models.Coding{{System: "http://interventionengine.org/tags/", Code: "MOST_RECENT"}},
 			}
 		}
-		raBundle.Entry[i+1].Resource = ra
 	}
-	return raBundle
+	return riskAssessmentTransaction(patientID, config.Method, ras)
 }
 
-func buildNARiskAssessmentBundle(patientID string, config plugin.RiskServicePluginConfig) *models.Bundle {
+// riskAssessmentTransaction builds a transaction bundle that deletes the patient's existing risk assessments for
+// the method and posts the new ones.
+func riskAssessmentTransaction(patientID string, method models.CodeableConcept, ras []*models.RiskAssessment) *models.Bundle {
 	raBundle := &models.Bundle{}
 	raBundle.Type = "transaction"
-	raBundle.Entry = make([]models.BundleEntryComponent, 2)
+	raBundle.Entry = make([]models.BundleEntryComponent, len(ras)+1)
 	raBundle.Entry[0].Request = &models.BundleEntryRequestComponent{
 		Method: "DELETE",
-		Url:    getRiskAssessmentDeleteURL(config.Method, patientID),
+		Url:    getRiskAssessmentDeleteURL(method, patientID),
 	}
-	raBundle.Entry[1].Request = &models.BundleEntryRequestComponent{
-		Method: "POST",
-		Url:    "RiskAssessment",
+	for i := range ras {
+		raBundle.Entry[i+1].Request = &models.BundleEntryRequestComponent{
+			Method: "POST",
+			Url:    "RiskAssessment",
+		}
+		raBundle.Entry[i+1].Resource = ras[i]
 	}
-	raBundle.Entry[1].Resource = &models.RiskAssessment{
+	return raBundle
+}
+
+func buildNARiskAssessmentBundle(patientID string, config plugin.RiskServicePluginConfig) *models.Bundle {
+	ra := &models.RiskAssessment{
 		DomainResource: models.DomainResource{
 			Resource: models.Resource{
 				Meta: &models.Meta{
@@ -331,7 +627,7 @@ func buildNARiskAssessmentBundle(patientID string, config plugin.RiskServicePlug
 			},
 		},
 	}
-	return raBundle
+	return riskAssessmentTransaction(patientID, config.Method, []*models.RiskAssessment{ra})
 }
 
 // getRiskAssessmentDeleteURL constructs the URL to use for identifying all risk assessments for a given patient
@@ -344,12 +640,14 @@ func getRiskAssessmentDeleteURL(concept models.CodeableConcept, patientID string
 }
 
 // sortAndConsolidate sorts calculations by date and then consolidates the ones that have the same timestamp into one,
-// choosing whichever was last in the original order
+// choosing whichever was last in the original order.  The consolidated result is only approximate if all of the
+// results it replaces are, since an exact change at that time means the risk really did change then.
 func sortAndConsolidate(results []plugin.RiskServiceCalculationResult) []plugin.RiskServiceCalculationResult {
 	// Use stable sort to retain original order on equal elements
 	plugin.SortResultsByAsOfDate(results)
 	for i := 0; i < len(results); i++ {
 		if i > 0 && results[i].AsOf.Equal(results[i-1].AsOf) {
+			results[i].Approximate = results[i].Approximate && results[i-1].Approximate
 			results = append(results[:(i-1)], results[i:]...)
 			i--
 		}
@@ -3,12 +3,17 @@ package service
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
+	"strconv"
 	"strings"
+	"testing"
 	"time"
 
 	"github.com/intervention-engine/fhir/models"
@@ -23,6 +28,10 @@ import (
 	"gopkg.in/mgo.v2/dbtest"
 )
 
+func Test(t *testing.T) { TestingT(t) }
+
+// ServiceSuite holds the tests that need MongoDB (for the FHIR server or the risk service's database).  It is
+// skipped where mongod isn't installed.
 type ServiceSuite struct {
 	DBServer *dbtest.DBServer
 	Session  *mgo.Session
@@ -34,6 +43,10 @@ type ServiceSuite struct {
 var _ = Suite(&ServiceSuite{})
 
 func (s *ServiceSuite) SetUpSuite(c *C) {
+	if _, err := exec.LookPath("mongod"); err != nil {
+		c.Skip("mongod is not installed")
+	}
+
 	// Set up the database
 	s.DBServer = &dbtest.DBServer{}
 	s.DBServer.SetPath(c.MkDir())
@@ -56,7 +69,20 @@ func (s *ServiceSuite) TearDownTest(c *C) {
 }
 
 func (s *ServiceSuite) TearDownSuite(c *C) {
-	s.DBServer.Stop()
+	if s.DBServer != nil {
+		s.DBServer.Stop()
+	}
+}
+
+// ServiceUnitSuite holds the tests that don't need MongoDB, so they run everywhere
+type ServiceUnitSuite struct {
+	Service *ReferenceRiskService
+}
+
+var _ = Suite(&ServiceUnitSuite{})
+
+func (s *ServiceUnitSuite) SetUpTest(c *C) {
+	s.Service = NewReferenceRiskService(nil)
 }
 
 func (s *ServiceSuite) TestEndToEndCalculations(c *C) {
@@ -91,8 +117,12 @@ func (s *ServiceSuite) TestEndToEndCalculations(c *C) {
 	s.Service.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
 	s.Service.RegisterPlugin(assessments.NewSimplePlugin())
 
-	err = s.Service.Calculate(patientID, s.Server.URL, s.Server.URL+"/pies")
+	outcome, err := s.Service.Calculate(patientID, s.Server.URL, s.Server.URL+"/pies")
 	util.CheckErr(err)
+	c.Assert(outcome.Plugins, DeepEquals, []PluginOutcome{
+		{Name: "CHA2DS2–VASc score", Method: "CHADS", Status: PluginScored, Results: 4},
+		{Name: "Simple Conditions + Medications", Method: "Simple", Status: PluginScored, Results: 4},
+	})
 
 	count, err = raCollection.Find(bson.M{"method.coding.code": "CHADS"}).Count()
 	util.CheckErr(err)
@@ -170,7 +200,7 @@ func (s *ServiceSuite) TestEndToEndOverwritingCalculations(c *C) {
 	// This is where we run it a bunch of times, but since it *should* clean up old data every time,
 	// then it should have the same results as a single time.
 	for i := 0; i < 5; i++ {
-		err = s.Service.Calculate(patientID, s.Server.URL, s.Server.URL+"/pies")
+		_, err = s.Service.Calculate(patientID, s.Server.URL, s.Server.URL+"/pies")
 		util.CheckErr(err)
 
 		count, err = raCollection.Find(bson.M{"method.coding.code": "CHADS"}).Count()
@@ -253,8 +283,12 @@ func (s *ServiceSuite) TestEndToEndCalculationsWithNACHADS(c *C) {
 	s.Service.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
 	s.Service.RegisterPlugin(assessments.NewSimplePlugin())
 
-	err = s.Service.Calculate(patientID, s.Server.URL, s.Server.URL+"/pies")
+	outcome, err := s.Service.Calculate(patientID, s.Server.URL, s.Server.URL+"/pies")
 	util.CheckErr(err)
+	c.Assert(outcome.Plugins, DeepEquals, []PluginOutcome{
+		{Name: "CHA2DS2–VASc score", Method: "CHADS", Status: PluginNotApplicable},
+		{Name: "Simple Conditions + Medications", Method: "Simple", Status: PluginScored, Results: 4},
+	})
 
 	count, err = raCollection.Find(bson.M{"method.coding.code": "CHADS"}).Count()
 	util.CheckErr(err)
@@ -365,7 +399,7 @@ func (s *ServiceSuite) checkSimplePie(c *C, ra *models.RiskAssessment, patientID
 	c.Assert(pie.Slices[1].Value, Equals, medications)
 }
 
-func (s *ServiceSuite) TestSortAndConsolidateOutOfOrder(c *C) {
+func (s *ServiceUnitSuite) TestSortAndConsolidateOutOfOrder(c *C) {
 	one, two, three, four, five := 1, 2, 3, 4, 5
 	results := []plugin.RiskServiceCalculationResult{
 		{
@@ -400,7 +434,7 @@ func (s *ServiceSuite) TestSortAndConsolidateOutOfOrder(c *C) {
 	c.Assert(*results[4].Score, Equals, 2)
 }
 
-func (s *ServiceSuite) TestBundleToEventStreamUnsupportedEvent(c *C) {
+func (s *ServiceUnitSuite) TestBundleToEventStreamUnsupportedEvent(c *C) {
 	data, err := ioutil.ReadFile("fixtures/brad_bradworth_event_source_bundle.json")
 	util.CheckErr(err)
 
@@ -408,7 +442,7 @@ func (s *ServiceSuite) TestBundleToEventStreamUnsupportedEvent(c *C) {
 	json.Unmarshal(data, bundle)
 
 	bundle.Entry = append(bundle.Entry, models.BundleEntryComponent{
-		Resource: &models.Encounter{},
+		Resource: &models.Goal{},
 		Search: &models.BundleEntrySearchComponent{
 			Mode: "include",
 		},
@@ -416,10 +450,535 @@ func (s *ServiceSuite) TestBundleToEventStreamUnsupportedEvent(c *C) {
 
 	_, err = BundleToEventStream(bundle)
 	c.Assert(err, NotNil)
-	c.Assert(err.Error(), Equals, "Unsupported: Converting Encounter to Event")
+	c.Assert(err.Error(), Equals, "Unsupported: Converting Goal to Event")
+}
+
+func (s *ServiceUnitSuite) TestBundleToEventStreamTolerant(c *C) {
+	data, err := ioutil.ReadFile("fixtures/brad_bradworth_event_source_bundle.json")
+	util.CheckErr(err)
+
+	bundle := new(models.Bundle)
+	json.Unmarshal(data, bundle)
+
+	bundle.Entry = append(bundle.Entry,
+		models.BundleEntryComponent{Resource: &models.Goal{}},
+		models.BundleEntryComponent{Resource: &models.Goal{}},
+		models.BundleEntryComponent{Resource: &models.Flag{}},
+		models.BundleEntryComponent{},
+	)
+
+	es, report, err := BundleToEventStreamWithOptions(bundle, ConversionOptions{Tolerant: true})
+	util.CheckErr(err)
+	c.Assert(es.Patient.Id, Equals, "507f1f77bcf86cd799439001")
+	c.Assert(es.Events, HasLen, 5)
+	c.Assert(report.Unsupported, DeepEquals, map[string]int{"Goal": 2, "Flag": 1})
+	c.Assert(report.Warnings, DeepEquals, []string{"Entry 8 has no resource"})
+	c.Assert(report.String(), Equals, "skipped 1 Flag, 2 Goal; Entry 8 has no resource")
+}
+
+func (s *ServiceUnitSuite) TestRegisterEventConverter(c *C) {
+	defer RegisterEventConverter("Flag", nil)
+	RegisterEventConverter("Flag", func(resource interface{}) ([]plugin.Event, error) {
+		r := resource.(*models.Flag)
+		if r.Period == nil {
+			return nil, errors.New("No period")
+		}
+		return []plugin.Event{{Date: r.Period.Start.Time, Type: "Flag", Value: r}}, nil
+	})
+
+	patient := &models.Patient{}
+	patient.Id = "12345"
+	flag := &models.Flag{Period: &models.Period{Start: &models.FHIRDateTime{Time: time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}}}
+	badFlag := &models.Flag{}
+	badFlag.Id = "bad"
+	bundle := &models.Bundle{Entry: []models.BundleEntryComponent{{Resource: patient}, {Resource: flag}, {Resource: badFlag}}}
+
+	// Converter errors fail a strict conversion...
+	_, err := BundleToEventStream(bundle)
+	c.Assert(err, ErrorMatches, "No period")
+
+	// ...but are only warnings in a tolerant one
+	es, report, err := BundleToEventStreamWithOptions(bundle, ConversionOptions{Tolerant: true})
+	util.CheckErr(err)
+	c.Assert(es.Events, HasLen, 1)
+	c.Assert(es.Events[0].Type, Equals, "Flag")
+	c.Assert(es.Events[0].Value, Equals, flag)
+	c.Assert(report.Unsupported, HasLen, 0)
+	c.Assert(report.Warnings, DeepEquals, []string{"Unable to convert Flag/bad: No period"})
+
+	// Once the converter is unregistered, flags are unsupported again
+	RegisterEventConverter("Flag", nil)
+	_, err = BundleToEventStream(bundle)
+	c.Assert(err, ErrorMatches, "Unsupported: Converting Flag to Event")
+}
+
+func (s *ServiceUnitSuite) TestEvaluateSkipsUnsupportedResources(c *C) {
+	data, err := ioutil.ReadFile("fixtures/chad_chadworth_bundle.json")
+	util.CheckErr(err)
+	bundle := new(models.Bundle)
+	util.CheckErr(json.Unmarshal(data, bundle))
+	bundle.Entry = append(bundle.Entry, models.BundleEntryComponent{Resource: &models.Goal{}})
+	s.Service.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
+
+	results, outcome, err := s.Service.Evaluate(bundle, "http://foo.com", CalculationOptions{})
+	util.CheckErr(err)
+	c.Assert(results, HasLen, 1)
+	c.Assert(outcome.Plugins[0].Status, Equals, PluginScored)
+	c.Assert(outcome.Conversion, NotNil)
+	c.Assert(outcome.Conversion.Unsupported, DeepEquals, map[string]int{"Goal": 1})
+	c.Assert(outcome.Conversion.Warnings, HasLen, 0)
+}
+
+func (s *ServiceUnitSuite) TestBundleToEventStreamWithEncounters(c *C) {
+	data, err := ioutil.ReadFile("fixtures/chad_chadworth_bundle.json")
+	util.CheckErr(err)
+	bundle := new(models.Bundle)
+	util.CheckErr(json.Unmarshal(data, bundle))
+
+	// Add an inpatient stay and an encounter that was cancelled
+	loc := time.FixedZone("-0500", -5*60*60)
+	stay := &models.Encounter{Status: "finished", Class: "inpatient", Period: &models.Period{
+		Start: &models.FHIRDateTime{Time: time.Date(2016, time.June, 1, 14, 0, 0, 0, loc), Precision: models.Timestamp},
+		End:   &models.FHIRDateTime{Time: time.Date(2016, time.June, 4, 10, 0, 0, 0, loc), Precision: models.Timestamp},
+	}}
+	cancelled := &models.Encounter{Status: "cancelled", Period: &models.Period{
+		Start: &models.FHIRDateTime{Time: time.Date(2016, time.July, 1, 9, 0, 0, 0, loc), Precision: models.Timestamp},
+	}}
+	bundle.Entry = append(bundle.Entry, models.BundleEntryComponent{Resource: stay}, models.BundleEntryComponent{Resource: cancelled})
+
+	es, err := BundleToEventStream(bundle)
+	util.CheckErr(err)
+	var encounters []plugin.Event
+	for _, e := range es.Events {
+		if e.Type == "Encounter" {
+			encounters = append(encounters, e)
+		}
+	}
+	// The fixture's four encounters only have a start, and the stay has a start and an end
+	c.Assert(encounters, HasLen, 6)
+	c.Assert(encounters[4].Value, Equals, stay)
+	c.Assert(encounters[4].End, Equals, false)
+	c.Assert(encounters[4].Date.Equal(stay.Period.Start.Time), Equals, true)
+	c.Assert(encounters[5].Value, Equals, stay)
+	c.Assert(encounters[5].End, Equals, true)
+	c.Assert(encounters[5].Date.Equal(stay.Period.End.Time), Equals, true)
+}
+
+func (s *ServiceUnitSuite) TestBundleToEventStreamWithOtherResourceTypes(c *C) {
+	patient := &models.Patient{}
+	patient.Id = "12345"
+	date := func(month time.Month) *models.FHIRDateTime {
+		return &models.FHIRDateTime{Time: time.Date(2015, month, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	}
+	notPerformed := true
+	surgery := &models.Procedure{Status: "completed", PerformedPeriod: &models.Period{Start: date(time.January), End: date(time.February)}}
+	allergy := &models.AllergyIntolerance{Status: "confirmed", Onset: date(time.March)}
+	flu := &models.Immunization{Status: "completed", Date: date(time.April)}
+	father := &models.FamilyMemberHistory{Status: "completed", Date: date(time.May)}
+	// Resolved allergies end when they were last updated, or right away if that isn't known
+	outgrown := &models.AllergyIntolerance{Status: "resolved", Onset: date(time.July)}
+	outgrown.Meta = &models.Meta{LastUpdated: date(time.September)}
+	inactive := &models.AllergyIntolerance{Status: "inactive", Onset: date(time.October)}
+	bundle := &models.Bundle{Entry: []models.BundleEntryComponent{
+		{Resource: patient},
+		{Resource: surgery},
+		{Resource: allergy},
+		{Resource: flu},
+		{Resource: father},
+		{Resource: outgrown},
+		{Resource: inactive},
+		// None of these should generate events
+		{Resource: &models.Procedure{Status: "aborted", PerformedDateTime: date(time.June)}},
+		{Resource: &models.Procedure{Status: "completed", NotPerformed: &notPerformed, PerformedDateTime: date(time.June)}},
+		{Resource: &models.AllergyIntolerance{Status: "refuted", Onset: date(time.June)}},
+		{Resource: &models.AllergyIntolerance{Status: "entered-in-error", Onset: date(time.June)}},
+		{Resource: &models.Immunization{Status: "in-progress", Date: date(time.June)}},
+		{Resource: &models.FamilyMemberHistory{Status: "health-unknown", Date: date(time.June)}},
+	}}
+
+	es, err := BundleToEventStream(bundle)
+	util.CheckErr(err)
+	c.Assert(es.Events, HasLen, 9)
+	expected := []struct {
+		Type  string
+		End   bool
+		Value interface{}
+		Month time.Month
+	}{
+		{"Procedure", false, surgery, time.January},
+		{"Procedure", true, surgery, time.February},
+		{"AllergyIntolerance", false, allergy, time.March},
+		{"Immunization", false, flu, time.April},
+		{"FamilyMemberHistory", false, father, time.May},
+		{"AllergyIntolerance", false, outgrown, time.July},
+		{"AllergyIntolerance", true, outgrown, time.September},
+		{"AllergyIntolerance", false, inactive, time.October},
+		{"AllergyIntolerance", true, inactive, time.October},
+	}
+	for i, e := range expected {
+		c.Assert(es.Events[i].Type, Equals, e.Type)
+		c.Assert(es.Events[i].End, Equals, e.End)
+		c.Assert(es.Events[i].Value, Equals, e.Value)
+		c.Assert(es.Events[i].Date.Month(), Equals, e.Month)
+	}
+
+	qURL, err := getRequiredDataQueryURL([]plugin.RiskServicePlugin{&requirementsPlugin{
+		resourceTypes: []string{"Procedure", "AllergyIntolerance", "Immunization", "FamilyMemberHistory"},
+	}}, "12345", "http://example.org/fhir")
+	util.CheckErr(err)
+	qURL2, _ := url.Parse(qURL)
+	c.Assert(qURL2.Query()["_revinclude"], DeepEquals, []string{"Procedure:patient", "AllergyIntolerance:patient", "Immunization:patient", "FamilyMemberHistory:patient"})
+}
+
+func (s *ServiceUnitSuite) TestBundleToEventStreamWithMedicationResources(c *C) {
+	patient := &models.Patient{}
+	patient.Id = "12345"
+	date := func(month time.Month) *models.FHIRDateTime {
+		return &models.FHIRDateTime{Time: time.Date(2015, month, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	}
+	thirty, notGiven := float64(30), true
+	order := &models.MedicationOrder{Status: "completed", DateWritten: date(time.January), DateEnded: date(time.June)}
+	dispense := &models.MedicationDispense{Status: "completed", WhenHandedOver: date(time.February), DaysSupply: &models.Quantity{Value: &thirty, Unit: "days"}}
+	administration := &models.MedicationAdministration{Status: "completed", EffectiveTimeDateTime: date(time.April)}
+	bundle := &models.Bundle{Entry: []models.BundleEntryComponent{
+		{Resource: patient},
+		{Resource: order},
+		{Resource: dispense},
+		{Resource: administration},
+		// None of these should generate events
+		{Resource: &models.MedicationOrder{Status: "draft", DateWritten: date(time.July)}},
+		{Resource: &models.MedicationDispense{Status: "in-progress", WhenPrepared: date(time.July)}},
+		{Resource: &models.MedicationAdministration{Status: "completed", WasNotGiven: &notGiven, EffectiveTimeDateTime: date(time.July)}},
+	}}
+
+	es, err := BundleToEventStream(bundle)
+	util.CheckErr(err)
+	c.Assert(es.Events, HasLen, 5)
+	expected := []struct {
+		Date  time.Time
+		Type  string
+		End   bool
+		Value interface{}
+	}{
+		{date(time.January).Time, "MedicationOrder", false, order},
+		{date(time.February).Time, "MedicationDispense", false, dispense},
+		{date(time.March).Time.AddDate(0, 0, 2), "MedicationDispense", true, dispense},
+		{date(time.April).Time, "MedicationAdministration", false, administration},
+		{date(time.June).Time, "MedicationOrder", true, order},
+	}
+	for i, e := range expected {
+		c.Assert(es.Events[i].Date, Equals, e.Date)
+		c.Assert(es.Events[i].Type, Equals, e.Type)
+		c.Assert(es.Events[i].End, Equals, e.End)
+		c.Assert(es.Events[i].Value, Equals, e.Value)
+	}
+}
+
+func (s *ServiceUnitSuite) TestBundleToEventStreamWithOrderSupply(c *C) {
+	patient := &models.Patient{}
+	patient.Id = "12345"
+	written := &models.FHIRDateTime{Time: time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	thirty, repeats := float64(30), uint32(2)
+	order := &models.MedicationOrder{Status: "active", DateWritten: written, DispenseRequest: &models.MedicationOrderDispenseRequestComponent{
+		ExpectedSupplyDuration: &models.Quantity{Value: &thirty, Code: "d"},
+		NumberOfRepeatsAllowed: &repeats,
+	}}
+	// Without a supply, the order has no end
+	open := &models.MedicationOrder{Status: "active", DateWritten: written}
+	bundle := &models.Bundle{Entry: []models.BundleEntryComponent{{Resource: patient}, {Resource: order}, {Resource: open}}}
+
+	es, err := BundleToEventStream(bundle)
+	util.CheckErr(err)
+	c.Assert(es.Events, HasLen, 3)
+	c.Assert(es.Events[0].Value, Equals, order)
+	c.Assert(es.Events[1].Value, Equals, open)
+	c.Assert(es.Events[2].Date, Equals, written.Time.AddDate(0, 0, 90))
+	c.Assert(es.Events[2].End, Equals, true)
+	c.Assert(es.Events[2].Value, Equals, order)
+}
+
+func (s *ServiceUnitSuite) TestBundleToEventStreamUndatedPolicies(c *C) {
+	birthDate := time.Date(1950, time.May, 1, 0, 0, 0, 0, time.UTC)
+	lastUpdated := time.Date(2015, time.August, 1, 0, 0, 0, 0, time.UTC)
+	patient := &models.Patient{BirthDate: &models.FHIRDateTime{Time: birthDate, Precision: models.Date}}
+	patient.Id = "12345"
+	condition := &models.Condition{VerificationStatus: "confirmed"}
+	condition.Id = "c1"
+	condition.Meta = &models.Meta{LastUpdated: &models.FHIRDateTime{Time: lastUpdated, Precision: models.Timestamp}}
+	medication := &models.MedicationStatement{Status: "active"}
+	medication.Id = "m1"
+	// The policy doesn't apply to encounters, which happened at some time rather than being something the patient has
+	encounter := &models.Encounter{Status: "finished", Class: "inpatient"}
+	encounter.Id = "e1"
+	encounter.Meta = &models.Meta{LastUpdated: &models.FHIRDateTime{Time: lastUpdated, Precision: models.Timestamp}}
+	bundle := &models.Bundle{Entry: []models.BundleEntryComponent{{Resource: patient}, {Resource: condition}, {Resource: medication}, {Resource: encounter}}}
+
+	// Dropped by default
+	es, report, err := BundleToEventStreamWithOptions(bundle, ConversionOptions{})
+	util.CheckErr(err)
+	c.Assert(es.Events, HasLen, 0)
+	c.Assert(report.Undated, DeepEquals, []UndatedResource{
+		{Resource: "Condition/c1", Dropped: true},
+		{Resource: "MedicationStatement/m1", Dropped: true},
+		{Resource: "Encounter/e1", Dropped: true},
+	})
+	c.Assert(report.String(), Equals, "skipped 3 undated (3 dropped)")
+
+	// Present since birth
+	es, report, err = BundleToEventStreamWithOptions(bundle, ConversionOptions{Undated: UndatedSinceBirth})
+	util.CheckErr(err)
+	c.Assert(es.Events, HasLen, 2)
+	for _, e := range es.Events {
+		c.Assert(e.Date, Equals, birthDate)
+		c.Assert(e.Type, Not(Equals), "Encounter")
+	}
+	c.Assert(report.Undated, HasLen, 3)
+	c.Assert(*report.Undated[0].Date, Equals, birthDate)
+	c.Assert(report.Undated[0].Dropped, Equals, false)
+	c.Assert(report.Undated[2], DeepEquals, UndatedResource{Resource: "Encounter/e1", Dropped: true})
+
+	// As of the last update, when there is one
+	es, report, err = BundleToEventStreamWithOptions(bundle, ConversionOptions{Undated: UndatedAsOfLastUpdated})
+	util.CheckErr(err)
+	c.Assert(es.Events, HasLen, 1)
+	c.Assert(es.Events[0].Date, Equals, lastUpdated)
+	c.Assert(es.Events[0].Value, Equals, condition)
+	c.Assert(report.Undated[0].Dropped, Equals, false)
+	c.Assert(report.Undated[1].Dropped, Equals, true)
+	c.Assert(report.Undated[2].Dropped, Equals, true)
+}
+
+func (s *ServiceUnitSuite) TestBundleToEventStreamDropsEndsOfUndatedResources(c *C) {
+	birthDate := time.Date(1950, time.May, 1, 0, 0, 0, 0, time.UTC)
+	stopped := time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC)
+	patient := &models.Patient{BirthDate: &models.FHIRDateTime{Time: birthDate, Precision: models.Date}}
+	patient.Id = "12345"
+	// The medication's start is unknown, but not when it was stopped
+	medication := &models.MedicationStatement{Status: "completed", EffectivePeriod: &models.Period{
+		End: &models.FHIRDateTime{Time: stopped, Precision: models.Date},
+	}}
+	medication.Id = "m1"
+	bundle := &models.Bundle{Entry: []models.BundleEntryComponent{{Resource: patient}, {Resource: medication}}}
+
+	es, report, err := BundleToEventStreamWithOptions(bundle, ConversionOptions{})
+	util.CheckErr(err)
+	c.Assert(es.Events, HasLen, 0)
+	c.Assert(report.Undated, HasLen, 1)
+	c.Assert(report.Undated[0].Resource, Equals, "MedicationStatement/m1")
+	c.Assert(report.Undated[0].Dropped, Equals, true)
+	c.Assert(*report.Undated[0].End, Equals, stopped)
+
+	// When the start is given a date, the end is kept
+	es, report, err = BundleToEventStreamWithOptions(bundle, ConversionOptions{Undated: UndatedSinceBirth})
+	util.CheckErr(err)
+	c.Assert(es.Events, HasLen, 2)
+	c.Assert(es.Events[0].Date, Equals, birthDate)
+	c.Assert(es.Events[0].End, Equals, false)
+	c.Assert(es.Events[1].Date, Equals, stopped)
+	c.Assert(es.Events[1].End, Equals, true)
+	c.Assert(report.Undated[0].Dropped, Equals, false)
+	c.Assert(*report.Undated[0].End, Equals, stopped)
+}
+
+func (s *ServiceUnitSuite) TestBundleToEventStreamWithApproximateDates(c *C) {
+	data := []byte(`{
+		"resourceType": "Bundle",
+		"entry": [
+			{"resource": {"resourceType": "Patient", "id": "12345"}},
+			{"resource": {"resourceType": "Condition", "id": "year", "verificationStatus": "confirmed", "onsetDateTime": "2009"}},
+			{"resource": {"resourceType": "Condition", "id": "month", "verificationStatus": "confirmed", "onsetDateTime": "2010-04"}},
+			{"resource": {"resourceType": "Condition", "id": "day", "verificationStatus": "confirmed", "onsetDateTime": "2011-05-06"}}
+		]
+	}`)
+	bundle, err := UnmarshalBundle(data)
+	util.CheckErr(err)
+
+	es, _, err := BundleToEventStreamWithOptions(bundle, ConversionOptions{})
+	util.CheckErr(err)
+	c.Assert(es.Events, HasLen, 3)
+	c.Assert(es.Events[0].Date, Equals, time.Date(2009, time.January, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(es.Events[0].Precision, Equals, plugin.Year)
+	c.Assert(es.Events[0].Approximate(), Equals, true)
+	c.Assert(es.Events[1].Date, Equals, time.Date(2010, time.April, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(es.Events[1].Precision, Equals, plugin.YearMonth)
+	c.Assert(es.Events[2].Precision, Equals, models.Precision(models.Date))
+	c.Assert(es.Events[2].Approximate(), Equals, false)
+
+	// Centering only moves the approximate dates
+	es, _, err = BundleToEventStreamWithOptions(bundle, ConversionOptions{CenterApproximateDates: true})
+	util.CheckErr(err)
+	c.Assert(es.Events[0].Date, Equals, time.Date(2009, time.July, 2, 12, 0, 0, 0, time.UTC))
+	c.Assert(es.Events[1].Date, Equals, time.Date(2010, time.April, 16, 0, 0, 0, 0, time.UTC))
+	c.Assert(es.Events[2].Date, Equals, time.Date(2011, time.May, 6, 0, 0, 0, 0, time.UTC))
+}
+
+func (s *ServiceUnitSuite) TestUnmarshalBundleWithPartialDates(c *C) {
+	data := []byte(`{
+		"resourceType": "Bundle",
+		"entry": [
+			{"resource": {"resourceType": "Patient", "id": "12345", "birthDate": "1950"}},
+			{"resource": {
+				"resourceType": "MedicationStatement",
+				"id": "m1",
+				"status": "active",
+				"effectivePeriod": {"start": "2009-04", "end": "2010-02-03"},
+				"medicationCodeableConcept": {"coding": [{"system": "http://example.org", "code": "2009"}]},
+				"contained": [{"resourceType": "Condition", "id": "c1", "onsetDateTime": "2008"}]
+			}}
+		]
+	}`)
+	bundle, err := UnmarshalBundle(data)
+	util.CheckErr(err)
+	c.Assert(bundle.Entry, HasLen, 2)
+
+	patient := bundle.Entry[0].Resource.(*models.Patient)
+	c.Assert(patient.BirthDate.Time, Equals, time.Date(1950, time.January, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(patient.BirthDate.Precision, Equals, plugin.Year)
+
+	statement := bundle.Entry[1].Resource.(*models.MedicationStatement)
+	c.Assert(statement.EffectivePeriod.Start.Time, Equals, time.Date(2009, time.April, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(statement.EffectivePeriod.Start.Precision, Equals, plugin.YearMonth)
+	c.Assert(statement.EffectivePeriod.End.Precision, Equals, models.Precision(models.Date))
+	// Only dates are touched, so a code that looks like a year is left alone
+	c.Assert(statement.MedicationCodeableConcept.Coding[0].Code, Equals, "2009")
+	c.Assert(statement.Contained, HasLen, 1)
+	condition := statement.Contained[0].(*models.Condition)
+	c.Assert(condition.OnsetDateTime.Precision, Equals, plugin.Year)
+
+	_, err = UnmarshalBundle([]byte(`{"resourceType": "Bundle", "entry": [`))
+	c.Assert(err, NotNil)
+}
+
+func (s *ServiceUnitSuite) TestRoundTripBundleKeepsPartialDates(c *C) {
+	patient := &models.Patient{BirthDate: &models.FHIRDateTime{Time: time.Date(1950, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: plugin.Year}}
+	patient.Id = "12345"
+	condition := &models.Condition{
+		OnsetDateTime:     &models.FHIRDateTime{Time: time.Date(2009, time.April, 1, 0, 0, 0, 0, time.UTC), Precision: plugin.YearMonth},
+		AbatementDateTime: &models.FHIRDateTime{Time: time.Date(2010, time.February, 3, 0, 0, 0, 0, time.UTC), Precision: models.Date},
+	}
+	condition.Id = "c1"
+	bundle, err := RoundTripBundle(&models.Bundle{Type: "searchset", Entry: []models.BundleEntryComponent{
+		{Resource: patient},
+		{Resource: condition},
+	}})
+	util.CheckErr(err)
+	c.Assert(bundle.Entry, HasLen, 2)
+
+	patient = bundle.Entry[0].Resource.(*models.Patient)
+	c.Assert(patient.BirthDate.Time.Year(), Equals, 1950)
+	c.Assert(patient.BirthDate.Precision, Equals, plugin.Year)
+	condition = bundle.Entry[1].Resource.(*models.Condition)
+	c.Assert(condition.OnsetDateTime.Time.Month(), Equals, time.April)
+	c.Assert(condition.OnsetDateTime.Precision, Equals, plugin.YearMonth)
+	c.Assert(condition.AbatementDateTime.Precision, Equals, models.Precision(models.Date))
+}
+
+func (s *ServiceUnitSuite) TestSortAndConsolidateApproximateResults(c *C) {
+	one, two, three := 1, 2, 3
+	jan1 := time.Date(2009, time.January, 1, 0, 0, 0, 0, time.UTC)
+	results := []plugin.RiskServiceCalculationResult{
+		{AsOf: jan1, Score: &one, Approximate: true},
+		{AsOf: jan1, Score: &two, Approximate: true},
+		{AsOf: jan1.AddDate(1, 0, 0), Score: &two, Approximate: true},
+		{AsOf: jan1.AddDate(1, 0, 0), Score: &three},
+	}
+	results = sortAndConsolidate(results)
+	c.Assert(results, HasLen, 2)
+	c.Assert(*results[0].Score, Equals, 2)
+	c.Assert(results[0].Approximate, Equals, true)
+	c.Assert(*results[1].Score, Equals, 3)
+	c.Assert(results[1].Approximate, Equals, false)
+}
+
+func (s *ServiceUnitSuite) TestParseUndatedPolicy(c *C) {
+	policy, err := ParseUndatedPolicy("birth")
+	util.CheckErr(err)
+	c.Assert(policy, Equals, UndatedSinceBirth)
+	_, err = ParseUndatedPolicy("never")
+	c.Assert(err, ErrorMatches, "Unknown undated policy: never.*")
+}
+
+func (s *ServiceUnitSuite) TestGetRequiredDataQueryURLWithEncounters(c *C) {
+	s.Service.RegisterPlugin(&requirementsPlugin{resourceTypes: []string{"Condition", "Encounter"}})
+	qURL, err := s.Service.getRequiredDataQueryURL("12345", "http://example.org/fhir")
+	util.CheckErr(err)
+	qURL2, _ := url.Parse(qURL)
+	c.Assert(qURL2.Query().Get("_id"), Equals, "12345")
+	c.Assert(qURL2.Query()["_revinclude"], DeepEquals, []string{"Condition:patient", "Encounter:patient"})
+}
+
+func (s *ServiceUnitSuite) TestRequiredObservationCodes(c *C) {
+	creatinine := &requirementsPlugin{resourceTypes: []string{"Observation"}, observationCodes: []string{"2160-0"}}
+	labs := &requirementsPlugin{resourceTypes: []string{"Condition", "Observation"}, observationCodes: []string{"2160-0", "1751-7"}}
+	allObservations := &requirementsPlugin{resourceTypes: []string{"Observation"}}
+	noObservations := assessments.NewSimplePlugin()
+
+	c.Assert(requiredObservationCodes([]plugin.RiskServicePlugin{creatinine, labs, noObservations}), DeepEquals, []string{"2160-0", "1751-7"})
+	c.Assert(requiredObservationCodes([]plugin.RiskServicePlugin{creatinine, allObservations}), IsNil)
+	c.Assert(requiredObservationCodes([]plugin.RiskServicePlugin{noObservations}), IsNil)
+}
+
+func (s *ServiceUnitSuite) TestCalculateGetsOnlyRequiredObservations(c *C) {
+	var queries []string
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Path+"?"+r.URL.RawQuery)
+		bundle := &models.Bundle{Type: "searchset"}
+		switch r.URL.Path {
+		case "/Patient":
+			patient := &models.Patient{}
+			patient.Id = "12345"
+			bundle.Entry = []models.BundleEntryComponent{{Resource: patient}}
+		case "/Observation":
+			bundle.Entry = []models.BundleEntryComponent{{Resource: creatinineObservation("o1", "2160-0")}}
+		}
+		json.NewEncoder(w).Encode(bundle)
+	}))
+	defer fhirServer.Close()
+	s.Service.RegisterPlugin(&requirementsPlugin{resourceTypes: []string{"Condition", "Observation"}, observationCodes: []string{"2160-0"}})
+
+	_, _, err := s.Service.CalculateWithOptions("12345", fhirServer.URL, "http://foo.com", CalculationOptions{DryRun: true})
+	util.CheckErr(err)
+	c.Assert(queries, DeepEquals, []string{
+		"/Patient?_id=12345&_revinclude=Condition%3Apatient",
+		"/Observation?code=http%3A%2F%2Floinc.org%7C2160-0&patient=12345",
+	})
+}
+
+func (s *ServiceUnitSuite) TestPatientDataFiltersObservations(c *C) {
+	patient := &models.Patient{}
+	patient.Id = "12345"
+	bundle := &models.Bundle{Entry: []models.BundleEntryComponent{
+		{Resource: patient},
+		{Resource: creatinineObservation("o1", "2160-0")},
+		{Resource: creatinineObservation("o2", "8867-4")},
+	}}
+	// The data source can't search for observations, so the ones that weren't asked for are filtered out
+	ds := struct{ PatientDataSource }{&fixedDataSource{bundle}}
+	data, err := patientData(ds, "12345", []string{"Observation"}, []string{"2160-0"})
+	util.CheckErr(err)
+	c.Assert(data.Entry, HasLen, 2)
+	c.Assert(data.Entry[1].Resource.(*models.Observation).Id, Equals, "o1")
+}
+
+func (s *ServiceUnitSuite) TestFileDataSourcePatientObservations(c *C) {
+	dir := c.MkDir()
+	patient := &models.Patient{}
+	patient.Id = "12345"
+	data, err := json.Marshal(&models.Bundle{Entry: []models.BundleEntryComponent{
+		{Resource: patient},
+		{Resource: creatinineObservation("o1", "2160-0")},
+		{Resource: creatinineObservation("o2", "8867-4")},
+	}})
+	util.CheckErr(err)
+	util.CheckErr(ioutil.WriteFile(dir+"/12345.json", data, 0644))
+
+	bundle, err := NewFileDataSource(dir).PatientObservations("12345", []string{"2160-0", "1751-7"})
+	util.CheckErr(err)
+	c.Assert(bundle.Entry, HasLen, 1)
+	c.Assert(bundle.Entry[0].Resource.(*models.Observation).Id, Equals, "o1")
 }
 
-func (s *ServiceSuite) TestBundleToEventStream(c *C) {
+func (s *ServiceUnitSuite) TestBundleToEventStream(c *C) {
 	data, err := ioutil.ReadFile("fixtures/brad_bradworth_event_source_bundle.json")
 	util.CheckErr(err)
 
@@ -460,7 +1019,7 @@ func (s *ServiceSuite) TestBundleToEventStream(c *C) {
 	c.Assert(es.Events[4].Value, DeepEquals, bundle.Entry[3].Resource)
 }
 
-func (s *ServiceSuite) TestUnconfirmedResourcesDontGenerateEvents(c *C) {
+func (s *ServiceUnitSuite) TestUnconfirmedResourcesDontGenerateEvents(c *C) {
 	data, err := ioutil.ReadFile("fixtures/brad_bradworth_event_source_bundle.json")
 	util.CheckErr(err)
 
@@ -495,7 +1054,88 @@ func (s *ServiceSuite) TestUnconfirmedResourcesDontGenerateEvents(c *C) {
 	c.Assert(es.Events[2].Value, DeepEquals, bundle.Entry[3].Resource)
 }
 
-func (s *ServiceSuite) TestAddSignificantBirthdays(c *C) {
+func (s *ServiceUnitSuite) TestResolvedConditionsGenerateEndEvents(c *C) {
+	date := func(month time.Month) *models.FHIRDateTime {
+		return &models.FHIRDateTime{Time: time.Date(2014, month, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	}
+	patient := &models.Patient{}
+	patient.Id = "12345"
+	resolved := &models.Condition{VerificationStatus: "confirmed", ClinicalStatus: "resolved", OnsetDateTime: date(time.January), DateRecorded: date(time.March)}
+	recordedEarly := &models.Condition{VerificationStatus: "confirmed", ClinicalStatus: "inactive", OnsetDateTime: date(time.May), DateRecorded: date(time.April)}
+	recordedEarly.Meta = &models.Meta{LastUpdated: date(time.June)}
+	remission := &models.Condition{VerificationStatus: "confirmed", ClinicalStatus: "remission", OnsetDateTime: date(time.July)}
+	active := &models.Condition{VerificationStatus: "confirmed", ClinicalStatus: "active", OnsetDateTime: date(time.August), DateRecorded: date(time.September)}
+	bundle := &models.Bundle{Entry: []models.BundleEntryComponent{
+		{Resource: patient}, {Resource: resolved}, {Resource: recordedEarly}, {Resource: remission}, {Resource: active},
+	}}
+
+	es, err := BundleToEventStream(bundle)
+	util.CheckErr(err)
+	c.Assert(es.Events, HasLen, 7)
+	expected := []struct {
+		Date  time.Time
+		End   bool
+		Value interface{}
+	}{
+		{date(time.January).Time, false, resolved},
+		{date(time.March).Time, true, resolved},
+		{date(time.May).Time, false, recordedEarly},
+		// Recorded before its onset, so it falls back to when it was last updated
+		{date(time.June).Time, true, recordedEarly},
+		{date(time.July).Time, false, remission},
+		// No other date, so it ends when it started
+		{date(time.July).Time, true, remission},
+		{date(time.August).Time, false, active},
+	}
+	for i, e := range expected {
+		c.Assert(es.Events[i].Date, Equals, e.Date)
+		c.Assert(es.Events[i].End, Equals, e.End)
+		c.Assert(es.Events[i].Value, Equals, e.Value)
+	}
+}
+
+func (s *ServiceUnitSuite) TestResolvedConditionPolicies(c *C) {
+	date := func(month time.Month) *models.FHIRDateTime {
+		return &models.FHIRDateTime{Time: time.Date(2014, month, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	}
+	condition := func(code, status string, onset, recorded time.Month) *models.Condition {
+		return &models.Condition{
+			Code:               &models.CodeableConcept{Coding: []models.Coding{{System: "http://hl7.org/fhir/sid/icd-9", Code: code}}},
+			VerificationStatus: "confirmed",
+			ClinicalStatus:     status,
+			OnsetDateTime:      date(onset),
+			DateRecorded:       date(recorded),
+		}
+	}
+	patient := &models.Patient{Gender: "male", BirthDate: &models.FHIRDateTime{Time: time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}}
+	patient.Id = "12345"
+	bundle := &models.Bundle{Entry: []models.BundleEntryComponent{
+		{Resource: patient},
+		{Resource: condition("427.31", "active", time.January, time.January)},
+		{Resource: condition("401.9", "resolved", time.February, time.March)},
+	}}
+
+	s.Service.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
+	s.Service.RegisterPlugin(assessments.NewSimplePlugin())
+	results, _, err := s.Service.Evaluate(bundle, "http://example.org/pies", CalculationOptions{})
+	util.CheckErr(err)
+	c.Assert(results, HasLen, 2)
+
+	// CHA2DS2-VASc still counts the resolved hypertension...
+	chads := results[0].RiskAssessments
+	c.Assert(chads, HasLen, 2)
+	c.Assert(*chads[1].Prediction[0].ProbabilityDecimal, Equals, 1.3)
+
+	// ...but the simple plugin stops counting it once it resolves
+	simple := results[1].RiskAssessments
+	c.Assert(simple, HasLen, 3)
+	c.Assert(simple[1].Date.Time.Equal(date(time.February).Time), Equals, true)
+	c.Assert(*simple[1].Prediction[0].ProbabilityDecimal, Equals, float64(2))
+	c.Assert(simple[2].Date.Time.Equal(date(time.March).Time), Equals, true)
+	c.Assert(*simple[2].Prediction[0].ProbabilityDecimal, Equals, float64(1))
+}
+
+func (s *ServiceUnitSuite) TestAddSignificantBirthdays(c *C) {
 	bd := time.Date(1950, time.March, 1, 12, 0, 0, 0, time.UTC)
 	es := &plugin.EventStream{
 		Patient: &models.Patient{
@@ -550,7 +1190,7 @@ func (s *ServiceSuite) TestAddSignificantBirthdays(c *C) {
 	})
 }
 
-func (s *ServiceSuite) TestSortAndConsolidateWithDuplicates(c *C) {
+func (s *ServiceUnitSuite) TestSortAndConsolidateWithDuplicates(c *C) {
 	one, two, three, four, five, six, seven, eight := 1, 2, 3, 4, 5, 6, 7, 8
 	results := []plugin.RiskServiceCalculationResult{
 		{
@@ -594,7 +1234,7 @@ func (s *ServiceSuite) TestSortAndConsolidateWithDuplicates(c *C) {
 	c.Assert(*results[4].Score, Equals, 6)
 }
 
-func (s *ServiceSuite) TestGetRiskAssessmentDeleteURL(c *C) {
+func (s *ServiceUnitSuite) TestGetRiskAssessmentDeleteURL(c *C) {
 	cc := models.CodeableConcept{
 		Coding: []models.Coding{
 			{System: "foo", Code: "bar"},
@@ -610,7 +1250,7 @@ func (s *ServiceSuite) TestGetRiskAssessmentDeleteURL(c *C) {
 	c.Assert(values.Get("method"), Equals, "foo|bar")
 }
 
-func (s *ServiceSuite) TestGetRequiredDataQueryURLForCHADS(c *C) {
+func (s *ServiceUnitSuite) TestGetRequiredDataQueryURLForCHADS(c *C) {
 	s.Service.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
 	qURL, err := s.Service.getRequiredDataQueryURL("12345", "http://example.org/fhir")
 	util.CheckErr(err)
@@ -622,7 +1262,7 @@ func (s *ServiceSuite) TestGetRequiredDataQueryURLForCHADS(c *C) {
 	c.Assert(qURL2.Query().Get("_revinclude"), Equals, "Condition:patient")
 }
 
-func (s *ServiceSuite) TestGetRequiredDataQueryURLForSimple(c *C) {
+func (s *ServiceUnitSuite) TestGetRequiredDataQueryURLForSimple(c *C) {
 	s.Service.RegisterPlugin(assessments.NewSimplePlugin())
 	qURL, err := s.Service.getRequiredDataQueryURL("12345", "http://example.org/fhir")
 	util.CheckErr(err)
@@ -630,37 +1270,19 @@ func (s *ServiceSuite) TestGetRequiredDataQueryURLForSimple(c *C) {
 	qURL2, _ := url.Parse(qURL)
 	c.Assert(qURL2.Query(), HasLen, 2)
 	c.Assert(qURL2.Query().Get("_id"), Equals, "12345")
-	c.Assert(qURL2.Query()["_revinclude"], HasLen, 2)
-	var cFound, mFound bool
-	for _, v := range qURL2.Query()["_revinclude"] {
-		if v == "Condition:patient" {
-			cFound = true
-		} else if v == "MedicationStatement:patient" {
-			mFound = true
-		}
-	}
-	c.Assert(cFound, Equals, true)
-	c.Assert(mFound, Equals, true)
+	c.Assert(qURL2.Query()["_revinclude"], DeepEquals, []string{"Condition:patient", "MedicationStatement:patient",
+		"MedicationOrder:patient", "MedicationDispense:patient", "MedicationAdministration:patient"})
 }
 
-func (s *ServiceSuite) TestGetRequiredDataQueryURLForCHADSandSimple(c *C) {
+func (s *ServiceUnitSuite) TestGetRequiredDataQueryURLForCHADSandSimple(c *C) {
 	s.Service.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
 	s.Service.RegisterPlugin(assessments.NewSimplePlugin())
 	qURL, err := s.Service.getRequiredDataQueryURL("12345", "http://example.org/fhir")
 	util.CheckErr(err)
 	c.Assert(strings.HasPrefix(qURL, "http://example.org/fhir/Patient?"), Equals, true)
 	qURL2, _ := url.Parse(qURL)
-	c.Assert(qURL2.Query()["_revinclude"], HasLen, 2)
-	var cFound, mFound bool
-	for _, v := range qURL2.Query()["_revinclude"] {
-		if v == "Condition:patient" {
-			cFound = true
-		} else if v == "MedicationStatement:patient" {
-			mFound = true
-		}
-	}
-	c.Assert(cFound, Equals, true)
-	c.Assert(mFound, Equals, true)
+	c.Assert(qURL2.Query()["_revinclude"], DeepEquals, []string{"Condition:patient", "MedicationStatement:patient",
+		"MedicationOrder:patient", "MedicationDispense:patient", "MedicationAdministration:patient"})
 }
 
 func (s *ServiceSuite) TestBuildRiskAssessmentBundle(c *C) {
@@ -738,7 +1360,7 @@ func (s *ServiceSuite) TestBuildRiskAssessmentBundle(c *C) {
 	}
 }
 
-func (s *ServiceSuite) TestBuildNARiskAssessmentBundle(c *C) {
+func (s *ServiceUnitSuite) TestBuildNARiskAssessmentBundle(c *C) {
 	simplePlugin := assessments.NewSimplePlugin()
 	bundle := buildNARiskAssessmentBundle("12345", simplePlugin.Config())
 
@@ -786,3 +1408,476 @@ func (s *ServiceSuite) TestBuildNARiskAssessmentBundle(c *C) {
 	c.Assert(ra.Prediction[0].ProbabilityCodeableConcept.Text, Equals, "Not applicable")
 	c.Assert(ra.Subject.Reference, Equals, "Patient/12345")
 }
+
+func (s *ServiceUnitSuite) TestCalculationOutcomeErr(c *C) {
+	outcome := &CalculationOutcome{
+		Plugins: []PluginOutcome{
+			{Name: "Foo", Method: "Foo", Status: PluginScored, Results: 2},
+			{Name: "Bar", Method: "Bar", Status: PluginNotApplicable},
+		},
+	}
+	c.Assert(outcome.Err(), IsNil)
+
+	outcome.Plugins = append(outcome.Plugins,
+		PluginOutcome{Name: "Baz", Method: "Baz", Status: PluginError, Error: "Baz is broken"},
+		PluginOutcome{Name: "Qux", Method: "Qux", Status: PluginError, Error: "Qux is broken"})
+	err := outcome.Err()
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, "Risk calculation failed for Baz: Baz is broken; Qux: Qux is broken")
+}
+
+func (s *ServiceSuite) TestEndToEndDryRunCalculations(c *C) {
+	data, err := os.Open("fixtures/chad_chadworth_bundle.json")
+	util.CheckErr(err)
+	defer data.Close()
+
+	// Store Chad Chadworth's information to Mongo
+	res, err := http.Post(s.Server.URL+"/", "application/json", data)
+	util.CheckErr(err)
+	defer res.Body.Close()
+
+	// Get the response so we can pull out the patient ID
+	responseBundle := new(models.Bundle)
+	err = json.NewDecoder(res.Body).Decode(responseBundle)
+	util.CheckErr(err)
+	patientID := responseBundle.Entry[0].Resource.(*models.Patient).Id
+
+	s.Service.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
+	s.Service.RegisterPlugin(assessments.NewSimplePlugin())
+
+	// Only calculate CHADS, as of the beginning of 2014, without saving anything
+	asOf := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	results, outcome, err := s.Service.CalculateWithOptions(patientID, s.Server.URL, s.Server.URL+"/pies", CalculationOptions{
+		Method: "http://interventionengine.org/risk-assessments|CHADS",
+		AsOf:   &asOf,
+		DryRun: true,
+	})
+	util.CheckErr(err)
+	c.Assert(outcome.Plugins, DeepEquals, []PluginOutcome{
+		{Name: "CHA2DS2–VASc score", Method: "CHADS", Status: PluginScored, Results: 2},
+	})
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].Name, Equals, "CHA2DS2–VASc score")
+	c.Assert(results[0].RiskAssessments, HasLen, 2)
+	c.Assert(results[0].Pies, HasLen, 2)
+	loc := time.FixedZone("-0500", -5*60*60)
+	c.Assert(results[0].RiskAssessments[0].Date.Time.Equal(time.Date(2012, time.September, 20, 8, 0, 0, 0, loc)), Equals, true)
+	c.Assert(results[0].RiskAssessments[1].Date.Time.Equal(time.Date(2013, time.September, 2, 10, 0, 0, 0, loc)), Equals, true)
+	c.Assert(results[0].RiskAssessments[1].Meta.Tag[0].Code, Equals, "MOST_RECENT")
+	c.Assert(results[0].RiskAssessments[1].Basis[0].Reference, Equals, s.Server.URL+"/pies/"+results[0].Pies[1].Id.Hex())
+
+	// Nothing should have been saved
+	count, err := s.Database.C("riskassessments").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 0)
+	count, err = s.Database.C("pies").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 0)
+}
+
+func (s *ServiceUnitSuite) TestSelectPlugins(c *C) {
+	s.Service.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
+	s.Service.RegisterPlugin(assessments.NewSimplePlugin())
+
+	plugins, err := s.Service.selectPlugins("")
+	util.CheckErr(err)
+	c.Assert(plugins, HasLen, 2)
+
+	plugins, err = s.Service.selectPlugins("Simple")
+	util.CheckErr(err)
+	c.Assert(plugins, HasLen, 1)
+	c.Assert(plugins[0].Config().Name, Equals, "Simple Conditions + Medications")
+
+	plugins, err = s.Service.selectPlugins("http://interventionengine.org/risk-assessments|CHADS")
+	util.CheckErr(err)
+	c.Assert(plugins, HasLen, 1)
+	c.Assert(plugins[0].Config().Name, Equals, "CHA2DS2–VASc score")
+
+	_, err = s.Service.selectPlugins("http://example.org|CHADS")
+	c.Assert(err, FitsTypeOf, UnknownMethodError{})
+	_, err = s.Service.selectPlugins("Foo")
+	c.Assert(err, FitsTypeOf, UnknownMethodError{})
+	c.Assert(err.Error(), Equals, "No risk assessment plugin is registered for method: Foo")
+}
+
+func (s *ServiceUnitSuite) TestParseAsOf(c *C) {
+	t, err := ParseAsOf("2015-01-01T12:30:00-05:00")
+	util.CheckErr(err)
+	c.Assert(t.Equal(time.Date(2015, time.January, 1, 17, 30, 0, 0, time.UTC)), Equals, true)
+
+	t, err = ParseAsOf("2015-01-01")
+	util.CheckErr(err)
+	c.Assert(t.Equal(time.Date(2015, time.January, 1, 23, 59, 59, 999999999, time.Local)), Equals, true)
+
+	_, err = ParseAsOf("January 1st")
+	c.Assert(err, NotNil)
+}
+
+func (s *ServiceUnitSuite) TestNextPageURL(c *C) {
+	bundle := &models.Bundle{Link: []models.BundleLinkComponent{
+		{Relation: "self", Url: "http://example.org/fhir/Patient?_offset=0"},
+		{Relation: "next", Url: "http://example.org/fhir/Patient?_offset=100"},
+	}}
+	c.Assert(NextPageURL(bundle), Equals, "http://example.org/fhir/Patient?_offset=100")
+
+	bundle.Link = bundle.Link[:1]
+	c.Assert(NextPageURL(bundle), Equals, "")
+}
+
+func (s *ServiceUnitSuite) TestFHIRDataSource(c *C) {
+	var query url.Values
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		patient := &models.Patient{}
+		patient.Id = "12345"
+		json.NewEncoder(w).Encode(&models.Bundle{Type: "searchset", Entry: []models.BundleEntryComponent{{Resource: patient}}})
+	}))
+	defer fhirServer.Close()
+
+	bundle, err := NewFHIRDataSource(fhirServer.URL).PatientData("12345", []string{"Condition", "MedicationStatement"})
+	util.CheckErr(err)
+	c.Assert(bundle.Entry, HasLen, 1)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Id, Equals, "12345")
+	c.Assert(query.Get("_id"), Equals, "12345")
+	c.Assert(query["_revinclude"], DeepEquals, []string{"Condition:patient", "MedicationStatement:patient"})
+}
+
+func (s *ServiceUnitSuite) TestFHIRDataSourceBadResponse(c *C) {
+	fhirServer := httptest.NewServer(http.NotFoundHandler())
+	defer fhirServer.Close()
+
+	_, err := NewFHIRDataSource(fhirServer.URL).PatientData("12345", []string{"Condition"})
+	c.Assert(err, ErrorMatches, "Unable to retrieve data for patient 12345.  Received response code: 404")
+}
+
+func (s *ServiceUnitSuite) TestFHIRDataSourceFollowsPages(c *C) {
+	fhirServer := newPagedPatientServer(3)
+	defer fhirServer.Close()
+
+	bundle, err := NewFHIRDataSource(fhirServer.URL).PatientData("12345", []string{"Condition"})
+	util.CheckErr(err)
+	c.Assert(NextPageURL(bundle), Equals, "")
+	// The patient is repeated on every page, but should only be included once
+	c.Assert(bundle.Entry, HasLen, 4)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Id, Equals, "12345")
+	for i, entry := range bundle.Entry[1:] {
+		c.Assert(entry.Resource.(*models.Condition).Id, Equals, fmt.Sprintf("c%d", i))
+	}
+}
+
+func (s *ServiceUnitSuite) TestFHIRDataSourceStopsAtMaxPages(c *C) {
+	fhirServer := newPagedPatientServer(3)
+	defer fhirServer.Close()
+
+	ds := NewFHIRDataSource(fhirServer.URL)
+	ds.MaxPages = 2
+	bundle, err := ds.PatientData("12345", []string{"Condition"})
+	util.CheckErr(err)
+	c.Assert(bundle.Entry, HasLen, 3)
+	c.Assert(NextPageURL(bundle), Equals, fhirServer.URL+"/Patient?_id=12345&_offset=2")
+}
+
+func (s *ServiceUnitSuite) TestCalculateRecordsTruncatedData(c *C) {
+	fhirServer := newPagedPatientServer(3)
+	defer fhirServer.Close()
+	s.Service.RegisterPlugin(assessments.NewSimplePlugin())
+
+	s.Service.SetMaxDataPages(2)
+	_, outcome, err := s.Service.CalculateWithOptions("12345", fhirServer.URL, "http://foo.com", CalculationOptions{DryRun: true})
+	util.CheckErr(err)
+	c.Assert(outcome.Truncated, Equals, true)
+
+	s.Service.SetMaxDataPages(0)
+	_, outcome, err = s.Service.CalculateWithOptions("12345", fhirServer.URL, "http://foo.com", CalculationOptions{DryRun: true})
+	util.CheckErr(err)
+	c.Assert(outcome.Truncated, Equals, false)
+}
+
+func (s *ServiceSuite) TestDataAccessLayerDataSource(c *C) {
+	data, err := os.Open("fixtures/chad_chadworth_bundle.json")
+	util.CheckErr(err)
+	defer data.Close()
+
+	// Store Chad Chadworth's information to Mongo
+	res, err := http.Post(s.Server.URL+"/", "application/json", data)
+	util.CheckErr(err)
+	defer res.Body.Close()
+	responseBundle := new(models.Bundle)
+	util.CheckErr(json.NewDecoder(res.Body).Decode(responseBundle))
+	patientID := responseBundle.Entry[0].Resource.(*models.Patient).Id
+
+	ds := NewDataAccessLayerDataSource(server.NewMongoDataAccessLayer(s.Database))
+	bundle, err := ds.PatientData(patientID, []string{"Condition", "MedicationStatement"})
+	util.CheckErr(err)
+	es, err := BundleToEventStream(bundle)
+	util.CheckErr(err)
+	c.Assert(es.Patient.Id, Equals, patientID)
+	c.Assert(es.Events, HasLen, 4)
+}
+
+func (s *ServiceUnitSuite) TestFileDataSource(c *C) {
+	dir := c.MkDir()
+	data, err := ioutil.ReadFile("fixtures/chad_chadworth_bundle.json")
+	util.CheckErr(err)
+	util.CheckErr(ioutil.WriteFile(dir+"/chad.json", data, 0644))
+	ds := NewFileDataSource(dir)
+
+	// Only the patient and the requested resource types (not the encounters or medications) should be returned
+	bundle, err := ds.PatientData("chad", []string{"Condition"})
+	util.CheckErr(err)
+	c.Assert(bundle.Entry, HasLen, 4)
+	_, ok := bundle.Entry[0].Resource.(*models.Patient)
+	c.Assert(ok, Equals, true)
+	for _, entry := range bundle.Entry[1:] {
+		_, ok := entry.Resource.(*models.Condition)
+		c.Assert(ok, Equals, true)
+	}
+
+	_, err = ds.PatientData("bob", []string{"Condition"})
+	c.Assert(err, NotNil)
+	_, err = ds.PatientData("../chad", []string{"Condition"})
+	c.Assert(err, ErrorMatches, "Invalid patient ID: ../chad")
+}
+
+func (s *ServiceUnitSuite) TestCalculateWithFileDataSource(c *C) {
+	s.useChadFileDataSource(c)
+
+	// No FHIR server is needed to get the data, and a dry run doesn't need one to post the results
+	results, outcome, err := s.Service.CalculateWithOptions("chad", "", "http://foo.com/pies", CalculationOptions{DryRun: true})
+	util.CheckErr(err)
+	c.Assert(outcome.Plugins, DeepEquals, []PluginOutcome{
+		{Name: "CHA2DS2–VASc score", Method: "CHADS", Status: PluginScored, Results: 4},
+		{Name: "Simple Conditions + Medications", Method: "Simple", Status: PluginScored, Results: 4},
+	})
+	c.Assert(results, HasLen, 2)
+}
+
+func (s *ServiceUnitSuite) TestResultSinks(c *C) {
+	s.useChadFileDataSource(c)
+	memory := NewMemorySink()
+	var out bytes.Buffer
+	s.Service.UseResultSink(MultiSink{memory, NewNDJSONSink(&out)})
+
+	_, err := s.Service.Calculate("chad", "http://example.org/fhir", "http://example.org/pies")
+	util.CheckErr(err)
+
+	results := memory.Results()
+	c.Assert(results, HasLen, 2)
+	c.Assert(results[0].Name, Equals, "CHA2DS2–VASc score")
+	c.Assert(results[0].Method.Coding[0].Code, Equals, "CHADS")
+	c.Assert(results[0].PatientID, Equals, "chad")
+	c.Assert(results[0].FHIREndpointURL, Equals, "http://example.org/fhir")
+	c.Assert(results[0].NotApplicable, Equals, false)
+	c.Assert(results[0].RiskAssessments, HasLen, 4)
+	c.Assert(results[0].Pies, HasLen, 4)
+	c.Assert(results[1].Method.Coding[0].Code, Equals, "Simple")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	var decoded PluginResults
+	util.CheckErr(json.Unmarshal([]byte(lines[1]), &decoded))
+	c.Assert(decoded.Name, Equals, "Simple Conditions + Medications")
+	c.Assert(decoded.PatientID, Equals, "chad")
+	c.Assert(decoded.RiskAssessments, HasLen, 4)
+	c.Assert(decoded.Pies, HasLen, 4)
+}
+
+func (s *ServiceUnitSuite) TestResultSinksNotUsedForDryRun(c *C) {
+	s.useChadFileDataSource(c)
+	memory := NewMemorySink()
+	s.Service.UseResultSink(memory)
+
+	_, _, err := s.Service.CalculateWithOptions("chad", "http://example.org/fhir", "http://example.org/pies", CalculationOptions{DryRun: true})
+	util.CheckErr(err)
+	c.Assert(memory.Results(), HasLen, 0)
+}
+
+func (s *ServiceUnitSuite) TestMultiSinkStopsAtFirstError(c *C) {
+	s.useChadFileDataSource(c)
+	memory := NewMemorySink()
+	s.Service.UseResultSink(MultiSink{failingSink{}, memory})
+
+	outcome, err := s.Service.Calculate("chad", "http://example.org/fhir", "http://example.org/pies")
+	c.Assert(err, NotNil)
+	c.Assert(outcome.Plugins[0].Status, Equals, PluginError)
+	c.Assert(outcome.Plugins[0].Error, Equals, "Sink unavailable")
+	c.Assert(memory.Results(), HasLen, 0)
+}
+
+func (s *ServiceUnitSuite) TestWebhookSink(c *C) {
+	var received PluginResults
+	status := http.StatusOK
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(status)
+	}))
+	defer hook.Close()
+
+	sink := NewWebhookSink(hook.URL)
+	util.CheckErr(sink.Write(PluginResults{Name: "Foo", PatientID: "12345"}))
+	c.Assert(received.Name, Equals, "Foo")
+	c.Assert(received.PatientID, Equals, "12345")
+
+	status = http.StatusInternalServerError
+	err := sink.Write(PluginResults{Name: "Foo", PatientID: "12345"})
+	c.Assert(err, ErrorMatches, "Results did not post to webhook properly.  Received response code: 500")
+}
+
+func (s *ServiceUnitSuite) TestChannelSink(c *C) {
+	sink := NewChannelSink(1)
+	util.CheckErr(sink.Write(PluginResults{Name: "Foo", PatientID: "12345"}))
+	results := <-sink.C
+	c.Assert(results.Name, Equals, "Foo")
+	c.Assert(results.PatientID, Equals, "12345")
+}
+
+func (s *ServiceUnitSuite) TestEventsAndResultsAsOf(c *C) {
+	events := []plugin.Event{
+		{Date: time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC), Type: "Condition"},
+		{Date: time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC), Type: "Condition"},
+		{Date: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC), Type: "Condition"},
+	}
+	c.Assert(eventsAsOf(events, time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)), HasLen, 2)
+	c.Assert(eventsAsOf(events, time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC)), HasLen, 0)
+	c.Assert(eventsAsOf(events, time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)), HasLen, 3)
+
+	one, two := 1, 2
+	results := []plugin.RiskServiceCalculationResult{
+		{AsOf: time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC), Score: &one},
+		{AsOf: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC), Score: &two},
+	}
+	c.Assert(resultsAsOf(results, time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)), HasLen, 1)
+	c.Assert(resultsAsOf(results, time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)), HasLen, 2)
+}
+
+func (s *ServiceUnitSuite) TestResultsBundle(c *C) {
+	one := 1
+	results := []plugin.RiskServiceCalculationResult{
+		{
+			AsOf:  time.Date(2012, 1, 1, 11, 0, 0, 0, time.UTC),
+			Score: &one,
+			Pie:   plugin.NewPie("http://example.org/fhir/Patient/12345"),
+		},
+	}
+	simplePlugin := assessments.NewSimplePlugin()
+	raBundle := buildRiskAssessmentBundle("12345", results, "http://example.org/pies", simplePlugin.Config())
+	bundle := ResultsBundle([]PluginResults{toPluginResults("12345", "http://example.org/fhir", simplePlugin.Config(), raBundle, results, false)}, "http://example.org/pies")
+
+	c.Assert(bundle.Type, Equals, "collection")
+	c.Assert(bundle.Entry, HasLen, 2)
+	ra, ok := bundle.Entry[0].Resource.(*models.RiskAssessment)
+	c.Assert(ok, Equals, true)
+	c.Assert(ra.Subject.Reference, Equals, "Patient/12345")
+	c.Assert(bundle.Entry[0].Request, IsNil)
+	c.Assert(bundle.Entry[1].Resource, Equals, results[0].Pie)
+	c.Assert(bundle.Entry[1].FullUrl, Equals, ra.Basis[0].Reference)
+}
+
+func (s *ServiceUnitSuite) TestEvaluate(c *C) {
+	data, err := ioutil.ReadFile("fixtures/brad_bradworth_event_source_bundle.json")
+	util.CheckErr(err)
+	bundle := new(models.Bundle)
+	json.Unmarshal(data, bundle)
+
+	s.Service.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
+	s.Service.RegisterPlugin(assessments.NewSimplePlugin())
+
+	results, outcome, err := s.Service.Evaluate(bundle, "http://example.org/pies", CalculationOptions{})
+	util.CheckErr(err)
+	c.Assert(outcome.Plugins, DeepEquals, []PluginOutcome{
+		{Name: "CHA2DS2–VASc score", Method: "CHADS", Status: PluginScored, Results: 4},
+		{Name: "Simple Conditions + Medications", Method: "Simple", Status: PluginScored, Results: 4},
+	})
+	c.Assert(results, HasLen, 2)
+	chads := results[0]
+	c.Assert(chads.RiskAssessments, HasLen, 4)
+	c.Assert(chads.Pies, HasLen, 4)
+	c.Assert(chads.RiskAssessments[3].Date.Time.Equal(time.Date(2015, time.September, 2, 0, 0, 0, 0, time.UTC)), Equals, true)
+	c.Assert(*chads.RiskAssessments[3].Prediction[0].ProbabilityDecimal, Equals, 6.7)
+	c.Assert(chads.RiskAssessments[3].Subject.Reference, Equals, "Patient/507f1f77bcf86cd799439001")
+	c.Assert(chads.Pies[3].Patient, Equals, "/Patient/507f1f77bcf86cd799439001")
+}
+
+func (s *ServiceUnitSuite) TestEvaluateWithoutPatient(c *C) {
+	s.Service.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
+	_, outcome, err := s.Service.Evaluate(&models.Bundle{Type: "collection"}, "http://example.org/pies", CalculationOptions{})
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, "The bundle must contain a patient")
+	c.Assert(outcome.Plugins, HasLen, 0)
+}
+
+// useChadFileDataSource sets up the service to calculate CHADS and Simple scores for Chad Chadworth (as patient
+// "chad") without a FHIR server.
+func (s *ServiceUnitSuite) useChadFileDataSource(c *C) {
+	dir := c.MkDir()
+	data, err := ioutil.ReadFile("fixtures/chad_chadworth_bundle.json")
+	util.CheckErr(err)
+	util.CheckErr(ioutil.WriteFile(dir+"/chad.json", data, 0644))
+	s.Service.UseDataSource(NewFileDataSource(dir))
+	s.Service.RegisterPlugin(assessments.NewCHA2DS2VAScPlugin())
+	s.Service.RegisterPlugin(assessments.NewSimplePlugin())
+}
+
+type failingSink struct{}
+
+func (f failingSink) Write(results PluginResults) error {
+	return errors.New("Sink unavailable")
+}
+
+// newPagedPatientServer returns a fake FHIR server that returns patient 12345's data in the given number of pages.
+// Each page has the patient and one condition, and links to the next page by its offset.
+func newPagedPatientServer(pages int) *httptest.Server {
+	var fhirServer *httptest.Server
+	fhirServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("_offset"))
+		patient := &models.Patient{}
+		patient.Id = "12345"
+		condition := &models.Condition{Code: &models.CodeableConcept{Text: "Condition"}, OnsetDateTime: &models.FHIRDateTime{Time: time.Date(2010, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}}
+		condition.Id = fmt.Sprintf("c%d", offset)
+		bundle := &models.Bundle{Type: "searchset", Entry: []models.BundleEntryComponent{{Resource: patient}, {Resource: condition}}}
+		if offset+1 < pages {
+			bundle.Link = []models.BundleLinkComponent{{
+				Relation: "next",
+				Url:      fmt.Sprintf("%s/Patient?_id=12345&_offset=%d", fhirServer.URL, offset+1),
+			}}
+		}
+		json.NewEncoder(w).Encode(bundle)
+	}))
+	return fhirServer
+}
+
+// requirementsPlugin is the simple plugin with different data requirements, standing in for plugins that need other
+// kinds of data (e.g., a utilization-based plugin that needs the patient's encounters).
+type requirementsPlugin struct {
+	assessments.SimplePlugin
+	resourceTypes    []string
+	observationCodes []string
+}
+
+func (r *requirementsPlugin) Config() plugin.RiskServicePluginConfig {
+	config := r.SimplePlugin.Config()
+	config.RequiredResourceTypes = r.resourceTypes
+	config.RequiredObservationCodes = r.observationCodes
+	return config
+}
+
+// fixedDataSource always returns the same bundle.
+type fixedDataSource struct {
+	bundle *models.Bundle
+}
+
+func (f *fixedDataSource) PatientData(patientID string, resourceTypes []string) (*models.Bundle, error) {
+	return f.bundle, nil
+}
+
+func creatinineObservation(id, loincCode string) *models.Observation {
+	value := 1.2
+	observation := &models.Observation{
+		Status:            "final",
+		Code:              &models.CodeableConcept{Coding: []models.Coding{{System: "http://loinc.org", Code: loincCode}}},
+		ValueQuantity:     &models.Quantity{Value: &value, Unit: "mg/dL"},
+		EffectiveDateTime: &models.FHIRDateTime{Time: time.Date(2015, time.March, 1, 8, 0, 0, 0, time.UTC), Precision: models.Timestamp},
+	}
+	observation.Id = id
+	return observation
+}
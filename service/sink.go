@@ -0,0 +1,156 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// ResultSink is a destination for the results of running a plugin for a patient.  The risk service writes the
+// results of every plugin that succeeds to its sink, unless it is doing a dry run.
+type ResultSink interface {
+	Write(results PluginResults) error
+}
+
+// MultiSink writes results to each of its sinks in order.  It stops at the first sink that fails, so a sink is
+// never ahead of the sinks before it (e.g., pies aren't replaced if the risk assessments referring to them
+// couldn't be posted).
+type MultiSink []ResultSink
+
+// Write fulfills the ResultSink interface.
+func (m MultiSink) Write(results PluginResults) error {
+	for _, sink := range m {
+		if err := sink.Write(results); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FHIRSink replaces the patient's risk assessments for the plugin's method on the FHIR server that the patient's
+// data came from.
+type FHIRSink struct{}
+
+// NewFHIRSink returns a new FHIRSink.
+func NewFHIRSink() *FHIRSink {
+	return &FHIRSink{}
+}
+
+// Write fulfills the ResultSink interface.
+func (f *FHIRSink) Write(results PluginResults) error {
+	raBundle := riskAssessmentTransaction(results.PatientID, results.Method, results.RiskAssessments)
+	return postRiskAssessmentBundle(results.FHIREndpointURL, raBundle)
+}
+
+// PieSink replaces the patient's pies for the plugin's method in the "pies" collection of a Mongo database.
+type PieSink struct {
+	db *mgo.Database
+}
+
+// NewPieSink returns a new PieSink storing pies in the passed in database.
+func NewPieSink(db *mgo.Database) *PieSink {
+	return &PieSink{db: db}
+}
+
+// Write fulfills the ResultSink interface.
+func (p *PieSink) Write(results PluginResults) error {
+	return replacePies(results.FHIREndpointURL, results.PatientID, results.Pies, p.db.C("pies"), results.Method)
+}
+
+// NDJSONSink writes each set of results as a line of JSON.  It is safe to use from concurrent calculations.
+type NDJSONSink struct {
+	sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewNDJSONSink returns a new NDJSONSink writing to w.
+func NewNDJSONSink(w io.Writer) *NDJSONSink {
+	return &NDJSONSink{encoder: json.NewEncoder(w)}
+}
+
+// Write fulfills the ResultSink interface.
+func (n *NDJSONSink) Write(results PluginResults) error {
+	n.Lock()
+	defer n.Unlock()
+	return n.encoder.Encode(&results)
+}
+
+// WebhookSink posts each set of results as JSON to a URL.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookSink returns a new WebhookSink posting to the given URL.
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{URL: url, Client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Write fulfills the ResultSink interface.
+func (w *WebhookSink) Write(results PluginResults) error {
+	data, err := json.Marshal(&results)
+	if err != nil {
+		return err
+	}
+	response, err := w.Client.Post(w.URL, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("Results did not post to webhook properly.  Received response code: %d", response.StatusCode)
+	}
+	return nil
+}
+
+// ChannelSink publishes each set of results on a channel.  It stands in for a message bus: a consumer reads the
+// results from the channel and forwards them wherever they need to go.  Writes block until the results are
+// received (or buffered, if the channel is buffered).
+type ChannelSink struct {
+	C chan PluginResults
+}
+
+// NewChannelSink returns a new ChannelSink with a channel of the given buffer size.
+func NewChannelSink(buffer int) *ChannelSink {
+	return &ChannelSink{C: make(chan PluginResults, buffer)}
+}
+
+// Write fulfills the ResultSink interface.
+func (c *ChannelSink) Write(results PluginResults) error {
+	c.C <- results
+	return nil
+}
+
+// MemorySink keeps every set of results in memory.  It is mostly useful for testing.
+type MemorySink struct {
+	sync.Mutex
+	results []PluginResults
+}
+
+// NewMemorySink returns a new, empty MemorySink.
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+// Write fulfills the ResultSink interface.
+func (m *MemorySink) Write(results PluginResults) error {
+	m.Lock()
+	defer m.Unlock()
+	m.results = append(m.results, results)
+	return nil
+}
+
+// Results returns the results written to the sink so far.
+func (m *MemorySink) Results() []PluginResults {
+	m.Lock()
+	defer m.Unlock()
+	results := make([]PluginResults, len(m.results))
+	copy(results, m.results)
+	return results
+}
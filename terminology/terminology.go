@@ -0,0 +1,266 @@
+// Package terminology provides value sets and concept maps for matching and translating codes, so that risk
+// calculations can look for conditions (or anything else that is coded) by named value sets instead of by
+// hardcoded codes in one particular code system.
+package terminology
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// The URIs of the code systems that the built-in plugins use.  ICD-9 and ICD-10 codes are compared without their
+// dots, and their hierarchies follow the codes (e.g., "428.0" is a "428").
+const (
+	ICD9System    = "http://hl7.org/fhir/sid/icd-9"
+	ICD10System   = "http://hl7.org/fhir/sid/icd-10"
+	ICD10CMSystem = "http://hl7.org/fhir/sid/icd-10-cm"
+	SNOMEDSystem  = "http://snomed.info/sct"
+)
+
+// systemAliases maps other URIs that are used for the same code systems to the ones above
+var systemAliases = map[string]string{
+	"http://hl7.org/fhir/sid/icd-9-cm": ICD9System,
+	"urn:oid:2.16.840.1.113883.6.103":  ICD9System,
+	"urn:oid:2.16.840.1.113883.6.90":   ICD10CMSystem,
+	"urn:oid:2.16.840.1.113883.6.96":   SNOMEDSystem,
+	"http://snomed.info/id":            SNOMEDSystem,
+}
+
+// Default is the terminology used by the built-in plugins.  They add their value sets to it when the program
+// starts, and value sets loaded into it afterwards (e.g., by a site with its own code lists) replace the built-in
+// ones with the same name or URL.
+var Default = New()
+
+// Terminology holds value sets and concept maps.  It is safe for concurrent use.
+type Terminology struct {
+	sync.RWMutex
+	valueSets map[string]*ValueSet
+	maps      map[string][]mapping
+	parents   map[string]map[string][]string
+}
+
+// mapping is one target of a concept map element
+type mapping struct {
+	target      models.Coding
+	equivalence string
+}
+
+// New returns an empty terminology.
+func New() *Terminology {
+	return &Terminology{
+		valueSets: make(map[string]*ValueSet),
+		maps:      make(map[string][]mapping),
+		parents:   make(map[string]map[string][]string),
+	}
+}
+
+// Load adds the value sets and concept maps in every JSON file in the directory.  A file may contain a ValueSet, a
+// ConceptMap, or a Bundle of them.
+func (t *Terminology) Load(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := t.LoadFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFile adds the value sets and concept maps in a JSON file, which may contain a ValueSet, a ConceptMap, or a
+// Bundle of them.
+func (t *Terminology) LoadFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var r struct {
+		ResourceType string `json:"resourceType"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("Unable to read %s: %v", file, err)
+	}
+	var resources []interface{}
+	switch r.ResourceType {
+	case "ValueSet":
+		vs := new(models.ValueSet)
+		err = json.Unmarshal(data, vs)
+		resources = append(resources, vs)
+	case "ConceptMap":
+		cm := new(models.ConceptMap)
+		err = json.Unmarshal(data, cm)
+		resources = append(resources, cm)
+	case "Bundle":
+		bundle := new(models.Bundle)
+		err = json.Unmarshal(data, bundle)
+		for _, entry := range bundle.Entry {
+			resources = append(resources, entry.Resource)
+		}
+	default:
+		return fmt.Errorf("Unable to read %s: expected a ValueSet, ConceptMap or Bundle, but found %s", file, r.ResourceType)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read %s: %v", file, err)
+	}
+	for _, resource := range resources {
+		switch resource := resource.(type) {
+		case *models.ValueSet:
+			t.AddValueSet(resource)
+		case *models.ConceptMap:
+			t.AddConceptMap(resource)
+		}
+	}
+	return nil
+}
+
+// AddValueSet adds a value set, which can then be looked up by its name or URL.  It replaces any value set with the
+// same name or URL.  If the value set defines a code system, the code system's hierarchy is used to decide which
+// codes are descendants of others.
+func (t *Terminology) AddValueSet(vs *models.ValueSet) *ValueSet {
+	compiled := compileValueSet(vs, t)
+	t.Lock()
+	defer t.Unlock()
+	if vs.Name != "" {
+		t.valueSets[vs.Name] = compiled
+	}
+	if vs.Url != "" {
+		t.valueSets[vs.Url] = compiled
+	}
+	if cs := vs.CodeSystem; cs != nil {
+		system := NormalizeSystem(cs.System)
+		if t.parents[system] == nil {
+			t.parents[system] = make(map[string][]string)
+		}
+		addParents(t.parents[system], "", cs.Concept)
+	}
+	return compiled
+}
+
+// addParents records the parent of each concept in a code system's nested concept definitions
+func addParents(parents map[string][]string, parent string, concepts []models.ValueSetConceptDefinitionComponent) {
+	for _, concept := range concepts {
+		if parent != "" {
+			parents[concept.Code] = append(parents[concept.Code], parent)
+		}
+		addParents(parents, concept.Code, concept.Concept)
+	}
+}
+
+// AddConceptMap adds a concept map, whose mappings are used to translate codes.
+func (t *Terminology) AddConceptMap(cm *models.ConceptMap) {
+	t.Lock()
+	defer t.Unlock()
+	for _, element := range cm.Element {
+		source := codeKey(element.CodeSystem, element.Code)
+		for _, target := range element.Target {
+			t.maps[source] = append(t.maps[source], mapping{
+				target:      models.Coding{System: NormalizeSystem(target.CodeSystem), Code: target.Code},
+				equivalence: target.Equivalence,
+			})
+		}
+	}
+}
+
+// ValueSet returns the value set with the given name or URL, or false if there isn't one.
+func (t *Terminology) ValueSet(nameOrURL string) (*ValueSet, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	vs, ok := t.valueSets[nameOrURL]
+	return vs, ok
+}
+
+// MustValueSet returns the value set with the given name or URL, panicking if there isn't one.  It is meant for
+// value sets that are built in, so a missing one is a programming error.
+func (t *Terminology) MustValueSet(nameOrURL string) *ValueSet {
+	vs, ok := t.ValueSet(nameOrURL)
+	if !ok {
+		panic("Unknown value set: " + nameOrURL)
+	}
+	return vs
+}
+
+// Translate returns the codes in the target code system that the concept maps map the code to.  Mappings whose
+// equivalence is "unmatched" or "disjoint" are left out, since they say there is no such code.
+func (t *Terminology) Translate(system, code, targetSystem string) []models.Coding {
+	var translations []models.Coding
+	for _, m := range t.mappings(system, code) {
+		if m.target.System == NormalizeSystem(targetSystem) && m.equivalence != "unmatched" && m.equivalence != "disjoint" {
+			translations = append(translations, m.target)
+		}
+	}
+	return translations
+}
+
+// mappings returns the concept map targets for a code
+func (t *Terminology) mappings(system, code string) []mapping {
+	t.RLock()
+	defer t.RUnlock()
+	return t.maps[codeKey(system, code)]
+}
+
+// IsA returns true if the code is the ancestor code or one of its descendants.  ICD-9 and ICD-10 descendants are
+// the codes that start with the ancestor code; for other code systems, the hierarchies of the code systems defined
+// in the value sets are used.
+func (t *Terminology) IsA(system, code, ancestor string) bool {
+	system = NormalizeSystem(system)
+	code, ancestor = NormalizeCode(system, code), NormalizeCode(system, ancestor)
+	if isICD(system) {
+		return strings.HasPrefix(code, ancestor)
+	}
+	t.RLock()
+	defer t.RUnlock()
+	return t.isA(t.parents[system], code, ancestor, make(map[string]bool))
+}
+
+func (t *Terminology) isA(parents map[string][]string, code, ancestor string, seen map[string]bool) bool {
+	if code == ancestor {
+		return true
+	}
+	if seen[code] {
+		return false
+	}
+	seen[code] = true
+	for _, parent := range parents[code] {
+		if t.isA(parents, parent, ancestor, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeSystem returns the URI used here for the code system, which ignores trailing slashes and treats a few
+// other common URIs (e.g., OIDs) as the same system.
+func NormalizeSystem(system string) string {
+	system = strings.TrimSuffix(strings.TrimSpace(system), "/")
+	if alias, ok := systemAliases[system]; ok {
+		return alias
+	}
+	return system
+}
+
+// NormalizeCode returns the code in the form used to compare codes in the code system: ICD-9 and ICD-10 codes are
+// upper case without their dots, and other codes are just trimmed.
+func NormalizeCode(system, code string) string {
+	code = strings.TrimSpace(code)
+	if isICD(NormalizeSystem(system)) {
+		code = strings.ToUpper(strings.Replace(code, ".", "", -1))
+	}
+	return code
+}
+
+func isICD(system string) bool {
+	return system == ICD9System || system == ICD10System || system == ICD10CMSystem
+}
+
+func codeKey(system, code string) string {
+	system = NormalizeSystem(system)
+	return system + "|" + NormalizeCode(system, code)
+}
@@ -0,0 +1,155 @@
+package terminology
+
+import (
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+)
+
+type TerminologySuite struct {
+	Terminology *Terminology
+}
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&TerminologySuite{})
+
+func (s *TerminologySuite) SetUpTest(c *C) {
+	s.Terminology = New()
+	util.CheckErr(s.Terminology.Load("fixtures"))
+}
+
+func (s *TerminologySuite) TestLoadValueSet(c *C) {
+	byName, ok := s.Terminology.ValueSet("Heart Failure")
+	c.Assert(ok, Equals, true)
+	byURL, ok := s.Terminology.ValueSet("http://example.org/fhir/ValueSet/heart-failure")
+	c.Assert(ok, Equals, true)
+	c.Assert(byName, Equals, byURL)
+	_, ok = s.Terminology.ValueSet("Heart Attack")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *TerminologySuite) TestLoadBadFile(c *C) {
+	err := s.Terminology.LoadFile("terminology.go")
+	c.Assert(err, ErrorMatches, "Unable to read terminology.go: .*")
+}
+
+func (s *TerminologySuite) TestValueSetContains(c *C) {
+	vs := s.Terminology.MustValueSet("Heart Failure")
+
+	// ICD codes match their descendants, with or without dots
+	c.Assert(vs.Contains(ICD9System, "428"), Equals, true)
+	c.Assert(vs.Contains(ICD9System, "428.0"), Equals, true)
+	c.Assert(vs.Contains(ICD9System, "42821"), Equals, true)
+	c.Assert(vs.Contains("http://hl7.org/fhir/sid/icd-9-cm", "428.1"), Equals, true)
+	c.Assert(vs.Contains(ICD10CMSystem, "I50.9"), Equals, true)
+	c.Assert(vs.Contains(ICD10CMSystem, "i5021"), Equals, true)
+	c.Assert(vs.Contains(ICD9System, "427.31"), Equals, false)
+	c.Assert(vs.Contains(ICD10CMSystem, "I48.91"), Equals, false)
+
+	// Excluded codes don't match
+	c.Assert(vs.Contains(ICD9System, "428.9"), Equals, false)
+
+	// Listed codes only match themselves
+	c.Assert(vs.Contains(SNOMEDSystem, "84114007"), Equals, true)
+	c.Assert(vs.Contains(SNOMEDSystem+"/", "84114007"), Equals, true)
+	c.Assert(vs.Contains(SNOMEDSystem, "42343007"), Equals, false)
+
+	// The same code in another system doesn't match
+	c.Assert(vs.Contains(ICD10CMSystem, "428.0"), Equals, false)
+
+	// It works as a plugin.CodeSet
+	concept := &models.CodeableConcept{Coding: []models.Coding{
+		{System: "http://example.org/local", Code: "HF"},
+		{System: ICD10CMSystem, Code: "I50.1"},
+	}}
+	c.Assert(plugin.ContainsConcept(vs, concept), Equals, true)
+}
+
+func (s *TerminologySuite) TestValueSetWithCodeSystemHierarchy(c *C) {
+	system := "http://example.org/fhir/CodeSystem/heart"
+	s.Terminology.AddValueSet(&models.ValueSet{
+		Name: "Heart Codes",
+		CodeSystem: &models.ValueSetCodeSystemComponent{
+			System: system,
+			Concept: []models.ValueSetConceptDefinitionComponent{
+				{Code: "heart", Concept: []models.ValueSetConceptDefinitionComponent{
+					{Code: "hf", Concept: []models.ValueSetConceptDefinitionComponent{{Code: "hf-acute"}}},
+					{Code: "afib"},
+				}},
+			},
+		},
+	})
+	vs := s.Terminology.AddValueSet(&models.ValueSet{
+		Name: "Heart Failure Codes",
+		Compose: &models.ValueSetComposeComponent{Include: []models.ValueSetConceptSetComponent{
+			{System: system, Filter: []models.ValueSetConceptSetFilterComponent{{Property: "concept", Op: "is-a", Value: "hf"}}},
+		}},
+	})
+	c.Assert(vs.Contains(system, "hf"), Equals, true)
+	c.Assert(vs.Contains(system, "hf-acute"), Equals, true)
+	c.Assert(vs.Contains(system, "afib"), Equals, false)
+	c.Assert(vs.Contains(system, "heart"), Equals, false)
+
+	// A value set that defines a code system contains all of its codes
+	all := s.Terminology.MustValueSet("Heart Codes")
+	c.Assert(all.Contains(system, "hf-acute"), Equals, true)
+	c.Assert(all.Contains(system, "kidney"), Equals, false)
+
+	c.Assert(s.Terminology.IsA(system, "hf-acute", "heart"), Equals, true)
+	c.Assert(s.Terminology.IsA(system, "heart", "hf-acute"), Equals, false)
+}
+
+func (s *TerminologySuite) TestValueSetFilters(c *C) {
+	vs := s.Terminology.AddValueSet(&models.ValueSet{
+		Name: "Filters",
+		Compose: &models.ValueSetComposeComponent{
+			Import: []string{"Heart Failure"},
+			Include: []models.ValueSetConceptSetComponent{
+				{System: ICD9System, Filter: []models.ValueSetConceptSetFilterComponent{
+					{Property: "concept", Op: "is-a", Value: "410"},
+					{Property: "concept", Op: "is-not-a", Value: "410.7"},
+				}},
+				{System: ICD9System, Filter: []models.ValueSetConceptSetFilterComponent{{Property: "concept", Op: "descendent-of", Value: "411"}}},
+				{System: ICD9System, Filter: []models.ValueSetConceptSetFilterComponent{{Property: "concept", Op: "in", Value: "413.0,413.1"}}},
+				{System: ICD9System, Filter: []models.ValueSetConceptSetFilterComponent{{Property: "concept", Op: "regex", Value: "414[0-9]+"}}},
+			},
+		},
+	})
+	c.Assert(vs.Contains(ICD9System, "410.01"), Equals, true)
+	c.Assert(vs.Contains(ICD9System, "410.71"), Equals, false)
+	c.Assert(vs.Contains(ICD9System, "411"), Equals, false)
+	c.Assert(vs.Contains(ICD9System, "411.1"), Equals, true)
+	c.Assert(vs.Contains(ICD9System, "413.1"), Equals, true)
+	c.Assert(vs.Contains(ICD9System, "413.9"), Equals, false)
+	c.Assert(vs.Contains(ICD9System, "414.01"), Equals, true)
+	c.Assert(vs.Contains(ICD9System, "414"), Equals, false)
+	// Imported from the Heart Failure value set
+	c.Assert(vs.Contains(ICD10CMSystem, "I50.9"), Equals, true)
+}
+
+func (s *TerminologySuite) TestTranslate(c *C) {
+	c.Assert(s.Terminology.Translate(SNOMEDSystem, "49436004", ICD9System), DeepEquals, []models.Coding{{System: ICD9System, Code: "427.31"}})
+	c.Assert(s.Terminology.Translate(ICD10CMSystem, "I4891", "http://snomed.info/sct/"), DeepEquals, []models.Coding{{System: SNOMEDSystem, Code: "49436004"}})
+	c.Assert(s.Terminology.Translate(ICD10CMSystem, "I48.91", ICD10CMSystem), HasLen, 0)
+	// Unmatched mappings aren't translations
+	c.Assert(s.Terminology.Translate(ICD10CMSystem, "I48.92", ICD9System), HasLen, 0)
+}
+
+func (s *TerminologySuite) TestValueSetContainsTranslatedCodes(c *C) {
+	vs := s.Terminology.AddValueSet(NewValueSet("AFib", map[string][]string{ICD9System: {"427.31"}}))
+	c.Assert(vs.Contains(ICD9System, "427.31"), Equals, true)
+	c.Assert(vs.Contains(SNOMEDSystem, "49436004"), Equals, true)
+	c.Assert(vs.Contains(ICD10CMSystem, "I48.91"), Equals, true)
+	c.Assert(vs.Contains(ICD10CMSystem, "I48.92"), Equals, false)
+}
+
+func (s *TerminologySuite) TestNormalize(c *C) {
+	c.Assert(NormalizeSystem("http://snomed.info/sct/"), Equals, SNOMEDSystem)
+	c.Assert(NormalizeSystem("urn:oid:2.16.840.1.113883.6.90"), Equals, ICD10CMSystem)
+	c.Assert(NormalizeCode(ICD10CMSystem, " i50.9 "), Equals, "I509")
+	c.Assert(NormalizeCode(SNOMEDSystem, " 84114007 "), Equals, "84114007")
+}
@@ -0,0 +1,221 @@
+package terminology
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// ValueSet is a value set prepared for checking whether codes are in it.  It implements plugin.CodeSet, so it can be
+// used with the event stream queries.
+type ValueSet struct {
+	Name    string
+	URL     string
+	include []conceptSet
+	exclude []conceptSet
+	imports []string
+	t       *Terminology
+}
+
+// conceptSet is a value set's include or exclude for one code system
+type conceptSet struct {
+	system  string
+	codes   map[string]bool
+	filters []filter
+}
+
+type filter struct {
+	op     string
+	value  string
+	values map[string]bool
+	regex  *regexp.Regexp
+}
+
+// compileValueSet prepares a value set from its compose, or if it doesn't have one, from its expansion or the
+// code system it defines
+func compileValueSet(vs *models.ValueSet, t *Terminology) *ValueSet {
+	compiled := &ValueSet{Name: vs.Name, URL: vs.Url, t: t}
+	switch {
+	case vs.Compose != nil:
+		compiled.imports = vs.Compose.Import
+		for _, include := range vs.Compose.Include {
+			compiled.include = append(compiled.include, compileConceptSet(include))
+		}
+		for _, exclude := range vs.Compose.Exclude {
+			compiled.exclude = append(compiled.exclude, compileConceptSet(exclude))
+		}
+	case vs.Expansion != nil:
+		bySystem := make(map[string]*conceptSet)
+		addExpansion(bySystem, vs.Expansion.Contains)
+		for _, cs := range bySystem {
+			compiled.include = append(compiled.include, *cs)
+		}
+	case vs.CodeSystem != nil:
+		system := NormalizeSystem(vs.CodeSystem.System)
+		cs := conceptSet{system: system, codes: make(map[string]bool)}
+		addDefinitions(cs.codes, system, vs.CodeSystem.Concept)
+		compiled.include = append(compiled.include, cs)
+	}
+	return compiled
+}
+
+func compileConceptSet(component models.ValueSetConceptSetComponent) conceptSet {
+	system := NormalizeSystem(component.System)
+	cs := conceptSet{system: system, codes: make(map[string]bool)}
+	for _, concept := range component.Concept {
+		cs.codes[NormalizeCode(system, concept.Code)] = true
+	}
+	for _, f := range component.Filter {
+		compiled := filter{op: f.Op, value: NormalizeCode(system, f.Value)}
+		switch f.Op {
+		case "in", "not-in":
+			compiled.values = make(map[string]bool)
+			for _, code := range strings.Split(f.Value, ",") {
+				compiled.values[NormalizeCode(system, code)] = true
+			}
+		case "regex":
+			// A bad pattern matches nothing
+			compiled.regex, _ = regexp.Compile("^(?:" + f.Value + ")$")
+		}
+		cs.filters = append(cs.filters, compiled)
+	}
+	return cs
+}
+
+func addExpansion(bySystem map[string]*conceptSet, contains []models.ValueSetExpansionContainsComponent) {
+	for _, c := range contains {
+		if c.Code != "" {
+			system := NormalizeSystem(c.System)
+			cs := bySystem[system]
+			if cs == nil {
+				cs = &conceptSet{system: system, codes: make(map[string]bool)}
+				bySystem[system] = cs
+			}
+			cs.codes[NormalizeCode(system, c.Code)] = true
+		}
+		addExpansion(bySystem, c.Contains)
+	}
+}
+
+func addDefinitions(codes map[string]bool, system string, concepts []models.ValueSetConceptDefinitionComponent) {
+	for _, concept := range concepts {
+		codes[NormalizeCode(system, concept.Code)] = true
+		addDefinitions(codes, system, concept.Concept)
+	}
+}
+
+// Contains returns true if the code is in the value set.  If it isn't in the value set directly, but the concept
+// maps say it is equivalent to (or narrower than) a code that is, it is also considered to be in the value set.
+// This is how a value set that only lists ICD-9 codes can still match a site's ICD-10-CM or SNOMED codes.
+func (v *ValueSet) Contains(system, code string) bool {
+	system = NormalizeSystem(system)
+	code = NormalizeCode(system, code)
+	if v.containsDirectly(system, code, make(map[*ValueSet]bool)) {
+		return true
+	}
+	for _, m := range v.t.mappings(system, code) {
+		if sameOrNarrower(m.equivalence) && v.containsDirectly(m.target.System, NormalizeCode(m.target.System, m.target.Code), make(map[*ValueSet]bool)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsCoding returns true if the coding is in the value set.
+func (v *ValueSet) ContainsCoding(coding models.Coding) bool {
+	return v.Contains(coding.System, coding.Code)
+}
+
+// sameOrNarrower returns true if a concept map's equivalence means that whatever is true of the target code is true
+// of the source code
+func sameOrNarrower(equivalence string) bool {
+	switch equivalence {
+	case "", "equivalent", "equal", "wider", "subsumes":
+		return true
+	}
+	return false
+}
+
+// containsDirectly checks the value set's own includes, excludes and imports, without translating the code
+func (v *ValueSet) containsDirectly(system, code string, seen map[*ValueSet]bool) bool {
+	if seen[v] {
+		return false
+	}
+	seen[v] = true
+	for i := range v.exclude {
+		if v.exclude[i].matches(v.t, system, code) {
+			return false
+		}
+	}
+	for i := range v.include {
+		if v.include[i].matches(v.t, system, code) {
+			return true
+		}
+	}
+	for _, imported := range v.imports {
+		if vs, ok := v.t.ValueSet(imported); ok && vs.containsDirectly(system, code, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the code is one of the listed codes or passes all of the filters.  A concept set with
+// neither includes the whole code system.
+func (cs *conceptSet) matches(t *Terminology, system, code string) bool {
+	if cs.system != system {
+		return false
+	}
+	if len(cs.codes) == 0 && len(cs.filters) == 0 {
+		return true
+	}
+	if cs.codes[code] {
+		return true
+	}
+	if len(cs.filters) == 0 {
+		return false
+	}
+	for _, f := range cs.filters {
+		if !f.matches(t, system, code) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *filter) matches(t *Terminology, system, code string) bool {
+	switch f.op {
+	case "=":
+		return code == f.value
+	case "is-a":
+		return t.IsA(system, code, f.value)
+	case "descendent-of":
+		return code != f.value && t.IsA(system, code, f.value)
+	case "is-not-a":
+		return !t.IsA(system, code, f.value)
+	case "in":
+		return f.values[code]
+	case "not-in":
+		return !f.values[code]
+	case "regex":
+		return f.regex != nil && f.regex.MatchString(code)
+	}
+	return false
+}
+
+// NewValueSet returns a FHIR ValueSet with the given name that includes each of the listed codes, along with their
+// descendants, in each code system.  This is how most risk factor code lists are defined (e.g., ICD-9 "428" for
+// every kind of heart failure).
+func NewValueSet(name string, codes map[string][]string) *models.ValueSet {
+	vs := &models.ValueSet{Name: name, Status: "active", Compose: &models.ValueSetComposeComponent{}}
+	for system, systemCodes := range codes {
+		for _, code := range systemCodes {
+			vs.Compose.Include = append(vs.Compose.Include, models.ValueSetConceptSetComponent{
+				System: system,
+				Filter: []models.ValueSetConceptSetFilterComponent{{Property: "concept", Op: "is-a", Value: code}},
+			})
+		}
+	}
+	return vs
+}